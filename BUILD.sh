@@ -30,10 +30,12 @@ compile_go() {
   echo "Building ruckstack ${VERSION}..."
 
   echo "Compiling system-control..."
-  (export GOOS=linux && go build -o builder/internal/bundled/system-control server/system_control/cmd/main.go)
+  (export GOOS=linux && export GOARCH=amd64 && go build -o builder/internal/bundled/system-control server/system_control/cmd/main.go)
+  (export GOOS=linux && export GOARCH=arm64 && go build -o builder/internal/bundled/system-control-arm64 server/system_control/cmd/main.go)
 
   echo "Compiling installer..."
-  (export GOOS=linux && go build -o builder/internal/bundled/installer installer/cmd/main.go)
+  (export GOOS=linux && export GOARCH=amd64 && go build -o builder/internal/bundled/installer installer/cmd/main.go)
+  (export GOOS=linux && export GOARCH=arm64 && go build -o builder/internal/bundled/installer-arm64 installer/cmd/main.go)
 
   echo "Compiling builder..."
   echo "Compiling builder...Linux..."
@@ -11,7 +11,7 @@ import (
 func init() {
 	var project string
 	var out string
-	var compressionLevel int
+	var buildOptions builder.BuildOptions
 
 	var cmd = &cobra.Command{
 		Use:   "build",
@@ -21,16 +21,35 @@ func init() {
 		RunE: func(cmd *cobra.Command, args []string) error {
 			environment.OutDir = out
 			environment.ProjectDir = project
-			return builder.Build(compressionLevel)
+			return builder.Build(buildOptions)
 		},
 	}
 
 	cmd.Flags().StringVar(&project, "project", ".", "Project directory")
 	cmd.Flags().StringVar(&out, "out", ".", "Directory to save installer to")
-	cmd.Flags().IntVar(&compressionLevel, "compression-level", flate.BestCompression, "Compression level to use. Range from 0 (no compression) to 9 (best compression)")
+	cmd.Flags().StringVar(&buildOptions.Profile, "profile", "", "Project profile to build, such as an edition defined in profiles. The installer can only upgrade installs of the same profile")
+	cmd.Flags().IntVar(&buildOptions.CompressionLevel, "compression-level", flate.BestCompression, "Compression level to use. Range from 0 (no compression) to 9 (best compression)")
+	cmd.Flags().StringVar(&buildOptions.Compression, "compression", "gzip", "Compression for image layers and installer contents: gzip or zstd. Zstd is faster to build and to install")
+	cmd.Flags().IntVar(&buildOptions.CompressionWorkers, "compression-workers", 0, "Number of layers to compress at once. Defaults to the number of CPUs")
+	cmd.Flags().IntVar(&buildOptions.ServiceWorkers, "service-workers", 0, "Number of services to build at once. Defaults to the number of CPUs")
+	cmd.Flags().BoolVar(&buildOptions.IgnoreImagePolicy, "ignore-image-policy", false, "Report imagePolicy violations as warnings instead of failing the build. For emergencies only")
+	cmd.Flags().BoolVar(&buildOptions.RefreshLock, "refresh-lock", false, "Re-resolve image digests instead of using the ones recorded in ruckstack.lock")
+
+	cmd.Flags().StringVar(&buildOptions.ImageBackend, "image-backend", "", "How to collect images: docker or registry. Defaults to registry unless the project contains dockerfile services")
+	cmd.Flags().StringArrayVar(&buildOptions.OciLayouts, "oci-layout", nil, "OCI layout directory to read images from before their registry. Can be specified multiple times")
+
+	cmd.Flags().StringVar(&buildOptions.DeltaFrom, "delta-from", "", "Previous installer to build a delta against. Files unchanged since it are left out, and the delta can only upgrade that exact version")
+
+	cmd.Flags().BoolVar(&environment.Offline, "offline", false, "Fail instead of using the network. Run ruckstack fetch first to download everything the project needs")
+
+	cmd.Flags().BoolVar(&buildOptions.Reproducible, "reproducible", false, "Build the same installer every time the project and its sources are the same. Uses SOURCE_DATE_EPOCH as the build time if it is set, which also enables this")
+	cmd.Flags().StringArrayVar(&buildOptions.Architectures, "arch", nil, "Server architecture to build an installer for: amd64 or arm64. Can be specified multiple times. Overrides architectures in the project file")
+
+	cmd.Flags().StringVar(&buildOptions.SignKey, "sign-key", "", "Private key to sign the installer with (ed25519 or RSA). Either a PEM file, or env:VARIABLE to read the PEM from an environment variable")
 
 	ui.MarkFlagsDirname(cmd, "project")
 	ui.MarkFlagsDirname(cmd, "out")
+	ui.MarkFlagsFilename(cmd, "delta-from")
 
 	RootCmd.AddCommand(cmd)
 
@@ -0,0 +1,203 @@
+package commands
+
+import (
+	"fmt"
+	"github.com/docker/go-units"
+	"github.com/ruckstack/ruckstack/builder/internal/cache"
+	"github.com/ruckstack/ruckstack/common/ui"
+	"github.com/spf13/cobra"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	var parentCommand = &cobra.Command{
+		Use:   "cache",
+		Short: "Commands for managing the build cache",
+		Long:  "Commands for managing the cache of downloads, helm indexes, image blobs and compressed layers kept between builds",
+	}
+
+	initCacheList(parentCommand)
+	initCacheSize(parentCommand)
+	initCachePrune(parentCommand)
+	initCacheClear(parentCommand)
+	initCacheExport(parentCommand)
+	initCacheImport(parentCommand)
+
+	RootCmd.AddCommand(parentCommand)
+}
+
+func initCacheList(parent *cobra.Command) {
+	var verify bool
+
+	var cmd = &cobra.Command{
+		Use:   "list",
+		Short: "Lists cached files",
+		Long:  "Lists cached files with their size and when they were last used, least recently used first",
+
+		RunE: func(cmd *cobra.Command, args []string) error {
+			buildCache := cache.Default()
+			entries, err := buildCache.List()
+			if err != nil {
+				return err
+			}
+			if verify {
+				buildCache.Verify(entries)
+			}
+
+			cache.PrintEntries(entries)
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVar(&verify, "verify", false, "Check each file against its recorded hash")
+
+	parent.AddCommand(cmd)
+}
+
+func initCacheSize(parent *cobra.Command) {
+	var cmd = &cobra.Command{
+		Use:   "size",
+		Short: "Shows the size of the cache",
+
+		RunE: func(cmd *cobra.Command, args []string) error {
+			total, byCategory, err := cache.Default().Size()
+			if err != nil {
+				return err
+			}
+
+			var categories []string
+			for category := range byCategory {
+				categories = append(categories, category)
+			}
+			sort.Strings(categories)
+
+			for _, category := range categories {
+				ui.Printf("%-10s %s", category, units.HumanSize(float64(byCategory[category])))
+			}
+			ui.Printf("%-10s %s", "total", units.HumanSize(float64(total)))
+			return nil
+		},
+	}
+
+	parent.AddCommand(cmd)
+}
+
+func initCachePrune(parent *cobra.Command) {
+	var olderThan string
+	var maxSize string
+
+	var cmd = &cobra.Command{
+		Use:   "prune",
+		Short: "Removes old and invalid cached files",
+		Long:  "Removes cached files that do not match their hash, then files not used within --older-than, then the least recently used files until the cache fits in --max-size",
+
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var options cache.PruneOptions
+			var err error
+
+			if olderThan != "" {
+				if options.OlderThan, err = parseAge(olderThan); err != nil {
+					return fmt.Errorf("invalid --older-than: %s", err)
+				}
+			}
+			if maxSize != "" {
+				if options.MaxSize, err = units.RAMInBytes(maxSize); err != nil {
+					return fmt.Errorf("invalid --max-size: %s", err)
+				}
+			}
+
+			removed, err := cache.Default().Prune(options)
+			if err != nil {
+				return err
+			}
+
+			var removedSize int64
+			for _, entry := range removed {
+				ui.VPrintf("Removed %s", entry.Path)
+				removedSize += entry.Size
+			}
+			ui.Printf("Removed %d cached files (%s)", len(removed), units.HumanSize(float64(removedSize)))
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&olderThan, "older-than", "", "Remove files not used for this long, such as 30d or 12h")
+	cmd.Flags().StringVar(&maxSize, "max-size", "", "Remove the least recently used files until the cache is no bigger than this, such as 20GB")
+
+	parent.AddCommand(cmd)
+}
+
+/**
+Parses a duration, also accepting a number of days such as 30d
+*/
+func parseAge(age string) (time.Duration, error) {
+	if strings.HasSuffix(age, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(age, "d"))
+		if err != nil {
+			return 0, fmt.Errorf("cannot parse %s", age)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(age)
+}
+
+func initCacheClear(parent *cobra.Command) {
+	var cmd = &cobra.Command{
+		Use:   "clear",
+		Short: "Removes everything from the cache",
+		Long:  "Removes everything from the cache. Helm repositories added with `ruckstack helm repo add` are removed as well",
+
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := cache.Default().Clear(); err != nil {
+				return err
+			}
+			ui.Printf("Cleared cache")
+			return nil
+		},
+	}
+
+	parent.AddCommand(cmd)
+}
+
+func initCacheExport(parent *cobra.Command) {
+	var cmd = &cobra.Command{
+		Use:   "export <file>",
+		Short: "Saves the cache to a tarball",
+		Long:  "Saves the cache to a tar.gz file which can be loaded with `ruckstack cache import`, such as to pre-seed an air-gapped build machine",
+		Args:  cobra.ExactArgs(1),
+
+		RunE: func(cmd *cobra.Command, args []string) error {
+			exported, err := cache.Default().Export(args[0])
+			if err != nil {
+				return err
+			}
+			ui.Printf("Exported %d cached files to %s", exported, args[0])
+			return nil
+		},
+	}
+
+	parent.AddCommand(cmd)
+}
+
+func initCacheImport(parent *cobra.Command) {
+	var cmd = &cobra.Command{
+		Use:   "import <file>",
+		Short: "Loads a tarball created by cache export",
+		Long:  "Loads a tar.gz file created by `ruckstack cache export` into the cache. Files that do not match their hash are discarded",
+		Args:  cobra.ExactArgs(1),
+
+		RunE: func(cmd *cobra.Command, args []string) error {
+			imported, err := cache.Default().Import(args[0])
+			if err != nil {
+				return err
+			}
+			ui.Printf("Imported %d cached files from %s", imported, args[0])
+			return nil
+		},
+	}
+
+	parent.AddCommand(cmd)
+}
@@ -0,0 +1,31 @@
+package commands
+
+import (
+	"github.com/ruckstack/ruckstack/builder/internal/builder"
+	"github.com/ruckstack/ruckstack/builder/internal/environment"
+	"github.com/ruckstack/ruckstack/common/ui"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	var project string
+	var imageBackend string
+
+	var cmd = &cobra.Command{
+		Use:   "fetch",
+		Short: "Downloads everything a project needs to build offline",
+		Long:  "Downloads helm, k3s, the k3s airgap images, the helm charts and images of the project and each of its profiles, and the git repositories it imports, to the cache so the project can be built with `ruckstack build --offline`. Images in helm charts are fetched once a build has recorded them in ruckstack.lock",
+
+		RunE: func(cmd *cobra.Command, args []string) error {
+			environment.ProjectDir = project
+			return builder.Fetch(imageBackend)
+		},
+	}
+
+	cmd.Flags().StringVar(&project, "project", ".", "Project directory")
+	cmd.Flags().StringVar(&imageBackend, "image-backend", "", "How to collect images: docker or registry. Must match the backend the offline build uses. Defaults to registry unless the project contains dockerfile services")
+
+	ui.MarkFlagsDirname(cmd, "project")
+
+	RootCmd.AddCommand(cmd)
+}
@@ -1,6 +1,8 @@
 package commands
 
 import (
+	"github.com/ruckstack/ruckstack/builder/internal/builder"
+	"github.com/ruckstack/ruckstack/builder/internal/environment"
 	"github.com/ruckstack/ruckstack/builder/internal/helm"
 	"github.com/ruckstack/ruckstack/common/ui"
 	"github.com/spf13/cobra"
@@ -15,6 +17,9 @@ func init() {
 	initRepoGroup(helmCommand)
 
 	initReIndex(helmCommand)
+	initSearch(helmCommand)
+	initOutdated(helmCommand)
+	initUpdate(helmCommand)
 
 	RootCmd.AddCommand(helmCommand)
 }
@@ -40,7 +45,7 @@ func initRepoAdd(parent *cobra.Command) {
 
 	var cmd = &cobra.Command{
 		Use:   "add",
-		Short: "Adds a new repository",
+		Short: "Adds a repository available to every project",
 		RunE: func(cmd *cobra.Command, args []string) error {
 			if err := helm.AddRepository(name, url, username, password); err != nil {
 				return err
@@ -95,3 +100,69 @@ func initReIndex(parent *cobra.Command) {
 
 	parent.AddCommand(cmd)
 }
+
+func initSearch(parent *cobra.Command) {
+	var project string
+
+	var cmd = &cobra.Command{
+		Use:   "search <repo/chart>",
+		Short: "Lists the available versions of a chart",
+		Long:  "Lists the versions of a chart in its repository with the application version each contains. The project's helm repositories are included when run in a project directory",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			environment.ProjectDir = project
+			return builder.HelmSearch(args[0])
+		},
+	}
+
+	cmd.Flags().StringVar(&project, "project", ".", "Project directory")
+
+	ui.MarkFlagsDirname(cmd, "project")
+
+	parent.AddCommand(cmd)
+}
+
+func initOutdated(parent *cobra.Command) {
+	var project string
+
+	var cmd = &cobra.Command{
+		Use:   "outdated",
+		Short: "Lists helm services with newer chart versions",
+		Long:  "Compares the chart version of each helm service in the project with the latest non pre-release version in its repository",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			environment.ProjectDir = project
+			return builder.HelmOutdated()
+		},
+	}
+
+	cmd.Flags().StringVar(&project, "project", ".", "Project directory")
+
+	ui.MarkFlagsDirname(cmd, "project")
+
+	parent.AddCommand(cmd)
+}
+
+func initUpdate(parent *cobra.Command) {
+	var project string
+	var serviceId string
+	var toVersion string
+
+	var cmd = &cobra.Command{
+		Use:   "update",
+		Short: "Changes the chart version of a helm service",
+		Long:  "Updates the chart version of a helm service in the project file, keeping the rest of the file and its comments unchanged",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			environment.ProjectDir = project
+			return builder.HelmUpdate(serviceId, toVersion)
+		},
+	}
+
+	cmd.Flags().StringVar(&project, "project", ".", "Project directory")
+	cmd.Flags().StringVar(&serviceId, "service", "", "Id of the helm service to update")
+	cmd.Flags().StringVar(&toVersion, "to", "", "Chart version to update to. Defaults to the latest non pre-release version")
+
+	ui.MarkFlagsRequired(cmd, "service")
+	ui.MarkFlagsDirname(cmd, "project")
+
+	parent.AddCommand(cmd)
+}
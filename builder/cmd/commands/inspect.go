@@ -0,0 +1,60 @@
+package commands
+
+import (
+	"fmt"
+	"github.com/ruckstack/ruckstack/builder/internal/inspect"
+	"github.com/ruckstack/ruckstack/common/ui"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	var diff bool
+	var showSbom bool
+
+	var cmd = &cobra.Command{
+		Use:   "inspect <installer> | --diff <old installer> <new installer>",
+		Short: "Shows the contents of an installer",
+		Long:  `Shows the version, images, charts, manifests and size breakdown of a built installer, or the differences between two installers`,
+
+		Args: func(cmd *cobra.Command, args []string) error {
+			if diff && len(args) != 2 {
+				return fmt.Errorf("--diff requires an old and a new installer")
+			}
+			if !diff && len(args) != 1 {
+				return fmt.Errorf("requires one installer")
+			}
+			return nil
+		},
+
+		RunE: func(cmd *cobra.Command, args []string) error {
+			installer, err := inspect.Open(args[0])
+			if err != nil {
+				return err
+			}
+
+			if showSbom {
+				if installer.Sbom == nil {
+					return fmt.Errorf("%s does not contain an SBOM", args[0])
+				}
+				return installer.Sbom.Write(ui.GetOutput())
+			}
+
+			if !diff {
+				return installer.Print()
+			}
+
+			newInstaller, err := inspect.Open(args[1])
+			if err != nil {
+				return err
+			}
+			inspect.Compare(installer, newInstaller).Print()
+
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVar(&diff, "diff", false, "Compare two installers")
+	cmd.Flags().BoolVar(&showSbom, "sbom", false, "Output the SBOM embedded in the installer")
+
+	RootCmd.AddCommand(cmd)
+}
@@ -0,0 +1,34 @@
+package commands
+
+import (
+	"github.com/ruckstack/ruckstack/builder/internal/builder"
+	"github.com/ruckstack/ruckstack/builder/internal/environment"
+	"github.com/ruckstack/ruckstack/common/ui"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	var project string
+	var renderOptions builder.RenderOptions
+
+	var cmd = &cobra.Command{
+		Use:   "render",
+		Short: "Outputs the Kubernetes resources the project generates",
+		Long:  "Writes the HelmChart resources, rendered chart templates and manifests each service generates, without building images or an installer, so they can be reviewed and compared between versions",
+
+		RunE: func(cmd *cobra.Command, args []string) error {
+			environment.ProjectDir = project
+			return builder.Render(renderOptions)
+		},
+	}
+
+	cmd.Flags().StringVar(&project, "project", ".", "Project directory")
+	cmd.Flags().StringVar(&renderOptions.ServiceId, "service", "", "Only render the service with this id")
+	cmd.Flags().StringVar(&renderOptions.Profile, "profile", "", "Project profile to render, such as an edition defined in profiles")
+	cmd.Flags().StringVar(&renderOptions.OutDir, "out", "", "Directory to write the resources to, in a directory for each service. Defaults to render in the project directory")
+
+	ui.MarkFlagsDirname(cmd, "project")
+	ui.MarkFlagsDirname(cmd, "out")
+
+	RootCmd.AddCommand(cmd)
+}
@@ -1,6 +1,7 @@
 package analytics
 
 import (
+	"github.com/ruckstack/ruckstack/builder/internal/environment"
 	"github.com/ruckstack/ruckstack/builder/internal/settings"
 	"github.com/ruckstack/ruckstack/common/global_util"
 	"github.com/ruckstack/ruckstack/common/ui"
@@ -55,7 +56,7 @@ func Ask() {
 }
 
 func TrackCommand(command string) {
-	if !settings.Settings.AllowAnalytics {
+	if !settings.Settings.AllowAnalytics || environment.Offline {
 		return
 	}
 
@@ -91,7 +92,7 @@ func TrackCommand(command string) {
 }
 
 func TrackError(seenError error) {
-	if !settings.Settings.AllowAnalytics {
+	if !settings.Settings.AllowAnalytics || environment.Offline {
 		return
 	}
 
@@ -0,0 +1,228 @@
+package artifacts
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/ruckstack/ruckstack/builder/internal/environment"
+	"github.com/ruckstack/ruckstack/builder/internal/util"
+	"github.com/ruckstack/ruckstack/common/global_util"
+	"github.com/ruckstack/ruckstack/common/ui"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	DefaultHelmUrl = "https://get.helm.sh"
+	DefaultK3sUrl  = "https://github.com/k3s-io/k3s/releases/download"
+)
+
+/**
+Where the third party files packaged in every installer are downloaded from
+*/
+type Config struct {
+	//Helm is the base URL of a helm release mirror. Defaults to https://get.helm.sh
+	Helm string `yaml:"helm"`
+
+	//K3s is the base URL of a k3s release mirror. Defaults to https://github.com/k3s-io/k3s/releases/download
+	K3s string `yaml:"k3s"`
+
+	//Directory contains pre-fetched files, laid out like the mirrors. Relative paths are relative to the project
+	Directory string `yaml:"directory"`
+}
+
+/**
+A third party file packaged in the installer
+*/
+type Artifact struct {
+	Name         string
+	Version      string
+	Architecture string
+
+	//Path is the location of the file relative to its mirror base URL or the artifacts directory
+	Path string
+	Url  string
+
+	//Checksums is the published sha256 list for the file, in the same form as Path and Url
+	ChecksumsPath string
+	ChecksumsUrl  string
+}
+
+func (config Config) Validate() error {
+	for name, baseUrl := range map[string]string{"helm": config.Helm, "k3s": config.K3s} {
+		if baseUrl == "" {
+			continue
+		}
+		parsed, err := url.Parse(baseUrl)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+			return fmt.Errorf("artifacts.%s must be an http or https URL", name)
+		}
+	}
+	return nil
+}
+
+/**
+Returns helm, k3s and the k3s airgap images for the given versions and architecture
+*/
+func (config Config) List(helmVersion string, k3sVersion string, architecture string) []Artifact {
+	helmBase := strings.TrimSuffix(config.Helm, "/")
+	if helmBase == "" {
+		helmBase = DefaultHelmUrl
+	}
+	k3sBase := strings.TrimSuffix(config.K3s, "/")
+	if k3sBase == "" {
+		k3sBase = DefaultK3sUrl
+	}
+
+	//k3s publishes the amd64 binary without a suffix
+	k3sBinary := "k3s"
+	if architecture != "amd64" {
+		k3sBinary = "k3s-" + architecture
+	}
+
+	helmPath := fmt.Sprintf("helm-v%s-linux-%s.tar.gz", url.PathEscape(helmVersion), architecture)
+	helmChecksumsPath := helmPath + ".sha256sum"
+	k3sPath := fmt.Sprintf("v%s/%s", url.PathEscape(k3sVersion), k3sBinary)
+	k3sImagesPath := fmt.Sprintf("v%s/k3s-airgap-images-%s.tar", url.PathEscape(k3sVersion), architecture)
+	k3sChecksumsPath := fmt.Sprintf("v%s/sha256sum-%s.txt", url.PathEscape(k3sVersion), architecture)
+
+	return []Artifact{
+		{
+			Name: "helm", Version: helmVersion, Architecture: architecture,
+			Path: helmPath, Url: helmBase + "/" + helmPath,
+			ChecksumsPath: helmChecksumsPath, ChecksumsUrl: helmBase + "/" + helmChecksumsPath,
+		},
+		{
+			Name: "k3s", Version: k3sVersion, Architecture: architecture,
+			Path: k3sPath, Url: k3sBase + "/" + k3sPath,
+			ChecksumsPath: k3sChecksumsPath, ChecksumsUrl: k3sBase + "/" + k3sChecksumsPath,
+		},
+		{
+			Name: "k3s-airgap-images", Version: k3sVersion, Architecture: architecture,
+			Path: k3sImagesPath, Url: k3sBase + "/" + k3sImagesPath,
+			ChecksumsPath: k3sChecksumsPath, ChecksumsUrl: k3sBase + "/" + k3sChecksumsPath,
+		},
+	}
+}
+
+/**
+Returns the file at artifactPath in the artifacts directory, or "" if there is none
+*/
+func (config Config) localPath(artifactPath string) string {
+	if config.Directory == "" {
+		return ""
+	}
+
+	directory := config.Directory
+	if !filepath.IsAbs(directory) {
+		directory = filepath.Join(environment.ProjectDir, directory)
+	}
+
+	//versions such as 1.20.7+k3s1 are escaped in URLs but not on disk
+	unescapedPath, err := url.PathUnescape(artifactPath)
+	if err != nil {
+		unescapedPath = artifactPath
+	}
+
+	localPath := filepath.Join(directory, filepath.FromSlash(path.Clean(unescapedPath)))
+	if _, err := os.Stat(localPath); err != nil {
+		return ""
+	}
+	return localPath
+}
+
+/**
+Returns true if the artifact can be used without the network
+*/
+func (config Config) Available(artifact Artifact) bool {
+	return (config.localPath(artifact.Path) != "" || util.IsDownloaded(artifact.Url)) &&
+		(config.localPath(artifact.ChecksumsPath) != "" || util.IsDownloaded(artifact.ChecksumsUrl))
+}
+
+/**
+Returns the path to the artifact, from the artifacts directory if it is there, otherwise downloading it to the cache.
+The artifact must match its published checksum.
+*/
+func (config Config) Fetch(artifact Artifact) (string, error) {
+	expectedSha256, err := config.publishedChecksum(artifact)
+	if err != nil {
+		return "", err
+	}
+
+	localPath := config.localPath(artifact.Path)
+	if localPath == "" {
+		downloadedPath, err := util.DownloadVerifiedFile(artifact.Url, expectedSha256)
+		if err != nil {
+			return "", fmt.Errorf("cannot download %s %s: %s", artifact.Name, artifact.Version, err)
+		}
+		return downloadedPath, nil
+	}
+
+	ui.VPrintf("Using %s for %s", localPath, artifact.Name)
+	actualSha256, err := global_util.HashFileSha256(localPath)
+	if err != nil {
+		return "", err
+	}
+	if actualSha256 != expectedSha256 {
+		return "", fmt.Errorf("%s does not match the published checksum for %s %s: expected sha256 %s but was %s", localPath, artifact.Name, artifact.Version, expectedSha256, actualSha256)
+	}
+
+	return localPath, nil
+}
+
+/**
+Returns the sha256 of the artifact from its published checksum list
+*/
+func (config Config) publishedChecksum(artifact Artifact) (string, error) {
+	checksumsPath := config.localPath(artifact.ChecksumsPath)
+	if checksumsPath == "" {
+		var err error
+		checksumsPath, err = util.DownloadFile(artifact.ChecksumsUrl)
+		if err != nil {
+			return "", fmt.Errorf("cannot download checksums for %s %s: %s", artifact.Name, artifact.Version, err)
+		}
+	}
+
+	checksums, err := ioutil.ReadFile(checksumsPath)
+	if err != nil {
+		return "", fmt.Errorf("cannot read checksums for %s %s: %s", artifact.Name, artifact.Version, err)
+	}
+
+	checksum, err := findChecksum(string(checksums), path.Base(artifact.Path))
+	if err != nil {
+		return "", fmt.Errorf("invalid checksums for %s %s from %s: %s", artifact.Name, artifact.Version, artifact.ChecksumsUrl, err)
+	}
+	return checksum, nil
+}
+
+/**
+Returns the checksum for fileName from a sha256sum style list of "<checksum>  <file name>" lines.
+A list with a single checksum and no file names is for the one file it was published with.
+*/
+func findChecksum(checksums string, fileName string) (string, error) {
+	lines := strings.Split(strings.TrimSpace(checksums), "\n")
+
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) == 1 && len(lines) == 1 {
+			return validChecksum(fields[0])
+		}
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == fileName {
+			return validChecksum(fields[0])
+		}
+	}
+
+	return "", fmt.Errorf("no checksum for %s", fileName)
+}
+
+func validChecksum(checksum string) (string, error) {
+	checksum = strings.ToLower(checksum)
+	if decoded, err := hex.DecodeString(checksum); err != nil || len(decoded) != sha256.Size {
+		return "", fmt.Errorf("%s is not a sha256 checksum", checksum)
+	}
+	return checksum, nil
+}
@@ -0,0 +1,141 @@
+package artifacts
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/ruckstack/ruckstack/builder/internal/environment"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestList(t *testing.T) {
+	testData := []struct {
+		name         string
+		config       Config
+		architecture string
+		expectedUrls []string
+	}{
+		{
+			name:         "defaults",
+			architecture: "amd64",
+			expectedUrls: []string{
+				"https://get.helm.sh/helm-v3.4.2-linux-amd64.tar.gz",
+				"https://github.com/k3s-io/k3s/releases/download/v1.20.7+k3s1/k3s",
+				"https://github.com/k3s-io/k3s/releases/download/v1.20.7+k3s1/k3s-airgap-images-amd64.tar",
+			},
+		},
+		{
+			name:         "mirrors",
+			config:       Config{Helm: "https://mirror.example.com/helm/", K3s: "http://mirror.example.com/k3s"},
+			architecture: "amd64",
+			expectedUrls: []string{
+				"https://mirror.example.com/helm/helm-v3.4.2-linux-amd64.tar.gz",
+				"http://mirror.example.com/k3s/v1.20.7+k3s1/k3s",
+				"http://mirror.example.com/k3s/v1.20.7+k3s1/k3s-airgap-images-amd64.tar",
+			},
+		},
+		{
+			name:         "arm64",
+			architecture: "arm64",
+			expectedUrls: []string{
+				"https://get.helm.sh/helm-v3.4.2-linux-arm64.tar.gz",
+				"https://github.com/k3s-io/k3s/releases/download/v1.20.7+k3s1/k3s-arm64",
+				"https://github.com/k3s-io/k3s/releases/download/v1.20.7+k3s1/k3s-airgap-images-arm64.tar",
+			},
+		},
+	}
+
+	for _, data := range testData {
+		t.Run(data.name, func(t *testing.T) {
+			var urls []string
+			for _, artifact := range data.config.List("3.4.2", "1.20.7+k3s1", data.architecture) {
+				urls = append(urls, artifact.Url)
+			}
+			assert.Equal(t, data.expectedUrls, urls)
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	assert.NoError(t, Config{}.Validate())
+	assert.NoError(t, Config{Helm: "https://mirror.example.com", Directory: "artifacts"}.Validate())
+	assert.EqualError(t, Config{K3s: "mirror.example.com/k3s"}.Validate(), "artifacts.k3s must be an http or https URL")
+}
+
+func TestFetch_Directory(t *testing.T) {
+	projectDir, err := ioutil.TempDir("", "artifacts-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(projectDir)
+
+	defer func(original string) { environment.ProjectDir = original }(environment.ProjectDir)
+	environment.ProjectDir = projectDir
+	defer func() { environment.Offline = false }()
+	environment.Offline = true
+
+	writeArtifact := func(path string, content string) {
+		fullPath := filepath.Join(projectDir, "artifacts", path)
+		require.NoError(t, os.MkdirAll(filepath.Dir(fullPath), 0755))
+		require.NoError(t, ioutil.WriteFile(fullPath, []byte(content), 0755))
+	}
+	checksum := func(content string) string {
+		hash := sha256.Sum256([]byte(content))
+		return hex.EncodeToString(hash[:])
+	}
+
+	writeArtifact("v1.20.7+k3s1/k3s", "k3s")
+	writeArtifact("v1.20.7+k3s1/k3s-airgap-images-amd64.tar", "modified images")
+	writeArtifact("v1.20.7+k3s1/sha256sum-amd64.txt", checksum("k3s")+"  k3s\n"+checksum("images")+"  k3s-airgap-images-amd64.tar\n")
+
+	config := Config{Helm: "https://mirror.invalid/helm", Directory: "artifacts"}
+	artifacts := config.List("3.4.2", "1.20.7+k3s1", "amd64")
+
+	assert.True(t, config.Available(artifacts[1]))
+	fetchedPath, err := config.Fetch(artifacts[1])
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(projectDir, "artifacts", "v1.20.7+k3s1", "k3s"), fetchedPath)
+
+	_, err = config.Fetch(artifacts[2])
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "does not match the published checksum for k3s-airgap-images 1.20.7+k3s1: expected sha256 "+checksum("images")+" but was "+checksum("modified images"))
+	}
+
+	assert.False(t, config.Available(artifacts[0]))
+	_, err = config.Fetch(artifacts[0])
+	assert.EqualError(t, err, "cannot download checksums for helm 3.4.2: cannot download https://mirror.invalid/helm/helm-v3.4.2-linux-amd64.tar.gz.sha256sum with --offline. Run `ruckstack fetch` first or add it to the artifacts directory")
+}
+
+func TestFindChecksum(t *testing.T) {
+	k3sChecksum := strings.Repeat("a", 64)
+	imagesChecksum := strings.Repeat("b", 64)
+
+	testData := []struct {
+		name          string
+		checksums     string
+		fileName      string
+		expected      string
+		expectedError string
+	}{
+		{name: "list", checksums: k3sChecksum + "  k3s\n" + imagesChecksum + "  k3s-airgap-images-amd64.tar\n", fileName: "k3s-airgap-images-amd64.tar", expected: imagesChecksum},
+		{name: "binary mode", checksums: strings.ToUpper(k3sChecksum) + " *k3s\n", fileName: "k3s", expected: k3sChecksum},
+		{name: "single checksum", checksums: k3sChecksum + "\n", fileName: "helm-v3.4.2-linux-amd64.tar.gz", expected: k3sChecksum},
+		{name: "missing", checksums: k3sChecksum + "  k3s\n", fileName: "k3s-airgap-images-amd64.tar", expectedError: "no checksum for k3s-airgap-images-amd64.tar"},
+		{name: "not sha256", checksums: "abc  k3s\n", fileName: "k3s", expectedError: "abc is not a sha256 checksum"},
+	}
+
+	for _, data := range testData {
+		t.Run(data.name, func(t *testing.T) {
+			actual, err := findChecksum(data.checksums, data.fileName)
+			if data.expectedError == "" {
+				assert.NoError(t, err)
+				assert.Equal(t, data.expected, actual)
+			} else {
+				assert.EqualError(t, err, data.expectedError)
+			}
+		})
+	}
+}
@@ -4,39 +4,262 @@ import (
 	"fmt"
 	"github.com/ruckstack/ruckstack/builder/internal/builder/install_file"
 	"github.com/ruckstack/ruckstack/builder/internal/bundled"
+	"github.com/ruckstack/ruckstack/builder/internal/docker"
 	"github.com/ruckstack/ruckstack/builder/internal/environment"
-	"github.com/ruckstack/ruckstack/builder/internal/helm"
+	"github.com/ruckstack/ruckstack/builder/internal/inspect"
 	"github.com/ruckstack/ruckstack/builder/internal/project"
+	"github.com/ruckstack/ruckstack/builder/internal/registry"
+	"github.com/ruckstack/ruckstack/builder/internal/timing"
 	"github.com/ruckstack/ruckstack/common/config"
+	"github.com/ruckstack/ruckstack/common/signature"
 	"github.com/ruckstack/ruckstack/common/ui"
-	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 )
 
-func Build(compressionLevel int) error {
+type BuildOptions struct {
+	CompressionLevel int
+
+	//RefreshLock re-resolves image digests instead of using the ones in the lock file
+	RefreshLock bool
+
+	//IgnoreImagePolicy reports image policy violations as warnings instead of failing the build
+	IgnoreImagePolicy bool
+
+	//ImageBackend is "docker" or "registry". If empty, registry is used unless the project builds Dockerfiles
+	ImageBackend string
+
+	//OciLayouts are OCI layout directories the registry backend reads images from before their registry
+	OciLayouts []string
+
+	//DeltaFrom is a previous installer. If set, a delta installer containing only the files changed since it is built
+	DeltaFrom string
+
+	//SignKey is the private key file to sign the installer with, or "env:<VARIABLE>" to read it from the environment
+	SignKey string
+
+	//Compression is the format for image layers and installer entries: gzip or zstd
+	Compression string
+
+	//CompressionWorkers is how many layers are compressed at once. Defaults to the number of CPUs
+	CompressionWorkers int
+
+	//ServiceWorkers is how many services are built at once. Defaults to the number of CPUs
+	ServiceWorkers int
+
+	//Architectures overrides the architectures in the project file. One installer is built for each
+	Architectures []string
+
+	//Reproducible builds the same installer from the same inputs. Also enabled by setting SOURCE_DATE_EPOCH
+	Reproducible bool
+
+	//Profile is the project profile to build, such as an enterprise edition. If empty, the project is built as written
+	Profile string
+}
+
+/**
+The build time of reproducible builds when SOURCE_DATE_EPOCH is not set: 1980-01-01, the earliest time a zip entry can record
+*/
+const defaultSourceDateEpoch int64 = 315532800
+
+func Build(options BuildOptions) error {
+	if options.Compression == "" {
+		options.Compression = install_file.CompressionGzip
+	}
+	if err := install_file.ValidateCompression(options.Compression); err != nil {
+		return err
+	}
+
+	timings := timing.New()
+
+	stopTiming := timings.Start("parsing project")
 	projectConfig, err := project.Parse(filepath.Join(environment.ProjectDir, "ruckstack.yaml"))
+	stopTiming()
 	if err != nil {
 		return fmt.Errorf("error parsing project: %s", err)
 	}
+	if options.Profile != "" {
+		if err := projectConfig.ApplyProfile(options.Profile); err != nil {
+			return fmt.Errorf("error applying profile: %s", err)
+		}
+		ui.Printf("Building profile %s", options.Profile)
+	}
+	if projectConfig.Git != nil {
+		ui.Printf("Building %s %s from commit %s", projectConfig.Id, projectConfig.Version, projectConfig.Git.Commit)
+		if projectConfig.Git.Dirty {
+			ui.Printf("WARNING: the project has uncommitted changes, so the installer will not match commit %s", projectConfig.Git.Commit)
+		}
+	}
 
-	installerPath := environment.OutPath(projectConfig.Id + "_" + projectConfig.Version + ".installer")
-	err = os.Remove(installerPath)
-	if os.IsNotExist(err) {
-		ui.VPrintf("No existing %s to delete", installerPath)
-	} else if err != nil {
+	buildTime, reproducible, err := reproducibleBuildTime(options.Reproducible)
+	if err != nil {
 		return err
 	}
+	if reproducible {
+		ui.Printf("Building reproducibly with build time %s", time.Unix(buildTime, 0).UTC().Format(time.RFC3339))
+	}
 
-	installFile, err := install_file.StartCreation(installerPath, compressionLevel)
+	architectures := options.Architectures
+	if len(architectures) == 0 {
+		architectures = projectConfig.GetArchitectures()
+	}
+	for _, architecture := range architectures {
+		if err := project.ValidateArchitecture(architecture); err != nil {
+			return err
+		}
+	}
+
+	if err := useHelmRepositories(projectConfig); err != nil {
+		return err
+	}
+
+	lockFilePath := filepath.Join(environment.ProjectDir, "ruckstack.lock")
+	imageLock, err := install_file.LoadImageLock(lockFilePath)
 	if err != nil {
 		return err
 	}
+	if options.RefreshLock {
+		ui.Printf("Refreshing image digests in %s", lockFilePath)
+		imageLock = install_file.NewImageLock(nil)
+	}
+
+	//credentials are only used for pulling and are never added to the install file
+	credentials := registry.NewCredentialStore(projectConfig.Registries, environment.ProjectDir)
+	docker.Credentials = credentials
+
+	if environment.Offline {
+		if err := CheckOffline(projectConfig, options, architectures, imageLock, credentials); err != nil {
+			return err
+		}
+	}
+
+	var signer *signature.Signer
+	if options.SignKey != "" {
+		signer, err = signature.LoadSigner(options.SignKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	var deltaBase *inspect.Installer
+	if options.DeltaFrom != "" {
+		if len(architectures) > 1 {
+			return fmt.Errorf("--delta-from can only be used when building a single architecture. Use --arch to select one")
+		}
+		deltaBase, err = inspect.Open(options.DeltaFrom)
+		if err != nil {
+			return fmt.Errorf("cannot read --delta-from installer: %s", err)
+		}
+		if deltaBase.PackageConfig.Id != projectConfig.Id {
+			return fmt.Errorf("cannot build a delta from %s: it is an installer for %s, not %s", options.DeltaFrom, deltaBase.PackageConfig.Id, projectConfig.Id)
+		}
+		if deltaBase.PackageConfig.Profile != projectConfig.Profile {
+			return fmt.Errorf("cannot build a delta from %s: it was built with the %s profile", options.DeltaFrom, deltaBase.PackageConfig.GetProfile())
+		}
+		if deltaBase.PackageConfig.GetArchitecture() != architectures[0] {
+			return fmt.Errorf("cannot build a delta from %s: it is an installer for %s, not %s", options.DeltaFrom, deltaBase.PackageConfig.GetArchitecture(), architectures[0])
+		}
+	}
+
+	//images are locked to the same digests for every architecture, so the lock is the combination of every build
+	pinnedImages := map[string]string{}
+	for _, architecture := range architectures {
+		installerName := projectConfig.Id
+		if projectConfig.Profile != "" {
+			installerName += "_" + projectConfig.Profile
+		}
+		installerName += "_" + projectConfig.Version
+		if len(architectures) > 1 || architecture != "amd64" {
+			installerName += "_" + architecture
+		}
+		if deltaBase != nil {
+			installerName += "_delta_" + deltaBase.PackageConfig.Version
+		}
+
+		installerPath := environment.OutPath(installerName + ".installer")
+		err = os.Remove(installerPath)
+		if os.IsNotExist(err) {
+			ui.VPrintf("No existing %s to delete", installerPath)
+		} else if err != nil {
+			return err
+		}
+
+		imageBackend, err := selectImageBackend(options, projectConfig, credentials, architecture)
+		if err != nil {
+			return err
+		}
+
+		installFile, err := install_file.StartCreation(installerPath, options.CompressionLevel, architecture)
+		if err != nil {
+			return err
+		}
+		installFile.ImageBackend = imageBackend
+		installFile.Compression = options.Compression
+		installFile.CompressionWorkers = options.CompressionWorkers
+		installFile.Timings = timings
+		installFile.Signer = signer
+		if deltaBase != nil {
+			ui.Printf("Building delta from %s version %s", filepath.Base(options.DeltaFrom), deltaBase.PackageConfig.Version)
+			installFile.DeltaBase = deltaBase.PackageConfig
+		}
+		installFile.ImageLock = imageLock
+		installFile.ImagePolicy = &projectConfig.ImagePolicy
+		installFile.IgnoreImagePolicy = options.IgnoreImagePolicy
+		if reproducible {
+			installFile.Reproducible = true
+			installFile.PackageConfig.BuildTime = buildTime
+		}
+
+		if err := buildInstaller(installFile, installerPath, projectConfig, options, timings); err != nil {
+			return err
+		}
+
+		for image, digest := range installFile.PackageConfig.Images {
+			pinnedImages[image] = digest
+		}
+	}
+
+	if err := install_file.NewImageLock(pinnedImages).Save(lockFilePath); err != nil {
+		return err
+	}
+
+	return timings.Print()
+}
+
+/**
+Returns the build time to use for a reproducible build, from SOURCE_DATE_EPOCH if it is set.
+The build is reproducible if SOURCE_DATE_EPOCH is set even without --reproducible
+*/
+func reproducibleBuildTime(reproducible bool) (int64, bool, error) {
+	sourceDateEpoch, found := os.LookupEnv("SOURCE_DATE_EPOCH")
+	if !found || sourceDateEpoch == "" {
+		return defaultSourceDateEpoch, reproducible, nil
+	}
+
+	buildTime, err := strconv.ParseInt(sourceDateEpoch, 10, 64)
+	if err != nil || buildTime < 0 {
+		return 0, false, fmt.Errorf("invalid SOURCE_DATE_EPOCH '%s': must be a unix timestamp", sourceDateEpoch)
+	}
+	return buildTime, true, nil
+}
+
+/**
+Adds the project to the install file and completes it, saving its SBOM next to installerPath
+*/
+func buildInstaller(installFile *install_file.InstallFile, installerPath string, projectConfig *project.Project, options BuildOptions, timings *timing.Timings) error {
 	installFile.PackageConfig.Id = projectConfig.Id
 	installFile.PackageConfig.Name = projectConfig.Name
 	installFile.PackageConfig.Version = projectConfig.Version
+	installFile.PackageConfig.Profile = projectConfig.Profile
+	if projectConfig.Git != nil {
+		installFile.PackageConfig.Commit = projectConfig.Git.Commit
+	}
 	installFile.PackageConfig.Support = projectConfig.Support
+	installFile.PackageConfig.K3sVersion = projectConfig.K3sVersion
+	installFile.PackageConfig.HelmVersion = projectConfig.HelmVersion
 
 	installFile.SystemConfig.ManagerFilename = projectConfig.ManagerFilename
 
@@ -52,6 +275,8 @@ func Build(compressionLevel int) error {
 		})
 	}
 
+	stopTiming := timings.Start("adding system files")
+
 	//add custom files
 	customFiles := map[string]string{
 		filepath.Join("ruckstack", "site-down.png"): "data/web/ops/img/public/site-down.png",
@@ -78,7 +303,11 @@ func Build(compressionLevel int) error {
 	}
 
 	//add system-control
-	systemControl, err := bundled.OpenFile("system-control")
+	systemControlBinary, err := bundled.BinaryPath("system-control", installFile.Architecture)
+	if err != nil {
+		return err
+	}
+	systemControl, err := bundled.OpenFile(systemControlBinary)
 	if err != nil {
 		return err
 	}
@@ -87,31 +316,87 @@ func Build(compressionLevel int) error {
 	}
 
 	//add 3rd party files
-	if err := installFile.AddDownloadedNestedFile(fmt.Sprintf("https://get.helm.sh/helm-v%s-linux-amd64.tar.gz", url.PathEscape(projectConfig.HelmVersion)), "linux-amd64/helm", "lib/helm"); err != nil {
-		return err
+	for _, artifact := range projectConfig.Artifacts.List(projectConfig.HelmVersion, projectConfig.K3sVersion, installFile.Architecture) {
+		artifactPath, err := projectConfig.Artifacts.Fetch(artifact)
+		if err != nil {
+			return err
+		}
+
+		switch artifact.Name {
+		case "helm":
+			err = installFile.AddNestedFile(artifactPath, "linux-"+artifact.Architecture+"/helm", "lib/helm")
+		case "k3s":
+			err = installFile.AddFileByPath(artifactPath, "lib/k3s")
+		case "k3s-airgap-images":
+			err = installFile.AddFileByPath(artifactPath, "data/agent/images/k3s.tar")
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := installFile.AddComponent(artifact.Name, artifact.Version, artifact.Url, artifactPath); err != nil {
+			return err
+		}
+	}
+
+	stopTiming()
+
+	stopTiming = timings.Start("building services")
+	var services []install_file.ServiceBuild
+	for _, serviceConfig := range projectConfig.GetServices() {
+		services = append(services, install_file.ServiceBuild{
+			Id:    serviceConfig.GetId(),
+			Build: serviceConfig.Build,
+		})
 	}
-	if err := installFile.AddDownloadedFile(fmt.Sprintf("https://github.com/k3s-io/k3s/releases/download/v%s/k3s", url.PathEscape(projectConfig.K3sVersion)), "lib/k3s"); err != nil {
+	if err := installFile.BuildServices(services, options.ServiceWorkers); err != nil {
 		return err
 	}
-	if err := installFile.AddDownloadedFile(fmt.Sprintf("https://github.com/k3s-io/k3s/releases/download/v%s/k3s-airgap-images-amd64.tar", url.PathEscape(projectConfig.K3sVersion)), "data/agent/images/k3s.tar"); err != nil {
+	stopTiming()
+
+	if err := installFile.CompleteCreation(); err != nil {
 		return err
 	}
 
-	for _, helmConfig := range projectConfig.HelmRepos {
-		if err := helm.AddRepository(helmConfig.Name, helmConfig.Url, helmConfig.Username, helmConfig.Password); err != nil {
-			if strings.Contains(err.Error(), "is already configured") {
-				ui.VPrintf(err.Error())
-			} else {
-				return err
-			}
+	sbomPath := strings.TrimSuffix(installerPath, ".installer") + ".sbom.json"
+	ui.VPrintf("Saving SBOM to %s", sbomPath)
+	return installFile.Sbom.Save(sbomPath)
+}
+
+/**
+Returns the image backend to use. The registry backend does not need docker but cannot build Dockerfiles.
+*/
+func selectImageBackend(options BuildOptions, projectConfig *project.Project, credentials *registry.CredentialStore, architecture string) (install_file.ImageBackend, error) {
+	backendName := options.ImageBackend
+	if backendName == "" {
+		if len(projectConfig.DockerfileServices) > 0 {
+			backendName = "docker"
+		} else {
+			backendName = "registry"
 		}
 	}
 
-	for _, serviceConfig := range projectConfig.GetServices() {
-		if err := serviceConfig.Build(installFile); err != nil {
-			return err
+	switch backendName {
+	case "docker":
+		if len(options.OciLayouts) > 0 {
+			return nil, fmt.Errorf("--oci-layout requires the registry image backend")
 		}
+		for _, registryConfig := range projectConfig.Registries {
+			if registryConfig.CaCert != "" {
+				ui.Printf("WARNING: caCert for %s is not used by the docker image backend. Add it to /etc/docker/certs.d/%s/ca.crt for the docker daemon", registryConfig.Host, registryConfig.Host)
+			}
+		}
+		ui.VPrintf("Using docker image backend")
+		return &docker.Backend{Architecture: architecture}, nil
+	case "registry":
+		if len(projectConfig.DockerfileServices) > 0 {
+			return nil, fmt.Errorf("the registry image backend cannot build dockerfile services. Use --image-backend docker")
+		}
+		ui.VPrintf("Using registry image backend")
+		backend := registry.NewBackend(options.OciLayouts, credentials)
+		backend.Architecture = architecture
+		return backend, nil
+	default:
+		return nil, fmt.Errorf("unknown image backend '%s'. Must be docker or registry", backendName)
 	}
-
-	return installFile.CompleteCreation()
 }
@@ -12,6 +12,7 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestBuild(t *testing.T) {
@@ -42,7 +43,7 @@ func TestBuild(t *testing.T) {
 			assert.NoError(t, util.CopyDir(os.DirFS(global_util.GetSourceRoot()+"/builder/internal/bundled/init/example"), environment.ProjectDir))
 
 			assert.FileExists(t, global_util.GetSourceRoot()+"/builder/internal/bundled/system-control", "compiled system-control does not exist. Should be created by BUILD.sh")
-			err := Build(0)
+			err := Build(BuildOptions{})
 			if tt.wantErr == "" {
 				if assert.NoError(t, err) {
 					//check contents
@@ -87,3 +88,72 @@ func TestBuild(t *testing.T) {
 		})
 	}
 }
+
+func TestBuild_Reproducible(t *testing.T) {
+	if testing.Short() {
+		t.Skip("--short does not build projects")
+	}
+
+	testRoot := environment.TempPath("builder_reproducible_test-*")
+	environment.ProjectDir = testRoot + "/project"
+	assert.NoError(t, os.MkdirAll(environment.ProjectDir, 0755))
+	assert.NoError(t, util.CopyDir(os.DirFS(global_util.GetSourceRoot()+"/builder/internal/bundled/init/example"), environment.ProjectDir))
+
+	build := func(outDir string) []byte {
+		environment.OutDir = outDir
+		assert.NoError(t, os.MkdirAll(environment.OutDir, 0755))
+		assert.NoError(t, Build(BuildOptions{Reproducible: true}))
+
+		content, err := ioutil.ReadFile(environment.OutPath("example_1.0.5.installer"))
+		assert.NoError(t, err)
+		return content
+	}
+
+	first := build(testRoot + "/out1")
+
+	//touch every project file so only modification times differ
+	now := time.Now()
+	assert.NoError(t, filepath.Walk(environment.ProjectDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Chtimes(path, now, now)
+	}))
+
+	second := build(testRoot + "/out2")
+
+	assert.True(t, bytes.Equal(first, second), "reproducible builds of the same project should be identical")
+}
+
+func TestReproducibleBuildTime(t *testing.T) {
+	defer os.Unsetenv("SOURCE_DATE_EPOCH")
+
+	testData := []struct {
+		name                 string
+		sourceDateEpoch      string
+		reproducible         bool
+		expectedBuildTime    int64
+		expectedReproducible bool
+		expectedError        string
+	}{
+		{name: "not reproducible", expectedBuildTime: defaultSourceDateEpoch},
+		{name: "reproducible", reproducible: true, expectedBuildTime: defaultSourceDateEpoch, expectedReproducible: true},
+		{name: "SOURCE_DATE_EPOCH", sourceDateEpoch: "1600000000", expectedBuildTime: 1600000000, expectedReproducible: true},
+		{name: "invalid SOURCE_DATE_EPOCH", sourceDateEpoch: "yesterday", expectedError: "invalid SOURCE_DATE_EPOCH 'yesterday': must be a unix timestamp"},
+	}
+
+	for _, data := range testData {
+		t.Run(data.name, func(t *testing.T) {
+			assert.NoError(t, os.Setenv("SOURCE_DATE_EPOCH", data.sourceDateEpoch))
+
+			buildTime, reproducible, err := reproducibleBuildTime(data.reproducible)
+			if data.expectedError != "" {
+				assert.EqualError(t, err, data.expectedError)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, data.expectedBuildTime, buildTime)
+			assert.Equal(t, data.expectedReproducible, reproducible)
+		})
+	}
+}
@@ -0,0 +1,230 @@
+package builder
+
+import (
+	"fmt"
+	"github.com/ruckstack/ruckstack/builder/internal/builder/install_file"
+	"github.com/ruckstack/ruckstack/builder/internal/docker"
+	"github.com/ruckstack/ruckstack/builder/internal/environment"
+	"github.com/ruckstack/ruckstack/builder/internal/helm"
+	"github.com/ruckstack/ruckstack/builder/internal/project"
+	"github.com/ruckstack/ruckstack/builder/internal/registry"
+	"github.com/ruckstack/ruckstack/common/ui"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+/**
+Downloads everything the project needs to the cache so it can be built with --offline.
+Images are pulled through the given image backend, or the one the build would use if it is empty
+*/
+func Fetch(imageBackend string) error {
+	projectConfig, err := project.Parse(filepath.Join(environment.ProjectDir, "ruckstack.yaml"))
+	if err != nil {
+		return fmt.Errorf("error parsing project: %s", err)
+	}
+
+	for _, architecture := range projectConfig.GetArchitectures() {
+		for _, artifact := range projectConfig.Artifacts.List(projectConfig.HelmVersion, projectConfig.K3sVersion, architecture) {
+			artifactPath, err := projectConfig.Artifacts.Fetch(artifact)
+			if err != nil {
+				return err
+			}
+			ui.Printf("Fetched %s %s for %s to %s", artifact.Name, artifact.Version, architecture, artifactPath)
+		}
+	}
+
+	if err := useHelmRepositories(projectConfig); err != nil {
+		return err
+	}
+
+	//charts are fetched for every profile, so any of them can be built offline
+	helmServices := projectConfig.HelmServices
+	for _, profileName := range projectConfig.ProfileNames() {
+		helmServices = append(helmServices, projectConfig.Profiles[profileName].HelmServices...)
+	}
+	fetchedCharts := map[string]bool{}
+	for _, helmService := range helmServices {
+		if fetchedCharts[helmService.Chart+":"+helmService.Version] {
+			continue
+		}
+		fetchedCharts[helmService.Chart+":"+helmService.Version] = true
+
+		chartPath, err := helm.DownloadChart(helmService.Chart, helmService.Version)
+		if err != nil {
+			return err
+		}
+		ui.Printf("Fetched chart %s %s to %s", helmService.Chart, helmService.Version, chartPath)
+	}
+
+	imageLock, err := install_file.LoadImageLock(filepath.Join(environment.ProjectDir, "ruckstack.lock"))
+	if err != nil {
+		return err
+	}
+	images, err := projectImages(projectConfig, imageLock, true)
+	if err != nil {
+		return err
+	}
+
+	credentials := registry.NewCredentialStore(projectConfig.Registries, environment.ProjectDir)
+	docker.Credentials = credentials
+	for _, architecture := range projectConfig.GetArchitectures() {
+		backend, err := selectImageBackend(BuildOptions{ImageBackend: imageBackend}, projectConfig, credentials, architecture)
+		if err != nil {
+			return err
+		}
+
+		for _, image := range sortedKeys(images) {
+			if err := backend.Pull(image, images[image]); err != nil {
+				return fmt.Errorf("error pulling %s: %s", image, err)
+			}
+			ui.Printf("Fetched image %s for %s", image, architecture)
+		}
+	}
+	if len(projectConfig.HelmServices) > 0 && len(imageLock.Images) == 0 {
+		ui.Printf("Images in helm charts are not known until the project is built. Build once with network access to record them in ruckstack.lock, then fetch again")
+	}
+
+	return nil
+}
+
+/**
+Returns the images the project is known to need, with the digest they are locked to if any.
+Images in helm charts are only known from the lock file, since they are found by rendering the chart during the build.
+If includeProfiles is set, the images of every profile's services are included too.
+*/
+func projectImages(projectConfig *project.Project, imageLock *install_file.ImageLock, includeProfiles bool) (map[string]string, error) {
+	manifestServices := projectConfig.ManifestServices
+	helmServices := projectConfig.HelmServices
+	dockerfileServices := projectConfig.DockerfileServices
+	if includeProfiles {
+		for _, profileName := range projectConfig.ProfileNames() {
+			profile := projectConfig.Profiles[profileName]
+			manifestServices = append(manifestServices, profile.ManifestServices...)
+			helmServices = append(helmServices, profile.HelmServices...)
+			dockerfileServices = append(dockerfileServices, profile.DockerfileServices...)
+		}
+	}
+
+	var tags []string
+	for _, manifestService := range manifestServices {
+		serviceImages, err := manifestService.Images()
+		if err != nil {
+			return nil, fmt.Errorf("error reading images of %s: %s", manifestService.Id, err)
+		}
+		tags = append(tags, serviceImages...)
+	}
+	for _, helmService := range helmServices {
+		tags = append(tags, helmService.AdditionalImages...)
+	}
+	for _, dockerfileService := range dockerfileServices {
+		tags = append(tags, dockerfileService.AdditionalImages...)
+	}
+	for tag := range imageLock.Images {
+		tags = append(tags, tag)
+	}
+
+	images := map[string]string{}
+	for _, tag := range tags {
+		//locally built images come from the dockerfile services themselves
+		if strings.HasPrefix(tag, "build.local/") {
+			continue
+		}
+		images[tag] = imageLock.Images[tag]
+	}
+	return images, nil
+}
+
+func sortedKeys(values map[string]string) []string {
+	var keys []string
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+/**
+Uses the project's helm repositories for the rest of the run, reading their passwords from the environment or password files
+*/
+func useHelmRepositories(projectConfig *project.Project) error {
+	var repositories []helm.Repository
+	for _, helmConfig := range projectConfig.HelmRepos {
+		if helmConfig.Password != "" {
+			ui.Printf("WARNING: the password for helm repository %s is stored in the project file. Use passwordEnv or passwordFile instead", helmConfig.Name)
+		}
+		password, err := helmConfig.GetPassword(environment.ProjectDir)
+		if err != nil {
+			return err
+		}
+
+		repositories = append(repositories, helm.Repository{
+			Name:     helmConfig.Name,
+			Url:      helmConfig.Url,
+			Username: helmConfig.Username,
+			Password: password,
+		})
+	}
+
+	return helm.UseProjectRepositories(projectConfig.Id, repositories)
+}
+
+/**
+Checks that everything the project downloads is already available, so an offline build fails before doing any work.
+Images in helm charts are only checked if they are in the lock file, the rest are checked as the chart is rendered.
+*/
+func CheckOffline(projectConfig *project.Project, options BuildOptions, architectures []string, imageLock *install_file.ImageLock, credentials *registry.CredentialStore) error {
+	var missing []string
+	seen := map[string]bool{}
+	addMissing := func(description string) {
+		if !seen[description] {
+			seen[description] = true
+			missing = append(missing, description)
+		}
+	}
+
+	for _, architecture := range architectures {
+		for _, artifact := range projectConfig.Artifacts.List(projectConfig.HelmVersion, projectConfig.K3sVersion, architecture) {
+			if !projectConfig.Artifacts.Available(artifact) {
+				addMissing(fmt.Sprintf("%s %s from %s", artifact.Name, artifact.Version, artifact.Url))
+			}
+		}
+	}
+
+	for _, helmRepo := range projectConfig.HelmRepos {
+		if _, err := helm.RepositoryUrl(helmRepo.Name); err != nil {
+			addMissing(fmt.Sprintf("helm repository %s", helmRepo.Name))
+		}
+	}
+
+	for _, helmService := range projectConfig.HelmServices {
+		repoName := strings.Split(helmService.Chart, "/")[0]
+		if _, err := helm.RepositoryUrl(repoName); err != nil {
+			addMissing(fmt.Sprintf("helm repository %s", repoName))
+		} else if !helm.IsChartDownloaded(helmService.Chart, helmService.Version) {
+			addMissing(fmt.Sprintf("chart %s %s", helmService.Chart, helmService.Version))
+		}
+	}
+
+	images, err := projectImages(projectConfig, imageLock, false)
+	if err != nil {
+		return err
+	}
+	for _, architecture := range architectures {
+		backend, err := selectImageBackend(options, projectConfig, credentials, architecture)
+		if err != nil {
+			return err
+		}
+		for _, image := range sortedKeys(images) {
+			if !backend.Available(image, images[image]) {
+				addMissing(fmt.Sprintf("image %s for %s", image, architecture))
+			}
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("cannot build with --offline. Missing:\n    %s\nRun `ruckstack fetch` with network access first", strings.Join(missing, "\n    "))
+	}
+
+	return nil
+}
@@ -0,0 +1,65 @@
+package builder
+
+import (
+	"github.com/ruckstack/ruckstack/builder/internal/builder/install_file"
+	"github.com/ruckstack/ruckstack/builder/internal/environment"
+	"github.com/ruckstack/ruckstack/builder/internal/project"
+	"github.com/ruckstack/ruckstack/builder/internal/project/service"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestProjectImages(t *testing.T) {
+	projectDir := environment.TempPath("project_images-*")
+	assert.NoError(t, os.MkdirAll(projectDir, 0755))
+	environment.ProjectDir = projectDir
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(projectDir, "app.yaml"), []byte(`
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      containers:
+        - name: app
+          image: nginx:1.19
+`), 0644))
+
+	projectConfig := &project.Project{
+		ManifestServices: []service.ManifestService{
+			{Id: "app", Manifest: "app.yaml", AdditionalImages: []string{"busybox:1.32"}},
+		},
+		HelmServices: []service.HelmService{
+			{Id: "db", AdditionalImages: []string{"postgres:13"}},
+		},
+		DockerfileServices: []service.DockerfileService{
+			{Id: "web", AdditionalImages: []string{"build.local/test/web:latest"}},
+		},
+		Profiles: map[string]project.Profile{
+			"enterprise": {
+				DockerfileServices: []service.DockerfileService{{Id: "audit", AdditionalImages: []string{"redis:6"}}},
+			},
+		},
+	}
+	imageLock := install_file.NewImageLock(map[string]string{
+		"nginx:1.19":          "sha256:1111",
+		"bitnami/redis:6.0.9": "sha256:2222",
+	})
+
+	images, err := projectImages(projectConfig, imageLock, false)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"nginx:1.19":          "sha256:1111",
+		"busybox:1.32":        "",
+		"postgres:13":         "",
+		"bitnami/redis:6.0.9": "sha256:2222",
+	}, images)
+
+	images, err = projectImages(projectConfig, imageLock, true)
+	assert.NoError(t, err)
+	assert.Contains(t, images, "redis:6")
+}
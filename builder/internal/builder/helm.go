@@ -0,0 +1,141 @@
+package builder
+
+import (
+	"fmt"
+	"github.com/ruckstack/ruckstack/builder/internal/environment"
+	"github.com/ruckstack/ruckstack/builder/internal/helm"
+	"github.com/ruckstack/ruckstack/builder/internal/project"
+	"github.com/ruckstack/ruckstack/builder/internal/project/service"
+	"github.com/ruckstack/ruckstack/common/ui"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+)
+
+/**
+Lists the versions of a chart available in its repository.
+The project's helm repositories are used if there is a project in the project directory
+*/
+func HelmSearch(chart string) error {
+	projectPath := filepath.Join(environment.ProjectDir, "ruckstack.yaml")
+	if _, err := os.Stat(projectPath); err == nil {
+		projectConfig, err := project.Parse(projectPath)
+		if err != nil {
+			return fmt.Errorf("error parsing project: %s", err)
+		}
+		if err := useHelmRepositories(projectConfig); err != nil {
+			return err
+		}
+	}
+
+	versions, err := helm.ChartVersions(chart, true)
+	if err != nil {
+		return err
+	}
+
+	table := tabwriter.NewWriter(ui.GetOutput(), 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(table, "VERSION\tAPP VERSION")
+	for _, version := range versions {
+		_, _ = fmt.Fprintf(table, "%s\t%s\n", version.Version, version.AppVersion)
+	}
+	return table.Flush()
+}
+
+/**
+Compares the version of each helm service in the project with the latest version in its repository
+*/
+func HelmOutdated() error {
+	projectConfig, err := project.Parse(filepath.Join(environment.ProjectDir, "ruckstack.yaml"))
+	if err != nil {
+		return fmt.Errorf("error parsing project: %s", err)
+	}
+	if err := useHelmRepositories(projectConfig); err != nil {
+		return err
+	}
+
+	if len(projectConfig.HelmServices) == 0 {
+		ui.Printf("Project has no helm services")
+		return nil
+	}
+
+	table := tabwriter.NewWriter(ui.GetOutput(), 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(table, "SERVICE\tCHART\tCURRENT\tLATEST")
+	outdated := 0
+	for _, helmService := range projectConfig.HelmServices {
+		versions, err := helm.ChartVersions(helmService.Chart, true)
+		if err != nil {
+			return err
+		}
+		latest := helm.LatestVersion(versions).Version
+		//services on a newer version than the latest release, such as a pre-release, are not outdated
+		if helm.IsNewerVersion(latest, helmService.Version) {
+			outdated++
+		}
+		_, _ = fmt.Fprintf(table, "%s\t%s\t%s\t%s\n", helmService.Id, helmService.Chart, helmService.Version, latest)
+	}
+	if err := table.Flush(); err != nil {
+		return err
+	}
+
+	if outdated == 0 {
+		ui.Printf("\nAll helm services are up to date")
+	} else {
+		ui.Printf("\n%d helm service(s) can be updated with `ruckstack helm update --service <id>`", outdated)
+	}
+
+	return nil
+}
+
+/**
+Changes the chart version of a helm service in the project file. Updates to the latest version if toVersion is empty
+*/
+func HelmUpdate(serviceId string, toVersion string) error {
+	projectPath := filepath.Join(environment.ProjectDir, "ruckstack.yaml")
+	projectConfig, err := project.Parse(projectPath)
+	if err != nil {
+		return fmt.Errorf("error parsing project: %s", err)
+	}
+	if err := useHelmRepositories(projectConfig); err != nil {
+		return err
+	}
+
+	var helmService *service.HelmService
+	for i := range projectConfig.HelmServices {
+		if projectConfig.HelmServices[i].Id == serviceId {
+			helmService = &projectConfig.HelmServices[i]
+		}
+	}
+	if helmService == nil {
+		return fmt.Errorf("project %s has no helm service %s", projectConfig.Id, serviceId)
+	}
+
+	versions, err := helm.ChartVersions(helmService.Chart, true)
+	if err != nil {
+		return err
+	}
+	if toVersion == "" {
+		toVersion = helm.LatestVersion(versions).Version
+	} else {
+		found := false
+		for _, version := range versions {
+			if version.Version == toVersion {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("version %s of %s not found. Run `ruckstack helm search %s` to list the available versions", toVersion, helmService.Chart, helmService.Chart)
+		}
+	}
+
+	if toVersion == helmService.Version {
+		ui.Printf("%s is already at %s %s", serviceId, helmService.Chart, toVersion)
+		return nil
+	}
+
+	if err := project.SetHelmServiceVersion(projectPath, serviceId, toVersion); err != nil {
+		return err
+	}
+	ui.Printf("Updated %s from %s %s to %s", serviceId, helmService.Chart, helmService.Version, toVersion)
+
+	return nil
+}
@@ -0,0 +1,212 @@
+package install_file
+
+import (
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ruckstack/ruckstack/builder/internal/cache"
+	"github.com/ruckstack/ruckstack/builder/internal/environment"
+	"github.com/ruckstack/ruckstack/common/global_util"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+/**
+Returns an error if the compression is not one the installer can read
+*/
+func ValidateCompression(compression string) error {
+	switch compression {
+	case CompressionGzip, CompressionZstd:
+		return nil
+	default:
+		return fmt.Errorf("unknown compression '%s'. Must be %s or %s", compression, CompressionGzip, CompressionZstd)
+	}
+}
+
+/**
+Returns the file extension for compressed image layers
+*/
+func (installFile *InstallFile) layerExtension() string {
+	if installFile.Compression == CompressionZstd {
+		return ".zst"
+	}
+	return ".gz"
+}
+
+/**
+Returns where the compressed layer at target is cached.
+The compression level is part of the path, so a build at another level never reuses layers compressed for this one.
+*/
+func (installFile *InstallFile) layerCachePath(target string) string {
+	return environment.CachePath(fmt.Sprintf("files/level-%d/%s%s", installFile.CompressionLevel, target, installFile.layerExtension()))
+}
+
+/**
+Returns the zip method to store the given file with.
+Image layers are already compressed, so are only stored.
+*/
+func (installFile *InstallFile) zipMethod(installerPath string) uint16 {
+	if installFile.Compression != CompressionZstd {
+		return zip.Store
+	}
+	if strings.HasSuffix(installerPath, ".gz") || strings.HasSuffix(installerPath, ".zst") || strings.HasSuffix(installerPath, ".tgz") {
+		return zip.Store
+	}
+	return global_util.ZipMethodZstd
+}
+
+/**
+Returns the zstd level closest to the 0-9 CompressionLevel
+*/
+func (installFile *InstallFile) zstdLevel() zstd.EncoderLevel {
+	switch {
+	case installFile.CompressionLevel <= 1:
+		return zstd.SpeedFastest
+	case installFile.CompressionLevel <= 5:
+		return zstd.SpeedDefault
+	case installFile.CompressionLevel <= 7:
+		return zstd.SpeedBetterCompression
+	default:
+		return zstd.SpeedBestCompression
+	}
+}
+
+/**
+Compresses rawPath to cachePath with the install file's compression.
+The result is written to a temp file first so an interrupted build never leaves a partial file in the cache.
+*/
+func (installFile *InstallFile) compressFile(rawPath string, cachePath string) error {
+	if err := os.MkdirAll(filepath.Dir(cachePath), 0755); err != nil {
+		return fmt.Errorf("cannot create cache directory %s: %s", filepath.Dir(cachePath), err)
+	}
+
+	rawFile, err := os.Open(rawPath)
+	if err != nil {
+		return err
+	}
+	defer rawFile.Close()
+
+	tempFile, err := os.CreateTemp(filepath.Dir(cachePath), filepath.Base(cachePath)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("cannot create cache file: %s", err)
+	}
+	defer os.Remove(tempFile.Name())
+
+	var compressor io.WriteCloser
+	if installFile.Compression == CompressionZstd {
+		compressor, err = zstd.NewWriter(tempFile, zstd.WithEncoderLevel(installFile.zstdLevel()), zstd.WithEncoderConcurrency(1))
+	} else {
+		compressor, err = gzip.NewWriterLevel(tempFile, installFile.CompressionLevel)
+	}
+	if err != nil {
+		_ = tempFile.Close()
+		return err
+	}
+
+	if _, err := io.Copy(compressor, rawFile); err != nil {
+		_ = tempFile.Close()
+		return fmt.Errorf("cannot compress %s: %s", rawPath, err)
+	}
+	if err := compressor.Close(); err != nil {
+		_ = tempFile.Close()
+		return fmt.Errorf("cannot compress %s: %s", rawPath, err)
+	}
+	if err := tempFile.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tempFile.Name(), cachePath); err != nil {
+		return err
+	}
+
+	return cache.Record(cachePath)
+}
+
+/**
+Registers the compressor used for zip entries
+*/
+func (installFile *InstallFile) registerZipCompressors() {
+	installFile.zipWriter.RegisterCompressor(global_util.ZipMethodZstd, func(out io.Writer) (io.WriteCloser, error) {
+		return zstd.NewWriter(out, zstd.WithEncoderLevel(installFile.zstdLevel()))
+	})
+}
+
+/**
+Runs jobs with at most a fixed number running at once. Wait returns the first error
+*/
+type workerPool struct {
+	slots chan bool
+	group sync.WaitGroup
+
+	errLock  sync.Mutex
+	firstErr error
+}
+
+func newWorkerPool(workers int) *workerPool {
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+	return &workerPool{
+		slots: make(chan bool, workers),
+	}
+}
+
+/**
+Runs the job once a worker is free. Blocks until then so callers do not queue up more work than can run
+*/
+func (pool *workerPool) Submit(job func() error) {
+	pool.slots <- true
+	pool.group.Add(1)
+
+	go func() {
+		defer func() {
+			<-pool.slots
+			pool.group.Done()
+		}()
+
+		if pool.err() != nil {
+			return
+		}
+		if err := job(); err != nil {
+			pool.errLock.Lock()
+			if pool.firstErr == nil {
+				pool.firstErr = err
+			}
+			pool.errLock.Unlock()
+		}
+	}()
+}
+
+func (pool *workerPool) err() error {
+	pool.errLock.Lock()
+	defer pool.errLock.Unlock()
+	return pool.firstErr
+}
+
+/**
+Waits for all submitted jobs and returns the first error
+*/
+func (pool *workerPool) Wait() error {
+	pool.group.Wait()
+	return pool.err()
+}
+
+/**
+A layer from the images tar, added to the install file once it is compressed
+*/
+type pendingLayer struct {
+	target    string
+	cachePath string
+	modTime   time.Time
+}
@@ -0,0 +1,162 @@
+package install_file
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ruckstack/ruckstack/builder/internal/environment"
+	"github.com/ruckstack/ruckstack/common/global_util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSaveImagesTar(t *testing.T) {
+	for _, compression := range []string{CompressionGzip, CompressionZstd} {
+		t.Run(compression, func(t *testing.T) {
+			//unique layer names so the layers are not already cached
+			layers := map[string][]byte{}
+			for i := 0; i < 5; i++ {
+				layers[fmt.Sprintf("%d/layer.tar", rand.Int())] = bytes.Repeat([]byte{byte(i)}, 10000*(i+1))
+			}
+
+			imagesTar := new(bytes.Buffer)
+			tarWriter := tar.NewWriter(imagesTar)
+			addEntry := func(name string, content []byte) {
+				require.NoError(t, tarWriter.WriteHeader(&tar.Header{Name: name, Size: int64(len(content)), Mode: 0644, Typeflag: tar.TypeReg}))
+				_, err := tarWriter.Write(content)
+				require.NoError(t, err)
+			}
+			addEntry("manifest.json", []byte("[]"))
+			for name, content := range layers {
+				addEntry(name, content)
+			}
+			require.NoError(t, tarWriter.Close())
+
+			imagesTarPath := environment.TempPath("images-*.tar")
+			require.NoError(t, os.MkdirAll(environment.TempPath(""), 0755))
+			require.NoError(t, ioutil.WriteFile(imagesTarPath, imagesTar.Bytes(), 0644))
+			imagesTarFile, err := os.Open(imagesTarPath)
+			require.NoError(t, err)
+			defer imagesTarFile.Close()
+
+			zipContent := new(bytes.Buffer)
+			installFile := newTestInstallFile()
+			installFile.Compression = compression
+			installFile.CompressionLevel = 1
+			installFile.CompressionWorkers = 2
+			installFile.zipWriter = zip.NewWriter(zipContent)
+			installFile.registerZipCompressors()
+
+			require.NoError(t, installFile.saveImagesTar(imagesTarFile, "data/agent/images/images.tar"))
+			require.NoError(t, installFile.zipWriter.Close())
+
+			zipReader, err := zip.NewReader(bytes.NewReader(zipContent.Bytes()), int64(zipContent.Len()))
+			require.NoError(t, err)
+
+			zipFiles := map[string]*zip.File{}
+			for _, zipFile := range zipReader.File {
+				zipFiles[zipFile.Name] = zipFile
+			}
+
+			manifest := zipFiles["data/agent/images/images.untar/manifest.json"]
+			if assert.NotNil(t, manifest) {
+				if compression == CompressionZstd {
+					assert.Equal(t, global_util.ZipMethodZstd, manifest.Method)
+				} else {
+					assert.Equal(t, zip.Store, manifest.Method)
+				}
+				assert.Equal(t, "[]", readZipFile(t, manifest))
+			}
+
+			for name, content := range layers {
+				layerName := "data/agent/images/images.untar/" + name + installFile.layerExtension()
+				assert.FileExists(t, installFile.layerCachePath("data/agent/images/images.untar/"+name))
+				assert.Equal(t, environment.CachePath("files/level-1/"+layerName), installFile.layerCachePath("data/agent/images/images.untar/"+name))
+
+				layerFile := zipFiles[layerName]
+				if !assert.NotNil(t, layerFile, layerName) {
+					continue
+				}
+				assert.Equal(t, zip.Store, layerFile.Method)
+
+				compressed, err := layerFile.Open()
+				require.NoError(t, err)
+
+				var decompressor io.Reader
+				if compression == CompressionZstd {
+					zstdReader, err := zstd.NewReader(compressed)
+					require.NoError(t, err)
+					defer zstdReader.Close()
+					decompressor = zstdReader
+				} else {
+					decompressor, err = gzip.NewReader(compressed)
+					require.NoError(t, err)
+				}
+				decompressed, err := ioutil.ReadAll(decompressor)
+				require.NoError(t, err)
+				assert.Equal(t, content, decompressed, name)
+			}
+		})
+	}
+}
+
+func readZipFile(t *testing.T, zipFile *zip.File) string {
+	reader, err := zipFile.Open()
+	require.NoError(t, err)
+	defer reader.Close()
+
+	content, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	return string(content)
+}
+
+func TestWorkerPool(t *testing.T) {
+	pool := newWorkerPool(3)
+
+	var running, maxRunning, completed int32
+	for i := 0; i < 20; i++ {
+		pool.Submit(func() error {
+			nowRunning := atomic.AddInt32(&running, 1)
+			for {
+				max := atomic.LoadInt32(&maxRunning)
+				if nowRunning <= max || atomic.CompareAndSwapInt32(&maxRunning, max, nowRunning) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			atomic.AddInt32(&running, -1)
+			atomic.AddInt32(&completed, 1)
+			return nil
+		})
+	}
+
+	assert.NoError(t, pool.Wait())
+	assert.Equal(t, int32(20), completed)
+	assert.LessOrEqual(t, maxRunning, int32(3))
+}
+
+func TestWorkerPool_Error(t *testing.T) {
+	pool := newWorkerPool(2)
+
+	pool.Submit(func() error { return fmt.Errorf("first failure") })
+	assert.EqualError(t, pool.Wait(), "first failure")
+
+	pool.Submit(func() error { return fmt.Errorf("second failure") })
+	assert.EqualError(t, pool.Wait(), "first failure")
+}
+
+func TestValidateCompression(t *testing.T) {
+	assert.NoError(t, ValidateCompression("gzip"))
+	assert.NoError(t, ValidateCompression("zstd"))
+	assert.EqualError(t, ValidateCompression("bzip2"), "unknown compression 'bzip2'. Must be gzip or zstd")
+}
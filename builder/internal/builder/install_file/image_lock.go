@@ -0,0 +1,116 @@
+package install_file
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"os"
+	"sort"
+	"strings"
+)
+
+/**
+Records the digest each image tag resolved to, so later builds package the same image contents.
+*/
+type ImageLock struct {
+	Images map[string]string `yaml:"images"`
+}
+
+/**
+Loads the lock file at the given path. Returns an empty lock if the file does not exist.
+*/
+func LoadImageLock(lockPath string) (*ImageLock, error) {
+	imageLock := &ImageLock{
+		Images: map[string]string{},
+	}
+
+	lockFile, err := os.Open(lockPath)
+	if os.IsNotExist(err) {
+		return imageLock, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot open lock file %s: %s", lockPath, err)
+	}
+	defer lockFile.Close()
+
+	decoder := yaml.NewDecoder(lockFile)
+	if err := decoder.Decode(imageLock); err != nil {
+		return nil, fmt.Errorf("error parsing lock file %s: %s", lockPath, err)
+	}
+	if imageLock.Images == nil {
+		imageLock.Images = map[string]string{}
+	}
+
+	return imageLock, nil
+}
+
+/**
+Creates a lock from the images pinned in a build. Locally built images are not locked because they are rebuilt from source.
+*/
+func NewImageLock(pinnedImages map[string]string) *ImageLock {
+	imageLock := &ImageLock{
+		Images: map[string]string{},
+	}
+	for tag, digest := range pinnedImages {
+		if strings.HasPrefix(tag, "build.local/") {
+			continue
+		}
+		imageLock.Images[tag] = digest
+	}
+
+	return imageLock
+}
+
+/**
+Returns the tag pinned to its locked digest, or the tag unchanged if it is not locked
+*/
+func (imageLock *ImageLock) PinnedReference(tag string) (string, error) {
+	digest := imageLock.Images[tag]
+	if digest == "" {
+		return tag, nil
+	}
+	return pinnedReference(tag, digest)
+}
+
+func (imageLock *ImageLock) Save(lockPath string) error {
+	lockFile, err := os.Create(lockPath)
+	if err != nil {
+		return fmt.Errorf("cannot write lock file %s: %s", lockPath, err)
+	}
+	defer lockFile.Close()
+
+	//sorted so the file stays stable in source control
+	var tags []string
+	for tag := range imageLock.Images {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+
+	imagesNode := &yaml.Node{Kind: yaml.MappingNode}
+	for _, tag := range tags {
+		imagesNode.Content = append(imagesNode.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Value: tag},
+			&yaml.Node{Kind: yaml.ScalarNode, Value: imageLock.Images[tag]},
+		)
+	}
+
+	document := &yaml.Node{
+		Kind:        yaml.DocumentNode,
+		HeadComment: "Generated by ruckstack build. Run `ruckstack build --refresh-lock` to re-resolve image digests",
+		Content: []*yaml.Node{
+			{
+				Kind: yaml.MappingNode,
+				Content: []*yaml.Node{
+					{Kind: yaml.ScalarNode, Value: "images"},
+					imagesNode,
+				},
+			},
+		},
+	}
+
+	encoder := yaml.NewEncoder(lockFile)
+	if err := encoder.Encode(document); err != nil {
+		return fmt.Errorf("error writing lock file %s: %s", lockPath, err)
+	}
+
+	return encoder.Close()
+}
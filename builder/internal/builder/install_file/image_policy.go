@@ -0,0 +1,125 @@
+package install_file
+
+import (
+	"fmt"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/go-units"
+	"sort"
+	"strings"
+)
+
+/**
+Rules every packaged image must follow. Locally built images are exempt from the registry rules.
+*/
+type ImagePolicy struct {
+	DisallowLatest    bool     `yaml:"disallowLatest"`
+	AllowedRegistries []string `yaml:"allowedRegistries"`
+	MaxImageSize      string   `yaml:"maxImageSize"`
+}
+
+type imagePolicyViolation struct {
+	image    string
+	services []string
+	reason   string
+}
+
+func (policy *ImagePolicy) Validate() error {
+	if policy.MaxImageSize != "" {
+		if _, err := units.FromHumanSize(policy.MaxImageSize); err != nil {
+			return fmt.Errorf("invalid imagePolicy maxImageSize '%s': %s", policy.MaxImageSize, err)
+		}
+	}
+
+	return nil
+}
+
+/**
+Checks the references of the given images against the tag and registry rules
+*/
+func (policy *ImagePolicy) checkReferences(imageSources map[string][]string) []imagePolicyViolation {
+	var violations []imagePolicyViolation
+
+	for _, tag := range sortedKeys(imageSources) {
+		named, err := reference.ParseNormalizedNamed(tag)
+		if err != nil {
+			violations = append(violations, imagePolicyViolation{image: tag, services: imageSources[tag], reason: err.Error()})
+			continue
+		}
+
+		if policy.DisallowLatest {
+			if _, isDigested := named.(reference.Canonical); !isDigested {
+				if tagged, isTagged := named.(reference.Tagged); !isTagged {
+					violations = append(violations, imagePolicyViolation{image: tag, services: imageSources[tag], reason: "no tag specified"})
+				} else if tagged.Tag() == "latest" {
+					violations = append(violations, imagePolicyViolation{image: tag, services: imageSources[tag], reason: "uses the 'latest' tag"})
+				}
+			}
+		}
+
+		if len(policy.AllowedRegistries) > 0 && !strings.HasPrefix(tag, "build.local/") && !policy.isAllowedRegistry(named) {
+			violations = append(violations, imagePolicyViolation{image: tag, services: imageSources[tag], reason: fmt.Sprintf("registry %s is not in allowedRegistries", reference.Domain(named))})
+		}
+	}
+
+	return violations
+}
+
+/**
+Checks the size of the given images, which must already be pulled
+*/
+func (policy *ImagePolicy) checkSizes(imageSources map[string][]string, backend ImageBackend) ([]imagePolicyViolation, error) {
+	if policy.MaxImageSize == "" {
+		return nil, nil
+	}
+
+	maxSize, err := units.FromHumanSize(policy.MaxImageSize)
+	if err != nil {
+		return nil, err
+	}
+
+	var violations []imagePolicyViolation
+	for _, tag := range sortedKeys(imageSources) {
+		size, err := backend.Size(tag)
+		if err != nil {
+			return nil, fmt.Errorf("cannot determine size of %s: %s", tag, err)
+		}
+
+		if size > maxSize {
+			violations = append(violations, imagePolicyViolation{image: tag, services: imageSources[tag], reason: fmt.Sprintf("size %s is larger than maxImageSize %s", units.HumanSize(float64(size)), policy.MaxImageSize)})
+		}
+	}
+
+	return violations, nil
+}
+
+/**
+Allowed registries can be a registry host such as "docker.io" or a repository prefix such as "ghcr.io/my-org"
+*/
+func (policy *ImagePolicy) isAllowedRegistry(named reference.Named) bool {
+	for _, allowed := range policy.AllowedRegistries {
+		allowed = strings.TrimSuffix(allowed, "/")
+		if reference.Domain(named) == allowed || strings.HasPrefix(named.Name(), allowed+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func formatImagePolicyViolations(violations []imagePolicyViolation) string {
+	lines := []string{fmt.Sprintf("%d image policy violations:", len(violations))}
+	for _, violation := range violations {
+		lines = append(lines, fmt.Sprintf("    %s (from %s): %s", violation.image, strings.Join(violation.services, ", "), violation.reason))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func sortedKeys(values map[string][]string) []string {
+	var keys []string
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
@@ -6,17 +6,24 @@ import (
 	"bufio"
 	"bytes"
 	"compress/flate"
-	"compress/gzip"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/go-units"
+	godigest "github.com/opencontainers/go-digest"
 	"github.com/ruckstack/ruckstack/builder/internal/bundled"
+	"github.com/ruckstack/ruckstack/builder/internal/cache"
 	"github.com/ruckstack/ruckstack/builder/internal/docker"
 	"github.com/ruckstack/ruckstack/builder/internal/environment"
 	"github.com/ruckstack/ruckstack/builder/internal/license"
+	"github.com/ruckstack/ruckstack/builder/internal/sbom"
+	"github.com/ruckstack/ruckstack/builder/internal/timing"
 	"github.com/ruckstack/ruckstack/builder/internal/util"
 	"github.com/ruckstack/ruckstack/common/config"
 	"github.com/ruckstack/ruckstack/common/global_util"
+	"github.com/ruckstack/ruckstack/common/signature"
 	"github.com/ruckstack/ruckstack/common/ui"
 	"gopkg.in/yaml.v3"
 	"helm.sh/helm/v3/pkg/chart"
@@ -26,24 +33,124 @@ import (
 	"io"
 	"io/fs"
 	"io/ioutil"
-	appV1 "k8s.io/api/apps/v1"
-	coreV1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes/scheme"
-	"log"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
+/**
+Path to the pod spec within each kind of kubernetes object that runs containers
+*/
+var podSpecPaths = map[string][]string{
+	"Pod":                   {"spec"},
+	"PodTemplate":           {"template", "spec"},
+	"ReplicationController": {"spec", "template", "spec"},
+	"ReplicaSet":            {"spec", "template", "spec"},
+	"Deployment":            {"spec", "template", "spec"},
+	"DaemonSet":             {"spec", "template", "spec"},
+	"StatefulSet":           {"spec", "template", "spec"},
+	"Job":                   {"spec", "template", "spec"},
+	"CronJob":               {"spec", "jobTemplate", "spec", "template", "spec"},
+}
+
+var containerFields = []string{"initContainers", "containers", "ephemeralContainers"}
+
+/**
+Source of the images packaged in the install file
+*/
+type ImageBackend interface {
+	Name() string
+
+	//Pull fetches the image. If digest is set, that digest is fetched instead of the current contents of imageRef
+	Pull(imageRef string, digest string) error
+
+	//Available returns true if Pull would succeed with --offline, without pulling anything
+	Available(imageRef string, digest string) bool
+
+	//Digest returns the digest the pulled image resolved to
+	Digest(imageRef string) (string, error)
+
+	//Size returns the uncompressed size of the pulled image
+	Size(imageRef string) (int64, error)
+
+	//Save writes the pulled images to outputPath in the `docker save` format
+	Save(outputPath string, imageRefs ...string) error
+}
+
 type InstallFile struct {
 	PackageConfig    *config.PackageConfig
 	SystemConfig     *config.SystemConfig
 	CompressionLevel int
 
-	dockerImages map[string]bool
-	addedFiles   map[string]bool
+	//Architecture is the server architecture the install file is for, such as amd64 or arm64
+	Architecture string
+
+	//Compression is the format for image layers and zip entries: CompressionGzip or CompressionZstd
+	Compression string
+
+	//CompressionWorkers is how many layers are compressed at once. Defaults to the number of CPUs
+	CompressionWorkers int
+
+	//Timings records how long each phase of the build takes. May be nil
+	Timings *timing.Timings
+
+	//ImageLock contains digests from a previous build to pull instead of the current tag contents
+	ImageLock *ImageLock
+
+	ImagePolicy       *ImagePolicy
+	IgnoreImagePolicy bool
+
+	//ImageBackend pulls and exports the packaged images. Defaults to the docker daemon
+	ImageBackend ImageBackend
+
+	//Sbom lists everything in the install file. Set by CompleteCreation
+	Sbom *sbom.Bom
+
+	//DeltaBase is the package config of a previous build. If set, files unchanged since that build are left out of the install file
+	DeltaBase *config.PackageConfig
+
+	//Signer signs the install file contents. If nil, the install file is not signed
+	Signer *signature.Signer
+
+	//Reproducible records the build time as the modification time of every file, so the same inputs always create the same install file
+	Reproducible bool
+
+	//parent is the install file a service install file is committed to. Nil except for install files created by BuildServices
+	parent *InstallFile
+
+	//output collects the messages of a service built alongside others. If nil, messages are printed immediately
+	output *ui.OutputGroup
+
+	//stagedFiles are the files added to a service install file, written to the parent when it is committed
+	stagedFiles []stagedFile
+
+	//imagesLock guards the resolved images and resolvingImages, which services built in parallel share
+	imagesLock sync.Mutex
+
+	//resolvingImages are the images being pulled, so a tag needed by several services is only pulled once
+	resolvingImages map[string]*resolvingImage
+
+	//dockerImages maps each image to the services that reference it
+	dockerImages   map[string][]string
+	addedFiles     map[string]bool
+	currentService string
+	components     []sbom.Component
+
+	//zipDigests is the sha256 of each file written to the zip and of the installer executable, used for the signature
+	zipDigests map[string]string
+
+	//executableSize is the length of the installer executable before the zip
+	executableSize int64
+
+	omittedFiles int
+	omittedBytes uint64
 
 	file      *os.File
 	zipWriter *zip.Writer
@@ -53,16 +160,21 @@ type InstallFile struct {
 Begins creating the install file.
 
 The install file is the installer binary followed by a zip of what to install.
-This method will create the file with the installer and open a zip write for the remaining contents.
+This method will create the file with the installer for the given architecture and open a zip write for the remaining contents.
 */
-func StartCreation(installerPath string, compressionLevel int) (*InstallFile, error) {
+func StartCreation(installerPath string, compressionLevel int, architecture string) (*InstallFile, error) {
 
 	installFile := &InstallFile{
 		CompressionLevel: compressionLevel,
+		Compression:      CompressionGzip,
+		Architecture:     architecture,
+		ImageBackend:     &docker.Backend{Architecture: architecture},
 		PackageConfig: &config.PackageConfig{
-			BuildTime: time.Now().Unix(),
+			BuildTime:    time.Now().Unix(),
+			Architecture: architecture,
 
-			Files: map[string]string{},
+			Files:  map[string]string{},
+			Images: map[string]string{},
 			FilePermissions: map[string]config.PackagedFileConfig{
 				".package.config": {
 					AdminGroupReadable: true,
@@ -103,7 +215,7 @@ func StartCreation(installerPath string, compressionLevel int) (*InstallFile, er
 			},
 		},
 		SystemConfig: &config.SystemConfig{},
-		dockerImages: map[string]bool{},
+		dockerImages: map[string][]string{},
 		addedFiles:   map[string]bool{},
 	}
 	if license.ActiveLicense != nil {
@@ -112,7 +224,11 @@ func StartCreation(installerPath string, compressionLevel int) (*InstallFile, er
 
 	ui.Printf("Building %s...", filepath.Base(installerPath))
 
-	installerBytes, err := bundled.ReadFile("installer")
+	installerBinary, err := bundled.BinaryPath("installer", architecture)
+	if err != nil {
+		return nil, err
+	}
+	installerBytes, err := bundled.ReadFile(installerBinary)
 	if err != nil {
 		return nil, err
 	}
@@ -131,11 +247,13 @@ func StartCreation(installerPath string, compressionLevel int) (*InstallFile, er
 	}
 
 	startOffset, _ := installFile.file.Seek(0, io.SeekEnd)
+	installFile.recordExecutable(installerBytes)
 
 	installFile.zipWriter = zip.NewWriter(installFile.file)
 	installFile.zipWriter.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
 		return flate.NewWriter(out, installFile.CompressionLevel)
 	})
+	installFile.registerZipCompressors()
 	installFile.zipWriter.SetOffset(startOffset)
 
 	return installFile, nil
@@ -150,6 +268,22 @@ func (installFile *InstallFile) CompleteCreation() error {
 		return err
 	}
 
+	stopTiming := installFile.Timings.Start("creating SBOM")
+	err := installFile.buildSbom()
+	stopTiming()
+	if err != nil {
+		return fmt.Errorf("error creating SBOM: %s", err)
+	}
+
+	defer installFile.Timings.Start("writing installer")()
+
+	if installFile.DeltaBase != nil {
+		installFile.PackageConfig.DeltaBase = &config.DeltaBase{
+			Version:   installFile.DeltaBase.Version,
+			BuildTime: installFile.DeltaBase.BuildTime,
+		}
+	}
+
 	packageConfigFilePath := environment.TempPath("package.config")
 	packageConfigFile, err := os.OpenFile(packageConfigFilePath, os.O_CREATE|os.O_RDWR, 0644)
 	if err != nil {
@@ -193,6 +327,12 @@ func (installFile *InstallFile) CompleteCreation() error {
 		return err
 	}
 
+	if installFile.Signer != nil {
+		if err := installFile.addSignature(); err != nil {
+			return err
+		}
+	}
+
 	if err := installFile.zipWriter.Close(); err != nil {
 		return err
 	}
@@ -201,6 +341,9 @@ func (installFile *InstallFile) CompleteCreation() error {
 		return err
 	}
 
+	if installFile.DeltaBase != nil {
+		ui.Printf("Left out %d files (%s) unchanged since version %s", installFile.omittedFiles, units.HumanSize(float64(installFile.omittedBytes)), installFile.DeltaBase.Version)
+	}
 	ui.Printf("Building %s...DONE", filepath.Base(installFile.file.Name()))
 
 	return nil
@@ -212,7 +355,7 @@ Downloads the given url and saves it to the installer
 func (installFile *InstallFile) AddDownloadedFile(url string, targetPath string) error {
 	savedLocation, err := util.DownloadFile(url)
 	if err != nil {
-		return nil
+		return err
 	}
 
 	downloadedFile, err := os.Open(savedLocation)
@@ -232,7 +375,14 @@ func (installFile *InstallFile) AddDownloadedNestedFile(url string, wantedFile s
 		return err
 	}
 
-	extractedFilePath, err := util.ExtractFromGzip(fileLocation, wantedFile)
+	return installFile.AddNestedFile(fileLocation, wantedFile, targetPath)
+}
+
+/**
+Extracts a specific file out of the tar.gz archive and saves it to the installer
+*/
+func (installFile *InstallFile) AddNestedFile(archivePath string, wantedFile string, targetPath string) error {
+	extractedFilePath, err := util.ExtractFromGzip(archivePath, wantedFile)
 	if err != nil {
 		return err
 	}
@@ -275,104 +425,226 @@ func (installFile *InstallFile) AddFile(file fs.File, targetPath string) error {
 	}
 
 	if installFile.addedFiles[targetPath] {
-		ui.VPrintf("File %s already added to installer", targetPath)
+		installFile.VPrintf("File %s already added to installer", targetPath)
 		return nil
 	}
 	installFile.addedFiles[targetPath] = true
 
-	ui.VPrintf("Adding %s to installer", targetPath)
+	installFile.VPrintf("Adding %s to installer", targetPath)
 
 	if strings.HasPrefix(targetPath, "data/agent/images") && strings.HasSuffix(targetPath, ".tar") {
 		if err := installFile.saveImagesTar(file, targetPath); err != nil {
 			return err
 		}
 	} else {
-		return installFile.AddFileData(file, targetPath, fileInfo.ModTime())
+		return installFile.AddFileData(file, fileInfo.Size(), targetPath, fileInfo.ModTime())
 	}
 
 	return nil
 
 }
 
-func (installFile *InstallFile) AddFileData(data io.Reader, installerPath string, modTime time.Time) error {
-	dataBytes, err := ioutil.ReadAll(data)
-	if err != nil {
-		return err
-	}
+/**
+Streams data into the installer while hashing it, so memory use does not depend on the file size.
+Size is the number of bytes expected, as known from the file stat or tar header.
+*/
+func (installFile *InstallFile) AddFileData(data io.Reader, size int64, installerPath string, modTime time.Time) error {
+	installerPath = strings.ReplaceAll(installerPath, "\\", "/")
+	installerPath = regexp.MustCompile("^.?/").ReplaceAllString(installerPath, "")
 
-	hash := sha1.New()
-	_, err = io.Copy(hash, bytes.NewReader(dataBytes))
-	if err != nil {
-		return fmt.Errorf("cannot compute hash for %s: %s", installerPath, err)
+	if installFile.parent != nil {
+		return installFile.stageFileData(data, size, installerPath, modTime)
 	}
 
-	hashBytes := hash.Sum(nil)[:20]
-	dataHash := hex.EncodeToString(hashBytes)
+	if installFile.isDeltaCandidate(installerPath) {
+		seekableData, cleanup, err := seekable(data)
+		if err != nil {
+			return fmt.Errorf("cannot buffer %s: %s", installerPath, err)
+		}
+		defer cleanup()
 
-	installerPath = strings.ReplaceAll(installerPath, "\\", "/")
-	installerPath = regexp.MustCompile("^.?/").ReplaceAllString(installerPath, "")
+		startOffset, err := seekableData.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		hash := sha1.New()
+		if _, err := io.Copy(hash, seekableData); err != nil {
+			return fmt.Errorf("cannot compute hash for %s: %s", installerPath, err)
+		}
+		dataHash := hex.EncodeToString(hash.Sum(nil))
+
+		if installFile.DeltaBase.Files[installerPath] == dataHash {
+			ui.VPrintf("Leaving unchanged %s out of delta installer", installerPath)
+			installFile.PackageConfig.Files[installerPath] = dataHash
+			installFile.omittedFiles++
+			installFile.omittedBytes += uint64(size)
+			return nil
+		}
+
+		if _, err := seekableData.Seek(startOffset, io.SeekStart); err != nil {
+			return err
+		}
+		data = seekableData
+	}
 
-	uncompressedSize := uint64(len(dataBytes))
 	header := &zip.FileHeader{
 		Name:               installerPath,
-		UncompressedSize64: uncompressedSize,
-		Modified:           modTime,
+		Method:             installFile.zipMethod(installerPath),
+		UncompressedSize64: uint64(size),
+		Modified:           installFile.entryModTime(modTime),
 	}
 
 	entryWriter, err := installFile.zipWriter.CreateHeader(header)
 	if err != nil {
-		return fmt.Errorf("could not write header for file %s: %s", installFile.file.Name(), err)
+		return fmt.Errorf("could not write header for file %s: %s", installerPath, err)
 	}
 
-	written, err := io.Copy(entryWriter, bytes.NewReader(dataBytes))
+	sha1Hash := sha1.New()
+	sha256Hash := sha256.New()
+	written, err := io.Copy(io.MultiWriter(entryWriter, sha1Hash, sha256Hash), data)
 	if err != nil {
-		return fmt.Errorf("could not write to %s: %s", installFile.file.Name(), err)
+		return fmt.Errorf("could not write %s to installer: %s", installerPath, err)
 	}
 
-	if uint64(written) != uncompressedSize {
-		return fmt.Errorf("expected %s to be %d bytes but was %d", installerPath, uncompressedSize, written)
+	if written != size {
+		return fmt.Errorf("expected %s to be %d bytes but was %d", installerPath, size, written)
 	}
 
-	installFile.PackageConfig.Files[installerPath] = dataHash
+	installFile.PackageConfig.Files[installerPath] = hex.EncodeToString(sha1Hash.Sum(nil))
+
+	if installFile.zipDigests == nil {
+		installFile.zipDigests = map[string]string{}
+	}
+	installFile.zipDigests[installerPath] = hex.EncodeToString(sha256Hash.Sum(nil))
 
 	return nil
 }
 
-func (installFile *InstallFile) AddHelmChart(chartFilePath string, chartId string, overrideParameters map[string]interface{}) error {
-	chartFileHash, err := global_util.HashFile(chartFilePath)
+/**
+Returns the modification time files generated for a reproducible build should record, or the zero time if the build is not reproducible.
+The time is in UTC since zip entries also store the time in the local time zone
+*/
+func (installFile *InstallFile) ReproducibleModTime() time.Time {
+	if !installFile.Reproducible {
+		return time.Time{}
+	}
+	return time.Unix(installFile.PackageConfig.BuildTime, 0).UTC()
+}
+
+func (installFile *InstallFile) entryModTime(modTime time.Time) time.Time {
+	if installFile.Reproducible {
+		return installFile.ReproducibleModTime()
+	}
+	return modTime
+}
+
+/**
+Returns data as something that can be read more than once. Streams that cannot seek, such as tar entries, are copied to a temp file.
+The returned function removes the temp file.
+*/
+func seekable(data io.Reader) (io.ReadSeeker, func(), error) {
+	if readSeeker, ok := data.(io.ReadSeeker); ok {
+		return readSeeker, func() {}, nil
+	}
+
+	tempFile, err := os.Create(environment.TempPath("buffer-*"))
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() {
+		_ = tempFile.Close()
+		_ = os.Remove(tempFile.Name())
+	}
+
+	if _, err := io.Copy(tempFile, data); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	if _, err := tempFile.Seek(0, io.SeekStart); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+
+	return tempFile, cleanup, nil
+}
+
+/**
+Records the digest of the installer executable written before the zip.
+The executable is what runs, so it is signed along with the zip contents
+*/
+func (installFile *InstallFile) recordExecutable(executable []byte) {
+	if len(executable) == 0 {
+		return
+	}
+
+	executableDigest := sha256.Sum256(executable)
+	if installFile.zipDigests == nil {
+		installFile.zipDigests = map[string]string{}
+	}
+	installFile.zipDigests[signature.ExecutablePath] = hex.EncodeToString(executableDigest[:])
+	installFile.executableSize = int64(len(executable))
+}
+
+/**
+Signs everything written to the zip and adds the signature. Must be the last file added.
+*/
+func (installFile *InstallFile) addSignature() error {
+	installerSignature, err := installFile.Signer.Sign(installFile.zipDigests)
 	if err != nil {
 		return err
 	}
+	if _, signsExecutable := installFile.zipDigests[signature.ExecutablePath]; signsExecutable {
+		installerSignature.ExecutableSize = installFile.executableSize
+	}
 
-	manifest := map[string]interface{}{
-		"apiVersion": "helm.cattle.io/v1",
-		"kind":       "HelmChart",
-		"metadata": map[string]interface{}{
-			"name":      chartId,
-			"namespace": "kube-system",
-		},
-		"spec": map[string]interface{}{
-			"chart":           "https://%{KUBERNETES_API}%/static/charts/" + chartId + "-" + chartFileHash + ".tgz",
-			"targetNamespace": "default",
-		},
+	entryWriter, err := installFile.zipWriter.CreateHeader(&zip.FileHeader{
+		Name:     signature.InstallerPath,
+		Modified: installFile.entryModTime(time.Unix(installFile.PackageConfig.BuildTime, 0)),
+	})
+	if err != nil {
+		return fmt.Errorf("could not write signature: %s", err)
+	}
+	if err := installerSignature.Write(entryWriter); err != nil {
+		return fmt.Errorf("could not write signature: %s", err)
 	}
 
-	if overrideParameters != nil && len(overrideParameters) > 0 {
-		valuesString, err := yaml.Marshal(overrideParameters)
-		if err != nil {
-			return err
-		}
-		manifest["spec"].(map[string]interface{})["valuesContent"] = string(valuesString)
+	ui.Printf("Signed with key %s", signature.Fingerprint(installFile.Signer.PublicKey()))
+	return nil
+}
+
+/**
+Returns true if the file exists in the delta base, so it may be left out if its hash is unchanged.
+Files the installer reads before upgrading are always included.
+*/
+func (installFile *InstallFile) isDeltaCandidate(installerPath string) bool {
+	if installFile.DeltaBase == nil {
+		return false
 	}
 
-	manifestData, err := yaml.Marshal(manifest)
+	switch installerPath {
+	case ".package.config", "config/system.config", sbom.InstallerPath:
+		return false
+	}
+
+	_, found := installFile.DeltaBase.Files[installerPath]
+	return found
+}
+
+/**
+Adds the chart and a HelmChart manifest to install it. Repository is the URL the chart was downloaded from, or "" for generated charts
+*/
+func (installFile *InstallFile) AddHelmChart(chartFilePath string, chartId string, repository string, overrideParameters map[string]interface{}) error {
+	chartFileHash, err := global_util.HashFile(chartFilePath)
 	if err != nil {
 		return err
 	}
 
-	manifestData = []byte(strings.ReplaceAll(string(manifestData), "valuesContent: |\n", "valuesContent: |-\n"))
+	manifestData, err := HelmChartManifest(chartId, chartFileHash, overrideParameters)
+	if err != nil {
+		return err
+	}
 
-	if err := installFile.AddFileData(bytes.NewReader(manifestData), "data/server/manifests/"+chartId+".yaml", time.Now()); err != nil {
+	if err := installFile.AddFileData(bytes.NewReader(manifestData), int64(len(manifestData)), "data/server/manifests/"+chartId+".yaml", time.Now()); err != nil {
 		return err
 	}
 
@@ -388,11 +660,45 @@ func (installFile *InstallFile) AddHelmChart(chartFilePath string, chartId strin
 	if err != nil {
 		return err
 	}
+	installFile.addChartComponent(chartId, loadedChart.Metadata.Name, loadedChart.Metadata.Version, repository)
 
-	return installFile.processManifests(loadedChart)
+	return installFile.processManifests(loadedChart, chartId, overrideParameters)
 
 }
 
+/**
+Returns the HelmChart resource that installs the chart saved with the given hash, with the given values
+*/
+func HelmChartManifest(chartId string, chartFileHash string, values map[string]interface{}) ([]byte, error) {
+	manifest := map[string]interface{}{
+		"apiVersion": "helm.cattle.io/v1",
+		"kind":       "HelmChart",
+		"metadata": map[string]interface{}{
+			"name":      chartId,
+			"namespace": "kube-system",
+		},
+		"spec": map[string]interface{}{
+			"chart":           "https://%{KUBERNETES_API}%/static/charts/" + chartId + "-" + chartFileHash + ".tgz",
+			"targetNamespace": "default",
+		},
+	}
+
+	if values != nil && len(values) > 0 {
+		valuesString, err := yaml.Marshal(values)
+		if err != nil {
+			return nil, err
+		}
+		manifest["spec"].(map[string]interface{})["valuesContent"] = string(valuesString)
+	}
+
+	manifestData, err := yaml.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(strings.ReplaceAll(string(manifestData), "valuesContent: |\n", "valuesContent: |-\n")), nil
+}
+
 func (installFile *InstallFile) installerFileMode(targetPath string) int64 {
 	if strings.HasPrefix(targetPath, "lib") || strings.HasPrefix(targetPath, "bin") {
 		return int64(0755)
@@ -415,22 +721,213 @@ func (installFile *InstallFile) AddDirectory(assetBase fs.FS, targetBase string)
 }
 
 func (installFile *InstallFile) AddImage(tag string) error {
-	if !installFile.dockerImages[tag] {
-		ui.Printf("Including image %s", tag)
-		installFile.dockerImages[tag] = true
+	if _, err := reference.ParseNormalizedNamed(tag); err != nil {
+		return fmt.Errorf("cannot resolve image reference '%s': %s", tag, err)
 	}
 
+	if installFile.isPinnedImage(tag) {
+		return nil
+	}
+
+	source := installFile.currentService
+	if source == "" {
+		source = "project"
+	}
+
+	sources, found := installFile.dockerImages[tag]
+	for _, existingSource := range sources {
+		if existingSource == source {
+			return nil
+		}
+	}
+
+	if !found {
+		installFile.Printf("Including image %s", tag)
+	}
+	installFile.dockerImages[tag] = append(sources, source)
+
 	return nil
 }
 
+/**
+Marks the following files and images as coming from the given service
+*/
+func (installFile *InstallFile) StartService(serviceId string) {
+	installFile.currentService = serviceId
+}
+
+/**
+Adds the given image to the installer and returns a reference to it pinned by digest
+*/
+func (installFile *InstallFile) PinImage(tag string) (string, error) {
+	if err := installFile.AddImage(tag); err != nil {
+		return "", err
+	}
+
+	//images that break the policy are not pulled. They are left unpinned and reported with every other violation by checkImageReferences
+	if installFile.ImagePolicy != nil && !installFile.IgnoreImagePolicy && len(installFile.ImagePolicy.checkReferences(map[string][]string{tag: nil})) > 0 {
+		return tag, nil
+	}
+
+	digest, err := installFile.resolveImage(tag)
+	if err != nil {
+		return "", err
+	}
+
+	return pinnedReference(tag, digest)
+}
+
+/**
+Returns true if the given reference is the pinned form of an image already in the installer
+*/
+func (installFile *InstallFile) isPinnedImage(imageRef string) bool {
+	if installFile.parent != nil {
+		return installFile.parent.isPinnedImage(imageRef)
+	}
+
+	installFile.imagesLock.Lock()
+	defer installFile.imagesLock.Unlock()
+
+	for tag, digest := range installFile.PackageConfig.Images {
+		pinnedRef, err := pinnedReference(tag, digest)
+		if err == nil && pinnedRef == imageRef {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+An image being pulled by resolveImage. Other callers for the same tag wait for done instead of pulling it again
+*/
+type resolvingImage struct {
+	done   chan struct{}
+	digest string
+	err    error
+}
+
+/**
+Pulls the given image and records the digest it resolved to in the package config.
+If the image lock contains a digest for the tag, that digest is pulled instead of the current tag contents.
+Service install files resolve images through their parent, so each image is only pulled once.
+*/
+func (installFile *InstallFile) resolveImage(tag string) (string, error) {
+	if installFile.parent != nil {
+		return installFile.parent.resolveImage(tag)
+	}
+
+	installFile.imagesLock.Lock()
+	if digest := installFile.PackageConfig.Images[tag]; digest != "" {
+		installFile.imagesLock.Unlock()
+		return digest, nil
+	}
+	if resolving, found := installFile.resolvingImages[tag]; found {
+		installFile.imagesLock.Unlock()
+		<-resolving.done
+		return resolving.digest, resolving.err
+	}
+	if installFile.resolvingImages == nil {
+		installFile.resolvingImages = map[string]*resolvingImage{}
+	}
+	resolving := &resolvingImage{done: make(chan struct{})}
+	installFile.resolvingImages[tag] = resolving
+	installFile.imagesLock.Unlock()
+
+	//the lock is not held while pulling, so other images are pulled at the same time
+	resolving.digest, resolving.err = installFile.pullImage(tag)
+
+	installFile.imagesLock.Lock()
+	if resolving.err == nil {
+		installFile.PackageConfig.Images[tag] = resolving.digest
+	}
+	//a failed pull is tried again by the next caller
+	delete(installFile.resolvingImages, tag)
+	installFile.imagesLock.Unlock()
+	close(resolving.done)
+
+	return resolving.digest, resolving.err
+}
+
+/**
+Pulls the given image, or its locked digest, and returns the digest it resolved to
+*/
+func (installFile *InstallFile) pullImage(tag string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(tag)
+	if err != nil {
+		return "", fmt.Errorf("cannot resolve image reference '%s': %s", tag, err)
+	}
+
+	lockedDigest := ""
+	if _, isDigested := named.(reference.Canonical); !isDigested && installFile.ImageLock != nil && !strings.HasPrefix(tag, "build.local/") {
+		lockedDigest = installFile.ImageLock.Images[tag]
+	}
+
+	if lockedDigest != "" {
+		ui.VPrintf("Using locked %s for %s", lockedDigest, tag)
+	}
+	if err := installFile.ImageBackend.Pull(tag, lockedDigest); err != nil {
+		return "", fmt.Errorf("error pulling %s: %s", tag, err)
+	}
+
+	//the locked digest is what was pulled, even if the image is known by other digests too
+	digest := lockedDigest
+	if digest == "" {
+		digest, err = installFile.ImageBackend.Digest(tag)
+		if err != nil {
+			return "", fmt.Errorf("cannot determine digest of %s: %s", tag, err)
+		}
+	}
+
+	ui.VPrintf("Resolved %s to %s", tag, digest)
+	return digest, nil
+}
+
+/**
+Returns the given tag as a digest reference, keeping the familiar form used in the original tag.
+*/
+func pinnedReference(tag string, digest string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(tag)
+	if err != nil {
+		return "", err
+	}
+
+	parsedDigest, err := godigest.Parse(digest)
+	if err != nil {
+		return "", err
+	}
+
+	canonical, err := reference.WithDigest(reference.TrimNamed(named), parsedDigest)
+	if err != nil {
+		return "", err
+	}
+
+	return reference.FamiliarString(canonical), nil
+}
+
 func (installFile *InstallFile) saveDockerImages() error {
+	if err := installFile.checkImageReferences(); err != nil {
+		return err
+	}
 
+	stopTiming := installFile.Timings.Start("pulling images")
 	var allTags []string
 	for tag, _ := range installFile.dockerImages {
 		allTags = append(allTags, tag)
-		err := docker.ImagePull(tag)
+		if _, err := installFile.resolveImage(tag); err != nil {
+			stopTiming()
+			return err
+		}
+	}
+	stopTiming()
+	sort.Strings(allTags)
+
+	if installFile.ImagePolicy != nil {
+		violations, err := installFile.ImagePolicy.checkSizes(installFile.dockerImages, installFile.ImageBackend)
 		if err != nil {
-			return fmt.Errorf("error pulling %s: %s", tag, err)
+			return err
+		}
+		if err := installFile.reportImagePolicyViolations(violations); err != nil {
+			return err
 		}
 	}
 
@@ -438,7 +935,10 @@ func (installFile *InstallFile) saveDockerImages() error {
 	if len(installFile.dockerImages) > 0 {
 		imagesTarPath := environment.TempPath("images-*.tar")
 		ui.VPrintf("Including %s in %s", strings.Join(allTags, ", "), imagesTarPath)
-		if err := docker.SaveImages(imagesTarPath, allTags...); err != nil {
+		stopTiming := installFile.Timings.Start("exporting images")
+		err := installFile.ImageBackend.Save(imagesTarPath, allTags...)
+		stopTiming()
+		if err != nil {
 			return fmt.Errorf("error collecting containers: %s", err)
 		}
 
@@ -454,15 +954,46 @@ func (installFile *InstallFile) saveDockerImages() error {
 	return nil
 }
 
-func (installFile *InstallFile) saveImagesTar(imagesTarFile fs.File, targetPath string) error {
-	defer ui.StartProgressf("Compressing " + targetPath).Stop()
+/**
+Checks the references of every image from every service against the image policy, before the images are pulled
+*/
+func (installFile *InstallFile) checkImageReferences() error {
+	if installFile.ImagePolicy == nil {
+		return nil
+	}
 
+	return installFile.reportImagePolicyViolations(installFile.ImagePolicy.checkReferences(installFile.dockerImages))
+}
+
+func (installFile *InstallFile) reportImagePolicyViolations(violations []imagePolicyViolation) error {
+	if len(violations) == 0 {
+		return nil
+	}
+
+	message := formatImagePolicyViolations(violations)
+	if installFile.IgnoreImagePolicy {
+		ui.Printf("WARNING: ignoring %s", message)
+		return nil
+	}
+
+	return fmt.Errorf("%s\nFix the images or build with --ignore-image-policy", message)
+}
+
+/**
+Adds the contents of a docker save tar to the installer, with each layer compressed.
+Layers are compressed in parallel and cached, so unchanged layers are only compressed once.
+*/
+func (installFile *InstallFile) saveImagesTar(imagesTarFile fs.File, targetPath string) error {
 	targetPath = strings.Replace(targetPath, ".tar", ".untar", 1)
 
 	ui.VPrintf("Saving images tar to %s", targetPath)
 
-	tarReader := tar.NewReader(imagesTarFile)
+	stopTiming := installFile.Timings.Start("compressing layers")
+	progress := ui.StartProgressf("Compressing " + targetPath)
+	pool := newWorkerPool(installFile.CompressionWorkers)
 
+	var layers []pendingLayer
+	tarReader := tar.NewReader(imagesTarFile)
 	for {
 		header, err := tarReader.Next()
 
@@ -471,66 +1002,108 @@ func (installFile *InstallFile) saveImagesTar(imagesTarFile fs.File, targetPath
 		}
 
 		if err != nil {
+			_ = pool.Wait()
+			progress.Stop()
+			stopTiming()
 			return err
 		}
 
-		if header == nil {
+		if header == nil || header.Typeflag != tar.TypeReg {
 			continue
 		}
 
 		target := targetPath + "/" + header.Name
 
-		switch header.Typeflag {
+		if !strings.HasSuffix(target, ".tar") {
+			if err := installFile.AddFileData(tarReader, header.Size, target, header.ModTime); err != nil {
+				_ = pool.Wait()
+				progress.Stop()
+				stopTiming()
+				return err
+			}
+			continue
+		}
 
-		case tar.TypeReg:
-			if strings.HasSuffix(target, ".tar") {
-				cachePath := environment.CachePath("files/" + target + ".gz")
+		layer := pendingLayer{
+			target:    target + installFile.layerExtension(),
+			cachePath: installFile.layerCachePath(target),
+			modTime:   header.ModTime,
+		}
+		layers = append(layers, layer)
 
-				_, err := os.Stat(cachePath)
-				if os.IsNotExist(err) {
-					err := os.MkdirAll(filepath.Dir(cachePath), 0755)
-					if err != nil {
-						return fmt.Errorf("cannot create cache directory %s: %s", cachePath, err)
-					}
+		if cache.Lookup(layer.cachePath) {
+			continue
+		}
 
-					ui.VPrintf("caching compressed layer at %s", cachePath)
-					cacheFile, err := os.Create(cachePath)
-					if err != nil {
-						return fmt.Errorf("cannot create cache file: %s", err)
-					}
+		//the tar can only be read in order, so copy the layer out before compressing it in the background
+		rawPath, err := spoolToTemp(tarReader, "layer-*.tar")
+		if err != nil {
+			_ = pool.Wait()
+			progress.Stop()
+			stopTiming()
+			return fmt.Errorf("cannot read layer %s: %s", header.Name, err)
+		}
 
-					gzipWriter, err := gzip.NewWriterLevel(cacheFile, installFile.CompressionLevel)
-					if err != nil {
-						return err
-					}
+		ui.VPrintf("caching compressed layer at %s", layer.cachePath)
+		pool.Submit(func() error {
+			defer os.Remove(rawPath)
+			return installFile.compressFile(rawPath, layer.cachePath)
+		})
+	}
+
+	err := pool.Wait()
+	progress.Stop()
+	stopTiming()
+	if err != nil {
+		return err
+	}
 
-					buffTarReader := bufio.NewReader(tarReader)
+	defer installFile.Timings.Start("writing installer")()
+	for _, layer := range layers {
+		if err := installFile.addCachedFile(layer.cachePath, layer.target, layer.modTime); err != nil {
+			return err
+		}
+	}
 
-					_, err = buffTarReader.WriteTo(gzipWriter)
-					if err != nil {
-						log.Fatal(err)
-					}
-					_ = gzipWriter.Close()
-					_ = cacheFile.Close()
-				}
+	return nil
+}
 
-				cacheFile, err := os.Open(cachePath)
-				if err != nil {
-					return fmt.Errorf("error opening cache file %s: %s", cachePath, err)
-				}
+func (installFile *InstallFile) addCachedFile(cachePath string, target string, modTime time.Time) error {
+	cacheFile, err := os.Open(cachePath)
+	if err != nil {
+		return fmt.Errorf("error opening cache file %s: %s", cachePath, err)
+	}
+	defer cacheFile.Close()
 
-				if err := installFile.AddFileData(cacheFile, target+".gz", header.ModTime); err != nil {
-					return err
-				}
-			} else {
-				if err := installFile.AddFileData(tarReader, target, header.ModTime); err != nil {
-					return err
-				}
-			}
+	cacheStat, err := cacheFile.Stat()
+	if err != nil {
+		return fmt.Errorf("error reading cache file %s: %s", cachePath, err)
+	}
 
-		}
+	return installFile.AddFileData(cacheFile, cacheStat.Size(), target, modTime)
+}
+
+/**
+Copies data to a new temp file and returns its path
+*/
+func spoolToTemp(data io.Reader, pattern string) (string, error) {
+	tempFile, err := os.Create(environment.TempPath(pattern))
+	if err != nil {
+		return "", err
 	}
-	return nil
+
+	if _, err := io.Copy(tempFile, data); err != nil {
+		_ = tempFile.Close()
+		_ = os.Remove(tempFile.Name())
+		return "", err
+	}
+
+	if err := tempFile.Close(); err != nil {
+		_ = os.Remove(tempFile.Name())
+		return "", err
+	}
+
+	return tempFile.Name(), nil
 }
 
 func (installFile *InstallFile) ClearDockerImages() error {
@@ -560,6 +1133,24 @@ func (installFile *InstallFile) ClearDockerImages() error {
 Parses the descriptorContent as a kubernetes descriptor and saves any referenced containers to the install file
 */
 func (installFile *InstallFile) AddImagesInManifest(descriptorContent []byte) error {
+	images, err := ImagesInManifest(descriptorContent)
+	if err != nil {
+		return err
+	}
+
+	for _, image := range images {
+		if err := installFile.AddImage(image); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/**
+Parses the descriptorContent as a kubernetes descriptor and returns the images of its containers
+*/
+func ImagesInManifest(descriptorContent []byte) ([]string, error) {
+	var images []string
 	decoder := yaml.NewDecoder(bytes.NewReader(descriptorContent))
 
 	for {
@@ -571,7 +1162,7 @@ func (installFile *InstallFile) AddImagesInManifest(descriptorContent []byte) er
 		}
 		if err != nil {
 			errMessage := strings.Replace(err.Error(), "yaml: ", "", 1) //remove extra "yaml: "
-			return fmt.Errorf("yaml syntax error: %s", errMessage)
+			return nil, fmt.Errorf("yaml syntax error: %s", errMessage)
 		}
 		if value == nil {
 			continue
@@ -581,80 +1172,219 @@ func (installFile *InstallFile) AddImagesInManifest(descriptorContent []byte) er
 		outputWriter := bufio.NewWriter(&output)
 		encoder := yaml.NewEncoder(outputWriter)
 		if err := encoder.Encode(value); err != nil {
-			return err
+			return nil, err
 		}
 		if err := outputWriter.Flush(); err != nil {
-			return nil
+			return nil, err
 		}
 
 		obj, groupVersionKind, err := scheme.Codecs.UniversalDeserializer().Decode(output.Bytes(), nil, nil)
 		if err != nil {
 			if strings.Contains(err.Error(), "no kind") {
 				//must be a CRD
-				return nil
+				continue
 			}
-			return err
+			return nil, err
+		}
+
+		podSpecPath, isPodBearing := podSpecPaths[groupVersionKind.Kind]
+		if !isPodBearing {
+			continue
 		}
 
-		var podSpec *coreV1.PodSpec
+		unstructuredObj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+		if err != nil {
+			return nil, err
+		}
 
-		switch groupVersionKind.Kind {
-		case "StatefulSet":
-			podSpec = &obj.(*appV1.StatefulSet).Spec.Template.Spec
-		case "Deployment":
-			podSpec = &obj.(*appV1.Deployment).Spec.Template.Spec
-		case "DaemonSet":
-			podSpec = &obj.(*appV1.DaemonSet).Spec.Template.Spec
-		case "ReplicaSet":
-			podSpec = &obj.(*appV1.ReplicaSet).Spec.Template.Spec
-		case "Pod":
-			podSpec = &obj.(*coreV1.Pod).Spec
+		podSpec, found, err := unstructured.NestedMap(unstructuredObj, podSpecPath...)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read pod spec in %s: %s", groupVersionKind.Kind, err)
+		}
+		if !found {
+			continue
 		}
 
-		if podSpec != nil {
-			for _, container := range podSpec.Containers {
-				if err := installFile.AddImage(container.Image); err != nil {
-					return err
+		for _, containerField := range containerFields {
+			containers, _, err := unstructured.NestedSlice(podSpec, containerField)
+			if err != nil {
+				return nil, fmt.Errorf("cannot read %s in %s: %s", containerField, groupVersionKind.Kind, err)
+			}
+
+			for _, container := range containers {
+				containerMap, ok := container.(map[string]interface{})
+				if !ok {
+					continue
 				}
+				containerName, _, _ := unstructured.NestedString(containerMap, "name")
+				image, _, _ := unstructured.NestedString(containerMap, "image")
+				if image == "" {
+					return nil, fmt.Errorf("container %s in %s %s has no image", containerName, groupVersionKind.Kind, unstructuredName(unstructuredObj))
+				}
+
+				images = append(images, image)
 			}
 		}
+	}
+	return images, nil
+
+}
+
+/**
+Returns the descriptorContent with every container image rewritten to a reference pinned by digest
+*/
+func (installFile *InstallFile) PinImagesInManifest(descriptorContent []byte) ([]byte, error) {
+	return PinImagesInManifest(descriptorContent, installFile.PinImage)
+}
+
+/**
+Returns the descriptorContent with every container image replaced by what pinImage returns for it
+*/
+func PinImagesInManifest(descriptorContent []byte, pinImage func(tag string) (string, error)) ([]byte, error) {
+	decoder := yaml.NewDecoder(bytes.NewReader(descriptorContent))
+
+	var output bytes.Buffer
+	encoder := yaml.NewEncoder(&output)
+	encoder.SetIndent(2)
+
+	for {
+		var document yaml.Node
+		err := decoder.Decode(&document)
+
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			errMessage := strings.Replace(err.Error(), "yaml: ", "", 1) //remove extra "yaml: "
+			return nil, fmt.Errorf("yaml syntax error: %s", errMessage)
+		}
+		if document.Kind == 0 {
+			continue
+		}
 
+		if err := pinImagesInNode(&document, pinImage); err != nil {
+			return nil, err
+		}
+
+		if err := encoder.Encode(&document); err != nil {
+			return nil, err
+		}
 	}
+
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+
+	return output.Bytes(), nil
+}
+
+func pinImagesInNode(node *yaml.Node, pinImage func(tag string) (string, error)) error {
+	if node.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i]
+			value := node.Content[i+1]
+
+			if !isContainerField(key.Value) || value.Kind != yaml.SequenceNode {
+				continue
+			}
+
+			for _, container := range value.Content {
+				if container.Kind != yaml.MappingNode {
+					continue
+				}
+				for j := 0; j+1 < len(container.Content); j += 2 {
+					if container.Content[j].Value != "image" || container.Content[j+1].Kind != yaml.ScalarNode {
+						continue
+					}
+
+					pinnedImage, err := pinImage(container.Content[j+1].Value)
+					if err != nil {
+						return err
+					}
+					container.Content[j+1].Value = pinnedImage
+				}
+			}
+		}
+	}
+
+	for _, child := range node.Content {
+		if err := pinImagesInNode(child, pinImage); err != nil {
+			return err
+		}
+	}
+
 	return nil
+}
 
+func isContainerField(field string) bool {
+	for _, containerField := range containerFields {
+		if field == containerField {
+			return true
+		}
+	}
+	return false
 }
 
-func (installFile *InstallFile) processManifests(loadedChart *chart.Chart) error {
+func unstructuredName(obj map[string]interface{}) string {
+	name, _, _ := unstructured.NestedString(obj, "metadata", "name")
+	return name
+}
+
+/**
+Renders the chart with the same release name and values the helm controller will use at install time,
+and saves any containers referenced in the generated manifests to the install file
+*/
+func (installFile *InstallFile) processManifests(loadedChart *chart.Chart, releaseName string, values map[string]interface{}) error {
+	rendered, err := RenderChart(loadedChart, releaseName, values)
+	if err != nil {
+		return err
+	}
+
+	for filename, data := range rendered {
+		if err := installFile.AddImagesInManifest([]byte(data)); err != nil {
+			return fmt.Errorf("Error parsing %s: %s", filename, err)
+		}
+	}
+
+	return nil
+}
+
+/**
+Renders the chart's templates with the same release name and values the helm controller will use at install time.
+Returns the content of each non-empty yaml file by its path in the chart
+*/
+func RenderChart(loadedChart *chart.Chart, releaseName string, values map[string]interface{}) (map[string]string, error) {
 	options := chartutil.ReleaseOptions{
-		Name:      "testRelease",
+		Name:      releaseName,
 		Namespace: "default",
+		Revision:  1,
+		IsInstall: true,
 	}
 
-	cvals, err := chartutil.CoalesceValues(loadedChart, map[string]interface{}{})
+	cvals, err := chartutil.CoalesceValues(loadedChart, values)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	valuesToRender, err := chartutil.ToRenderValues(loadedChart, cvals, options, nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	render, err := engine.Render(loadedChart, valuesToRender)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	rendered := map[string]string{}
 	for filename, data := range render {
 		data = strings.TrimSpace(data)
 		if len(data) == 0 {
 			continue
 		}
 		if strings.HasSuffix(filename, ".yaml") || strings.HasSuffix(filename, ".yml") {
-			if err := installFile.AddImagesInManifest([]byte(data)); err != nil {
-				return fmt.Errorf("Error parsing %s: %s", filename, err)
-			}
+			rendered[filename] = data
 		}
 	}
 
-	return nil
+	return rendered, nil
 }
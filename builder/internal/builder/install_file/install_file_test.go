@@ -1,16 +1,33 @@
 package install_file
 
 import (
+	"archive/zip"
 	"bytes"
 	"compress/flate"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"github.com/docker/go-units"
 	"github.com/ruckstack/ruckstack/builder/internal/environment"
+	"github.com/ruckstack/ruckstack/builder/internal/sbom"
+	"github.com/ruckstack/ruckstack/common/config"
 	"github.com/ruckstack/ruckstack/common/global_util"
+	"github.com/ruckstack/ruckstack/common/signature"
 	"github.com/ruckstack/ruckstack/common/ui"
 	"github.com/stretchr/testify/assert"
+	"helm.sh/helm/v3/pkg/chart"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestCreatingInstallFile(t *testing.T) {
@@ -27,7 +44,7 @@ func TestCreatingInstallFile(t *testing.T) {
 
 	assert.FileExists(t, global_util.GetSourceRoot()+"/builder/internal/bundled/installer", "compiled installer does not exist. Should be created by BUILD.sh")
 
-	installFile, err := StartCreation(environment.OutPath("test-project.installer"), flate.BestSpeed)
+	installFile, err := StartCreation(environment.OutPath("test-project.installer"), flate.BestSpeed, "amd64")
 	assert.NoError(t, err)
 	installFile.PackageConfig.Id = "test-project"
 	installFile.PackageConfig.Version = "5.6.7"
@@ -63,6 +80,7 @@ func TestCreatingInstallFile(t *testing.T) {
 
 	assert.FileExists(t, filepath.Join(unzipPath, "config/package_config.go"))
 	assert.FileExists(t, filepath.Join(unzipPath, "config/system.config"))
+	assert.FileExists(t, filepath.Join(unzipPath, ".sbom.json"))
 	assert.FileExists(t, filepath.Join(unzipPath, "ui/ui.go"))
 	assert.FileExists(t, filepath.Join(unzipPath, "was-build.sh"))
 	assert.FileExists(t, filepath.Join(unzipPath, "example.html"))
@@ -90,3 +108,723 @@ func TestCreatingInstallFile(t *testing.T) {
 	assert.Contains(t, string(manifestContent), "\"RepoTags\":[\"traefik:2.3\"]")
 	assert.Contains(t, string(manifestContent), "\"RepoTags\":[\"alpine:3.12\"]")
 }
+
+func TestAddImagesInManifest(t *testing.T) {
+	output := new(bytes.Buffer)
+	ui.SetOutput(output)
+
+	tests := []struct {
+		name       string
+		manifest   string
+		wantImages []string
+		wantErr    string
+	}{
+		{
+			name: "Finds init and ephemeral containers",
+			manifest: `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: test-deployment
+spec:
+  selector:
+    matchLabels:
+      app: test
+  template:
+    spec:
+      initContainers:
+        - name: init
+          image: busybox:1.33
+      containers:
+        - name: main
+          image: nginx:1.19
+      ephemeralContainers:
+        - name: debug
+          image: alpine:3.12
+`,
+			wantImages: []string{"busybox:1.33", "nginx:1.19", "alpine:3.12"},
+		},
+		{
+			name: "Finds jobs and cron jobs",
+			manifest: `
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: test-job
+spec:
+  template:
+    spec:
+      containers:
+        - name: job
+          image: job-image:1.0
+---
+apiVersion: batch/v1beta1
+kind: CronJob
+metadata:
+  name: test-cron
+spec:
+  schedule: "* * * * *"
+  jobTemplate:
+    spec:
+      template:
+        spec:
+          containers:
+            - name: cron
+              image: registry.example.com/cron-image:2.0
+`,
+			wantImages: []string{"job-image:1.0", "registry.example.com/cron-image:2.0"},
+		},
+		{
+			name: "Continues past custom resources",
+			manifest: `
+apiVersion: helm.cattle.io/v1
+kind: HelmChart
+metadata:
+  name: test-chart
+---
+apiVersion: v1
+kind: Pod
+metadata:
+  name: test-pod
+spec:
+  containers:
+    - name: pod
+      image: pod-image:1.0
+`,
+			wantImages: []string{"pod-image:1.0"},
+		},
+		{
+			name: "Fails on unresolvable image",
+			manifest: `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: test-pod
+spec:
+  containers:
+    - name: pod
+      image: "{{ .Values.image }}"
+`,
+			wantErr: "cannot resolve image reference '{{ .Values.image }}'",
+		},
+		{
+			name: "Fails on missing image",
+			manifest: `
+apiVersion: apps/v1
+kind: StatefulSet
+metadata:
+  name: test-set
+spec:
+  selector:
+    matchLabels:
+      app: test
+  template:
+    spec:
+      containers:
+        - name: no-image
+`,
+			wantErr: "container no-image in StatefulSet test-set has no image",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			installFile := newTestInstallFile()
+
+			err := installFile.AddImagesInManifest([]byte(tt.manifest))
+			if tt.wantErr != "" {
+				if assert.Error(t, err) {
+					assert.Contains(t, err.Error(), tt.wantErr)
+				}
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, len(tt.wantImages), len(installFile.dockerImages))
+				for _, image := range tt.wantImages {
+					assert.Contains(t, installFile.dockerImages, image)
+				}
+			}
+		})
+	}
+}
+
+func TestProcessManifests(t *testing.T) {
+	output := new(bytes.Buffer)
+	ui.SetOutput(output)
+
+	testChart := &chart.Chart{
+		Metadata: &chart.Metadata{
+			APIVersion: "v2",
+			Name:       "test-chart",
+			Version:    "1.0.0",
+		},
+		Values: map[string]interface{}{
+			"image": "default-image:1.0",
+		},
+		Templates: []*chart.File{
+			{
+				Name: "templates/pod.yaml",
+				Data: []byte(`
+apiVersion: v1
+kind: Pod
+metadata:
+  name: {{ .Release.Name }}
+spec:
+  containers:
+    - name: main
+      image: {{ .Values.image }}
+`),
+			},
+		},
+	}
+
+	installFile := newTestInstallFile()
+	assert.NoError(t, installFile.processManifests(testChart, "test-chart", nil))
+	assert.Contains(t, installFile.dockerImages, "default-image:1.0")
+
+	installFile = newTestInstallFile()
+	assert.NoError(t, installFile.processManifests(testChart, "test-chart", map[string]interface{}{
+		"image": "override-image:2.0",
+	}))
+	assert.Contains(t, installFile.dockerImages, "override-image:2.0")
+	assert.NotContains(t, installFile.dockerImages, "default-image:1.0")
+}
+
+func TestPinImagesInManifest(t *testing.T) {
+	output := new(bytes.Buffer)
+	ui.SetOutput(output)
+
+	installFile := newTestInstallFile()
+	installFile.PackageConfig.Images["nginx:1.19"] = "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+	installFile.PackageConfig.Images["registry.example.com/app:2.0"] = "sha256:2222222222222222222222222222222222222222222222222222222222222222"
+
+	pinned, err := installFile.PinImagesInManifest([]byte(`
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: test-deployment
+  annotations:
+    image: nginx:1.19
+spec:
+  template:
+    spec:
+      initContainers:
+        - name: init
+          image: registry.example.com/app:2.0
+      containers:
+        - name: main
+          image: nginx:1.19 # web server
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: test-config
+`))
+	assert.NoError(t, err)
+	assert.Contains(t, string(pinned), "image: nginx@sha256:1111111111111111111111111111111111111111111111111111111111111111 # web server")
+	assert.Contains(t, string(pinned), "image: registry.example.com/app@sha256:2222222222222222222222222222222222222222222222222222222222222222")
+	assert.Contains(t, string(pinned), "    image: nginx:1.19\n") //not a container
+	assert.Contains(t, string(pinned), "name: test-config")
+
+	assert.Contains(t, installFile.dockerImages, "nginx:1.19")
+	assert.Contains(t, installFile.dockerImages, "registry.example.com/app:2.0")
+
+	//pinned references found later are not added again
+	assert.NoError(t, installFile.AddImage("nginx@sha256:1111111111111111111111111111111111111111111111111111111111111111"))
+	assert.Equal(t, 2, len(installFile.dockerImages))
+}
+
+func TestImageLock(t *testing.T) {
+	lockPath := environment.TempPath("image-lock-*.lock")
+	assert.NoError(t, os.MkdirAll(filepath.Dir(lockPath), 0755))
+
+	imageLock, err := LoadImageLock(lockPath)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(imageLock.Images))
+
+	imageLock = NewImageLock(map[string]string{
+		"nginx:1.19":                   "sha256:1111111111111111111111111111111111111111111111111111111111111111",
+		"build.local/test/service:1.0": "sha256:3333333333333333333333333333333333333333333333333333333333333333",
+	})
+	assert.NoError(t, imageLock.Save(lockPath))
+
+	lockContent, err := ioutil.ReadFile(lockPath)
+	assert.NoError(t, err)
+	assert.Contains(t, string(lockContent), "# Generated by ruckstack build")
+	assert.NotContains(t, string(lockContent), "build.local") //rebuilt from source
+
+	imageLock, err = LoadImageLock(lockPath)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"nginx:1.19": "sha256:1111111111111111111111111111111111111111111111111111111111111111",
+	}, imageLock.Images)
+}
+
+func TestImagePolicy(t *testing.T) {
+	output := new(bytes.Buffer)
+	ui.SetOutput(output)
+
+	policy := &ImagePolicy{
+		DisallowLatest:    true,
+		AllowedRegistries: []string{"docker.io", "ghcr.io/my-org"},
+	}
+
+	installFile := newTestInstallFile()
+	installFile.ImagePolicy = policy
+
+	installFile.StartService("frontend")
+	assert.NoError(t, installFile.AddImage("nginx:1.19"))
+	assert.NoError(t, installFile.AddImage("nginx"))
+	assert.NoError(t, installFile.AddImage("build.local/test/frontend:1.0"))
+
+	installFile.StartService("backend")
+	assert.NoError(t, installFile.AddImage("nginx:latest"))
+	assert.NoError(t, installFile.AddImage("nginx:1.19"))
+	assert.NoError(t, installFile.AddImage("ghcr.io/my-org/backend:2.0"))
+	assert.NoError(t, installFile.AddImage("ghcr.io/other-org/backend:2.0"))
+	assert.NoError(t, installFile.AddImage("quay.io/backend@sha256:1111111111111111111111111111111111111111111111111111111111111111"))
+
+	assert.Equal(t, []string{"frontend", "backend"}, installFile.dockerImages["nginx:1.19"])
+
+	violations := policy.checkReferences(installFile.dockerImages)
+	assert.Equal(t, `4 image policy violations:
+    ghcr.io/other-org/backend:2.0 (from backend): registry ghcr.io is not in allowedRegistries
+    nginx (from frontend): no tag specified
+    nginx:latest (from backend): uses the 'latest' tag
+    quay.io/backend@sha256:1111111111111111111111111111111111111111111111111111111111111111 (from backend): registry quay.io is not in allowedRegistries`, formatImagePolicyViolations(violations))
+
+	err := installFile.checkImageReferences()
+	if assert.Error(t, err) {
+		assert.Equal(t, formatImagePolicyViolations(violations)+"\nFix the images or build with --ignore-image-policy", err.Error())
+	}
+
+	installFile.IgnoreImagePolicy = true
+	assert.NoError(t, installFile.checkImageReferences())
+	assert.Contains(t, output.String(), "WARNING: ignoring 4 image policy violations")
+}
+
+func TestImagePolicy_CheckedBeforePull(t *testing.T) {
+	output := new(bytes.Buffer)
+	ui.SetOutput(output)
+
+	backend := &fakeImageBackend{
+		digests: map[string]string{"nginx:latest": "sha256:" + strings.Repeat("1", 64)},
+	}
+	installFile := newTestInstallFile()
+	installFile.ImageBackend = backend
+	installFile.ImageLock = &ImageLock{Images: map[string]string{}}
+	installFile.ImagePolicy = &ImagePolicy{
+		DisallowLatest:    true,
+		AllowedRegistries: []string{"docker.io"},
+	}
+	installFile.StartService("frontend")
+
+	pinnedImage, err := installFile.PinImage("nginx:latest")
+	assert.NoError(t, err)
+	assert.Equal(t, "nginx:latest", pinnedImage, "disallowed images are not pinned")
+	assert.NoError(t, installFile.AddImage("nginx:1.19"))
+
+	installFile.StartService("backend")
+	assert.NoError(t, installFile.AddImage("quay.io/app:1.0"))
+	assert.NoError(t, installFile.AddImage("nginx:latest"))
+	assert.Empty(t, backend.pulls)
+
+	assert.EqualError(t, installFile.saveDockerImages(), "2 image policy violations:\n    nginx:latest (from frontend, backend): uses the 'latest' tag\n    quay.io/app:1.0 (from backend): registry quay.io is not in allowedRegistries\nFix the images or build with --ignore-image-policy")
+	assert.Empty(t, backend.pulls, "violations are reported before any image is pulled")
+
+	installFile.IgnoreImagePolicy = true
+	_, err = installFile.PinImage("nginx:latest")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"nginx:latest|"}, backend.pulls)
+	assert.NoError(t, installFile.checkImageReferences())
+	assert.Contains(t, output.String(), "WARNING: ignoring 2 image policy violations")
+}
+
+func TestBuildSbom(t *testing.T) {
+	installFile := newTestInstallFile()
+	installFile.zipWriter = zip.NewWriter(new(bytes.Buffer))
+	installFile.PackageConfig.Id = "test-project"
+	installFile.PackageConfig.Version = "1.2.3"
+	installFile.PackageConfig.BuildTime = 1600000000
+	installFile.PackageConfig.Files["lib/k3s"] = "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	installFile.PackageConfig.Images["nginx:1.19"] = "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+	installFile.PackageConfig.Images["ghcr.io/my-org/backend:2.0"] = "sha256:2222222222222222222222222222222222222222222222222222222222222222"
+	installFile.dockerImages["nginx:1.19"] = []string{"frontend", "backend"}
+
+	installFile.addChartComponent("wordpress", "wordpress", "10.1.0", "https://charts.bitnami.com/bitnami")
+	installFile.addChartComponent("frontend", "frontend", "1.0.0", "")
+
+	assert.NoError(t, installFile.buildSbom())
+
+	bom := installFile.Sbom
+	assert.Equal(t, "CycloneDX", bom.BomFormat)
+	assert.Equal(t, "2020-09-13T12:26:40Z", bom.Metadata.Timestamp)
+	assert.Equal(t, "test-project", bom.Metadata.Component.Name)
+	assert.Equal(t, "1.2.3", bom.Metadata.Component.Version)
+
+	images := bom.ComponentsOfType(sbom.TypeContainer)
+	if assert.Len(t, images, 2) {
+		assert.Equal(t, "ghcr.io/my-org/backend", images[0].Name)
+		assert.Equal(t, "pkg:oci/backend@sha256%3A2222222222222222222222222222222222222222222222222222222222222222?repository_url=ghcr.io%2Fmy-org%2Fbackend&tag=2.0", images[0].Purl)
+		assert.Equal(t, "nginx", images[1].Name)
+		assert.Equal(t, "sha256:1111111111111111111111111111111111111111111111111111111111111111", images[1].Version)
+		assert.Equal(t, "1111111111111111111111111111111111111111111111111111111111111111", images[1].Hash(sbom.HashSha256))
+		assert.Equal(t, "frontend,backend", images[1].Property("ruckstack:services"))
+	}
+
+	charts := bom.ComponentsOfType(sbom.TypeApplication)
+	if assert.Len(t, charts, 2) {
+		assert.Equal(t, "frontend", charts[0].Name)
+		assert.Empty(t, charts[0].ExternalReferences)
+		assert.Equal(t, "wordpress", charts[1].Name)
+		assert.Equal(t, "10.1.0", charts[1].Version)
+		assert.Equal(t, "pkg:helm/wordpress@10.1.0?repository_url=https%3A%2F%2Fcharts.bitnami.com%2Fbitnami", charts[1].Purl)
+		assert.Equal(t, "https://charts.bitnami.com/bitnami", charts[1].ExternalReferences[0].Url)
+	}
+
+	files := bom.ComponentsOfType(sbom.TypeFile)
+	if assert.Len(t, files, 1) {
+		assert.Equal(t, "lib/k3s", files[0].Name)
+		assert.Equal(t, "da39a3ee5e6b4b0d3255bfef95601890afd80709", files[0].Hash(sbom.HashSha1))
+	}
+
+	assert.Contains(t, installFile.PackageConfig.Files, ".sbom.json")
+}
+
+func TestAddFileData_DeltaBase(t *testing.T) {
+	zipContent := new(bytes.Buffer)
+	installFile := newTestInstallFile()
+	installFile.zipWriter = zip.NewWriter(zipContent)
+	unchanged := []byte("unchanged")
+	unchangedHash := sha1.Sum(unchanged)
+	systemConfigHash := sha1.Sum([]byte("managerFilename: test\n"))
+	installFile.DeltaBase = &config.PackageConfig{
+		Version: "1.0.0",
+		Files: map[string]string{
+			"lib/unchanged": hex.EncodeToString(unchangedHash[:]),
+			"data/agent/images/images.untar/abc/layer.tar.gz": "da39a3ee5e6b4b0d3255bfef95601890afd80709",
+			"config/system.config":                            hex.EncodeToString(systemConfigHash[:]),
+			"lib/streamed-unchanged":                          hex.EncodeToString(unchangedHash[:]),
+			"lib/streamed-changed":                            hex.EncodeToString(unchangedHash[:]),
+		},
+	}
+
+	modTime := time.Unix(1600000000, 0)
+	assert.NoError(t, installFile.AddFileData(bytes.NewReader(unchanged), int64(len(unchanged)), "lib/unchanged", modTime))
+	assert.NoError(t, installFile.AddFileData(bytes.NewReader([]byte("changed layer")), 13, "data/agent/images/images.untar/abc/layer.tar.gz", modTime))
+	assert.NoError(t, installFile.AddFileData(bytes.NewReader([]byte("new")), 3, "lib/new", modTime))
+	assert.NoError(t, installFile.AddFileData(bytes.NewReader([]byte("managerFilename: test\n")), 22, "config/system.config", modTime))
+
+	//tar entries cannot seek, so are buffered to disk to hash before deciding whether to include them
+	assert.NoError(t, installFile.AddFileData(struct{ io.Reader }{bytes.NewReader(unchanged)}, int64(len(unchanged)), "lib/streamed-unchanged", modTime))
+	assert.NoError(t, installFile.AddFileData(struct{ io.Reader }{bytes.NewReader([]byte("streamed"))}, 8, "lib/streamed-changed", modTime))
+	assert.NoError(t, installFile.zipWriter.Close())
+
+	assert.Equal(t, 2, installFile.omittedFiles)
+	assert.Equal(t, uint64(2*len(unchanged)), installFile.omittedBytes)
+	assert.Len(t, installFile.PackageConfig.Files, 6, "full file list is still recorded")
+	assert.Equal(t, hex.EncodeToString(unchangedHash[:]), installFile.PackageConfig.Files["lib/unchanged"])
+
+	zipReader, err := zip.NewReader(bytes.NewReader(zipContent.Bytes()), int64(zipContent.Len()))
+	assert.NoError(t, err)
+	var zippedFiles []string
+	for _, zipFile := range zipReader.File {
+		zippedFiles = append(zippedFiles, zipFile.Name)
+	}
+	assert.ElementsMatch(t, []string{"data/agent/images/images.untar/abc/layer.tar.gz", "lib/new", "config/system.config", "lib/streamed-changed"}, zippedFiles)
+}
+
+/**
+Generates size bytes without holding them in memory
+*/
+type generatedReader struct {
+	remaining int64
+	next      byte
+}
+
+func (reader *generatedReader) Read(buffer []byte) (int, error) {
+	if reader.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(buffer)) > reader.remaining {
+		buffer = buffer[:reader.remaining]
+	}
+	for i := range buffer {
+		buffer[i] = reader.next
+		reader.next = reader.next*31 + 7
+	}
+	reader.remaining -= int64(len(buffer))
+
+	return len(buffer), nil
+}
+
+func TestAddFileData_ConstantMemory(t *testing.T) {
+	allocatedAdding := func(size int64) uint64 {
+		installFile := newTestInstallFile()
+		installFile.zipWriter = zip.NewWriter(ioutil.Discard)
+
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		assert.NoError(t, installFile.AddFileData(&generatedReader{remaining: size}, size, "data/file", time.Now()))
+		runtime.ReadMemStats(&after)
+
+		return after.TotalAlloc - before.TotalAlloc
+	}
+
+	small := allocatedAdding(1 << 20)
+	large := allocatedAdding(64 << 20)
+
+	assert.Less(t, large, small+(4<<20), "adding 64MB allocated %d bytes but adding 1MB allocated %d bytes", large, small)
+}
+
+func TestAddFileData_WrongSize(t *testing.T) {
+	installFile := newTestInstallFile()
+	installFile.zipWriter = zip.NewWriter(ioutil.Discard)
+
+	err := installFile.AddFileData(bytes.NewReader([]byte("short")), 10, "data/file", time.Now())
+	assert.EqualError(t, err, "expected data/file to be 10 bytes but was 5")
+}
+
+/**
+B/op should stay the same as the file size grows
+*/
+func BenchmarkAddFileData(b *testing.B) {
+	for _, size := range []int64{1 << 20, 16 << 20, 256 << 20} {
+		b.Run(units.BytesSize(float64(size)), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(size)
+
+			for i := 0; i < b.N; i++ {
+				installFile := newTestInstallFile()
+				installFile.zipWriter = zip.NewWriter(ioutil.Discard)
+				if err := installFile.AddFileData(&generatedReader{remaining: size}, size, "data/file", time.Now()); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestAddSignature(t *testing.T) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	privateKeyDer, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	assert.NoError(t, err)
+	signer, err := signature.ParseSigner(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateKeyDer}))
+	assert.NoError(t, err)
+
+	zipContent := new(bytes.Buffer)
+	installFile := newTestInstallFile()
+	installFile.zipWriter = zip.NewWriter(zipContent)
+	installFile.Signer = signer
+
+	modTime := time.Unix(1600000000, 0)
+	assert.NoError(t, installFile.AddFileData(bytes.NewReader([]byte("manager")), 7, "bin/manager", modTime))
+	assert.NoError(t, installFile.AddFileData(bytes.NewReader([]byte("id: test")), 8, ".package.config", modTime))
+	assert.NoError(t, installFile.addSignature())
+	assert.NoError(t, installFile.zipWriter.Close())
+
+	zipReader, err := zip.NewReader(bytes.NewReader(zipContent.Bytes()), int64(zipContent.Len()))
+	assert.NoError(t, err)
+	installerSignature, digests, err := signature.ReadZip(zipReader)
+	assert.NoError(t, err)
+	if assert.NotNil(t, installerSignature) {
+		assert.Equal(t, signature.AlgorithmEd25519, installerSignature.Algorithm)
+		assert.Len(t, digests, 2)
+		assert.NoError(t, installerSignature.Verify(digests, privateKey.Public()))
+	}
+}
+
+func TestAddSignature_Executable(t *testing.T) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	privateKeyDer, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	assert.NoError(t, err)
+	signer, err := signature.ParseSigner(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateKeyDer}))
+	assert.NoError(t, err)
+
+	executable := []byte("#!/bin/sh\necho installer\n")
+	installerContent := bytes.NewBuffer(append([]byte{}, executable...))
+	installFile := newTestInstallFile()
+	installFile.zipWriter = zip.NewWriter(installerContent)
+	installFile.zipWriter.SetOffset(int64(len(executable)))
+	installFile.recordExecutable(executable)
+	installFile.Signer = signer
+
+	assert.NoError(t, installFile.AddFileData(bytes.NewReader([]byte("manager")), 7, "bin/manager", time.Unix(1600000000, 0)))
+	assert.NoError(t, installFile.addSignature())
+	assert.NoError(t, installFile.zipWriter.Close())
+
+	installer := installerContent.Bytes()
+	installerSignature, digests, err := signature.ReadInstaller(bytes.NewReader(installer), int64(len(installer)))
+	assert.NoError(t, err)
+	if assert.NotNil(t, installerSignature) {
+		assert.Equal(t, int64(len(executable)), installerSignature.ExecutableSize)
+		assert.Len(t, digests, 2)
+		assert.NoError(t, installerSignature.Verify(digests, privateKey.Public()))
+	}
+
+	copy(installer, "#!/bin/sh\necho malicious\n")
+	installerSignature, digests, err = signature.ReadInstaller(bytes.NewReader(installer), int64(len(installer)))
+	assert.NoError(t, err)
+	assert.Error(t, installerSignature.Verify(digests, privateKey.Public()), "the executable is signed")
+}
+
+func newTestInstallFile() *InstallFile {
+	return &InstallFile{
+		PackageConfig: &config.PackageConfig{
+			Files:  map[string]string{},
+			Images: map[string]string{},
+		},
+		dockerImages: map[string][]string{},
+		addedFiles:   map[string]bool{},
+	}
+}
+
+func TestCreatingInstallFile_Reproducible(t *testing.T) {
+	output := new(bytes.Buffer)
+	ui.SetOutput(output)
+
+	testTempRoot := environment.TempPath("install_file_reproducible_test-*")
+	defer os.RemoveAll(testTempRoot)
+
+	build := func(name string, fileTime time.Time) []byte {
+		sourceDir := filepath.Join(testTempRoot, name, "source")
+		assert.NoError(t, os.MkdirAll(filepath.Join(sourceDir, "chart", "templates"), 0755))
+		for path, content := range map[string]string{
+			"bin/tool":                        "tool",
+			"data/config.yaml":                "key: value",
+			"chart/Chart.yaml":                "apiVersion: v2\nname: test-chart\nversion: 1.0.0\n",
+			"chart/templates/configmap.yaml":  "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: test\n",
+			"data/nested/deeper/content.json": "{}",
+		} {
+			filePath := filepath.Join(sourceDir, path)
+			assert.NoError(t, os.MkdirAll(filepath.Dir(filePath), 0755))
+			assert.NoError(t, ioutil.WriteFile(filePath, []byte(content), 0644))
+			assert.NoError(t, os.Chtimes(filePath, fileTime, fileTime))
+		}
+
+		installerPath := filepath.Join(testTempRoot, name, "test-project.installer")
+		installFile, err := StartCreation(installerPath, flate.BestSpeed, "amd64")
+		assert.NoError(t, err)
+		installFile.Reproducible = true
+		installFile.PackageConfig.BuildTime = 1600000000
+		installFile.PackageConfig.Id = "test-project"
+		installFile.PackageConfig.Version = "1.2.3"
+
+		assert.NoError(t, installFile.AddDirectory(os.DirFS(filepath.Join(sourceDir, "bin")), "bin"))
+		assert.NoError(t, installFile.AddDirectory(os.DirFS(filepath.Join(sourceDir, "data")), "data/files"))
+		assert.NoError(t, installFile.AddFileData(bytes.NewReader([]byte("generated")), 9, "data/generated.txt", time.Now()))
+
+		chartPath := filepath.Join(testTempRoot, name, "chart.tgz")
+		assert.NoError(t, global_util.TarDirectoryAt(filepath.Join(sourceDir, "chart"), chartPath, true, installFile.ReproducibleModTime()))
+		assert.NoError(t, installFile.AddHelmChart(chartPath, "test-chart", "", nil))
+
+		assert.NoError(t, installFile.CompleteCreation())
+
+		content, err := ioutil.ReadFile(installerPath)
+		assert.NoError(t, err)
+		return content
+	}
+
+	first := build("first", time.Unix(1500000000, 0))
+	second := build("second", time.Now())
+
+	assert.True(t, bytes.Equal(first, second), "reproducible install files with the same contents should be identical")
+}
+
+/**
+Image backend that records pulls instead of downloading anything
+*/
+type fakeImageBackend struct {
+	digests map[string]string
+	pulls   []string
+	lock    sync.Mutex
+
+	//if release is set, pulls send their image to pulling and wait for release to be closed
+	pulling chan string
+	release chan struct{}
+}
+
+func (backend *fakeImageBackend) Name() string {
+	return "fake"
+}
+
+func (backend *fakeImageBackend) Pull(imageRef string, digest string) error {
+	backend.lock.Lock()
+	backend.pulls = append(backend.pulls, imageRef+"|"+digest)
+	backend.lock.Unlock()
+
+	if backend.release != nil {
+		backend.pulling <- imageRef
+		<-backend.release
+	}
+	return nil
+}
+
+func (backend *fakeImageBackend) Available(imageRef string, digest string) bool {
+	return true
+}
+
+func (backend *fakeImageBackend) Digest(imageRef string) (string, error) {
+	return backend.digests[imageRef], nil
+}
+
+func (backend *fakeImageBackend) Size(imageRef string) (int64, error) {
+	return 0, nil
+}
+
+func (backend *fakeImageBackend) Save(outputPath string, imageRefs ...string) error {
+	return nil
+}
+
+func TestResolveImage_Locked(t *testing.T) {
+	lockedDigest := "sha256:" + strings.Repeat("1", 64)
+	backend := &fakeImageBackend{
+		//the image is also known by another digest, which must not replace the locked one
+		digests: map[string]string{"nginx:1.19": "sha256:" + strings.Repeat("2", 64)},
+	}
+	installFile := &InstallFile{
+		PackageConfig: &config.PackageConfig{Images: map[string]string{}},
+		ImageLock:     &ImageLock{Images: map[string]string{"nginx:1.19": lockedDigest}},
+		ImageBackend:  backend,
+	}
+
+	digest, err := installFile.resolveImage("nginx:1.19")
+	assert.NoError(t, err)
+	assert.Equal(t, lockedDigest, digest)
+	assert.Equal(t, lockedDigest, installFile.PackageConfig.Images["nginx:1.19"])
+	assert.Equal(t, []string{"nginx:1.19|" + lockedDigest}, backend.pulls)
+}
+
+func TestResolveImage_Concurrent(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("1", 64)
+	backend := &fakeImageBackend{
+		digests: map[string]string{"nginx:1.19": digest},
+		pulling: make(chan string, 10),
+		release: make(chan struct{}),
+	}
+	installFile := newTestInstallFile()
+	installFile.ImageBackend = backend
+
+	var wait sync.WaitGroup
+	resolved := make([]string, 5)
+	for i := range resolved {
+		wait.Add(1)
+		go func(i int) {
+			defer wait.Done()
+			resolved[i], _ = installFile.resolveImage("nginx:1.19")
+		}(i)
+	}
+
+	assert.Equal(t, "nginx:1.19", <-backend.pulling)
+	//the images lock is not held while pulling
+	assert.False(t, installFile.isPinnedImage("nginx@"+digest))
+	assert.NoError(t, installFile.AddImage("redis:6"))
+
+	close(backend.release)
+	wait.Wait()
+
+	assert.Equal(t, []string{"nginx:1.19|"}, backend.pulls, "pulled once")
+	assert.Equal(t, []string{digest, digest, digest, digest, digest}, resolved)
+	assert.True(t, installFile.isPinnedImage("nginx@"+digest))
+}
@@ -0,0 +1,161 @@
+package install_file
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/docker/distribution/reference"
+	"github.com/ruckstack/ruckstack/builder/internal/sbom"
+	"github.com/ruckstack/ruckstack/common/global_util"
+	uuid "github.com/satori/go.uuid"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+/**
+Records a third party download, such as k3s, in the SBOM. The checksum is of the file as downloaded, so it can be compared to the published checksum.
+SavedLocation is where the file was downloaded to.
+*/
+func (installFile *InstallFile) AddComponent(name string, version string, downloadUrl string, savedLocation string) error {
+	downloadedFile, err := os.Open(savedLocation)
+	if err != nil {
+		return err
+	}
+	defer downloadedFile.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, downloadedFile); err != nil {
+		return fmt.Errorf("cannot compute checksum of %s: %s", downloadUrl, err)
+	}
+
+	installFile.components = append(installFile.components, sbom.Component{
+		Type:    sbom.TypeApplication,
+		BomRef:  "binary:" + name,
+		Name:    name,
+		Version: version,
+		Hashes: []sbom.Hash{
+			{Alg: sbom.HashSha256, Content: hex.EncodeToString(hash.Sum(nil))},
+		},
+		ExternalReferences: []sbom.ExternalReference{
+			{Type: "distribution", Url: downloadUrl},
+		},
+	})
+
+	return nil
+}
+
+func (installFile *InstallFile) addChartComponent(chartId string, chartName string, chartVersion string, repository string) {
+	component := sbom.Component{
+		Type:    sbom.TypeApplication,
+		BomRef:  "chart:" + chartId,
+		Name:    chartName,
+		Version: chartVersion,
+		Purl:    fmt.Sprintf("pkg:helm/%s@%s", chartName, chartVersion),
+		Properties: []sbom.Property{
+			{Name: "ruckstack:type", Value: "helm-chart"},
+			{Name: "ruckstack:service", Value: chartId},
+		},
+	}
+	if repository != "" {
+		component.Purl += "?repository_url=" + url.QueryEscape(repository)
+		component.ExternalReferences = []sbom.ExternalReference{
+			{Type: "distribution", Url: repository},
+		}
+	}
+
+	installFile.components = append(installFile.components, component)
+}
+
+/**
+Creates the SBOM from everything added to the install file
+*/
+func (installFile *InstallFile) buildSbom() error {
+	packageConfig := installFile.PackageConfig
+
+	bom := sbom.New()
+	bom.SerialNumber = "urn:uuid:" + uuid.NewV5(uuid.NamespaceURL, fmt.Sprintf("ruckstack:%s:%s:%d", packageConfig.Id, packageConfig.Version, packageConfig.BuildTime)).String()
+	bom.Metadata = sbom.Metadata{
+		Timestamp: time.Unix(packageConfig.BuildTime, 0).UTC().Format(time.RFC3339),
+		Tools: []sbom.Tool{
+			{Vendor: "Ruckstack", Name: "ruckstack", Version: global_util.RuckstackVersion},
+		},
+		Component: &sbom.Component{
+			Type:    sbom.TypeApplication,
+			BomRef:  "package:" + packageConfig.Id,
+			Name:    packageConfig.Id,
+			Version: packageConfig.Version,
+		},
+	}
+
+	bom.Components = append(bom.Components, installFile.components...)
+
+	for tag, digest := range packageConfig.Images {
+		named, err := reference.ParseNormalizedNamed(tag)
+		if err != nil {
+			return err
+		}
+
+		component := sbom.Component{
+			Type:    sbom.TypeContainer,
+			BomRef:  "image:" + tag,
+			Name:    reference.FamiliarName(named),
+			Version: digest,
+			Purl:    imagePurl(named, digest),
+			Properties: []sbom.Property{
+				{Name: "ruckstack:image", Value: tag},
+				{Name: "ruckstack:services", Value: strings.Join(installFile.dockerImages[tag], ",")},
+			},
+		}
+		if algorithmAndHash := strings.SplitN(digest, ":", 2); len(algorithmAndHash) == 2 && algorithmAndHash[0] == "sha256" {
+			component.Hashes = []sbom.Hash{{Alg: sbom.HashSha256, Content: algorithmAndHash[1]}}
+		}
+
+		bom.Components = append(bom.Components, component)
+	}
+
+	var filePaths []string
+	for filePath := range packageConfig.Files {
+		filePaths = append(filePaths, filePath)
+	}
+	sort.Strings(filePaths)
+	for _, filePath := range filePaths {
+		bom.Components = append(bom.Components, sbom.Component{
+			Type:   sbom.TypeFile,
+			BomRef: "file:" + filePath,
+			Name:   filePath,
+			Hashes: []sbom.Hash{
+				{Alg: sbom.HashSha1, Content: packageConfig.Files[filePath]},
+			},
+		})
+	}
+
+	bom.Sort()
+	installFile.Sbom = bom
+
+	sbomContent := new(bytes.Buffer)
+	if err := bom.Write(sbomContent); err != nil {
+		return err
+	}
+
+	return installFile.AddFileData(sbomContent, int64(sbomContent.Len()), sbom.InstallerPath, time.Unix(packageConfig.BuildTime, 0))
+}
+
+/**
+Returns the package URL for the image, following the purl spec for OCI images
+*/
+func imagePurl(named reference.Named, digest string) string {
+	path := reference.Path(named)
+	name := path[strings.LastIndex(path, "/")+1:]
+
+	purl := fmt.Sprintf("pkg:oci/%s@%s?repository_url=%s", name, url.QueryEscape(digest), url.QueryEscape(reference.Domain(named)+"/"+path))
+	if tagged, isTagged := reference.TagNameOnly(named).(reference.Tagged); isTagged {
+		purl += "&tag=" + url.QueryEscape(tagged.Tag())
+	}
+
+	return purl
+}
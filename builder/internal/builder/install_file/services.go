@@ -0,0 +1,202 @@
+package install_file
+
+import (
+	"fmt"
+	"github.com/ruckstack/ruckstack/common/ui"
+	"io"
+	"os"
+	"time"
+)
+
+/**
+A service to build into the install file
+*/
+type ServiceBuild struct {
+	Id    string
+	Build func(*InstallFile) error
+}
+
+/**
+A file added to a service install file, waiting in a temp file until the service is committed
+*/
+type stagedFile struct {
+	installerPath string
+	tempPath      string
+	size          int64
+	modTime       time.Time
+}
+
+/**
+Builds the services with at most workers running at once. Workers less than 1 uses the number of CPUs.
+
+Each service builds into its own install file. Once every service has built, they are written to this install file in the given order,
+so the install file does not depend on which service finished first. Output from services built at the same time is grouped by service.
+*/
+func (installFile *InstallFile) BuildServices(services []ServiceBuild, workers int) error {
+	pool := newWorkerPool(workers)
+	grouped := len(services) > 1 && cap(pool.slots) > 1
+
+	serviceFiles := make([]*InstallFile, len(services))
+	for i, service := range services {
+		var output *ui.OutputGroup
+		if grouped {
+			output = ui.NewOutputGroup(service.Id)
+		}
+
+		serviceFile := installFile.newServiceFile(service.Id, output)
+		serviceFiles[i] = serviceFile
+
+		build := service.Build
+		pool.Submit(func() error {
+			if output != nil {
+				defer output.Flush()
+			}
+			return build(serviceFile)
+		})
+	}
+
+	if err := pool.Wait(); err != nil {
+		for _, serviceFile := range serviceFiles {
+			serviceFile.removeStagedFiles()
+		}
+		return err
+	}
+
+	for _, serviceFile := range serviceFiles {
+		if err := installFile.commitService(serviceFile); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/**
+Returns an install file for building the given service, sharing this install file's settings and images
+*/
+func (installFile *InstallFile) newServiceFile(serviceId string, output *ui.OutputGroup) *InstallFile {
+	return &InstallFile{
+		PackageConfig:      installFile.PackageConfig,
+		SystemConfig:       installFile.SystemConfig,
+		CompressionLevel:   installFile.CompressionLevel,
+		Architecture:       installFile.Architecture,
+		Compression:        installFile.Compression,
+		CompressionWorkers: installFile.CompressionWorkers,
+		ImageLock:          installFile.ImageLock,
+		ImagePolicy:        installFile.ImagePolicy,
+		IgnoreImagePolicy:  installFile.IgnoreImagePolicy,
+		ImageBackend:       installFile.ImageBackend,
+		DeltaBase:          installFile.DeltaBase,
+		Reproducible:       installFile.Reproducible,
+
+		parent:         installFile,
+		output:         output,
+		currentService: serviceId,
+		dockerImages:   map[string][]string{},
+		addedFiles:     map[string]bool{},
+	}
+}
+
+/**
+Copies the data to a temp file to be added when the service is committed
+*/
+func (installFile *InstallFile) stageFileData(data io.Reader, size int64, installerPath string, modTime time.Time) error {
+	tempPath, err := spoolToTemp(data, "staged-*")
+	if err != nil {
+		return fmt.Errorf("could not stage %s: %s", installerPath, err)
+	}
+
+	installFile.stagedFiles = append(installFile.stagedFiles, stagedFile{
+		installerPath: installerPath,
+		tempPath:      tempPath,
+		size:          size,
+		modTime:       modTime,
+	})
+
+	return nil
+}
+
+/**
+Adds everything the service install file collected to this install file
+*/
+func (installFile *InstallFile) commitService(serviceFile *InstallFile) error {
+	defer serviceFile.removeStagedFiles()
+
+	for _, staged := range serviceFile.stagedFiles {
+		if installFile.addedFiles[staged.installerPath] {
+			installFile.VPrintf("File %s already added to installer", staged.installerPath)
+			continue
+		}
+		installFile.addedFiles[staged.installerPath] = true
+
+		stagedData, err := os.Open(staged.tempPath)
+		if err != nil {
+			return fmt.Errorf("cannot open staged %s: %s", staged.installerPath, err)
+		}
+		err = installFile.AddFileData(stagedData, staged.size, staged.installerPath, staged.modTime)
+		_ = stagedData.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	for tag, sources := range serviceFile.dockerImages {
+		for _, source := range sources {
+			if !contains(installFile.dockerImages[tag], source) {
+				installFile.dockerImages[tag] = append(installFile.dockerImages[tag], source)
+			}
+		}
+	}
+
+	installFile.components = append(installFile.components, serviceFile.components...)
+
+	return nil
+}
+
+func (installFile *InstallFile) removeStagedFiles() {
+	for _, staged := range installFile.stagedFiles {
+		_ = os.Remove(staged.tempPath)
+	}
+	installFile.stagedFiles = nil
+}
+
+/**
+Prints the message, grouped with the rest of the service's output if it is built alongside others
+*/
+func (installFile *InstallFile) Printf(format string, a ...interface{}) {
+	if installFile.output != nil {
+		installFile.output.Printf(format, a...)
+	} else {
+		ui.Printf(format, a...)
+	}
+}
+
+/**
+Prints the message only if verbose is enabled
+*/
+func (installFile *InstallFile) VPrintf(format string, a ...interface{}) {
+	if installFile.output != nil {
+		installFile.output.VPrintf(format, a...)
+	} else {
+		ui.VPrintf(format, a...)
+	}
+}
+
+/**
+Returns where to write command output, such as from docker builds, so it is grouped with the service's other output
+*/
+func (installFile *InstallFile) Output() io.Writer {
+	if installFile.output != nil {
+		return installFile.output
+	}
+	return ui.GetOutput()
+}
+
+func contains(values []string, value string) bool {
+	for _, existing := range values {
+		if existing == value {
+			return true
+		}
+	}
+	return false
+}
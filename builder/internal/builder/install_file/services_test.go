@@ -0,0 +1,104 @@
+package install_file
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"github.com/ruckstack/ruckstack/common/ui"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildServices(t *testing.T) {
+	output := new(bytes.Buffer)
+	ui.SetOutput(output)
+
+	modTime := time.Unix(1600000000, 0)
+	services := func() []ServiceBuild {
+		var services []ServiceBuild
+		for i, id := range []string{"first", "second", "third"} {
+			id := id
+			//later services finish first
+			delay := time.Duration(3-i) * 20 * time.Millisecond
+			services = append(services, ServiceBuild{
+				Id: id,
+				Build: func(installFile *InstallFile) error {
+					installFile.Printf("Building %s", id)
+					time.Sleep(delay)
+					content := []byte("content of " + id)
+					if err := installFile.AddFileData(bytes.NewReader(content), int64(len(content)), "data/"+id, modTime); err != nil {
+						return err
+					}
+					shared := []byte("shared")
+					if err := installFile.AddFileData(bytes.NewReader(shared), int64(len(shared)), "data/shared", modTime); err != nil {
+						return err
+					}
+					installFile.Printf("Built %s", id)
+					return nil
+				},
+			})
+		}
+		return services
+	}
+
+	build := func(workers int) ([]byte, *InstallFile) {
+		zipContent := new(bytes.Buffer)
+		installFile := newTestInstallFile()
+		installFile.zipWriter = zip.NewWriter(zipContent)
+
+		assert.NoError(t, installFile.BuildServices(services(), workers))
+		assert.NoError(t, installFile.zipWriter.Close())
+
+		return zipContent.Bytes(), installFile
+	}
+
+	sequential, _ := build(1)
+	assert.NotContains(t, output.String(), "---- first ----", "output is not grouped when building one at a time")
+
+	output.Reset()
+	parallel, installFile := build(3)
+	assert.True(t, bytes.Equal(sequential, parallel), "building in parallel should create the same install file")
+	assert.Len(t, installFile.PackageConfig.Files, 4)
+
+	zipReader, err := zip.NewReader(bytes.NewReader(parallel), int64(len(parallel)))
+	assert.NoError(t, err)
+	var zippedFiles []string
+	for _, zipFile := range zipReader.File {
+		zippedFiles = append(zippedFiles, zipFile.Name)
+	}
+	assert.Equal(t, []string{"data/first", "data/shared", "data/second", "data/third"}, zippedFiles, "services are committed in order")
+
+	for _, id := range []string{"first", "second", "third"} {
+		assert.Contains(t, output.String(), fmt.Sprintf("---- %s ----\nBuilding %s\nBuilt %s\n", id, id, id))
+	}
+	assert.Less(t, strings.Index(output.String(), "---- third ----"), strings.Index(output.String(), "---- first ----"), "output is shown as each service finishes")
+}
+
+func TestBuildServices_Error(t *testing.T) {
+	output := new(bytes.Buffer)
+	ui.SetOutput(output)
+
+	zipContent := new(bytes.Buffer)
+	installFile := newTestInstallFile()
+	installFile.zipWriter = zip.NewWriter(zipContent)
+
+	err := installFile.BuildServices([]ServiceBuild{
+		{
+			Id: "working",
+			Build: func(installFile *InstallFile) error {
+				return installFile.AddFileData(bytes.NewReader([]byte("works")), 5, "data/working", time.Now())
+			},
+		},
+		{
+			Id: "broken",
+			Build: func(installFile *InstallFile) error {
+				return fmt.Errorf("cannot build broken")
+			},
+		},
+	}, 2)
+
+	assert.EqualError(t, err, "cannot build broken")
+	assert.Empty(t, installFile.PackageConfig.Files, "nothing is added if a service fails")
+}
@@ -0,0 +1,121 @@
+package builder
+
+import (
+	"fmt"
+	"github.com/ruckstack/ruckstack/builder/internal/builder/install_file"
+	"github.com/ruckstack/ruckstack/builder/internal/environment"
+	"github.com/ruckstack/ruckstack/builder/internal/project"
+	"github.com/ruckstack/ruckstack/builder/internal/render"
+	"github.com/ruckstack/ruckstack/common/ui"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type RenderOptions struct {
+	//ServiceId limits rendering to a single service. Renders every service if empty
+	ServiceId string
+
+	//OutDir is where each service's resources are written. Defaults to render in the project directory
+	OutDir string
+
+	//Profile is the project profile to render. If empty, the project is rendered as written
+	Profile string
+}
+
+/**
+Writes the Kubernetes resources the project's services generate, without building images or an installer
+*/
+func Render(options RenderOptions) error {
+	projectConfig, err := project.Parse(filepath.Join(environment.ProjectDir, "ruckstack.yaml"))
+	if err != nil {
+		return fmt.Errorf("error parsing project: %s", err)
+	}
+	if options.Profile != "" {
+		if err := projectConfig.ApplyProfile(options.Profile); err != nil {
+			return fmt.Errorf("error applying profile: %s", err)
+		}
+	}
+
+	var services []project.Service
+	for _, serviceConfig := range projectConfig.GetServices() {
+		if options.ServiceId == "" || serviceConfig.GetId() == options.ServiceId {
+			services = append(services, serviceConfig)
+		}
+	}
+	if len(services) == 0 {
+		if options.ServiceId != "" {
+			return fmt.Errorf("project %s has no service %s", projectConfig.Id, options.ServiceId)
+		}
+		return fmt.Errorf("project %s has no services to render", projectConfig.Id)
+	}
+
+	imageLock, err := install_file.LoadImageLock(filepath.Join(environment.ProjectDir, "ruckstack.lock"))
+	if err != nil {
+		return err
+	}
+
+	if err := useHelmRepositories(projectConfig); err != nil {
+		return err
+	}
+
+	outDir := options.OutDir
+	if outDir == "" {
+		outDir = filepath.Join(environment.ProjectDir, "render")
+	}
+	if err := prepareOutDir(outDir); err != nil {
+		return err
+	}
+
+	renderer := &render.Renderer{
+		OutDir:       outDir,
+		Architecture: projectConfig.GetArchitectures()[0],
+		ImageLock:    imageLock,
+		ModTime:      time.Unix(defaultSourceDateEpoch, 0).UTC(),
+	}
+
+	for _, serviceConfig := range services {
+		//removed first so resources a service no longer generates do not show up in a diff
+		serviceOutDir := filepath.Join(outDir, serviceConfig.GetId())
+		if err := os.RemoveAll(serviceOutDir); err != nil {
+			return err
+		}
+
+		if err := serviceConfig.Render(renderer); err != nil {
+			return fmt.Errorf("cannot render %s: %s", serviceConfig.GetId(), err)
+		}
+		ui.Printf("Rendered %s to %s", serviceConfig.GetId(), serviceOutDir)
+	}
+
+	return nil
+}
+
+/**
+Marks a directory render wrote, so it only ever replaces service directories inside its own output
+*/
+const renderMarkerFile = ".ruckstack-render"
+
+/**
+Creates and marks outDir for render. An existing directory must be empty or already marked,
+since rendering replaces the directory of each service in it
+*/
+func prepareOutDir(outDir string) error {
+	markerPath := filepath.Join(outDir, renderMarkerFile)
+	if _, err := os.Stat(markerPath); err == nil {
+		return nil
+	}
+
+	entries, err := ioutil.ReadDir(outDir)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("cannot read %s: %s", outDir, err)
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("%s already contains files not written by render. Choose an empty or new --out directory", outDir)
+	}
+
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(markerPath, []byte("Written by ruckstack render. Service directories in here are replaced each time it runs\n"), 0644)
+}
@@ -0,0 +1,95 @@
+package builder
+
+import (
+	"github.com/ruckstack/ruckstack/builder/internal/environment"
+	"github.com/ruckstack/ruckstack/builder/internal/util"
+	"github.com/ruckstack/ruckstack/common/global_util"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRender(t *testing.T) {
+	testRoot := environment.TempPath("render_test-*")
+	defer os.RemoveAll(testRoot)
+
+	environment.ProjectDir = filepath.Join(testRoot, "project")
+	assert.NoError(t, os.MkdirAll(environment.ProjectDir, 0755))
+	assert.NoError(t, util.CopyDir(os.DirFS(global_util.GetSourceRoot()+"/builder/internal/bundled/init/example"), environment.ProjectDir))
+
+	outDir := filepath.Join(testRoot, "render")
+	assert.NoError(t, Render(RenderOptions{ServiceId: "backend", OutDir: outDir}))
+
+	helmChart, err := ioutil.ReadFile(filepath.Join(outDir, "backend", "backend.yaml"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(helmChart), "kind: HelmChart")
+	assert.Regexp(t, `chart: https://%\{KUBERNETES_API}%/static/charts/backend-[0-9a-f]+\.tgz`, string(helmChart))
+
+	daemonSet, err := ioutil.ReadFile(filepath.Join(outDir, "backend", "rendered", "backend", "templates", "daemonset.yaml"))
+	assert.NoError(t, err)
+	assert.Regexp(t, `image: build\.local/example/backend:0\.0\.0-sha[0-9a-f]{12}`, string(daemonSet))
+	assert.FileExists(t, filepath.Join(outDir, "backend", "rendered", "backend", "templates", "service.yaml"))
+	assert.FileExists(t, filepath.Join(outDir, "backend", "rendered", "backend", "templates", "ingress.yaml"))
+	assert.NoDirExists(t, filepath.Join(outDir, "frontend"), "only the given service is rendered")
+
+	//stale files are removed and unchanged services render the same
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(outDir, "backend", "stale.yaml"), []byte("stale"), 0644))
+	assert.NoError(t, Render(RenderOptions{ServiceId: "backend", OutDir: outDir}))
+	assert.NoFileExists(t, filepath.Join(outDir, "backend", "stale.yaml"))
+	renderedAgain, err := ioutil.ReadFile(filepath.Join(outDir, "backend", "backend.yaml"))
+	assert.NoError(t, err)
+	assert.Equal(t, string(helmChart), string(renderedAgain))
+
+	assert.EqualError(t, Render(RenderOptions{ServiceId: "missing", OutDir: outDir}), "project example has no service missing")
+}
+
+func TestRender_OutDir(t *testing.T) {
+	testRoot := environment.TempPath("render_out_dir_test-*")
+	defer os.RemoveAll(testRoot)
+
+	environment.ProjectDir = filepath.Join(testRoot, "project")
+	assert.NoError(t, os.MkdirAll(environment.ProjectDir, 0755))
+	assert.NoError(t, util.CopyDir(os.DirFS(global_util.GetSourceRoot()+"/builder/internal/bundled/init/example"), environment.ProjectDir))
+
+	//defaults to the project directory, not the working directory
+	assert.NoError(t, Render(RenderOptions{ServiceId: "backend"}))
+	assert.FileExists(t, filepath.Join(environment.ProjectDir, "render", "backend", "backend.yaml"))
+	assert.FileExists(t, filepath.Join(environment.ProjectDir, "render", renderMarkerFile))
+
+	//directories render did not write are left alone
+	userDir := filepath.Join(testRoot, "user")
+	assert.NoError(t, os.MkdirAll(filepath.Join(userDir, "backend"), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(userDir, "backend", "important.txt"), []byte("important"), 0644))
+	assert.EqualError(t, Render(RenderOptions{ServiceId: "backend", OutDir: userDir}), userDir+" already contains files not written by render. Choose an empty or new --out directory")
+	assert.FileExists(t, filepath.Join(userDir, "backend", "important.txt"))
+
+	emptyDir := filepath.Join(testRoot, "empty")
+	assert.NoError(t, os.MkdirAll(emptyDir, 0755))
+	assert.NoError(t, Render(RenderOptions{ServiceId: "backend", OutDir: emptyDir}))
+	assert.FileExists(t, filepath.Join(emptyDir, "backend", "backend.yaml"))
+}
+
+func TestRender_Manifest(t *testing.T) {
+	testRoot := environment.TempPath("render_manifest_test-*")
+	defer os.RemoveAll(testRoot)
+
+	environment.ProjectDir = filepath.Join(testRoot, "project")
+	assert.NoError(t, os.MkdirAll(environment.ProjectDir, 0755))
+	for path, content := range map[string]string{
+		"ruckstack.yaml": "id: manifest-project\nname: Manifest Project\nversion: 1.0.0\nmanagerFilename: manifest-manager\nmanifestServices:\n  - id: web\n    manifest: web.yaml\n",
+		"web.yaml":       "apiVersion: v1\nkind: Pod\nmetadata:\n  name: web\nspec:\n  containers:\n    - name: web\n      image: nginx:1.19\n    - name: sidecar\n      image: busybox:1.32\n",
+		"ruckstack.lock": "images:\n  nginx:1.19: sha256:0000000000000000000000000000000000000000000000000000000000000001\n",
+	} {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(environment.ProjectDir, path), []byte(content), 0644))
+	}
+
+	outDir := filepath.Join(testRoot, "render")
+	assert.NoError(t, Render(RenderOptions{OutDir: outDir}))
+
+	manifest, err := ioutil.ReadFile(filepath.Join(outDir, "web", "web.yaml"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(manifest), "image: nginx@sha256:0000000000000000000000000000000000000000000000000000000000000001", "locked images are pinned")
+	assert.Contains(t, string(manifest), "image: busybox:1.32", "images not in the lock are left as tags")
+}
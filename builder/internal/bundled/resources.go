@@ -2,10 +2,11 @@ package bundled
 
 import (
 	"embed"
+	"fmt"
 	"io/fs"
 )
 
-//go:embed init/* init_common/* install_dir/* installer system-control
+//go:embed init/* init_common/* install_dir/* installer* system-control*
 var embededFiles embed.FS
 
 func OpenFile(path string) (fs.File, error) {
@@ -23,3 +24,19 @@ func OpenDir(path string) (fs.FS, error) {
 func ReadDir(path string) ([]fs.DirEntry, error) {
 	return embededFiles.ReadDir(path)
 }
+
+/**
+Returns the path to the given bundled binary compiled for the architecture.
+Binaries for architectures other than amd64 have the architecture appended, such as installer-arm64
+*/
+func BinaryPath(name string, architecture string) (string, error) {
+	path := name
+	if architecture != "amd64" {
+		path = name + "-" + architecture
+	}
+
+	if _, err := fs.Stat(embededFiles, path); err != nil {
+		return "", fmt.Errorf("this build of ruckstack does not include the %s %s binary", architecture, name)
+	}
+	return path, nil
+}
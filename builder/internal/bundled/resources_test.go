@@ -25,3 +25,12 @@ func TestOpenDir(t *testing.T) {
 		assert.NoError(t, err)
 	}
 }
+
+func TestBinaryPath(t *testing.T) {
+	path, err := BinaryPath("installer", "amd64")
+	assert.NoError(t, err)
+	assert.Equal(t, "installer", path)
+
+	_, err = BinaryPath("installer", "mips")
+	assert.EqualError(t, err, "this build of ruckstack does not include the mips installer binary")
+}
@@ -0,0 +1,171 @@
+package cache
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"github.com/ruckstack/ruckstack/common/ui"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+/**
+Writes every valid entry, with its recorded hash, to a tar.gz that Import can load on another machine.
+Returns the number of entries exported.
+*/
+func (cache *Cache) Export(exportPath string) (int, error) {
+	entries, err := cache.List()
+	if err != nil {
+		return 0, err
+	}
+	cache.Verify(entries)
+
+	exportFile, err := os.Create(exportPath)
+	if err != nil {
+		return 0, fmt.Errorf("cannot create %s: %s", exportPath, err)
+	}
+	defer exportFile.Close()
+
+	gzipWriter := gzip.NewWriter(exportFile)
+	tarWriter := tar.NewWriter(gzipWriter)
+
+	exported := 0
+	for _, entry := range entries {
+		if entry.Status == StatusInvalid {
+			ui.Printf("Not exporting invalid %s", entry.Path)
+			continue
+		}
+
+		paths := []string{entry.Path}
+		for _, suffix := range []string{hashSuffix, verifiedSuffix} {
+			if _, err := os.Stat(cache.path(entry) + suffix); err == nil {
+				paths = append(paths, entry.Path+suffix)
+			}
+		}
+		for _, entryPath := range paths {
+			if err := cache.addToTar(tarWriter, entryPath); err != nil {
+				return exported, fmt.Errorf("cannot export %s: %s", entryPath, err)
+			}
+		}
+		exported++
+	}
+
+	if err := tarWriter.Close(); err != nil {
+		return exported, err
+	}
+	if err := gzipWriter.Close(); err != nil {
+		return exported, err
+	}
+	return exported, exportFile.Close()
+}
+
+func (cache *Cache) addToTar(tarWriter *tar.Writer, entryPath string) error {
+	file, err := os.Open(filepath.Join(cache.Root, filepath.FromSlash(entryPath)))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = entryPath
+
+	if err := tarWriter.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = io.Copy(tarWriter, file)
+	return err
+}
+
+/**
+Loads entries from a tar.gz created by Export. Entries that do not match their hash are discarded.
+Returns the number of entries imported.
+*/
+func (cache *Cache) Import(importPath string) (int, error) {
+	importFile, err := os.Open(importPath)
+	if err != nil {
+		return 0, fmt.Errorf("cannot open %s: %s", importPath, err)
+	}
+	defer importFile.Close()
+
+	gzipReader, err := gzip.NewReader(importFile)
+	if err != nil {
+		return 0, fmt.Errorf("cannot read %s: %s", importPath, err)
+	}
+	tarReader := tar.NewReader(gzipReader)
+
+	var imported []string
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("cannot read %s: %s", importPath, err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		entryPath := path.Clean(header.Name)
+		if path.IsAbs(entryPath) || entryPath == ".." || strings.HasPrefix(entryPath, "../") {
+			return 0, fmt.Errorf("invalid path in %s: %s", importPath, header.Name)
+		}
+
+		if err := cache.extract(tarReader, entryPath); err != nil {
+			return 0, fmt.Errorf("cannot import %s: %s", entryPath, err)
+		}
+		if !isInternal(entryPath) {
+			imported = append(imported, entryPath)
+		}
+	}
+
+	count := 0
+	for _, entryPath := range imported {
+		entry := &Entry{Path: entryPath}
+		cache.Verify([]*Entry{entry})
+		if entry.Status == StatusInvalid {
+			ui.Printf("Discarding invalid %s", entryPath)
+			remove(cache.path(entry))
+			continue
+		}
+		count++
+	}
+
+	return count, nil
+}
+
+/**
+Writes through a temp file so a failed import never leaves a partial entry
+*/
+func (cache *Cache) extract(data io.Reader, entryPath string) error {
+	targetPath := filepath.Join(cache.Root, filepath.FromSlash(entryPath))
+	if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
+		return err
+	}
+
+	tempFile, err := ioutil.TempFile(filepath.Dir(targetPath), filepath.Base(targetPath)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+
+	_, err = io.Copy(tempFile, data)
+	_ = tempFile.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tempFile.Name(), targetPath)
+}
@@ -0,0 +1,375 @@
+package cache
+
+import (
+	"fmt"
+	"github.com/docker/go-units"
+	godigest "github.com/opencontainers/go-digest"
+	"github.com/ruckstack/ruckstack/builder/internal/environment"
+	"github.com/ruckstack/ruckstack/common/global_util"
+	"github.com/ruckstack/ruckstack/common/ui"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+/**
+Each cached file has a sidecar with this suffix containing its sha1, written once the file is complete.
+Blobs are named by their digest so need no sidecar.
+*/
+const hashSuffix = ".sha1"
+
+/**
+Downloads checked against a published checksum have a sidecar with this suffix containing that checksum
+*/
+const verifiedSuffix = ".verified"
+
+/**
+Files still being written to the cache end in .tmp. Ones older than this are left over from killed builds
+*/
+const staleTempAge = time.Hour
+
+const (
+	StatusValid      = "valid"
+	StatusInvalid    = "invalid"
+	StatusUnverified = "unverified"
+)
+
+/**
+The builder cache directory, containing downloads, helm indexes, registry blobs and compressed layers
+*/
+type Cache struct {
+	Root string
+}
+
+type Entry struct {
+	//Path is relative to the cache root, using / separators
+	Path     string
+	Size     int64
+	LastUsed time.Time
+
+	//Status is only set by Verify
+	Status string
+}
+
+/**
+Returns the cache in the Ruckstack work directory
+*/
+func Default() *Cache {
+	return &Cache{Root: environment.CachePath("")}
+}
+
+/**
+Records the hash of a file that has been completely written to the cache, so it can be validated before reuse
+*/
+func Record(cachedPath string) error {
+	if _, isBlob := blobDigest(cachedPath); isBlob {
+		return nil
+	}
+
+	hash, err := global_util.HashFile(cachedPath)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(cachedPath+hashSuffix, []byte(hash), 0644); err != nil {
+		return fmt.Errorf("cannot record hash of %s: %s", cachedPath, err)
+	}
+	return nil
+}
+
+/**
+Records that the cached file matched the given published checksum
+*/
+func MarkVerified(cachedPath string, checksum string) error {
+	if err := ioutil.WriteFile(cachedPath+verifiedSuffix, []byte(checksum), 0644); err != nil {
+		return fmt.Errorf("cannot record checksum of %s: %s", cachedPath, err)
+	}
+	return nil
+}
+
+/**
+Returns true if the cached file was checked against the given published checksum.
+Lookup must be called first to check the file has not changed since.
+*/
+func IsVerified(cachedPath string, checksum string) bool {
+	recorded, err := ioutil.ReadFile(cachedPath + verifiedSuffix)
+	return err == nil && strings.TrimSpace(string(recorded)) == checksum
+}
+
+/**
+Returns true if the cached file exists and matches its recorded hash, and marks it as used.
+A file that does not match, such as one truncated by a killed build, is removed so it is created again.
+*/
+func Lookup(cachedPath string) bool {
+	if _, err := os.Stat(cachedPath); err != nil {
+		return false
+	}
+
+	if err := verify(cachedPath); err != nil {
+		ui.Printf("Discarding cached %s: %s", filepath.Base(cachedPath), err)
+		remove(cachedPath)
+		return false
+	}
+
+	now := time.Now()
+	_ = os.Chtimes(cachedPath, now, now)
+	return true
+}
+
+/**
+Checks the file against its digest name or recorded hash
+*/
+func verify(cachedPath string) error {
+	if digest, isBlob := blobDigest(cachedPath); isBlob {
+		blobFile, err := os.Open(cachedPath)
+		if err != nil {
+			return err
+		}
+		defer blobFile.Close()
+
+		actual, err := digest.Algorithm().FromReader(blobFile)
+		if err != nil {
+			return err
+		}
+		if actual != digest {
+			return fmt.Errorf("content does not match %s", digest)
+		}
+		return nil
+	}
+
+	expected, err := ioutil.ReadFile(cachedPath + hashSuffix)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("no recorded hash")
+	} else if err != nil {
+		return err
+	}
+
+	actual, err := global_util.HashFile(cachedPath)
+	if err != nil {
+		return err
+	}
+	if actual != strings.TrimSpace(string(expected)) {
+		return fmt.Errorf("hash %s does not match recorded %s", actual, strings.TrimSpace(string(expected)))
+	}
+	return nil
+}
+
+/**
+Blobs are stored as blobs/<algorithm>/<encoded digest>
+*/
+func blobDigest(cachedPath string) (godigest.Digest, bool) {
+	algorithmDir := filepath.Dir(cachedPath)
+	if filepath.Base(filepath.Dir(algorithmDir)) != "blobs" {
+		return "", false
+	}
+
+	digest := godigest.NewDigestFromEncoded(godigest.Algorithm(filepath.Base(algorithmDir)), filepath.Base(cachedPath))
+	if digest.Validate() != nil {
+		return "", false
+	}
+	return digest, true
+}
+
+/**
+Returns true for files that are tracked as part of another entry or are still being written
+*/
+func isInternal(path string) bool {
+	return strings.HasSuffix(path, hashSuffix) || strings.HasSuffix(path, verifiedSuffix) || strings.HasSuffix(path, ".tmp")
+}
+
+/**
+Hash sidecars and helm indexes are not validated, only files the build reuses
+*/
+func isVerifiable(relativePath string) bool {
+	return strings.HasPrefix(relativePath, "blobs/") || strings.HasPrefix(relativePath, "download/") || strings.HasPrefix(relativePath, "files/") || strings.HasPrefix(relativePath, "services/")
+}
+
+func remove(cachedPath string) {
+	for _, path := range []string{cachedPath, cachedPath + hashSuffix, cachedPath + verifiedSuffix} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			ui.VPrintf("Cannot remove %s: %s", path, err)
+		}
+	}
+}
+
+/**
+Returns every entry in the cache, least recently used first
+*/
+func (cache *Cache) List() ([]*Entry, error) {
+	var entries []*Entry
+
+	err := filepath.WalkDir(cache.Root, func(path string, dirEntry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if dirEntry.IsDir() || isInternal(path) {
+			return nil
+		}
+
+		info, err := dirEntry.Info()
+		if err != nil {
+			return err
+		}
+
+		relativePath, err := filepath.Rel(cache.Root, path)
+		if err != nil {
+			return err
+		}
+
+		entries = append(entries, &Entry{
+			Path:     filepath.ToSlash(relativePath),
+			Size:     info.Size(),
+			LastUsed: info.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot read cache %s: %s", cache.Root, err)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].LastUsed.Before(entries[j].LastUsed)
+	})
+
+	return entries, nil
+}
+
+/**
+Sets the status of each entry by checking it against its hash
+*/
+func (cache *Cache) Verify(entries []*Entry) {
+	for _, entry := range entries {
+		if !isVerifiable(entry.Path) {
+			entry.Status = StatusUnverified
+		} else if err := verify(cache.path(entry)); err != nil {
+			ui.VPrintf("%s is invalid: %s", entry.Path, err)
+			entry.Status = StatusInvalid
+		} else {
+			entry.Status = StatusValid
+		}
+	}
+}
+
+/**
+Returns the total size of the cache, and the size of each top level directory
+*/
+func (cache *Cache) Size() (int64, map[string]int64, error) {
+	entries, err := cache.List()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var total int64
+	byCategory := map[string]int64{}
+	for _, entry := range entries {
+		total += entry.Size
+		byCategory[strings.SplitN(entry.Path, "/", 2)[0]] += entry.Size
+	}
+
+	return total, byCategory, nil
+}
+
+type PruneOptions struct {
+	//OlderThan removes entries not used for this long. Zero means no age limit
+	OlderThan time.Duration
+
+	//MaxSize removes the least recently used entries until the cache is no bigger than this. Zero means no size limit
+	MaxSize int64
+}
+
+/**
+Removes invalid entries, temp files left by killed builds, and then entries outside the age and size limits.
+Returns the removed entries.
+*/
+func (cache *Cache) Prune(options PruneOptions) ([]*Entry, error) {
+	if err := cache.removeStaleTempFiles(); err != nil {
+		return nil, err
+	}
+
+	entries, err := cache.List()
+	if err != nil {
+		return nil, err
+	}
+	cache.Verify(entries)
+
+	var total int64
+	for _, entry := range entries {
+		total += entry.Size
+	}
+
+	var removed []*Entry
+	now := time.Now()
+	for _, entry := range entries {
+		//entries are least recently used first
+		prune := entry.Status == StatusInvalid ||
+			(options.OlderThan > 0 && now.Sub(entry.LastUsed) > options.OlderThan) ||
+			(options.MaxSize > 0 && total > options.MaxSize)
+		if !prune {
+			continue
+		}
+
+		remove(cache.path(entry))
+		total -= entry.Size
+		removed = append(removed, entry)
+	}
+
+	return removed, nil
+}
+
+func (cache *Cache) removeStaleTempFiles() error {
+	return filepath.WalkDir(cache.Root, func(path string, dirEntry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if dirEntry.IsDir() || !strings.HasSuffix(path, ".tmp") {
+			return nil
+		}
+
+		info, err := dirEntry.Info()
+		if err != nil {
+			return err
+		}
+		if time.Since(info.ModTime()) > staleTempAge {
+			ui.VPrintf("Removing %s left by an incomplete build", path)
+			return os.Remove(path)
+		}
+		return nil
+	})
+}
+
+/**
+Removes everything from the cache, including configured helm repositories
+*/
+func (cache *Cache) Clear() error {
+	dirEntries, err := os.ReadDir(cache.Root)
+	if err != nil {
+		return fmt.Errorf("cannot read cache %s: %s", cache.Root, err)
+	}
+
+	for _, dirEntry := range dirEntries {
+		if err := os.RemoveAll(filepath.Join(cache.Root, dirEntry.Name())); err != nil {
+			return fmt.Errorf("cannot clear cache: %s", err)
+		}
+	}
+	return nil
+}
+
+func (cache *Cache) path(entry *Entry) string {
+	return filepath.Join(cache.Root, filepath.FromSlash(entry.Path))
+}
+
+/**
+Prints the entries as a table
+*/
+func PrintEntries(entries []*Entry) {
+	for _, entry := range entries {
+		status := ""
+		if entry.Status != "" && entry.Status != StatusValid {
+			status = " (" + entry.Status + ")"
+		}
+		ui.Printf("%-10s %-20s %s%s", units.HumanSize(float64(entry.Size)), entry.LastUsed.Format("2006-01-02 15:04"), entry.Path, status)
+	}
+}
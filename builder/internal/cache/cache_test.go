@@ -0,0 +1,195 @@
+package cache
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testCache(t *testing.T) *Cache {
+	root, err := ioutil.TempDir("", "cache-test-")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = os.RemoveAll(root) })
+	return &Cache{Root: root}
+}
+
+/**
+Writes a file to the cache, recording its hash unless record is false. Returns the full path
+*/
+func writeEntry(t *testing.T, cache *Cache, path string, content string, lastUsed time.Time, record bool) string {
+	fullPath := filepath.Join(cache.Root, path)
+	require.NoError(t, os.MkdirAll(filepath.Dir(fullPath), 0755))
+	require.NoError(t, ioutil.WriteFile(fullPath, []byte(content), 0644))
+	if record {
+		require.NoError(t, Record(fullPath))
+	}
+	require.NoError(t, os.Chtimes(fullPath, lastUsed, lastUsed))
+	return fullPath
+}
+
+func blobPath(content string) string {
+	digest := sha256.Sum256([]byte(content))
+	return "blobs/sha256/" + hex.EncodeToString(digest[:])
+}
+
+func TestLookup(t *testing.T) {
+	cache := testCache(t)
+	lastWeek := time.Now().Add(-7 * 24 * time.Hour)
+
+	assert.False(t, Lookup(filepath.Join(cache.Root, "files/missing.gz")))
+
+	layer := writeEntry(t, cache, "files/layer.tar.gz", "compressed layer", lastWeek, true)
+	assert.True(t, Lookup(layer))
+	stat, err := os.Stat(layer)
+	require.NoError(t, err)
+	assert.True(t, stat.ModTime().After(lastWeek), "lookup should mark the entry as used")
+
+	//a build killed while writing leaves a truncated file
+	require.NoError(t, ioutil.WriteFile(layer, []byte("compressed"), 0644))
+	assert.False(t, Lookup(layer))
+	assert.NoFileExists(t, layer)
+	assert.NoFileExists(t, layer+hashSuffix)
+
+	unrecorded := writeEntry(t, cache, "download/general/k3s", "k3s", lastWeek, false)
+	assert.False(t, Lookup(unrecorded))
+
+	blob := writeEntry(t, cache, blobPath("blob content"), "blob content", lastWeek, true)
+	assert.NoFileExists(t, blob+hashSuffix, "blobs are named by their digest")
+	assert.True(t, Lookup(blob))
+
+	require.NoError(t, ioutil.WriteFile(blob, []byte("blob"), 0644))
+	assert.False(t, Lookup(blob))
+}
+
+func TestPrune(t *testing.T) {
+	now := time.Now()
+
+	testData := []struct {
+		name            string
+		options         PruneOptions
+		expectedRemoved []string
+	}{
+		{
+			name:            "invalid only",
+			expectedRemoved: []string{"files/truncated.gz"},
+		},
+		{
+			name:            "older than",
+			options:         PruneOptions{OlderThan: 5 * 24 * time.Hour},
+			expectedRemoved: []string{"download/general/old", "files/truncated.gz"},
+		},
+		{
+			name:            "max size",
+			options:         PruneOptions{MaxSize: 20},
+			expectedRemoved: []string{"download/general/old", "files/truncated.gz", "files/middle.gz"},
+		},
+	}
+
+	for _, data := range testData {
+		t.Run(data.name, func(t *testing.T) {
+			cache := testCache(t)
+			writeEntry(t, cache, "download/general/old", "0123456789", now.Add(-10*24*time.Hour), true)
+			truncated := writeEntry(t, cache, "files/truncated.gz", "0123456789", now.Add(-3*24*time.Hour), true)
+			require.NoError(t, ioutil.WriteFile(truncated, []byte("01234"), 0644))
+			require.NoError(t, os.Chtimes(truncated, now.Add(-3*24*time.Hour), now.Add(-3*24*time.Hour)))
+			writeEntry(t, cache, "files/middle.gz", "0123456789", now.Add(-2*24*time.Hour), true)
+			writeEntry(t, cache, "helm/repositories.yaml", "repos", now.Add(-24*time.Hour), false)
+			writeEntry(t, cache, "files/recent.gz", "0123456789", now, true)
+			writeEntry(t, cache, "files/killed.gz.123.tmp", "0123", now.Add(-2*time.Hour), false)
+
+			removed, err := cache.Prune(data.options)
+			require.NoError(t, err)
+
+			var removedPaths []string
+			for _, entry := range removed {
+				removedPaths = append(removedPaths, entry.Path)
+			}
+			assert.Equal(t, data.expectedRemoved, removedPaths)
+			assert.NoFileExists(t, filepath.Join(cache.Root, "files/killed.gz.123.tmp"))
+			assert.FileExists(t, filepath.Join(cache.Root, "files/recent.gz"))
+			assert.FileExists(t, filepath.Join(cache.Root, "helm/repositories.yaml"))
+		})
+	}
+}
+
+func TestSize(t *testing.T) {
+	cache := testCache(t)
+	writeEntry(t, cache, "files/a.gz", "12345", time.Now(), true)
+	writeEntry(t, cache, "files/b.gz", "123", time.Now(), true)
+	writeEntry(t, cache, "helm/repositories.yaml", "12", time.Now(), false)
+
+	total, byCategory, err := cache.Size()
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), total)
+	assert.Equal(t, map[string]int64{"files": 8, "helm": 2}, byCategory)
+
+	require.NoError(t, cache.Clear())
+	entries, err := cache.List()
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+	assert.DirExists(t, cache.Root)
+}
+
+func TestExportImport(t *testing.T) {
+	source := testCache(t)
+	writeEntry(t, source, "files/layer.tar.gz", "layer", time.Now(), true)
+	writeEntry(t, source, blobPath("blob"), "blob", time.Now(), true)
+	writeEntry(t, source, "helm/repositories.yaml", "repos", time.Now(), false)
+	truncated := writeEntry(t, source, "download/general/truncated", "0123456789", time.Now(), true)
+	require.NoError(t, ioutil.WriteFile(truncated, []byte("01234"), 0644))
+
+	exportPath := filepath.Join(testCache(t).Root, "cache.tar.gz")
+	exported, err := source.Export(exportPath)
+	require.NoError(t, err)
+	assert.Equal(t, 3, exported)
+
+	target := testCache(t)
+	imported, err := target.Import(exportPath)
+	require.NoError(t, err)
+	assert.Equal(t, 3, imported)
+
+	assert.True(t, Lookup(filepath.Join(target.Root, "files/layer.tar.gz")))
+	assert.True(t, Lookup(filepath.Join(target.Root, blobPath("blob"))))
+	assert.FileExists(t, filepath.Join(target.Root, "helm/repositories.yaml"))
+	assert.NoFileExists(t, filepath.Join(target.Root, "download/general/truncated"))
+}
+
+func TestImport_InvalidEntries(t *testing.T) {
+	writeArchive := func(files map[string]string) string {
+		archivePath := filepath.Join(testCache(t).Root, "cache.tar.gz")
+		archiveFile, err := os.Create(archivePath)
+		require.NoError(t, err)
+		gzipWriter := gzip.NewWriter(archiveFile)
+		tarWriter := tar.NewWriter(gzipWriter)
+		for name, content := range files {
+			require.NoError(t, tarWriter.WriteHeader(&tar.Header{Name: name, Size: int64(len(content)), Mode: 0644, Typeflag: tar.TypeReg}))
+			_, err := tarWriter.Write([]byte(content))
+			require.NoError(t, err)
+		}
+		require.NoError(t, tarWriter.Close())
+		require.NoError(t, gzipWriter.Close())
+		require.NoError(t, archiveFile.Close())
+		return archivePath
+	}
+
+	target := testCache(t)
+	archivePath := writeArchive(map[string]string{"../escape": "bad"})
+	_, err := target.Import(archivePath)
+	assert.EqualError(t, err, "invalid path in "+archivePath+": ../escape")
+
+	imported, err := target.Import(writeArchive(map[string]string{
+		"files/layer.tar.gz":      "layer",
+		"files/layer.tar.gz.sha1": "0000000000000000000000000000000000000000",
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, 0, imported)
+	assert.NoFileExists(t, filepath.Join(target.Root, "files/layer.tar.gz"))
+}
@@ -0,0 +1,191 @@
+package docker
+
+import (
+	"fmt"
+	"github.com/docker/distribution/reference"
+	godigest "github.com/opencontainers/go-digest"
+	"strings"
+	"sync"
+)
+
+/**
+Image backend that pulls and exports images through the docker daemon.
+Required when the project builds images from Dockerfiles.
+*/
+type Backend struct {
+	//Architecture is the platform to pull from multi-platform images. Defaults to amd64
+	Architecture string
+
+	//digestRefs maps images pulled by a locked digest to the digest reference they were pulled as, so the user's own tags are never changed
+	digestRefs map[string]string
+	//pinnedRefs maps images pulled by a locked digest to the builder-owned tag they are saved from
+	pinnedRefs     map[string]string
+	digestRefsLock sync.Mutex
+}
+
+func (backend *Backend) Name() string {
+	return "docker"
+}
+
+/**
+Pulls the given image. If digest is set, that digest is pulled and used in place of imageRef, leaving imageRef's local tag unchanged.
+The digest is also tagged under a pinned.local/ name so Save can export it with a name
+*/
+func (backend *Backend) Pull(imageRef string, digest string) error {
+	if digest == "" {
+		return ImagePull(imageRef, backend.platform())
+	}
+
+	digestRef, err := digestReference(imageRef, digest)
+	if err != nil {
+		return err
+	}
+
+	if err := ImagePull(digestRef, backend.platform()); err != nil {
+		return fmt.Errorf("error pulling %s: %s", digestRef, err)
+	}
+
+	pinnedRef, err := pinnedReference(imageRef, digest)
+	if err != nil {
+		return err
+	}
+	if pinnedRef != "" {
+		if err := ImageTag(digestRef, pinnedRef); err != nil {
+			return fmt.Errorf("error tagging %s: %s", digestRef, err)
+		}
+	}
+
+	backend.digestRefsLock.Lock()
+	defer backend.digestRefsLock.Unlock()
+	if backend.digestRefs == nil {
+		backend.digestRefs = map[string]string{}
+		backend.pinnedRefs = map[string]string{}
+	}
+	backend.digestRefs[imageRef] = digestRef
+	if pinnedRef != "" {
+		backend.pinnedRefs[imageRef] = pinnedRef
+	}
+
+	return nil
+}
+
+/**
+Returns true if the image, or its locked digest, is already in the docker daemon for the backend's architecture
+*/
+func (backend *Backend) Available(imageRef string, digest string) bool {
+	localRef := imageRef
+	if digest != "" {
+		digestRef, err := digestReference(imageRef, digest)
+		if err != nil {
+			return false
+		}
+		localRef = digestRef
+	}
+
+	localPlatform, err := ImagePlatform(localRef)
+	return err == nil && localPlatform == backend.platform()
+}
+
+/**
+Returns the reference the image was pulled as: its locked digest reference, or imageRef itself
+*/
+func (backend *Backend) pulledRef(imageRef string) string {
+	backend.digestRefsLock.Lock()
+	defer backend.digestRefsLock.Unlock()
+
+	if digestRef, found := backend.digestRefs[imageRef]; found {
+		return digestRef
+	}
+	return imageRef
+}
+
+/**
+Returns the registry digest of the image, or the image ID for locally built images
+*/
+func (backend *Backend) Digest(imageRef string) (string, error) {
+	if strings.HasPrefix(imageRef, "build.local/") {
+		return ImageId(imageRef)
+	}
+
+	named, err := reference.ParseNormalizedNamed(backend.pulledRef(imageRef))
+	if err != nil {
+		return "", err
+	}
+	if canonical, isDigested := named.(reference.Canonical); isDigested {
+		return canonical.Digest().String(), nil
+	}
+
+	return ImageDigest(imageRef)
+}
+
+func (backend *Backend) Size(imageRef string) (int64, error) {
+	return ImageSize(backend.pulledRef(imageRef))
+}
+
+/**
+Saves the images. Images pulled by a locked digest are saved from their pinned.local/ tag, renamed back to imageRef in the tar
+so the server imports them under the name the project uses
+*/
+func (backend *Backend) Save(outputPath string, imageRefs ...string) error {
+	backend.digestRefsLock.Lock()
+	var savedRefs []string
+	renames := map[string]string{}
+	for _, imageRef := range imageRefs {
+		if pinnedRef, found := backend.pinnedRefs[imageRef]; found {
+			savedRefs = append(savedRefs, pinnedRef)
+			renames[pinnedRef] = imageRef
+		} else if digestRef, found := backend.digestRefs[imageRef]; found {
+			savedRefs = append(savedRefs, digestRef)
+		} else {
+			savedRefs = append(savedRefs, imageRef)
+		}
+	}
+	backend.digestRefsLock.Unlock()
+
+	return SaveRenamedImages(outputPath, savedRefs, renames)
+}
+
+/**
+Returns imageRef's repository with the given digest
+*/
+func digestReference(imageRef string, digest string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(imageRef)
+	if err != nil {
+		return "", err
+	}
+	parsedDigest, err := godigest.Parse(digest)
+	if err != nil {
+		return "", err
+	}
+	canonical, err := reference.WithDigest(reference.TrimNamed(named), parsedDigest)
+	if err != nil {
+		return "", err
+	}
+	return reference.FamiliarString(canonical), nil
+}
+
+/**
+Returns the builder-owned tag a locked digest of imageRef is saved from, or "" if imageRef has no tag to save it as
+*/
+func pinnedReference(imageRef string, digest string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(imageRef)
+	if err != nil {
+		return "", err
+	}
+	if _, isDigested := named.(reference.Digested); isDigested {
+		return "", nil
+	}
+	parsedDigest, err := godigest.Parse(digest)
+	if err != nil {
+		return "", err
+	}
+
+	return "pinned.local/" + reference.Path(named) + ":" + parsedDigest.Encoded(), nil
+}
+
+func (backend *Backend) platform() string {
+	if backend.Architecture == "" {
+		return "linux/amd64"
+	}
+	return "linux/" + backend.Architecture
+}
@@ -0,0 +1,74 @@
+package docker
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"github.com/ruckstack/ruckstack/builder/internal/environment"
+	"github.com/ruckstack/ruckstack/common/ui"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestBackend_SaveLocked(t *testing.T) {
+	if testing.Short() {
+		t.Skip("-short tests do not pull docker images")
+	}
+	output := new(bytes.Buffer)
+	ui.SetOutput(output)
+
+	assert.NoError(t, ImagePull(alpineImage, "linux/amd64"))
+	digest, err := ImageDigest(alpineImage)
+	assert.NoError(t, err)
+
+	backend := &Backend{}
+	assert.NoError(t, backend.Pull(alpineImage, digest))
+
+	outputPath := environment.TempPath("test_backend_save-*.tar")
+	defer os.Remove(outputPath)
+	assert.NoError(t, backend.Save(outputPath, alpineImage))
+
+	savedFile, err := os.Open(outputPath)
+	assert.NoError(t, err)
+	defer savedFile.Close()
+
+	var manifest []struct {
+		RepoTags []string
+	}
+	tarReader := tar.NewReader(savedFile)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		if header.Name == "manifest.json" {
+			content, err := ioutil.ReadAll(tarReader)
+			assert.NoError(t, err)
+			assert.NoError(t, json.Unmarshal(content, &manifest))
+		}
+	}
+
+	if assert.Len(t, manifest, 1) {
+		assert.Equal(t, []string{alpineImage}, manifest[0].RepoTags, "locked images are saved under the project's tag")
+	}
+}
+
+func TestPinnedReference(t *testing.T) {
+	digest := "sha256:" + "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+	pinnedRef, err := pinnedReference("nginx:1.19", digest)
+	assert.NoError(t, err)
+	assert.Equal(t, "pinned.local/library/nginx:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef", pinnedRef)
+
+	pinnedRef, err = pinnedReference("quay.io/org/app", digest)
+	assert.NoError(t, err)
+	assert.Equal(t, "pinned.local/org/app:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef", pinnedRef)
+
+	pinnedRef, err = pinnedReference("nginx@"+digest, digest)
+	assert.NoError(t, err)
+	assert.Equal(t, "", pinnedRef, "digest references have no tag to save")
+}
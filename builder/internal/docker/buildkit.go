@@ -0,0 +1,234 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/docker/docker/pkg/term"
+	controlapi "github.com/moby/buildkit/api/services/control"
+	"github.com/moby/buildkit/session"
+	"github.com/moby/buildkit/session/secrets/secretsprovider"
+	"github.com/moby/buildkit/session/sshforward/sshprovider"
+	"github.com/ruckstack/ruckstack/common/ui"
+	"io"
+	"net"
+	"strings"
+)
+
+/**
+Settings for building with BuildKit instead of the classic builder
+*/
+type BuildKitOptions struct {
+	//Secrets are available to RUN --mount=type=secret without being stored in the image
+	Secrets []BuildSecret
+
+	//Ssh are the agents available to RUN --mount=type=ssh
+	Ssh []BuildSsh
+
+	//CacheFrom are images to import build cache from
+	CacheFrom []string
+
+	//CacheTo is an image to push with the build cache embedded, so later builds can use it in CacheFrom
+	CacheTo string
+}
+
+/**
+A build secret read from a file or environment variable
+*/
+type BuildSecret struct {
+	Id   string
+	File string
+	Env  string
+}
+
+/**
+An ssh agent socket or key files to forward. No paths uses SSH_AUTH_SOCK
+*/
+type BuildSsh struct {
+	Id    string
+	Paths []string
+}
+
+/**
+Builds with BuildKit, using a session with the daemon to provide secrets and ssh agents
+*/
+func imageBuildKit(buildContext io.Reader, buildOptions types.ImageBuildOptions, buildKit *BuildKitOptions, output io.Writer) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	buildSession, err := newBuildSession(ctx, buildKit)
+	if err != nil {
+		return err
+	}
+	go func() {
+		err := buildSession.Run(ctx, func(ctx context.Context, proto string, meta map[string][]string) (net.Conn, error) {
+			return dockerClient.DialHijack(ctx, "/session", proto, meta)
+		})
+		if err != nil {
+			ui.VPrintf("Build session ended: %s", err)
+		}
+	}()
+	defer buildSession.Close()
+
+	buildOptions.Version = types.BuilderBuildKit
+	buildOptions.SessionID = buildSession.ID()
+	buildOptions.CacheFrom = buildKit.CacheFrom
+	if buildKit.CacheTo != "" {
+		inlineCache := "1"
+		buildOptions.BuildArgs = map[string]*string{
+			"BUILDKIT_INLINE_CACHE": &inlineCache,
+		}
+		buildOptions.Tags = append(buildOptions.Tags, buildKit.CacheTo)
+	}
+
+	resp, err := dockerClient.ImageBuild(ctx, buildContext, buildOptions)
+	if err != nil {
+		return fmt.Errorf("cannot build image: %s", cleanErrorMessage(err))
+	}
+	defer resp.Body.Close()
+
+	if err := sendBuildKitOutput(resp.Body, output); err != nil {
+		return fmt.Errorf("cannot build image: %s", err)
+	}
+
+	if buildKit.CacheTo != "" {
+		if err := imagePush(buildKit.CacheTo, output); err != nil {
+			return fmt.Errorf("cannot export build cache to %s: %s", buildKit.CacheTo, err)
+		}
+	}
+
+	return nil
+}
+
+func newBuildSession(ctx context.Context, buildKit *BuildKitOptions) (*session.Session, error) {
+	buildSession, err := session.NewSession(ctx, "ruckstack", "")
+	if err != nil {
+		return nil, fmt.Errorf("cannot start build session: %s", err)
+	}
+
+	if len(buildKit.Secrets) > 0 {
+		var sources []secretsprovider.Source
+		for _, secret := range buildKit.Secrets {
+			sources = append(sources, secretsprovider.Source{
+				ID:       secret.Id,
+				FilePath: secret.File,
+				Env:      secret.Env,
+			})
+		}
+		store, err := secretsprovider.NewStore(sources)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load build secrets: %s", err)
+		}
+		buildSession.Allow(secretsprovider.NewSecretProvider(store))
+	}
+
+	if len(buildKit.Ssh) > 0 {
+		var agents []sshprovider.AgentConfig
+		for _, ssh := range buildKit.Ssh {
+			agents = append(agents, sshprovider.AgentConfig{
+				ID:    ssh.Id,
+				Paths: ssh.Paths,
+			})
+		}
+		provider, err := sshprovider.NewSSHAgentProvider(agents)
+		if err != nil {
+			return nil, fmt.Errorf("cannot forward ssh: %s", err)
+		}
+		buildSession.Allow(provider)
+	}
+
+	return buildSession, nil
+}
+
+func imagePush(imageRef string, output io.Writer) error {
+	registryAuth, err := encodedRegistryAuth(imageRef)
+	if err != nil {
+		return err
+	}
+	if registryAuth == "" {
+		//the daemon rejects a push without an auth header, so send an empty config for registries without credentials
+		registryAuth = "e30="
+	}
+
+	ui.VPrintf("Pushing %s...", imageRef)
+	reader, err := dockerClient.ImagePush(context.Background(), imageRef, types.ImagePushOptions{
+		RegistryAuth: registryAuth,
+	})
+	if err != nil {
+		return cleanErrorMessage(err)
+	}
+	defer reader.Close()
+
+	termFd, isTerm := term.GetFdInfo(output)
+	return jsonmessage.DisplayJSONMessagesStream(reader, output, termFd, isTerm, nil)
+}
+
+/**
+Writes the BuildKit progress in the build response as one line per step. Returns the error if the build failed
+*/
+func sendBuildKitOutput(reader io.Reader, output io.Writer) error {
+	progress := &buildKitProgress{
+		output:    output,
+		steps:     map[string]int{},
+		completed: map[string]bool{},
+	}
+
+	termFd, isTerm := term.GetFdInfo(output)
+	return jsonmessage.DisplayJSONMessagesStream(reader, output, termFd, isTerm, progress.write)
+}
+
+type buildKitProgress struct {
+	output    io.Writer
+	steps     map[string]int
+	completed map[string]bool
+}
+
+func (progress *buildKitProgress) write(message jsonmessage.JSONMessage) {
+	if message.ID != "moby.buildkit.trace" || message.Aux == nil {
+		return
+	}
+
+	var encoded []byte
+	if err := json.Unmarshal(*message.Aux, &encoded); err != nil {
+		ui.VPrintf("Cannot parse build progress: %s", err)
+		return
+	}
+	status := &controlapi.StatusResponse{}
+	if err := status.Unmarshal(encoded); err != nil {
+		ui.VPrintf("Cannot parse build progress: %s", err)
+		return
+	}
+
+	for _, vertex := range status.Vertexes {
+		digest := vertex.Digest.String()
+		step, found := progress.steps[digest]
+		if !found {
+			step = len(progress.steps) + 1
+			progress.steps[digest] = step
+			_, _ = fmt.Fprintf(progress.output, "#%d %s\n", step, vertex.Name)
+		}
+
+		if progress.completed[digest] {
+			continue
+		}
+		if vertex.Error != "" {
+			progress.completed[digest] = true
+			_, _ = fmt.Fprintf(progress.output, "#%d ERROR: %s\n", step, vertex.Error)
+		} else if vertex.Cached {
+			progress.completed[digest] = true
+			_, _ = fmt.Fprintf(progress.output, "#%d CACHED\n", step)
+		} else if vertex.Completed != nil {
+			progress.completed[digest] = true
+			_, _ = fmt.Fprintf(progress.output, "#%d DONE\n", step)
+		}
+	}
+
+	for _, log := range status.Logs {
+		step := progress.steps[log.Vertex.String()]
+		for _, line := range strings.Split(strings.TrimRight(string(log.Msg), "\n"), "\n") {
+			_, _ = fmt.Fprintf(progress.output, "#%d %s\n", step, line)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package docker
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/docker/docker/pkg/jsonmessage"
+	controlapi "github.com/moby/buildkit/api/services/control"
+	"github.com/opencontainers/go-digest"
+	"github.com/ruckstack/ruckstack/builder/internal/environment"
+	"github.com/ruckstack/ruckstack/common/ui"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSendBuildKitOutput(t *testing.T) {
+	step1 := digest.FromString("step1")
+	step2 := digest.FromString("step2")
+	completed := time.Unix(1600000000, 0)
+
+	stream := new(bytes.Buffer)
+	for _, status := range []*controlapi.StatusResponse{
+		{
+			Vertexes: []*controlapi.Vertex{
+				{Digest: step1, Name: "[1/2] FROM docker.io/library/alpine"},
+				{Digest: step2, Name: "[2/2] RUN echo hello"},
+			},
+		},
+		{
+			Vertexes: []*controlapi.Vertex{{Digest: step1, Name: "[1/2] FROM docker.io/library/alpine", Cached: true}},
+			Logs:     []*controlapi.VertexLog{{Vertex: step2, Msg: []byte("hello\nworld\n")}},
+		},
+		{
+			Vertexes: []*controlapi.Vertex{{Digest: step2, Name: "[2/2] RUN echo hello", Completed: &completed}},
+		},
+	} {
+		encoded, err := status.Marshal()
+		assert.NoError(t, err)
+		aux, err := json.Marshal(encoded)
+		assert.NoError(t, err)
+		rawAux := json.RawMessage(aux)
+		message, err := json.Marshal(jsonmessage.JSONMessage{ID: "moby.buildkit.trace", Aux: &rawAux})
+		assert.NoError(t, err)
+		stream.Write(append(message, '\n'))
+	}
+
+	output := new(bytes.Buffer)
+	assert.NoError(t, sendBuildKitOutput(stream, output))
+	assert.Equal(t, "#1 [1/2] FROM docker.io/library/alpine\n"+
+		"#2 [2/2] RUN echo hello\n"+
+		"#1 CACHED\n"+
+		"#2 hello\n"+
+		"#2 world\n"+
+		"#2 DONE\n", output.String())
+
+	failed, err := json.Marshal(jsonmessage.JSONMessage{Error: &jsonmessage.JSONError{Message: "failed to solve"}})
+	assert.NoError(t, err)
+	assert.EqualError(t, sendBuildKitOutput(bytes.NewReader(failed), new(bytes.Buffer)), "failed to solve")
+}
+
+func TestImageBuild_BuildKit(t *testing.T) {
+	if testing.Short() {
+		t.Skip("-short tests do not run docker images")
+	}
+	output := new(bytes.Buffer)
+	ui.SetOutput(output)
+
+	contextDir := environment.TempPath("buildkit-test-*")
+	assert.NoError(t, os.MkdirAll(contextDir, 0755))
+	defer os.RemoveAll(contextDir)
+
+	dockerfile := filepath.Join(contextDir, "Dockerfile")
+	assert.NoError(t, ioutil.WriteFile(dockerfile, []byte("FROM "+alpineImage+"\n"+
+		"RUN --mount=type=secret,id=token test \"$(cat /run/secrets/token)\" = \"secret-value\"\n"+
+		"RUN --mount=type=cache,target=/cache touch /cache/used\n"), 0644))
+
+	assert.NoError(t, os.Setenv("RUCKSTACK_TEST_TOKEN", "secret-value"))
+	defer os.Unsetenv("RUCKSTACK_TEST_TOKEN")
+
+	err := ImageBuild(dockerfile, []string{"ruckstack:test-buildkit"}, nil, "linux/amd64", &BuildKitOptions{
+		Secrets: []BuildSecret{{Id: "token", Env: "RUCKSTACK_TEST_TOKEN"}},
+	}, output)
+	assert.NoError(t, err)
+}
@@ -1,15 +1,23 @@
 package docker
 
 import (
+	"archive/tar"
+	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"github.com/docker/distribution/reference"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/client"
 	"github.com/docker/docker/pkg/archive"
 	"github.com/docker/docker/pkg/jsonmessage"
 	"github.com/docker/docker/pkg/term"
+	"github.com/ruckstack/ruckstack/builder/internal/environment"
+	"github.com/ruckstack/ruckstack/builder/internal/registry"
 	"github.com/ruckstack/ruckstack/common/ui"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
@@ -17,6 +25,9 @@ import (
 
 var dockerClient *client.Client
 
+// Credentials are sent to the daemon for every pull, since it does not read the docker config file itself
+var Credentials *registry.CredentialStore
+
 func init() {
 	var err error
 
@@ -26,14 +37,38 @@ func init() {
 	}
 }
 
-func ImagePull(imageRef string) error {
+func ImagePull(imageRef string, platform string) error {
 	if strings.HasPrefix(imageRef, "build.local/") {
 		ui.VPrintf("Don't pull local image %s", imageRef)
 		return nil
 	}
 
+	if environment.Offline {
+		imageInfo, _, err := dockerClient.ImageInspectWithRaw(context.Background(), imageRef)
+		if err != nil {
+			if client.IsErrNotFound(err) {
+				return fmt.Errorf("image %s is not available with --offline. Run `ruckstack fetch` first", imageRef)
+			}
+			return cleanErrorMessage(err)
+		}
+		//the local image is whichever platform was pulled last, which may not be the one being built
+		if localPlatform := imageInfo.Os + "/" + imageInfo.Architecture; platform != "" && localPlatform != platform {
+			return fmt.Errorf("image %s is not available for %s with --offline, only for %s. Run `ruckstack fetch` first", imageRef, platform, localPlatform)
+		}
+		ui.VPrintf("Using local image %s with --offline", imageRef)
+		return nil
+	}
+
+	registryAuth, err := encodedRegistryAuth(imageRef)
+	if err != nil {
+		return err
+	}
+
 	ui.VPrintf("Pulling %s...", imageRef)
-	reader, err := dockerClient.ImagePull(context.Background(), imageRef, types.ImagePullOptions{})
+	reader, err := dockerClient.ImagePull(context.Background(), imageRef, types.ImagePullOptions{
+		RegistryAuth: registryAuth,
+		Platform:     platform,
+	})
 	if err != nil {
 		if strings.Contains(err.Error(), "manifest unknown") {
 			return fmt.Errorf("Cannot pull image %s. May be an invalid version?", imageRef)
@@ -48,26 +83,216 @@ func ImagePull(imageRef string) error {
 	return nil
 }
 
+/**
+Returns the registry digest of the given image, as recorded when it was pulled
+*/
+func ImageDigest(imageRef string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(imageRef)
+	if err != nil {
+		return "", err
+	}
+
+	imageInfo, _, err := dockerClient.ImageInspectWithRaw(context.Background(), imageRef)
+	if err != nil {
+		return "", cleanErrorMessage(err)
+	}
+
+	for _, repoDigest := range imageInfo.RepoDigests {
+		digested, err := reference.ParseNormalizedNamed(repoDigest)
+		if err != nil {
+			continue
+		}
+		if canonical, ok := digested.(reference.Canonical); ok && digested.Name() == named.Name() {
+			return canonical.Digest().String(), nil
+		}
+	}
+
+	return "", fmt.Errorf("cannot determine digest of %s", imageRef)
+}
+
+/**
+Returns the os/architecture of the given image in the docker daemon
+*/
+func ImagePlatform(imageRef string) (string, error) {
+	imageInfo, _, err := dockerClient.ImageInspectWithRaw(context.Background(), imageRef)
+	if err != nil {
+		return "", cleanErrorMessage(err)
+	}
+
+	return imageInfo.Os + "/" + imageInfo.Architecture, nil
+}
+
+/**
+Returns the ID of the given image. Used for images that were built locally and have no registry digest
+*/
+func ImageId(imageRef string) (string, error) {
+	imageInfo, _, err := dockerClient.ImageInspectWithRaw(context.Background(), imageRef)
+	if err != nil {
+		return "", cleanErrorMessage(err)
+	}
+
+	return imageInfo.ID, nil
+}
+
+func ImageSize(imageRef string) (int64, error) {
+	imageInfo, _, err := dockerClient.ImageInspectWithRaw(context.Background(), imageRef)
+	if err != nil {
+		return 0, cleanErrorMessage(err)
+	}
+
+	return imageInfo.Size, nil
+}
+
+func ImageTag(sourceRef string, targetRef string) error {
+	ui.VPrintf("Tagging %s as %s", sourceRef, targetRef)
+	if err := dockerClient.ImageTag(context.Background(), sourceRef, targetRef); err != nil {
+		return cleanErrorMessage(err)
+	}
+
+	return nil
+}
+
 func SaveImages(outputPath string, imageRefs ...string) error {
+	return SaveRenamedImages(outputPath, imageRefs, nil)
+}
+
+/**
+Saves the images like SaveImages, but records each image in renames under its mapped name in the saved tar's manifest.json and repositories files.
+Lets images be exported under their original names without changing those tags in the docker daemon
+*/
+func SaveRenamedImages(outputPath string, imageRefs []string, renames map[string]string) error {
 	defer ui.StartProgressf("Exporting images").Stop()
 
 	outputFile, err := os.Create(outputPath)
 	if err != nil {
 		return err
 	}
+	defer outputFile.Close()
 
 	ui.VPrintf("exporting %s to %s", strings.Join(imageRefs, ", "), outputPath)
 	tarStream, err := dockerClient.ImageSave(context.Background(), imageRefs)
 	if err != nil {
 		return fmt.Errorf("Error saving images %s: %s", strings.Join(imageRefs, ", "), cleanErrorMessage(err))
 	}
+	defer tarStream.Close()
 
-	_, err = io.Copy(outputFile, tarStream)
-	if err != nil {
+	if len(renames) == 0 {
+		_, err = io.Copy(outputFile, tarStream)
 		return err
 	}
 
-	return nil
+	return renameSavedImages(tarStream, outputFile, renames)
+}
+
+/**
+Copies a `docker save` tar, replacing the image names in its manifest.json and repositories files according to renames
+*/
+func renameSavedImages(input io.Reader, output io.Writer, renames map[string]string) error {
+	normalizedRenames := map[string]reference.NamedTagged{}
+	for from, to := range renames {
+		fromNamed, err := reference.ParseNormalizedNamed(from)
+		if err != nil {
+			return err
+		}
+		toNamed, err := reference.ParseNormalizedNamed(to)
+		if err != nil {
+			return err
+		}
+		toTagged, isTagged := reference.TagNameOnly(toNamed).(reference.NamedTagged)
+		if !isTagged {
+			return fmt.Errorf("cannot save %s as %s: images can only be saved under a tag", from, to)
+		}
+		normalizedRenames[reference.TagNameOnly(fromNamed).String()] = toTagged
+	}
+	rename := func(name string) reference.NamedTagged {
+		named, err := reference.ParseNormalizedNamed(name)
+		if err != nil {
+			return nil
+		}
+		return normalizedRenames[reference.TagNameOnly(named).String()]
+	}
+
+	tarReader := tar.NewReader(input)
+	tarWriter := tar.NewWriter(output)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error reading saved images: %s", err)
+		}
+
+		var content io.Reader = tarReader
+		if header.Name == "manifest.json" || header.Name == "repositories" {
+			original, err := ioutil.ReadAll(tarReader)
+			if err != nil {
+				return err
+			}
+			var renamed []byte
+			if header.Name == "manifest.json" {
+				renamed, err = renameManifestRepoTags(original, rename)
+			} else {
+				renamed, err = renameRepositories(original, rename)
+			}
+			if err != nil {
+				return fmt.Errorf("error renaming images in %s: %s", header.Name, err)
+			}
+			header.Size = int64(len(renamed))
+			content = bytes.NewReader(renamed)
+		}
+
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tarWriter, content); err != nil {
+			return err
+		}
+	}
+
+	return tarWriter.Close()
+}
+
+func renameManifestRepoTags(manifest []byte, rename func(string) reference.NamedTagged) ([]byte, error) {
+	var entries []map[string]interface{}
+	if err := json.Unmarshal(manifest, &entries); err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		repoTags, _ := entry["RepoTags"].([]interface{})
+		for i, repoTag := range repoTags {
+			if renamed := rename(fmt.Sprint(repoTag)); renamed != nil {
+				repoTags[i] = reference.FamiliarString(renamed)
+			}
+		}
+	}
+
+	return json.Marshal(entries)
+}
+
+func renameRepositories(repositories []byte, rename func(string) reference.NamedTagged) ([]byte, error) {
+	var repos map[string]map[string]string
+	if err := json.Unmarshal(repositories, &repos); err != nil {
+		return nil, err
+	}
+
+	renamedRepos := map[string]map[string]string{}
+	for repo, tags := range repos {
+		for tag, id := range tags {
+			renamedRepo, renamedTag := repo, tag
+			if renamed := rename(repo + ":" + tag); renamed != nil {
+				renamedRepo = reference.FamiliarName(renamed)
+				renamedTag = renamed.Tag()
+			}
+			if renamedRepos[renamedRepo] == nil {
+				renamedRepos[renamedRepo] = map[string]string{}
+			}
+			renamedRepos[renamedRepo][renamedTag] = id
+		}
+	}
+
+	return json.Marshal(renamedRepos)
 }
 
 func cleanErrorMessage(err error) error {
@@ -77,11 +302,78 @@ func cleanErrorMessage(err error) error {
 }
 
 func sendOutputToUi(output io.ReadCloser) {
-	termFd, isTerm := term.GetFdInfo(ui.GetOutput())
-	jsonmessage.DisplayJSONMessagesStream(output, ui.GetOutput(), termFd, isTerm, nil)
+	sendOutput(output, ui.GetOutput())
 }
 
-func ImageBuild(dockerfile string, tags []string, labels map[string]string) error {
+func sendOutput(output io.ReadCloser, writer io.Writer) {
+	termFd, isTerm := term.GetFdInfo(writer)
+	jsonmessage.DisplayJSONMessagesStream(output, writer, termFd, isTerm, nil)
+}
+
+/**
+Returns the credentials for the image's registry in the format the docker API expects
+*/
+func encodedRegistryAuth(imageRef string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(imageRef)
+	if err != nil {
+		return "", err
+	}
+
+	authConfig, err := registryAuthConfig(reference.Domain(named))
+	if err != nil || authConfig == nil {
+		return "", err
+	}
+
+	authJson, err := json.Marshal(authConfig)
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(authJson), nil
+}
+
+func registryAuthConfig(host string) (*types.AuthConfig, error) {
+	credentials, err := Credentials.Lookup(host)
+	if err != nil || credentials == nil {
+		return nil, err
+	}
+
+	return &types.AuthConfig{
+		Username:      credentials.Username,
+		Password:      credentials.Password,
+		IdentityToken: credentials.IdentityToken,
+		ServerAddress: host,
+	}, nil
+}
+
+/**
+Returns credentials for every known registry, since Dockerfile base images can come from any of them
+*/
+func buildAuthConfigs() (map[string]types.AuthConfig, error) {
+	authConfigs := map[string]types.AuthConfig{}
+	for _, host := range Credentials.Hosts() {
+		authConfig, err := registryAuthConfig(host)
+		if err != nil {
+			return nil, err
+		}
+		if authConfig == nil {
+			continue
+		}
+
+		if host == "docker.io" {
+			//the daemon looks up Docker Hub credentials by the legacy index address
+			host = "https://index.docker.io/v1/"
+			authConfig.ServerAddress = host
+		}
+		authConfigs[host] = *authConfig
+	}
+
+	return authConfigs, nil
+}
+
+/**
+Builds the Dockerfile for the given platform, writing the build output to output. If buildKit is nil, the classic builder is used
+*/
+func ImageBuild(dockerfile string, tags []string, labels map[string]string, platform string, buildKit *BuildKitOptions, output io.Writer) error {
 	dockerfile, err := filepath.Abs(dockerfile)
 	if err != nil {
 		return err
@@ -100,21 +392,32 @@ func ImageBuild(dockerfile string, tags []string, labels map[string]string) erro
 
 	buildContext, _ := archive.TarWithOptions(filepath.Dir(dockerfile), &archive.TarOptions{})
 
-	resp, err := dockerClient.ImageBuild(context.Background(), buildContext, types.ImageBuildOptions{
-		//Version: types.BuilderBuildKit,
+	authConfigs, err := buildAuthConfigs()
+	if err != nil {
+		return err
+	}
+
+	buildOptions := types.ImageBuildOptions{
 		Dockerfile:  filepath.Base(dockerfile),
 		Tags:        tags,
 		Labels:      labels,
 		Remove:      true,
 		ForceRemove: true,
-	})
+		AuthConfigs: authConfigs,
+		Platform:    platform,
+	}
+	if buildKit != nil {
+		return imageBuildKit(buildContext, buildOptions, buildKit, output)
+	}
+
+	resp, err := dockerClient.ImageBuild(context.Background(), buildContext, buildOptions)
 
 	if err != nil {
 		return fmt.Errorf("cannot build image: %s", cleanErrorMessage(err))
 	}
 	defer resp.Body.Close()
 
-	sendOutputToUi(resp.Body)
+	sendOutput(resp.Body, output)
 
 	return nil
 }
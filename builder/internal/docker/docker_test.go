@@ -1,11 +1,14 @@
 package docker
 
 import (
+	"archive/tar"
 	"bytes"
 	"github.com/ruckstack/ruckstack/builder/internal/environment"
 	"github.com/ruckstack/ruckstack/common/global_util"
 	"github.com/ruckstack/ruckstack/common/ui"
 	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
 	"os"
 	"testing"
 )
@@ -45,7 +48,7 @@ func TestImagePull(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			err := ImagePull(tt.args.imageRef)
+			err := ImagePull(tt.args.imageRef, "linux/amd64")
 			if tt.wantErr {
 				assert.Error(t, err)
 			} else {
@@ -57,6 +60,24 @@ func TestImagePull(t *testing.T) {
 	}
 }
 
+func TestImagePull_Offline(t *testing.T) {
+	if testing.Short() {
+		t.Skip("-short tests do not pull docker images")
+	}
+	assert.NoError(t, ImagePull(alpineImage, "linux/amd64"))
+
+	environment.Offline = true
+	defer func() { environment.Offline = false }()
+
+	assert.NoError(t, ImagePull(alpineImage, "linux/amd64"), "local images are used offline")
+
+	err := ImagePull(alpineImage, "linux/arm64")
+	assert.EqualError(t, err, "image alpine:3.12 is not available for linux/arm64 with --offline, only for linux/amd64. Run `ruckstack fetch` first")
+
+	err = ImagePull("alpine:0.0.0-never-pulled", "linux/amd64")
+	assert.EqualError(t, err, "image alpine:0.0.0-never-pulled is not available with --offline. Run `ruckstack fetch` first")
+}
+
 func TestSaveImages(t *testing.T) {
 	if testing.Short() {
 		t.Skip("-short tests do not run docker images")
@@ -106,6 +127,46 @@ func TestSaveImages(t *testing.T) {
 	_ = os.Remove(outputPath)
 }
 
+func TestRenameSavedImages(t *testing.T) {
+	savedTar := new(bytes.Buffer)
+	tarWriter := tar.NewWriter(savedTar)
+	for name, content := range map[string]string{
+		"manifest.json": `[{"Config":"abc.json","RepoTags":["pinned.local/library/nginx:abc","redis:6"],"Layers":["layer.tar"]}]`,
+		"repositories":  `{"pinned.local/library/nginx":{"abc":"abc"},"redis":{"6":"def"}}`,
+		"layer.tar":     "layer content",
+	} {
+		assert.NoError(t, tarWriter.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content))}))
+		_, err := tarWriter.Write([]byte(content))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, tarWriter.Close())
+
+	renamedTar := new(bytes.Buffer)
+	assert.NoError(t, renameSavedImages(savedTar, renamedTar, map[string]string{
+		"pinned.local/library/nginx:abc": "nginx:1.19",
+	}))
+
+	contents := map[string]string{}
+	tarReader := tar.NewReader(renamedTar)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		content, err := ioutil.ReadAll(tarReader)
+		assert.NoError(t, err)
+		contents[header.Name] = string(content)
+	}
+
+	assert.JSONEq(t, `[{"Config":"abc.json","RepoTags":["nginx:1.19","redis:6"],"Layers":["layer.tar"]}]`, contents["manifest.json"])
+	assert.JSONEq(t, `{"nginx":{"1.19":"abc"},"redis":{"6":"def"}}`, contents["repositories"])
+	assert.Equal(t, "layer content", contents["layer.tar"])
+
+	err := renameSavedImages(new(bytes.Buffer), new(bytes.Buffer), map[string]string{"pinned.local/nginx:abc": "nginx@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"})
+	assert.EqualError(t, err, "cannot save pinned.local/nginx:abc as nginx@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef: images can only be saved under a tag")
+}
+
 func TestImageBuild(t *testing.T) {
 	if testing.Short() {
 		t.Skip("-short tests do not run docker images")
@@ -136,7 +197,7 @@ func TestImageBuild(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			err := ImageBuild(tt.args.dockerfile, tt.args.tags, tt.args.labels)
+			err := ImageBuild(tt.args.dockerfile, tt.args.tags, tt.args.labels, "linux/amd64", nil, ui.GetOutput())
 			if tt.wantErr {
 				assert.Error(t, err)
 			} else {
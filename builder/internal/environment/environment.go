@@ -20,6 +20,9 @@ var (
 	OutDir     string
 	ProjectDir string
 
+	//Offline fails anything that would need the network instead of downloading
+	Offline bool
+
 	PackagedK3sVersion  = "1.20.7+k3s1"
 	PackagedHelmVersion = "3.4.2" //should match go.mod
 
@@ -2,6 +2,7 @@ package helm
 
 import (
 	"fmt"
+	"github.com/ruckstack/ruckstack/builder/internal/cache"
 	"github.com/ruckstack/ruckstack/builder/internal/environment"
 	"github.com/ruckstack/ruckstack/common/ui"
 	"helm.sh/helm/v3/pkg/cli"
@@ -13,12 +14,23 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"regexp"
 	"strings"
+	"sync"
 )
 
 var (
-	helmHome           string
+	helmHome string
+
+	//globalRepoConfigYamlPath contains the repositories added with `ruckstack helm repo add`
+	globalRepoConfigYamlPath string
+
+	//repoConfigYamlPath and repositoryCache are the repositories in use, which are the project's during a build
 	repoConfigYamlPath string
+	repositoryCache    string
+
+	//downloadLock keeps services built in parallel from downloading or reindexing at the same time
+	downloadLock sync.Mutex
 )
 
 func init() {
@@ -30,7 +42,9 @@ func init() {
 		ui.VPrintf("cannot set helm env: %s", err)
 	}
 
-	repoConfigYamlPath = helmpath.ConfigPath("repositories.yaml")
+	globalRepoConfigYamlPath = helmpath.ConfigPath("repositories.yaml")
+	repoConfigYamlPath = globalRepoConfigYamlPath
+	repositoryCache = filepath.Join(helmHome, "cache", "helm", "repository")
 
 	ui.VPrintf("Helm config: %s", repoConfigYamlPath)
 
@@ -71,6 +85,10 @@ func init() {
 }
 
 func ReIndex() error {
+	if environment.Offline {
+		return fmt.Errorf("cannot reindex helm repositories with --offline")
+	}
+
 	ui.Println("Reindexing helm repositories...")
 	defer ui.Println("Reindexing helm repositories...DONE")
 
@@ -80,16 +98,27 @@ func ReIndex() error {
 	}
 
 	for _, repository := range repoFile.Repositories {
-		ui.VPrintf("Reindexing %s from %s", repository.Name, repository.URL)
-		chartRepository, err := repo.NewChartRepository(repository, getter.All(cli.New()))
-		if err != nil {
+		if err := indexRepository(repository); err != nil {
 			return err
 		}
+	}
 
-		_, err = chartRepository.DownloadIndexFile()
-		if err != nil {
-			return err
-		}
+	return nil
+}
+
+/**
+Downloads the index of the repository to the cache of the repositories in use
+*/
+func indexRepository(repository *repo.Entry) error {
+	ui.VPrintf("Reindexing %s from %s", repository.Name, repository.URL)
+	chartRepository, err := repo.NewChartRepository(repository, getter.All(cli.New()))
+	if err != nil {
+		return err
+	}
+	chartRepository.CachePath = repositoryCache
+
+	if _, err := chartRepository.DownloadIndexFile(); err != nil {
+		return fmt.Errorf("cannot index helm repository %s: %s", repository.Name, err)
 	}
 
 	return nil
@@ -108,11 +137,26 @@ func openRepoConfig() (*repo.File, error) {
 Download the given chart. Returns the path to the downloaded file. Will not re-download.
 */
 func DownloadChart(chart string, version string) (string, error) {
+	downloadLock.Lock()
+	defer downloadLock.Unlock()
+
+	savePath, err := chartPath(chart, version)
+	if err != nil {
+		return "", err
+	}
+
 	splitChart := strings.Split(chart, "/")
 	repoName := splitChart[0]
 	chartName := splitChart[1]
+	if cache.Lookup(savePath) {
+		ui.VPrintf("Already downloaded chart %s to %s", filepath.Base(savePath), savePath)
+		return savePath, nil
+	}
+	if environment.Offline {
+		return "", fmt.Errorf("cannot download chart %s %s with --offline. Run `ruckstack fetch` first", chart, version)
+	}
 
-	downloadDir := environment.CachePath("download/helm/" + repoName)
+	downloadDir := filepath.Dir(savePath)
 	if err := os.MkdirAll(downloadDir, 0755); err != nil {
 		return "", err
 	}
@@ -122,37 +166,71 @@ func DownloadChart(chart string, version string) (string, error) {
 		//Keyring:  f.keyring,
 		Verify:           downloader.VerifyNever,
 		RepositoryConfig: repoConfigYamlPath,
-		RepositoryCache:  filepath.Join(helmHome, "cache", "helm", "repository"),
+		RepositoryCache:  repositoryCache,
 		Getters:          getter.All(cli.New()),
 	}
 
-	_, err := os.Stat(chartDownloader.RepositoryCache + "/" + repoName + "-index.yaml")
-	if os.IsNotExist(err) {
+	if _, err := os.Stat(filepath.Join(repositoryCache, helmpath.CacheIndexFile(repoName))); os.IsNotExist(err) {
 		ui.VPrintf("No index for repo %s. Forcing re-index", repoName)
-		if err := ReIndex(); err != nil {
+		repoFile, err := openRepoConfig()
+		if err != nil {
+			return "", err
+		}
+		entry := repoFile.Get(repoName)
+		if entry == nil {
+			return "", fmt.Errorf("no Helm repository named %s is configured. Add it to helmRepos in the project or with `ruckstack helm repo add`", repoName)
+		}
+		if err := indexRepository(entry); err != nil {
 			return "", err
 		}
-	}
-	_, err = os.Stat(chartDownloader.RepositoryCache + "/" + repoName + "-index.yaml")
-	if os.IsNotExist(err) {
-		return "", fmt.Errorf("no Helm repository named %s is configured. Add it with `ruckstack helm repo add`", repoName)
 	}
 
-	savePath := filepath.Join(downloadDir, chartName+"-"+version+".tgz")
-	_, err = os.Stat(savePath)
-	if os.IsNotExist(err) {
-		defer ui.StartProgressf("Downloading chart %s", filepath.Base(savePath)).Stop()
+	defer ui.StartProgressf("Downloading chart %s", filepath.Base(savePath)).Stop()
 
-		savePath, _, err := chartDownloader.DownloadTo(repoName+"/"+chartName, version, downloadDir)
-		if err != nil {
-			errMessage := err.Error()
-			errMessage = strings.Replace(errMessage, ". (try 'helm repo update')", "", 1)
-			return "", fmt.Errorf(errMessage)
-		}
-		ui.VPrintf("Saved to %s", savePath)
-	} else {
-		ui.VPrintf("Already downloaded chart %s to %s", filepath.Base(savePath), savePath)
+	savePath, _, err = chartDownloader.DownloadTo(repoName+"/"+chartName, version, downloadDir)
+	if err != nil {
+		errMessage := err.Error()
+		errMessage = strings.Replace(errMessage, ". (try 'helm repo update')", "", 1)
+		return "", fmt.Errorf(errMessage)
+	}
+	ui.VPrintf("Saved to %s", savePath)
+	if err := cache.Record(savePath); err != nil {
+		return "", err
 	}
 
 	return savePath, nil
 }
+
+/**
+Returns where DownloadChart saves the given chart. Charts are saved by the URL of their repository, so repositories with the same name in different projects do not share them
+*/
+func chartPath(chart string, version string) (string, error) {
+	splitChart := strings.Split(chart, "/")
+	if len(splitChart) != 2 {
+		return "", fmt.Errorf("invalid chart %s. Must be in the form repository/chart", chart)
+	}
+
+	repoUrl, err := RepositoryUrl(splitChart[0])
+	if err != nil {
+		return "", fmt.Errorf("%s. Add it to helmRepos in the project or with `ruckstack helm repo add`", err)
+	}
+
+	return environment.CachePath(filepath.Join("download/helm", urlDirectory(repoUrl), splitChart[1]+"-"+version+".tgz")), nil
+}
+
+/**
+Returns the host and path of the URL as a directory name
+*/
+func urlDirectory(repoUrl string) string {
+	directory := regexp.MustCompile("^[a-zA-Z]+://").ReplaceAllString(repoUrl, "")
+	directory = strings.Trim(directory, "/")
+	return regexp.MustCompile(`[^a-zA-Z0-9._/-]`).ReplaceAllString(directory, "_")
+}
+
+/**
+Returns true if the chart has already been downloaded, so can be used with --offline
+*/
+func IsChartDownloaded(chart string, version string) bool {
+	savePath, err := chartPath(chart, version)
+	return err == nil && cache.Lookup(savePath)
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -70,24 +71,139 @@ func TestDownloadChart(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			//delete it for the original download
-			_ = os.Remove(environment.CachePath("/download/helm/stable/postgresql-8.1.2.tgz"))
+			_ = os.Remove(environment.CachePath("/download/helm/charts.helm.sh/stable/postgresql-8.1.2.tgz"))
 
 			got, err := DownloadChart(tt.args.chart, tt.args.version)
 			if tt.wantErr {
 				assert.Equal(t, err, tt.wantErr)
 			} else {
 				assert.NoError(t, err)
-				assert.Contains(t, got, "/cache/download/helm/stable/postgresql-8.1.2.tgz")
+				assert.Contains(t, got, "/cache/download/helm/charts.helm.sh/stable/postgresql-8.1.2.tgz")
 				assert.FileExists(t, got)
 
 				//does not re-download
 				output.Reset()
 				got, err = DownloadChart(tt.args.chart, tt.args.version)
 				assert.NoError(t, err)
-				assert.Contains(t, got, "/cache/download/helm/stable/postgresql-8.1.2.tgz")
+				assert.Contains(t, got, "/cache/download/helm/charts.helm.sh/stable/postgresql-8.1.2.tgz")
 				assert.Contains(t, output.String(), "Already downloaded")
 
 			}
 		})
 	}
 }
+
+func TestDownloadChart_UnknownRepository(t *testing.T) {
+	_, err := DownloadChart("stabel/postgresql", "8.1.2")
+	assert.EqualError(t, err, "no Helm repository named stabel is configured. Add it to helmRepos in the project or with `ruckstack helm repo add`")
+
+	_, err = DownloadChart("postgresql", "8.1.2")
+	assert.EqualError(t, err, "invalid chart postgresql. Must be in the form repository/chart")
+}
+
+func TestUseProjectRepositories(t *testing.T) {
+	defer func(originalConfig string, originalCache string) {
+		repoConfigYamlPath = originalConfig
+		repositoryCache = originalCache
+	}(repoConfigYamlPath, repositoryCache)
+
+	projectId := "helm-repos-test"
+	defer os.RemoveAll(environment.CachePath("helm/projects/" + projectId))
+
+	err := UseProjectRepositories(projectId, []Repository{{Name: "stable", Url: "https://charts.example.com/stable"}})
+	assert.EqualError(t, err, "helm repository stable is https://charts.example.com/stable in the project but https://charts.helm.sh/stable in the global configuration. Rename the project's repository or run `ruckstack helm repo remove --name stable`")
+
+	assert.NoError(t, UseProjectRepositories(projectId, []Repository{
+		{Name: "stable", Url: "https://charts.helm.sh/stable/"},
+		{Name: "private", Url: "https://charts.example.com/private", Username: "user", Password: "secret"},
+	}))
+
+	privateUrl, err := RepositoryUrl("private")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://charts.example.com/private", privateUrl)
+	_, err = RepositoryUrl("stable")
+	assert.NoError(t, err, "global repositories are still available")
+
+	globalConfig, err := ioutil.ReadFile(globalRepoConfigYamlPath)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(globalConfig), "private", "project repositories are not added to the global configuration")
+
+	indexedConfig, err := ioutil.ReadFile(environment.CachePath("helm/projects/" + projectId + "/repositories.yaml"))
+	assert.NoError(t, err)
+	assert.NotContains(t, string(indexedConfig), "secret", "credentials are not saved to the cache")
+
+	//the index is kept while the URL stays the same, and removed when it changes
+	indexPath := filepath.Join(repositoryCache, "private-index.yaml")
+	assert.NoError(t, ioutil.WriteFile(indexPath, []byte("apiVersion: v1\n"), 0644))
+	assert.NoError(t, UseProjectRepositories(projectId, []Repository{{Name: "private", Url: "https://charts.example.com/private"}}))
+	assert.FileExists(t, indexPath)
+	assert.NoError(t, UseProjectRepositories(projectId, []Repository{{Name: "private", Url: "https://charts.example.com/moved"}}))
+	assert.NoFileExists(t, indexPath)
+
+	savePath, err := chartPath("private/app", "1.2.3")
+	assert.NoError(t, err)
+	assert.Equal(t, environment.CachePath("download/helm/charts.example.com/moved/app-1.2.3.tgz"), savePath)
+}
+
+func TestChartVersions(t *testing.T) {
+	defer func(originalConfig string, originalCache string) {
+		repoConfigYamlPath = originalConfig
+		repositoryCache = originalCache
+	}(repoConfigYamlPath, repositoryCache)
+
+	projectId := "helm-versions-test"
+	defer os.RemoveAll(environment.CachePath("helm/projects/" + projectId))
+
+	assert.NoError(t, UseProjectRepositories(projectId, []Repository{{Name: "private", Url: "https://charts.example.com/private"}}))
+
+	//written after the repository is added, so it is used without downloading
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(repositoryCache, "private-index.yaml"), []byte(`apiVersion: v1
+entries:
+  app:
+  - name: app
+    version: 1.1.0
+    appVersion: "2.1"
+  - name: app
+    version: 1.2.0-beta.1
+    appVersion: "2.2-beta"
+  - name: app
+    version: 1.0.0
+    appVersion: "2.0"
+`), 0644))
+
+	versions, err := ChartVersions("private/app", false)
+	assert.NoError(t, err)
+	if assert.Len(t, versions, 3) {
+		assert.Equal(t, "1.2.0-beta.1", versions[0].Version, "sorted newest first")
+		assert.Equal(t, "2.1", versions[1].AppVersion)
+	}
+	assert.Equal(t, "1.1.0", LatestVersion(versions).Version, "pre-releases are not the latest version")
+
+	_, err = ChartVersions("private/missing", false)
+	assert.EqualError(t, err, "chart missing not found in helm repository private")
+
+	_, err = ChartVersions("app", false)
+	assert.EqualError(t, err, "invalid chart app. Must be in the form repository/chart")
+}
+
+func TestIsNewerVersion(t *testing.T) {
+	tests := []struct {
+		candidate string
+		current   string
+		want      bool
+	}{
+		{candidate: "1.1.0", current: "1.0.0", want: true},
+		{candidate: "1.10.0", current: "1.9.0", want: true},
+		{candidate: "1.0.0", current: "1.0.0", want: false},
+		{candidate: "1.0.0", current: "1.1.0", want: false},
+		{candidate: "1.1.0", current: "1.2.0-beta.1", want: false},
+		{candidate: "1.2.0", current: "1.2.0-beta.1", want: true},
+		{candidate: "1.1.0", current: "v1.0.0", want: true},
+		{candidate: "1.1.0", current: "not-a-version", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.candidate+" over "+tt.current, func(t *testing.T) {
+			assert.Equal(t, tt.want, IsNewerVersion(tt.candidate, tt.current))
+		})
+	}
+}
@@ -2,12 +2,28 @@ package helm
 
 import (
 	"fmt"
+	"github.com/ruckstack/ruckstack/builder/internal/environment"
 	"github.com/ruckstack/ruckstack/common/ui"
-	"helm.sh/helm/v3/pkg/cli"
-	"helm.sh/helm/v3/pkg/getter"
+	"helm.sh/helm/v3/pkg/helmpath"
 	"helm.sh/helm/v3/pkg/repo"
+	"os"
+	"path/filepath"
+	"strings"
 )
 
+/**
+A chart repository configured by a project
+*/
+type Repository struct {
+	Name     string
+	Url      string
+	Username string
+	Password string
+}
+
+/**
+Adds a repository to the global configuration, which every project can use
+*/
 func AddRepository(repoName string, repoUrl string, username string, password string) error {
 	defer ui.StartProgressf("Adding new Helm repository %s", repoName).Stop()
 	ui.VPrintf("Adding helm repository %s as %s", repoUrl, repoName)
@@ -18,36 +34,40 @@ func AddRepository(repoName string, repoUrl string, username string, password st
 		Password: password,
 	}
 
-	repoConfig, err := openRepoConfig()
+	repoConfig, err := repo.LoadFile(globalRepoConfigYamlPath)
 	if err != nil {
 		return err
 	}
 
-	if repoConfig.Has(repoName) {
+	if existing := repoConfig.Get(repoName); existing != nil {
+		if !sameUrl(existing.URL, repoUrl) {
+			return fmt.Errorf("repository %s is already configured with a different URL: %s", repoName, existing.URL)
+		}
 		return fmt.Errorf("repository %s is already configured", repoName)
 	}
 
-	repoConfig.Add(newEntry)
-
-	chartRepository, err := repo.NewChartRepository(newEntry, getter.All(cli.New()))
-	if err != nil {
-		return err
+	if environment.Offline {
+		return fmt.Errorf("cannot add helm repository %s with --offline. Run `ruckstack fetch` first", repoName)
 	}
 
-	_, err = chartRepository.DownloadIndexFile()
-	if err != nil {
+	repoConfig.Add(newEntry)
+
+	if err := indexRepository(newEntry); err != nil {
 		return err
 	}
 
-	if err := repoConfig.WriteFile(repoConfigYamlPath, 0644); err != nil {
-		return fmt.Errorf("error writing %s: %s", repoConfigYamlPath, err)
+	if err := repoConfig.WriteFile(globalRepoConfigYamlPath, 0644); err != nil {
+		return fmt.Errorf("error writing %s: %s", globalRepoConfigYamlPath, err)
 	}
 
 	return nil
 }
 
+/**
+Removes a repository from the global configuration
+*/
 func RemoveRepository(repoName string) error {
-	repoConfig, err := openRepoConfig()
+	repoConfig, err := repo.LoadFile(globalRepoConfigYamlPath)
 	if err != nil {
 		return err
 	}
@@ -60,9 +80,101 @@ func RemoveRepository(repoName string) error {
 		ui.Printf("No repository named %s was found", repoName)
 	}
 
-	if err := repoConfig.WriteFile(repoConfigYamlPath, 0644); err != nil {
-		return fmt.Errorf("cannot write %s: %s", repoConfigYamlPath, err)
+	if err := repoConfig.WriteFile(globalRepoConfigYamlPath, 0644); err != nil {
+		return fmt.Errorf("cannot write %s: %s", globalRepoConfigYamlPath, err)
 	}
 
 	return nil
 }
+
+/**
+Returns the URL of the given configured repository
+*/
+func RepositoryUrl(repoName string) (string, error) {
+	repoConfig, err := openRepoConfig()
+	if err != nil {
+		return "", err
+	}
+
+	entry := repoConfig.Get(repoName)
+	if entry == nil {
+		return "", fmt.Errorf("no Helm repository named %s is configured", repoName)
+	}
+
+	return entry.URL, nil
+}
+
+/**
+Uses the global repositories plus the project's own for the rest of the run, without changing the global configuration.
+Fails if a project repository has the same name as a global one with a different URL, rather than using the wrong one.
+*/
+func UseProjectRepositories(projectId string, repositories []Repository) error {
+	downloadLock.Lock()
+	defer downloadLock.Unlock()
+
+	globalConfig, err := repo.LoadFile(globalRepoConfigYamlPath)
+	if err != nil {
+		return fmt.Errorf("cannot read %s: %s", globalRepoConfigYamlPath, err)
+	}
+
+	projectHome := environment.CachePath(filepath.Join("helm", "projects", projectId))
+	projectCache := filepath.Join(projectHome, "repository")
+	if err := os.MkdirAll(projectCache, 0755); err != nil {
+		return err
+	}
+
+	//the URLs used last time, without credentials, to know which indexes are out of date
+	indexedConfigPath := filepath.Join(projectHome, "repositories.yaml")
+	indexedConfig, err := repo.LoadFile(indexedConfigPath)
+	if err != nil {
+		indexedConfig = repo.NewFile()
+	}
+
+	projectConfig := repo.NewFile()
+	projectConfig.Add(globalConfig.Repositories...)
+	for _, repository := range repositories {
+		if global := globalConfig.Get(repository.Name); global != nil && !sameUrl(global.URL, repository.Url) {
+			return fmt.Errorf("helm repository %s is %s in the project but %s in the global configuration. Rename the project's repository or run `ruckstack helm repo remove --name %s`", repository.Name, repository.Url, global.URL, repository.Name)
+		}
+
+		projectConfig.Update(&repo.Entry{
+			Name:     repository.Name,
+			URL:      repository.Url,
+			Username: repository.Username,
+			Password: repository.Password,
+		})
+
+		if indexed := indexedConfig.Get(repository.Name); indexed == nil || !sameUrl(indexed.URL, repository.Url) {
+			ui.VPrintf("Helm repository %s is now %s. Removing its old index", repository.Name, repository.Url)
+			for _, indexFile := range []string{helmpath.CacheIndexFile(repository.Name), helmpath.CacheChartsFile(repository.Name)} {
+				if err := os.Remove(filepath.Join(projectCache, indexFile)); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+			}
+			indexedConfig.Update(&repo.Entry{Name: repository.Name, URL: repository.Url})
+		}
+	}
+
+	if err := indexedConfig.WriteFile(indexedConfigPath, 0644); err != nil {
+		return fmt.Errorf("cannot write %s: %s", indexedConfigPath, err)
+	}
+
+	//credentials are only kept in the temp directory, which is removed when ruckstack exits
+	projectConfigPath := environment.TempPath(filepath.Join("helm", projectId+"-repositories.yaml"))
+	if err := os.MkdirAll(filepath.Dir(projectConfigPath), 0700); err != nil {
+		return err
+	}
+	if err := projectConfig.WriteFile(projectConfigPath, 0600); err != nil {
+		return fmt.Errorf("cannot write %s: %s", projectConfigPath, err)
+	}
+
+	ui.VPrintf("Using helm repositories in %s", projectConfigPath)
+	repoConfigYamlPath = projectConfigPath
+	repositoryCache = projectCache
+
+	return nil
+}
+
+func sameUrl(url1 string, url2 string) bool {
+	return strings.TrimSuffix(url1, "/") == strings.TrimSuffix(url2, "/")
+}
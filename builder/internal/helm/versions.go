@@ -0,0 +1,89 @@
+package helm
+
+import (
+	"fmt"
+	"github.com/Masterminds/semver/v3"
+	"github.com/ruckstack/ruckstack/builder/internal/environment"
+	"helm.sh/helm/v3/pkg/helmpath"
+	"helm.sh/helm/v3/pkg/repo"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/**
+Returns the versions of the chart in its repository's index, newest first.
+The index is downloaded if it is missing, or if refresh is set and ruckstack is not --offline
+*/
+func ChartVersions(chart string, refresh bool) (repo.ChartVersions, error) {
+	downloadLock.Lock()
+	defer downloadLock.Unlock()
+
+	splitChart := strings.Split(chart, "/")
+	if len(splitChart) != 2 {
+		return nil, fmt.Errorf("invalid chart %s. Must be in the form repository/chart", chart)
+	}
+	repoName := splitChart[0]
+	chartName := splitChart[1]
+
+	repoFile, err := openRepoConfig()
+	if err != nil {
+		return nil, err
+	}
+	entry := repoFile.Get(repoName)
+	if entry == nil {
+		return nil, fmt.Errorf("no Helm repository named %s is configured. Add it to helmRepos in the project or with `ruckstack helm repo add`", repoName)
+	}
+
+	indexPath := filepath.Join(repositoryCache, helmpath.CacheIndexFile(repoName))
+	_, err = os.Stat(indexPath)
+	indexMissing := os.IsNotExist(err)
+	if indexMissing && environment.Offline {
+		return nil, fmt.Errorf("helm repository %s has not been indexed and cannot be with --offline", repoName)
+	}
+	if indexMissing || (refresh && !environment.Offline) {
+		if err := indexRepository(entry); err != nil {
+			return nil, err
+		}
+	}
+
+	index, err := repo.LoadIndexFile(indexPath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read index of helm repository %s: %s", repoName, err)
+	}
+
+	versions, found := index.Entries[chartName]
+	if !found || len(versions) == 0 {
+		return nil, fmt.Errorf("chart %s not found in helm repository %s", chartName, repoName)
+	}
+
+	return versions, nil
+}
+
+/**
+Returns the newest version that is not a pre-release, or the newest version if they all are
+*/
+func LatestVersion(versions repo.ChartVersions) *repo.ChartVersion {
+	for _, version := range versions {
+		parsed, err := semver.NewVersion(version.Version)
+		if err == nil && parsed.Prerelease() == "" {
+			return version
+		}
+	}
+	return versions[0]
+}
+
+/**
+Returns true if candidate is a newer version than current. Versions that are not semver are never newer
+*/
+func IsNewerVersion(candidate string, current string) bool {
+	candidateVersion, err := semver.NewVersion(candidate)
+	if err != nil {
+		return false
+	}
+	currentVersion, err := semver.NewVersion(current)
+	if err != nil {
+		return false
+	}
+	return candidateVersion.GreaterThan(currentVersion)
+}
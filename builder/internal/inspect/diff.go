@@ -0,0 +1,169 @@
+package inspect
+
+import (
+	"fmt"
+	"github.com/ruckstack/ruckstack/common/ui"
+	"sort"
+)
+
+/**
+Differences between two installers
+*/
+type Diff struct {
+	OldVersion string
+	NewVersion string
+
+	OldArchitecture string
+	NewArchitecture string
+
+	AddedFiles   []string
+	RemovedFiles []string
+	ChangedFiles []string
+
+	Images Changes
+	Charts Changes
+}
+
+/**
+Items added, removed, or changed between two installers. Values are "name" or "name version" descriptions
+*/
+type Changes struct {
+	Added   []string
+	Removed []string
+	Changed []string
+}
+
+/**
+Compares the contents of two installers. Files are compared by their hashes in the package config
+*/
+func Compare(oldInstaller *Installer, newInstaller *Installer) *Diff {
+	diff := &Diff{
+		OldVersion: oldInstaller.PackageConfig.Version,
+		NewVersion: newInstaller.PackageConfig.Version,
+
+		OldArchitecture: oldInstaller.PackageConfig.GetArchitecture(),
+		NewArchitecture: newInstaller.PackageConfig.GetArchitecture(),
+	}
+
+	diff.AddedFiles, diff.RemovedFiles, diff.ChangedFiles = compareMaps(oldInstaller.PackageConfig.Files, newInstaller.PackageConfig.Files)
+
+	added, removed, changed := compareMaps(imageDigests(oldInstaller), imageDigests(newInstaller))
+	diff.Images = Changes{
+		Added:   describe(added, imageDigests(newInstaller)),
+		Removed: describe(removed, imageDigests(oldInstaller)),
+	}
+	for _, tag := range changed {
+		diff.Images.Changed = append(diff.Images.Changed, fmt.Sprintf("%s %s -> %s", tag, imageDigests(oldInstaller)[tag], imageDigests(newInstaller)[tag]))
+	}
+
+	added, removed, changed = compareMaps(chartVersions(oldInstaller), chartVersions(newInstaller))
+	diff.Charts = Changes{
+		Added:   describe(added, chartVersions(newInstaller)),
+		Removed: describe(removed, chartVersions(oldInstaller)),
+	}
+	for _, name := range changed {
+		diff.Charts.Changed = append(diff.Charts.Changed, fmt.Sprintf("%s %s -> %s", name, chartVersions(oldInstaller)[name], chartVersions(newInstaller)[name]))
+	}
+
+	return diff
+}
+
+/**
+Returns each image's digest. Images without a recorded digest use their tag so they are only reported as added or removed
+*/
+func imageDigests(installer *Installer) map[string]string {
+	digests := map[string]string{}
+	for _, image := range installer.Images {
+		digests[image.Tag] = valueOrUnknown(image.Digest)
+	}
+	return digests
+}
+
+func chartVersions(installer *Installer) map[string]string {
+	versions := map[string]string{}
+	for _, chart := range installer.Charts {
+		versions[chart.Name] = chart.Version
+	}
+	return versions
+}
+
+/**
+Returns the sorted keys that were added, removed, or had their value changed
+*/
+func compareMaps(oldValues map[string]string, newValues map[string]string) (added []string, removed []string, changed []string) {
+	for key, newValue := range newValues {
+		oldValue, found := oldValues[key]
+		if !found {
+			added = append(added, key)
+		} else if oldValue != newValue {
+			changed = append(changed, key)
+		}
+	}
+	for key := range oldValues {
+		if _, found := newValues[key]; !found {
+			removed = append(removed, key)
+		}
+	}
+
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(changed)
+
+	return added, removed, changed
+}
+
+func describe(keys []string, values map[string]string) []string {
+	var descriptions []string
+	for _, key := range keys {
+		descriptions = append(descriptions, key+" "+values[key])
+	}
+	return descriptions
+}
+
+func (diff *Diff) IsEmpty() bool {
+	return len(diff.AddedFiles)+len(diff.RemovedFiles)+len(diff.ChangedFiles) == 0 &&
+		diff.Images.isEmpty() && diff.Charts.isEmpty()
+}
+
+func (changes Changes) isEmpty() bool {
+	return len(changes.Added)+len(changes.Removed)+len(changes.Changed) == 0
+}
+
+func (diff *Diff) Print() {
+	ui.Printf("Version: %s -> %s", diff.OldVersion, diff.NewVersion)
+	if diff.OldArchitecture != diff.NewArchitecture {
+		ui.Printf("Architecture: %s -> %s", diff.OldArchitecture, diff.NewArchitecture)
+	}
+	ui.Println()
+
+	if diff.IsEmpty() {
+		ui.Printf("No differences")
+		return
+	}
+
+	printChanges("Images", diff.Images)
+	printChanges("Charts", diff.Charts)
+	printChanges("Files", Changes{
+		Added:   diff.AddedFiles,
+		Removed: diff.RemovedFiles,
+		Changed: diff.ChangedFiles,
+	})
+}
+
+func printChanges(title string, changes Changes) {
+	if changes.isEmpty() {
+		return
+	}
+
+	ui.Printf("%s:", title)
+	for _, added := range changes.Added {
+		ui.Printf("    + %s", added)
+	}
+	for _, removed := range changes.Removed {
+		ui.Printf("    - %s", removed)
+	}
+	for _, changed := range changes.Changed {
+		ui.Printf("    ~ %s", changed)
+	}
+	ui.Println()
+}
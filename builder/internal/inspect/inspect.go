@@ -0,0 +1,409 @@
+package inspect
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"github.com/docker/go-units"
+	"github.com/ruckstack/ruckstack/builder/internal/sbom"
+	"github.com/ruckstack/ruckstack/common/config"
+	_ "github.com/ruckstack/ruckstack/common/global_util" //reads zstd compressed entries
+	"github.com/ruckstack/ruckstack/common/signature"
+	"github.com/ruckstack/ruckstack/common/ui"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const imagesDir = "data/agent/images/images.untar/"
+
+/**
+Contents of a built installer, read from the zip appended to the installer binary
+*/
+type Installer struct {
+	Path string
+	Size int64
+
+	PackageConfig *config.PackageConfig
+	SystemConfig  *config.SystemConfig
+
+	Images    []Image
+	Charts    []Chart
+	Manifests []File
+
+	//Sbom is the bill of materials embedded at build time. Nil for installers built before SBOMs were added
+	Sbom *sbom.Bom
+
+	//Signature is nil if the installer is not signed
+	Signature *signature.Signature
+
+	files map[string]*zip.File
+}
+
+type Image struct {
+	Tag    string
+	Digest string
+
+	//Size is the compressed size of the image's layers in the installer
+	Size int64
+}
+
+type Chart struct {
+	Path       string
+	Name       string
+	Version    string
+	AppVersion string
+
+	//Repository is the URL the chart was downloaded from, as recorded in the SBOM
+	Repository string
+}
+
+type File struct {
+	Path string
+	Size int64
+}
+
+/**
+Reads the given installer
+*/
+func Open(installerPath string) (*Installer, error) {
+	installerStat, err := os.Stat(installerPath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open %s: %s", installerPath, err)
+	}
+
+	zipReader, err := zip.OpenReader(installerPath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %s: %s", installerPath, err)
+	}
+	defer zipReader.Close()
+
+	installer := &Installer{
+		Path:  installerPath,
+		Size:  installerStat.Size(),
+		files: map[string]*zip.File{},
+	}
+
+	for _, zipFile := range zipReader.File {
+		installer.files[zipFile.Name] = zipFile
+	}
+
+	packageConfigFile := installer.files[".package.config"]
+	if packageConfigFile == nil {
+		return nil, fmt.Errorf("%s is not a ruckstack installer: cannot find .package.config", installerPath)
+	}
+	packageConfigReader, err := packageConfigFile.Open()
+	if err != nil {
+		return nil, fmt.Errorf("error reading .package.config: %s", err)
+	}
+	installer.PackageConfig, err = config.ReadPackageConfig(packageConfigReader)
+	_ = packageConfigReader.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	if systemConfigFile := installer.files["config/system.config"]; systemConfigFile != nil {
+		systemConfigReader, err := systemConfigFile.Open()
+		if err != nil {
+			return nil, fmt.Errorf("error reading system.config: %s", err)
+		}
+		installer.SystemConfig, err = config.ReadSystemConfig(systemConfigReader)
+		_ = systemConfigReader.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if sbomFile := installer.files[sbom.InstallerPath]; sbomFile != nil {
+		sbomReader, err := sbomFile.Open()
+		if err != nil {
+			return nil, fmt.Errorf("error reading SBOM: %s", err)
+		}
+		installer.Sbom, err = sbom.Read(sbomReader)
+		_ = sbomReader.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if signatureFile := installer.files[signature.InstallerPath]; signatureFile != nil {
+		signatureReader, err := signatureFile.Open()
+		if err != nil {
+			return nil, fmt.Errorf("error reading signature: %s", err)
+		}
+		installer.Signature, err = signature.Read(signatureReader)
+		_ = signatureReader.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := installer.readImages(); err != nil {
+		return nil, err
+	}
+	if err := installer.readCharts(); err != nil {
+		return nil, err
+	}
+
+	for _, filePath := range installer.FilePaths() {
+		if strings.HasPrefix(filePath, "data/server/manifests/") {
+			installer.Manifests = append(installer.Manifests, File{
+				Path: filePath,
+				Size: int64(installer.files[filePath].UncompressedSize64),
+			})
+		}
+	}
+
+	return installer, nil
+}
+
+/**
+Reads the images from the saved manifest.json. Layers shared between images count towards each image's size.
+*/
+func (installer *Installer) readImages() error {
+	manifestFile := installer.files[imagesDir+"manifest.json"]
+	if manifestFile == nil {
+		return nil
+	}
+
+	manifestReader, err := manifestFile.Open()
+	if err != nil {
+		return fmt.Errorf("error reading image manifest: %s", err)
+	}
+	defer manifestReader.Close()
+
+	var manifest []struct {
+		Config   string
+		RepoTags []string
+		Layers   []string
+	}
+	if err := json.NewDecoder(manifestReader).Decode(&manifest); err != nil {
+		return fmt.Errorf("error parsing image manifest: %s", err)
+	}
+
+	for _, entry := range manifest {
+		var size int64
+		for _, layer := range append([]string{entry.Config}, entry.Layers...) {
+			for _, layerPath := range []string{imagesDir + layer, imagesDir + layer + ".gz", imagesDir + layer + ".zst"} {
+				if layerFile := installer.files[layerPath]; layerFile != nil {
+					size += int64(layerFile.CompressedSize64)
+				}
+			}
+		}
+
+		for _, tag := range entry.RepoTags {
+			installer.Images = append(installer.Images, Image{
+				Tag:    tag,
+				Digest: installer.PackageConfig.Images[tag],
+				Size:   size,
+			})
+		}
+	}
+
+	sort.Slice(installer.Images, func(i, j int) bool {
+		return installer.Images[i].Tag < installer.Images[j].Tag
+	})
+
+	return nil
+}
+
+func (installer *Installer) readCharts() error {
+	for _, filePath := range installer.FilePaths() {
+		if !strings.HasPrefix(filePath, "data/server/static/charts/") || !strings.HasSuffix(filePath, ".tgz") {
+			continue
+		}
+
+		chartReader, err := installer.files[filePath].Open()
+		if err != nil {
+			return fmt.Errorf("error reading %s: %s", filePath, err)
+		}
+		loadedChart, err := loader.LoadArchive(chartReader)
+		_ = chartReader.Close()
+		if err != nil {
+			return fmt.Errorf("error loading chart %s: %s", filePath, err)
+		}
+
+		installer.Charts = append(installer.Charts, Chart{
+			Path:       filePath,
+			Name:       loadedChart.Metadata.Name,
+			Version:    loadedChart.Metadata.Version,
+			AppVersion: loadedChart.Metadata.AppVersion,
+			Repository: installer.chartRepository(loadedChart.Metadata.Name, loadedChart.Metadata.Version),
+		})
+	}
+
+	return nil
+}
+
+func (installer *Installer) chartRepository(chartName string, chartVersion string) string {
+	if installer.Sbom == nil {
+		return ""
+	}
+
+	for _, component := range installer.Sbom.Components {
+		if component.Property("ruckstack:type") == "helm-chart" && component.Name == chartName && component.Version == chartVersion {
+			for _, externalReference := range component.ExternalReferences {
+				return externalReference.Url
+			}
+		}
+	}
+	return ""
+}
+
+/**
+Returns the path of every file in the installer, sorted
+*/
+func (installer *Installer) FilePaths() []string {
+	var filePaths []string
+	for filePath := range installer.files {
+		if !strings.HasSuffix(filePath, "/") {
+			filePaths = append(filePaths, filePath)
+		}
+	}
+	sort.Strings(filePaths)
+
+	return filePaths
+}
+
+/**
+Returns the compressed size of the files in each category. The "installer" category is the installer binary and zip overhead.
+*/
+func (installer *Installer) SizeByCategory() map[string]int64 {
+	sizes := map[string]int64{}
+	var zippedSize int64
+	for _, filePath := range installer.FilePaths() {
+		size := int64(installer.files[filePath].CompressedSize64)
+		sizes[category(filePath)] += size
+		zippedSize += size
+	}
+	sizes["installer"] = installer.Size - zippedSize
+
+	return sizes
+}
+
+func category(filePath string) string {
+	switch {
+	case strings.HasPrefix(filePath, imagesDir):
+		return "images"
+	case strings.HasPrefix(filePath, "data/agent/images/"):
+		return "system images"
+	case strings.HasPrefix(filePath, "data/server/static/charts/"):
+		return "charts"
+	case strings.HasPrefix(filePath, "data/server/manifests/"):
+		return "manifests"
+	case strings.HasPrefix(filePath, "lib/") || strings.HasPrefix(filePath, "bin/"):
+		return "binaries"
+	case strings.HasPrefix(filePath, "data/web/"):
+		return "web"
+	case strings.HasPrefix(filePath, "config/") || path.Base(filePath) == ".package.config" || filePath == signature.InstallerPath:
+		return "config"
+	default:
+		return "other"
+	}
+}
+
+/**
+Prints a summary of the installer contents
+*/
+func (installer *Installer) Print() error {
+	packageConfig := installer.PackageConfig
+
+	output := tabwriter.NewWriter(ui.GetOutput(), 0, 4, 2, ' ', 0)
+	fmt.Fprintf(output, "Installer:\t%s\n", installer.Path)
+	fmt.Fprintf(output, "Package:\t%s (%s)\n", packageConfig.Name, packageConfig.Id)
+	fmt.Fprintf(output, "Version:\t%s\n", packageConfig.Version)
+	fmt.Fprintf(output, "Profile:\t%s\n", packageConfig.GetProfile())
+	fmt.Fprintf(output, "Architecture:\t%s\n", packageConfig.GetArchitecture())
+	fmt.Fprintf(output, "Build time:\t%s\n", time.Unix(packageConfig.BuildTime, 0).Format(time.RFC3339))
+	if packageConfig.DeltaBase != nil {
+		fmt.Fprintf(output, "Delta from:\t%s (built %s)\n", packageConfig.DeltaBase.Version, time.Unix(packageConfig.DeltaBase.BuildTime, 0).Format(time.RFC3339))
+	}
+	fmt.Fprintf(output, "K3s version:\t%s\n", valueOrUnknown(packageConfig.K3sVersion))
+	fmt.Fprintf(output, "Helm version:\t%s\n", valueOrUnknown(packageConfig.HelmVersion))
+	if installer.SystemConfig != nil {
+		fmt.Fprintf(output, "Manager:\t%s\n", installer.SystemConfig.ManagerFilename)
+	}
+	fmt.Fprintf(output, "Files:\t%d\n", len(installer.FilePaths()))
+	if installer.Signature != nil {
+		signedBy, err := installer.Signature.SignedBy()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(output, "Signed by:\t%s (%s)\n", signature.Fingerprint(signedBy), installer.Signature.Algorithm)
+	} else {
+		fmt.Fprintf(output, "Signed by:\tunsigned\n")
+	}
+	if installer.Sbom != nil {
+		fmt.Fprintf(output, "SBOM:\t%s %s, %d components\n", installer.Sbom.BomFormat, installer.Sbom.SpecVersion, len(installer.Sbom.Components))
+		for _, component := range installer.Sbom.ComponentsOfType(sbom.TypeApplication) {
+			if checksum := component.Hash(sbom.HashSha256); checksum != "" {
+				fmt.Fprintf(output, "%s checksum:\tsha256:%s\n", component.Name, checksum)
+			}
+		}
+	} else {
+		fmt.Fprintf(output, "SBOM:\tnone\n")
+	}
+	if err := output.Flush(); err != nil {
+		return err
+	}
+
+	ui.Println()
+	ui.Printf("Images:")
+	output = tabwriter.NewWriter(ui.GetOutput(), 0, 4, 2, ' ', 0)
+	for _, image := range installer.Images {
+		fmt.Fprintf(output, "    %s\t%s\t%s\n", image.Tag, valueOrUnknown(image.Digest), units.HumanSize(float64(image.Size)))
+	}
+	if err := output.Flush(); err != nil {
+		return err
+	}
+
+	ui.Println()
+	ui.Printf("Charts:")
+	output = tabwriter.NewWriter(ui.GetOutput(), 0, 4, 2, ' ', 0)
+	for _, chart := range installer.Charts {
+		fmt.Fprintf(output, "    %s\t%s\tapp %s\t%s\t%s\n", chart.Name, chart.Version, valueOrUnknown(chart.AppVersion), path.Base(chart.Path), chart.Repository)
+	}
+	if err := output.Flush(); err != nil {
+		return err
+	}
+
+	ui.Println()
+	ui.Printf("Manifests:")
+	output = tabwriter.NewWriter(ui.GetOutput(), 0, 4, 2, ' ', 0)
+	for _, manifest := range installer.Manifests {
+		fmt.Fprintf(output, "    %s\t%s\n", path.Base(manifest.Path), units.HumanSize(float64(manifest.Size)))
+	}
+	if err := output.Flush(); err != nil {
+		return err
+	}
+
+	ui.Println()
+	ui.Printf("Size:")
+	sizes := installer.SizeByCategory()
+	var categories []string
+	for category := range sizes {
+		categories = append(categories, category)
+	}
+	sort.Slice(categories, func(i, j int) bool {
+		return sizes[categories[i]] > sizes[categories[j]]
+	})
+
+	output = tabwriter.NewWriter(ui.GetOutput(), 0, 4, 2, ' ', 0)
+	for _, category := range categories {
+		fmt.Fprintf(output, "    %s\t%s\t%.1f%%\n", category, units.HumanSize(float64(sizes[category])), float64(sizes[category])*100/float64(installer.Size))
+	}
+	fmt.Fprintf(output, "    total\t%s\n", units.HumanSize(float64(installer.Size)))
+
+	return output.Flush()
+}
+
+func valueOrUnknown(value string) string {
+	if value == "" {
+		return "unknown"
+	}
+	return value
+}
@@ -0,0 +1,238 @@
+package inspect
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"github.com/ruckstack/ruckstack/builder/internal/environment"
+	"github.com/ruckstack/ruckstack/builder/internal/sbom"
+	"github.com/ruckstack/ruckstack/common/config"
+	"github.com/ruckstack/ruckstack/common/ui"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+/**
+Writes a fake installer: a stub "binary" followed by a zip of the given files with a matching package config
+*/
+func writeTestInstaller(t *testing.T, version string, images map[string]string, files map[string][]byte) string {
+	packageConfig := config.PackageConfig{
+		Id:          "test",
+		Name:        "Test Project",
+		Version:     version,
+		BuildTime:   1600000000,
+		K3sVersion:  "1.20.7+k3s1",
+		HelmVersion: "3.4.2",
+		Files:       map[string]string{},
+		Images:      images,
+	}
+
+	installerPath := environment.TempPath("test-*.installer")
+	installerFile, err := os.Create(installerPath)
+	require.NoError(t, err)
+	defer installerFile.Close()
+
+	stub := bytes.Repeat([]byte("installer"), 100)
+	_, err = installerFile.Write(stub)
+	require.NoError(t, err)
+
+	zipWriter := zip.NewWriter(installerFile)
+	zipWriter.SetOffset(int64(len(stub)))
+	for filePath, content := range files {
+		fileWriter, err := zipWriter.Create(filePath)
+		require.NoError(t, err)
+		_, err = fileWriter.Write(content)
+		require.NoError(t, err)
+
+		hash := sha1.Sum(content)
+		packageConfig.Files[filePath] = hex.EncodeToString(hash[:])
+	}
+
+	packageConfigContent, err := yaml.Marshal(packageConfig)
+	require.NoError(t, err)
+	fileWriter, err := zipWriter.Create(".package.config")
+	require.NoError(t, err)
+	_, err = fileWriter.Write(packageConfigContent)
+	require.NoError(t, err)
+
+	fileWriter, err = zipWriter.Create("config/system.config")
+	require.NoError(t, err)
+	_, err = fileWriter.Write([]byte("managerFilename: test\n"))
+	require.NoError(t, err)
+
+	require.NoError(t, zipWriter.Close())
+
+	return installerPath
+}
+
+func testChart(t *testing.T, version string) []byte {
+	chartDir, err := ioutil.TempDir(environment.TempPath(""), "chart-")
+	require.NoError(t, err)
+
+	chartPath, err := chartutil.Save(&chart.Chart{
+		Metadata: &chart.Metadata{
+			APIVersion: chart.APIVersionV2,
+			Name:       "test-chart",
+			Version:    version,
+			AppVersion: "5.6",
+		},
+	}, chartDir)
+	require.NoError(t, err)
+
+	content, err := ioutil.ReadFile(chartPath)
+	require.NoError(t, err)
+	return content
+}
+
+func testSbom(t *testing.T) []byte {
+	bom := sbom.New()
+	bom.Components = []sbom.Component{
+		{
+			Type:               sbom.TypeApplication,
+			Name:               "test-chart",
+			Version:            "1.2.3",
+			ExternalReferences: []sbom.ExternalReference{{Type: "distribution", Url: "https://charts.example.com"}},
+			Properties:         []sbom.Property{{Name: "ruckstack:type", Value: "helm-chart"}},
+		},
+		{
+			Type:    sbom.TypeApplication,
+			Name:    "k3s",
+			Version: "1.20.7+k3s1",
+			Hashes:  []sbom.Hash{{Alg: sbom.HashSha256, Content: "abc123"}},
+		},
+	}
+
+	content := new(bytes.Buffer)
+	require.NoError(t, bom.Write(content))
+	return content.Bytes()
+}
+
+const testImagesManifest = `[
+  {"Config": "config1.json", "RepoTags": ["nginx:1.19"], "Layers": ["layer1/layer.tar", "layer2/layer.tar"]},
+  {"Config": "config2.json", "RepoTags": ["redis:6"], "Layers": ["layer2/layer.tar"]}
+]`
+
+func TestOpen(t *testing.T) {
+	installerPath := writeTestInstaller(t, "1.0.0", map[string]string{"nginx:1.19": "sha256:aaa"}, map[string][]byte{
+		"data/agent/images/images.untar/manifest.json":       []byte(testImagesManifest),
+		"data/agent/images/images.untar/config1.json":        []byte("{}"),
+		"data/agent/images/images.untar/config2.json":        []byte("{}"),
+		"data/agent/images/images.untar/layer1/layer.tar.gz": bytes.Repeat([]byte("1"), 1000),
+		"data/agent/images/images.untar/layer2/layer.tar.gz": bytes.Repeat([]byte("2"), 1000),
+		"data/server/static/charts/test-service-abc123.tgz":  testChart(t, "1.2.3"),
+		"data/server/manifests/test-service.yaml":            []byte("kind: HelmChart\n"),
+		"lib/k3s":                               bytes.Repeat([]byte("k"), 500),
+		"data/agent/images/k3s.tar":             bytes.Repeat([]byte("s"), 500),
+		"data/web/ops/img/public/site-down.png": []byte("png"),
+		"bin/test":                              []byte("system-control"),
+		"data/server/static/charts/unrelated-file-not-a-chart": []byte("ignored"),
+		"data/other.md": []byte("other"),
+		".sbom.json":    testSbom(t),
+	})
+
+	installer, err := Open(installerPath)
+	require.NoError(t, err)
+
+	assert.Equal(t, "1.0.0", installer.PackageConfig.Version)
+	assert.Equal(t, "1.20.7+k3s1", installer.PackageConfig.K3sVersion)
+	assert.Equal(t, "test", installer.SystemConfig.ManagerFilename)
+
+	require.Len(t, installer.Images, 2)
+	assert.Equal(t, "nginx:1.19", installer.Images[0].Tag)
+	assert.Equal(t, "sha256:aaa", installer.Images[0].Digest)
+	assert.Equal(t, "redis:6", installer.Images[1].Tag)
+	assert.Equal(t, "", installer.Images[1].Digest)
+	assert.Greater(t, installer.Images[0].Size, installer.Images[1].Size)
+
+	assert.Equal(t, []Chart{{Path: "data/server/static/charts/test-service-abc123.tgz", Name: "test-chart", Version: "1.2.3", AppVersion: "5.6", Repository: "https://charts.example.com"}}, installer.Charts)
+	assert.Equal(t, []File{{Path: "data/server/manifests/test-service.yaml", Size: 16}}, installer.Manifests)
+
+	sizes := installer.SizeByCategory()
+	for _, category := range []string{"images", "system images", "charts", "manifests", "binaries", "web", "config", "other", "installer"} {
+		assert.Greater(t, sizes[category], int64(0), category)
+	}
+	var total int64
+	for _, size := range sizes {
+		total += size
+	}
+	assert.Equal(t, installer.Size, total)
+
+	output := new(bytes.Buffer)
+	ui.SetOutput(output)
+	defer ui.SetOutput(os.Stdout)
+
+	require.NoError(t, installer.Print())
+	assert.Contains(t, output.String(), "Test Project (test)")
+	assert.Contains(t, output.String(), "nginx:1.19")
+	assert.Contains(t, output.String(), "test-chart")
+	assert.Contains(t, output.String(), "test-service.yaml")
+	assert.Contains(t, output.String(), "system images")
+	assert.Contains(t, output.String(), "CycloneDX 1.4, 2 components")
+	assert.Contains(t, output.String(), "k3s checksum:  sha256:abc123")
+}
+
+func TestOpen_NotAnInstaller(t *testing.T) {
+	_, err := Open("invalid.installer")
+	assert.Error(t, err)
+
+	zipPath := environment.TempPath("test-*.zip")
+	zipFile, err := os.Create(zipPath)
+	require.NoError(t, err)
+	require.NoError(t, zip.NewWriter(zipFile).Close())
+	require.NoError(t, zipFile.Close())
+
+	_, err = Open(zipPath)
+	assert.Contains(t, err.Error(), "is not a ruckstack installer")
+}
+
+func TestCompare(t *testing.T) {
+	oldInstaller, err := Open(writeTestInstaller(t, "1.0.0", map[string]string{"nginx:1.19": "sha256:aaa", "redis:6": "sha256:bbb"}, map[string][]byte{
+		"data/agent/images/images.untar/manifest.json":      []byte(testImagesManifest),
+		"data/server/static/charts/test-service-abc123.tgz": testChart(t, "1.2.3"),
+		"lib/k3s":         []byte("k3s"),
+		"bin/test":        []byte("old"),
+		"data/removed.md": []byte("removed"),
+	}))
+	require.NoError(t, err)
+
+	newInstaller, err := Open(writeTestInstaller(t, "1.1.0", map[string]string{"nginx:1.19": "sha256:ccc", "postgres:13": "sha256:ddd"}, map[string][]byte{
+		"data/agent/images/images.untar/manifest.json": []byte(`[
+  {"Config": "config1.json", "RepoTags": ["nginx:1.19"], "Layers": []},
+  {"Config": "config3.json", "RepoTags": ["postgres:13"], "Layers": []}
+]`),
+		"data/server/static/charts/test-service-def456.tgz": testChart(t, "1.3.0"),
+		"lib/k3s":       []byte("k3s"),
+		"bin/test":      []byte("new"),
+		"data/added.md": []byte("added"),
+	}))
+	require.NoError(t, err)
+
+	diff := Compare(oldInstaller, newInstaller)
+	assert.Equal(t, "1.0.0", diff.OldVersion)
+	assert.Equal(t, "1.1.0", diff.NewVersion)
+	assert.Equal(t, "amd64", diff.OldArchitecture)
+	assert.Equal(t, "amd64", diff.NewArchitecture)
+
+	assert.Equal(t, []string{"data/added.md", "data/server/static/charts/test-service-def456.tgz"}, diff.AddedFiles)
+	assert.Equal(t, []string{"data/removed.md", "data/server/static/charts/test-service-abc123.tgz"}, diff.RemovedFiles)
+	assert.Equal(t, []string{"bin/test", "data/agent/images/images.untar/manifest.json"}, diff.ChangedFiles)
+
+	assert.Equal(t, Changes{
+		Added:   []string{"postgres:13 sha256:ddd"},
+		Removed: []string{"redis:6 sha256:bbb"},
+		Changed: []string{"nginx:1.19 sha256:aaa -> sha256:ccc"},
+	}, diff.Images)
+	assert.Equal(t, Changes{
+		Changed: []string{"test-chart 1.2.3 -> 1.3.0"},
+	}, diff.Charts)
+	assert.False(t, diff.IsEmpty())
+
+	assert.True(t, Compare(oldInstaller, oldInstaller).IsEmpty())
+}
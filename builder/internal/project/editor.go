@@ -0,0 +1,93 @@
+package project
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+/**
+Sets the version of the helm service in the project file.
+Only the version is changed, so comments and formatting in the rest of the file are kept
+*/
+func SetHelmServiceVersion(projectPath string, serviceId string, version string) error {
+	content, err := ioutil.ReadFile(projectPath)
+	if err != nil {
+		return fmt.Errorf("cannot read %s: %s", projectPath, err)
+	}
+
+	var document yaml.Node
+	if err := yaml.Unmarshal(content, &document); err != nil {
+		return fmt.Errorf("error parsing %s: %s", projectPath, err)
+	}
+
+	versionNode := findHelmServiceVersion(&document, serviceId)
+	if versionNode == nil {
+		return fmt.Errorf("no helm service %s with a version in %s", serviceId, projectPath)
+	}
+
+	var oldToken, newToken string
+	switch versionNode.Style {
+	case yaml.DoubleQuotedStyle:
+		oldToken, newToken = `"`+versionNode.Value+`"`, `"`+version+`"`
+	case yaml.SingleQuotedStyle:
+		oldToken, newToken = "'"+versionNode.Value+"'", "'"+version+"'"
+	default:
+		oldToken, newToken = versionNode.Value, version
+	}
+
+	lines := strings.Split(string(content), "\n")
+	line := lines[versionNode.Line-1]
+	column := versionNode.Column - 1
+	if column > len(line) || !strings.HasPrefix(line[column:], oldToken) {
+		return fmt.Errorf("cannot update the version of %s on line %d of %s. Edit it manually", serviceId, versionNode.Line, projectPath)
+	}
+	lines[versionNode.Line-1] = line[:column] + newToken + line[column+len(oldToken):]
+
+	fileInfo, err := os.Stat(projectPath)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(projectPath, []byte(strings.Join(lines, "\n")), fileInfo.Mode()); err != nil {
+		return fmt.Errorf("cannot write %s: %s", projectPath, err)
+	}
+
+	return nil
+}
+
+/**
+Returns the node containing the version of the given helm service, or nil if there is none
+*/
+func findHelmServiceVersion(document *yaml.Node, serviceId string) *yaml.Node {
+	if len(document.Content) == 0 {
+		return nil
+	}
+
+	helmServices := mappingValue(document.Content[0], "helmServices")
+	if helmServices == nil || helmServices.Kind != yaml.SequenceNode {
+		return nil
+	}
+
+	for _, helmService := range helmServices.Content {
+		id := mappingValue(helmService, "id")
+		if id != nil && id.Value == serviceId {
+			return mappingValue(helmService, "version")
+		}
+	}
+
+	return nil
+}
+
+func mappingValue(mapping *yaml.Node, key string) *yaml.Node {
+	if mapping.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+	return nil
+}
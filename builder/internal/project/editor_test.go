@@ -0,0 +1,81 @@
+package project
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestSetHelmServiceVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		project string
+		want    string
+		wantErr string
+	}{
+		{
+			name: "Plain version keeps comments",
+			project: `id: test
+# charts from the stable repository
+helmServices:
+  - id: other
+    chart: stable/other
+    version: 1.0.0
+  - id: cache
+    chart: stable/redis
+    version: 10.5.7 # pinned for the cluster api
+`,
+			want: `id: test
+# charts from the stable repository
+helmServices:
+  - id: other
+    chart: stable/other
+    version: 1.0.0
+  - id: cache
+    chart: stable/redis
+    version: 10.6.0 # pinned for the cluster api
+`,
+		},
+		{
+			name: "Quoted version keeps quotes",
+			project: `helmServices:
+  - id: cache
+    version: "10.5.7"
+    chart: stable/redis
+`,
+			want: `helmServices:
+  - id: cache
+    version: "10.6.0"
+    chart: stable/redis
+`,
+		},
+		{
+			name: "Unknown service fails",
+			project: `helmServices:
+  - id: other
+    version: 1.0.0
+`,
+			wantErr: "no helm service cache with a version in ",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			projectPath := filepath.Join(t.TempDir(), "ruckstack.yaml")
+			assert.NoError(t, ioutil.WriteFile(projectPath, []byte(tt.project), 0644))
+
+			err := SetHelmServiceVersion(projectPath, "cache", "10.6.0")
+			if tt.wantErr != "" {
+				if assert.Error(t, err) {
+					assert.Contains(t, err.Error(), tt.wantErr)
+				}
+				return
+			}
+
+			assert.NoError(t, err)
+			content, err := ioutil.ReadFile(projectPath)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, string(content))
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package project
+
+import (
+	"fmt"
+	"github.com/Masterminds/semver/v3"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+/**
+The commit a project is built from
+*/
+type GitInfo struct {
+	Commit string
+
+	//Dirty is set when the working tree has uncommitted changes, so the build does not exactly match Commit
+	Dirty bool
+}
+
+/**
+Returns the commit checked out in the directory, or nil if it is not in a git repository or git is not installed
+*/
+func ReadGitInfo(dir string) *GitInfo {
+	commit, err := runGit(dir, "rev-parse", "HEAD")
+	if err != nil {
+		return nil
+	}
+
+	status, err := runGit(dir, "status", "--porcelain", "--untracked-files=no")
+	if err != nil {
+		return nil
+	}
+
+	return &GitInfo{
+		Commit: commit,
+		Dirty:  status != "",
+	}
+}
+
+/**
+Derives a version from the nearest tag and the number of commits since it.
+A tagged commit uses the tag's version, such as 1.2.3 for v1.2.3.
+Later commits use the next patch version as a pre-release, such as 1.2.4-dev.5.g1a2b3c4 five commits after v1.2.3, so they sort between the two releases
+*/
+func GitVersion(dir string) (string, error) {
+	describe, err := runGit(dir, "describe", "--tags", "--long", "--abbrev=7")
+	if err != nil {
+		return "", fmt.Errorf("cannot derive the version from git: %s. Tag a commit with a version such as v1.0.0", err)
+	}
+
+	return versionFromDescribe(describe)
+}
+
+/**
+Converts `git describe --long` output such as v1.2.3-5-g1a2b3c4 to a version
+*/
+func versionFromDescribe(describe string) (string, error) {
+	//the tag may contain dashes, so split from the end
+	hashStart := strings.LastIndex(describe, "-")
+	if hashStart < 0 {
+		return "", fmt.Errorf("unexpected git describe output %s", describe)
+	}
+	distanceStart := strings.LastIndex(describe[:hashStart], "-")
+	if distanceStart < 0 {
+		return "", fmt.Errorf("unexpected git describe output %s", describe)
+	}
+	tag := describe[:distanceStart]
+	hash := describe[hashStart+1:]
+	distance, err := strconv.Atoi(describe[distanceStart+1 : hashStart])
+	if err != nil {
+		return "", fmt.Errorf("unexpected git describe output %s", describe)
+	}
+
+	tagVersion, err := semver.StrictNewVersion(strings.TrimPrefix(tag, "v"))
+	if err != nil {
+		return "", fmt.Errorf("tag %s is not a semantic version such as v1.2.3", tag)
+	}
+
+	if distance == 0 {
+		return tagVersion.String(), nil
+	}
+
+	if tagVersion.Prerelease() != "" {
+		//1.0.0-rc.1.dev.5 sorts after 1.0.0-rc.1 and before 1.0.0-rc.2
+		return fmt.Sprintf("%s.dev.%d.%s", tagVersion.String(), distance, hash), nil
+	}
+	return fmt.Sprintf("%s-dev.%d.%s", tagVersion.IncPatch().String(), distance, hash), nil
+}
+
+func runGit(dir string, args ...string) (string, error) {
+	command := exec.Command("git", args...)
+	command.Dir = dir
+	output, err := command.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) > 0 {
+			return "", fmt.Errorf("%s", strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return "", err
+	}
+	return strings.TrimSpace(string(output)), nil
+}
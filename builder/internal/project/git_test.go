@@ -0,0 +1,94 @@
+package project
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func Test_versionFromDescribe(t *testing.T) {
+	tests := []struct {
+		describe string
+		want     string
+		wantErr  string
+	}{
+		{describe: "v1.2.3-0-g1a2b3c4", want: "1.2.3"},
+		{describe: "1.2.3-0-g1a2b3c4", want: "1.2.3"},
+		{describe: "v1.2.3-5-g1a2b3c4", want: "1.2.4-dev.5.g1a2b3c4"},
+		{describe: "v2.0.0-rc.1-3-g1a2b3c4", want: "2.0.0-rc.1.dev.3.g1a2b3c4"},
+		{describe: "release-one-0-g1a2b3c4", wantErr: "tag release-one is not a semantic version such as v1.2.3"},
+		{describe: "g1a2b3c4", wantErr: "unexpected git describe output g1a2b3c4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.describe, func(t *testing.T) {
+			got, err := versionFromDescribe(tt.describe)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.want, got)
+			}
+		})
+	}
+}
+
+func TestParse_GitVersion(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	projectDir := t.TempDir()
+	projectPath := filepath.Join(projectDir, "ruckstack.yaml")
+	assert.NoError(t, ioutil.WriteFile(projectPath, []byte(`id: git-project
+name: Git Project
+version: git
+dockerfileServices:
+  - id: web
+    dockerfile: Dockerfile
+`), 0644))
+
+	_, err := Parse(projectPath)
+	assert.EqualError(t, err, "project version is git but "+projectDir+" is not in a git repository")
+
+	git := func(args ...string) {
+		command := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		command.Dir = projectDir
+		output, err := command.CombinedOutput()
+		assert.NoError(t, err, string(output))
+	}
+	git("init", "-q")
+	git("add", "ruckstack.yaml")
+	git("commit", "-q", "-m", "initial")
+
+	_, err = Parse(projectPath)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Tag a commit with a version such as v1.0.0")
+	}
+
+	git("tag", "v1.0.0")
+	projectConfig, err := Parse(projectPath)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "1.0.0", projectConfig.Version)
+		assert.Equal(t, "1.0.0", projectConfig.DockerfileServices[0].ServiceVersion)
+		assert.Len(t, projectConfig.Git.Commit, 40)
+		assert.False(t, projectConfig.Git.Dirty)
+	}
+
+	git("commit", "-q", "--allow-empty", "-m", "second")
+	assert.NoError(t, ioutil.WriteFile(projectPath, []byte(`id: git-project
+name: Git Project
+version: git
+dockerfileServices:
+  - id: web
+    dockerfile: Dockerfile
+    serviceVersion: 3.0.0
+`), 0644))
+	projectConfig, err = Parse(projectPath)
+	if assert.NoError(t, err) {
+		assert.Regexp(t, `^1\.0\.1-dev\.1\.g[0-9a-f]{7}$`, projectConfig.Version)
+		assert.Equal(t, "3.0.0", projectConfig.DockerfileServices[0].ServiceVersion)
+		assert.True(t, projectConfig.Git.Dirty)
+	}
+}
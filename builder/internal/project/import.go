@@ -0,0 +1,269 @@
+package project
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"github.com/ruckstack/ruckstack/builder/internal/environment"
+	"github.com/ruckstack/ruckstack/builder/internal/project/service"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+/**
+Another Ruckstack project whose services, helm repositories and proxies are merged into this one
+*/
+type ImportConfig struct {
+	//Path is the imported project's directory, relative to this project. If Git is set, it is relative to the root of the repository
+	Path string
+
+	//Git is the URL of a git repository containing the project
+	Git string
+
+	//Ref is the branch, tag or commit to check out from Git. Defaults to the repository's default branch
+	Ref string
+
+	//Prefix is added to the ids of the imported services, so the auth service imported with prefix platform becomes platform-auth
+	Prefix string
+}
+
+/**
+Describes where the import comes from for messages
+*/
+func (importConfig ImportConfig) source() string {
+	if importConfig.Git == "" {
+		return importConfig.Path
+	}
+
+	source := importConfig.Git
+	if importConfig.Ref != "" {
+		source += "@" + importConfig.Ref
+	}
+	if importConfig.Path != "" {
+		source += "/" + importConfig.Path
+	}
+	return source
+}
+
+func (importConfig ImportConfig) validate() error {
+	if importConfig.Path == "" && importConfig.Git == "" {
+		return fmt.Errorf("import must set path or git")
+	}
+	if importConfig.Ref != "" && importConfig.Git == "" {
+		return fmt.Errorf("import %s sets ref without git", importConfig.source())
+	}
+	if importConfig.Git == "" && filepath.IsAbs(importConfig.Path) {
+		return fmt.Errorf("import path %s must be relative to the project root", importConfig.Path)
+	}
+
+	matched, _ := regexp.MatchString(`^[a-z0-9-]+$`, importConfig.Prefix)
+	if !matched {
+		return fmt.Errorf("import %s must set a prefix that is lower case, alphanumeric and dashes", importConfig.source())
+	}
+
+	return nil
+}
+
+/**
+Returns the directory containing the imported project, checking it out of git if needed
+*/
+func (importConfig ImportConfig) directory(projectDir string) (string, error) {
+	if importConfig.Git == "" {
+		return filepath.Join(projectDir, importConfig.Path), nil
+	}
+
+	//each ref gets its own checkout, so imports of different refs of the same repository do not conflict
+	key := sha1.Sum([]byte(importConfig.Git + "\n" + importConfig.Ref))
+	checkoutDir := environment.CachePath(filepath.Join("imports", hex.EncodeToString(key[:])[:16]))
+
+	if _, err := os.Stat(checkoutDir); os.IsNotExist(err) {
+		if environment.Offline {
+			return "", fmt.Errorf("import %s has not been downloaded and cannot be with --offline. Run `ruckstack fetch` first", importConfig.source())
+		}
+		if _, err := runGit("", "clone", "--quiet", importConfig.Git, checkoutDir); err != nil {
+			_ = os.RemoveAll(checkoutDir)
+			return "", fmt.Errorf("cannot clone %s: %s", importConfig.Git, err)
+		}
+	} else if !environment.Offline && !importConfig.pinned(checkoutDir) {
+		if _, err := runGit(checkoutDir, "fetch", "--quiet", "--tags", "origin"); err != nil {
+			return "", fmt.Errorf("cannot fetch %s: %s", importConfig.Git, err)
+		}
+	}
+
+	//branches are checked out from the remote, so fetched changes are used
+	target := "origin/HEAD"
+	if importConfig.Ref != "" {
+		target = importConfig.Ref
+		if _, err := runGit(checkoutDir, "rev-parse", "--verify", "--quiet", "refs/remotes/origin/"+importConfig.Ref); err == nil {
+			target = "origin/" + importConfig.Ref
+		}
+	}
+	if _, err := runGit(checkoutDir, "checkout", "--quiet", "--detach", target); err != nil {
+		return "", fmt.Errorf("cannot check out %s: %s", importConfig.source(), err)
+	}
+
+	return filepath.Join(checkoutDir, importConfig.Path), nil
+}
+
+/**
+Returns true if the ref is a tag or commit already in the checkout, which never needs fetching again
+*/
+func (importConfig ImportConfig) pinned(checkoutDir string) bool {
+	if importConfig.Ref == "" {
+		return false
+	}
+	if _, err := runGit(checkoutDir, "rev-parse", "--verify", "--quiet", "refs/tags/"+importConfig.Ref); err == nil {
+		return true
+	}
+	commit, err := runGit(checkoutDir, "rev-parse", "--verify", "--quiet", importConfig.Ref+"^{commit}")
+	return err == nil && strings.HasPrefix(commit, importConfig.Ref)
+}
+
+/**
+Parses each imported project and merges its services, helm repositories and proxies into this one.
+Imported services are prefixed and their files are made relative to this project's directory
+*/
+func (project *Project) mergeImports(projectDir string, importedBy []string) error {
+	absProjectDir, err := filepath.Abs(projectDir)
+	if err != nil {
+		return err
+	}
+	importChain := append(importedBy[:len(importedBy):len(importedBy)], absProjectDir)
+
+	for _, importConfig := range project.Imports {
+		if err := importConfig.validate(); err != nil {
+			return err
+		}
+
+		importDir, err := importConfig.directory(projectDir)
+		if err != nil {
+			return err
+		}
+		absImportDir, err := filepath.Abs(importDir)
+		if err != nil {
+			return err
+		}
+		for _, chainDir := range importChain {
+			if chainDir == absImportDir {
+				return fmt.Errorf("import cycle: %s imports %s", strings.Join(importChain, " imports "), absImportDir)
+			}
+		}
+
+		imported, err := parse(filepath.Join(importDir, "ruckstack.yaml"), importChain)
+		if err != nil {
+			return fmt.Errorf("error importing %s: %s", importConfig.source(), err)
+		}
+
+		pathBase, err := filepath.Rel(absProjectDir, absImportDir)
+		if err != nil {
+			return err
+		}
+		if err := project.merge(imported, importConfig, pathBase); err != nil {
+			return fmt.Errorf("error importing %s: %s", importConfig.source(), err)
+		}
+	}
+
+	return nil
+}
+
+/**
+Adds the imported project's services, helm repositories and proxies. pathBase is the imported project's directory relative to this one
+*/
+func (project *Project) merge(imported *Project, importConfig ImportConfig, pathBase string) error {
+	rebase := func(path string) string {
+		if filepath.IsAbs(path) {
+			return path
+		}
+		return filepath.Join(pathBase, path)
+	}
+	prefix := func(id string) string {
+		return importConfig.Prefix + "-" + id
+	}
+
+	importedIds := map[string]bool{}
+	for _, serviceConfig := range imported.GetServices() {
+		importedIds[serviceConfig.GetId()] = true
+		if project.hasService(prefix(serviceConfig.GetId())) {
+			return fmt.Errorf("service %s is already defined in the project", prefix(serviceConfig.GetId()))
+		}
+	}
+
+	for _, serviceConfig := range imported.ManifestServices {
+		serviceConfig.Id = prefix(serviceConfig.Id)
+		serviceConfig.Manifest = rebase(serviceConfig.Manifest)
+		project.ManifestServices = append(project.ManifestServices, serviceConfig)
+	}
+
+	for _, serviceConfig := range imported.HelmServices {
+		serviceConfig.Id = prefix(serviceConfig.Id)
+		project.HelmServices = append(project.HelmServices, serviceConfig)
+	}
+
+	for _, serviceConfig := range imported.DockerfileServices {
+		serviceConfig.Id = prefix(serviceConfig.Id)
+		serviceConfig.Dockerfile = rebase(serviceConfig.Dockerfile)
+
+		var secrets []service.DockerfileServiceBuildSecret
+		for _, secret := range serviceConfig.BuildKit.Secrets {
+			if secret.File != "" {
+				secret.File = rebase(secret.File)
+			}
+			secrets = append(secrets, secret)
+		}
+		serviceConfig.BuildKit.Secrets = secrets
+
+		var sshAgents []service.DockerfileServiceBuildSsh
+		for _, ssh := range serviceConfig.BuildKit.Ssh {
+			var paths []string
+			for _, path := range ssh.Paths {
+				paths = append(paths, rebase(path))
+			}
+			ssh.Paths = paths
+			sshAgents = append(sshAgents, ssh)
+		}
+		serviceConfig.BuildKit.Ssh = sshAgents
+
+		project.DockerfileServices = append(project.DockerfileServices, serviceConfig)
+	}
+
+	for _, helmRepo := range imported.HelmRepos {
+		if helmRepo.PasswordFile != "" {
+			helmRepo.PasswordFile = rebase(helmRepo.PasswordFile)
+		}
+
+		duplicate := false
+		for _, existing := range project.HelmRepos {
+			if existing.Name != helmRepo.Name {
+				continue
+			}
+			if strings.TrimSuffix(existing.Url, "/") != strings.TrimSuffix(helmRepo.Url, "/") {
+				return fmt.Errorf("helm repository %s is %s in the import but %s in the project", helmRepo.Name, helmRepo.Url, existing.Url)
+			}
+			duplicate = true
+		}
+		if !duplicate {
+			project.HelmRepos = append(project.HelmRepos, helmRepo)
+		}
+	}
+
+	for _, proxyConfig := range imported.Proxy {
+		for _, existing := range project.Proxy {
+			if existing.Port == proxyConfig.Port {
+				return fmt.Errorf("proxy port %d is already used by the project", proxyConfig.Port)
+			}
+		}
+
+		//helm and dockerfile services name their Kubernetes services after the service id, which is now prefixed
+		for id := range importedIds {
+			if proxyConfig.ServiceName == id || strings.HasPrefix(proxyConfig.ServiceName, id+"-") {
+				proxyConfig.ServiceName = prefix(proxyConfig.ServiceName)
+				break
+			}
+		}
+		project.Proxy = append(project.Proxy, proxyConfig)
+	}
+
+	return nil
+}
@@ -0,0 +1,245 @@
+package project
+
+import (
+	"github.com/ruckstack/ruckstack/builder/internal/environment"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var platformProject = `id: platform
+name: Platform
+version: 2.0.0
+helmRepos:
+  - name: bitnami
+    url: https://charts.bitnami.com/bitnami
+proxy:
+  - serviceName: web
+    port: 443
+manifestServices:
+  - id: auth
+    manifest: auth.yaml
+helmServices:
+  - id: queue
+    chart: bitnami/rabbitmq
+    version: 8.6.1
+dockerfileServices:
+  - id: web
+    dockerfile: web/Dockerfile
+    http:
+      containerPort: 8080
+      pathPrefix: /platform
+`
+
+func writeProjects(t *testing.T, projects map[string]string) string {
+	rootDir := t.TempDir()
+	for dir, content := range projects {
+		require.NoError(t, os.MkdirAll(filepath.Join(rootDir, dir), 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(rootDir, dir, "ruckstack.yaml"), []byte(content), 0644))
+	}
+	return rootDir
+}
+
+func TestParse_Import(t *testing.T) {
+	rootDir := writeProjects(t, map[string]string{
+		"platform": platformProject,
+		"product": `id: product
+name: Product
+version: 1.0.0
+import:
+  - path: ../platform
+    prefix: platform
+helmRepos:
+  - name: bitnami
+    url: https://charts.bitnami.com/bitnami/
+manifestServices:
+  - id: app
+    manifest: app.yaml
+`,
+	})
+
+	projectConfig, err := Parse(filepath.Join(rootDir, "product", "ruckstack.yaml"))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	var serviceIds []string
+	for _, serviceConfig := range projectConfig.GetServices() {
+		serviceIds = append(serviceIds, serviceConfig.GetId())
+	}
+	assert.Equal(t, []string{"app", "platform-auth", "platform-queue", "platform-web"}, serviceIds)
+
+	assert.Equal(t, filepath.Join("..", "platform", "auth.yaml"), projectConfig.ManifestServices[1].Manifest)
+	assert.Equal(t, filepath.Join("..", "platform", "web", "Dockerfile"), projectConfig.DockerfileServices[0].Dockerfile)
+	assert.Equal(t, "product", projectConfig.DockerfileServices[0].ProjectId)
+	assert.Equal(t, "1.0.0", projectConfig.HelmServices[0].ProjectVersion)
+
+	assert.Len(t, projectConfig.HelmRepos, 1, "the same repository is only added once")
+	assert.Equal(t, []ProxyConfig{{ServiceName: "platform-web", Port: 443, ServicePort: 443}}, projectConfig.Proxy)
+}
+
+func TestParse_ImportConflicts(t *testing.T) {
+	tests := []struct {
+		name     string
+		projects map[string]string
+		wantErr  string
+	}{
+		{
+			name: "Service ids cannot conflict",
+			projects: map[string]string{
+				"platform": platformProject,
+				"product": `id: product
+name: Product
+version: 1.0.0
+import: [{path: ../platform, prefix: platform}]
+manifestServices:
+  - id: platform-auth
+    manifest: auth.yaml
+`,
+			},
+			wantErr: "error importing ../platform: service platform-auth is already defined in the project",
+		},
+		{
+			name: "Http paths cannot conflict",
+			projects: map[string]string{
+				"platform": platformProject,
+				"product": `id: product
+name: Product
+version: 1.0.0
+import: [{path: ../platform, prefix: platform}]
+dockerfileServices:
+  - id: app
+    dockerfile: Dockerfile
+    http:
+      containerPort: 8080
+      pathPrefix: /platform
+`,
+			},
+			wantErr: "error parsing project file: http pathPrefix /platform is used by both app and platform-web",
+		},
+		{
+			name: "Proxy ports cannot conflict",
+			projects: map[string]string{
+				"platform": platformProject,
+				"product": `id: product
+name: Product
+version: 1.0.0
+import: [{path: ../platform, prefix: platform}]
+proxy:
+  - serviceName: app
+    port: 443
+manifestServices:
+  - id: app
+    manifest: app.yaml
+`,
+			},
+			wantErr: "error importing ../platform: proxy port 443 is already used by the project",
+		},
+		{
+			name: "Helm repositories cannot conflict",
+			projects: map[string]string{
+				"platform": platformProject,
+				"product": `id: product
+name: Product
+version: 1.0.0
+import: [{path: ../platform, prefix: platform}]
+helmRepos:
+  - name: bitnami
+    url: https://charts.example.com/bitnami
+manifestServices:
+  - id: app
+    manifest: app.yaml
+`,
+			},
+			wantErr: "error importing ../platform: helm repository bitnami is https://charts.bitnami.com/bitnami in the import but https://charts.example.com/bitnami in the project",
+		},
+		{
+			name: "Imports need a prefix",
+			projects: map[string]string{
+				"platform": platformProject,
+				"product": `id: product
+name: Product
+version: 1.0.0
+import: [{path: ../platform}]
+`,
+			},
+			wantErr: "import ../platform must set a prefix that is lower case, alphanumeric and dashes",
+		},
+		{
+			name: "Imports cannot be cycles",
+			projects: map[string]string{
+				"platform": strings.Replace(platformProject, "helmRepos:", "import: [{path: ../product, prefix: product}]\nhelmRepos:", 1),
+				"product": `id: product
+name: Product
+version: 1.0.0
+import: [{path: ../platform, prefix: platform}]
+`,
+			},
+			wantErr: "error importing ../platform: import cycle: ",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rootDir := writeProjects(t, tt.projects)
+			_, err := Parse(filepath.Join(rootDir, "product", "ruckstack.yaml"))
+			if assert.Error(t, err) {
+				assert.True(t, strings.HasPrefix(err.Error(), tt.wantErr), err.Error())
+			}
+		})
+	}
+}
+
+func TestParse_ImportGit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	rootDir := writeProjects(t, map[string]string{
+		"platform-repo/stack": platformProject,
+	})
+	repoDir := filepath.Join(rootDir, "platform-repo")
+	git := func(args ...string) {
+		command := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		command.Dir = repoDir
+		output, err := command.CombinedOutput()
+		require.NoError(t, err, string(output))
+	}
+	git("init", "-q")
+	git("add", ".")
+	git("commit", "-q", "-m", "platform")
+	git("tag", "v2.0.0")
+
+	productPath := filepath.Join(rootDir, "product", "ruckstack.yaml")
+	require.NoError(t, os.MkdirAll(filepath.Dir(productPath), 0755))
+	require.NoError(t, ioutil.WriteFile(productPath, []byte(`id: product
+name: Product
+version: 1.0.0
+import:
+  - git: `+repoDir+`
+    ref: v2.0.0
+    path: stack
+    prefix: platform
+`), 0644))
+
+	projectConfig, err := Parse(productPath)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, "platform-web", projectConfig.DockerfileServices[0].Id)
+	importedDir := filepath.Dir(filepath.Dir(filepath.Join(rootDir, "product", projectConfig.DockerfileServices[0].Dockerfile)))
+	defer os.RemoveAll(filepath.Dir(importedDir))
+	assert.True(t, strings.HasPrefix(importedDir, environment.CachePath("imports")), importedDir)
+	assert.FileExists(t, filepath.Join(importedDir, "ruckstack.yaml"))
+
+	//the tag is already checked out, so it can be used offline
+	environment.Offline = true
+	defer func() { environment.Offline = false }()
+	_, err = Parse(productPath)
+	assert.NoError(t, err)
+}
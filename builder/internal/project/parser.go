@@ -6,10 +6,18 @@ import (
 	"gopkg.in/yaml.v3"
 	"io"
 	"os"
+	"path/filepath"
 	"regexp"
 )
 
 func Parse(projectPath string) (*Project, error) {
+	return parse(projectPath, nil)
+}
+
+/**
+Parses the project, which is imported by the projects in importedBy
+*/
+func parse(projectPath string, importedBy []string) (*Project, error) {
 	content, err := os.Open(projectPath)
 
 	if err != nil {
@@ -17,11 +25,15 @@ func Parse(projectPath string) (*Project, error) {
 	}
 	defer content.Close()
 
-	return ParseData(content, projectPath)
+	return parseData(content, projectPath, importedBy)
 
 }
 
 func ParseData(data io.Reader, projectPath string) (*Project, error) {
+	return parseData(data, projectPath, nil)
+}
+
+func parseData(data io.Reader, projectPath string, importedBy []string) (*Project, error) {
 	decoder := yaml.NewDecoder(data)
 	decoder.KnownFields(true)
 
@@ -38,34 +50,33 @@ func ParseData(data io.Reader, projectPath string) (*Project, error) {
 		return nil, fmt.Errorf("project id must be lower case, alphanumeric, with no whitespace")
 	}
 
-	if len(projectConfig.GetServices()) == 0 {
-		return nil, fmt.Errorf("No services are defined in %s", projectPath)
+	projectDir := filepath.Dir(projectPath)
+	projectConfig.Git = ReadGitInfo(projectDir)
+	if projectConfig.Version == "git" {
+		if projectConfig.Git == nil {
+			return nil, fmt.Errorf("project version is git but %s is not in a git repository", projectDir)
+		}
+		version, err := GitVersion(projectDir)
+		if err != nil {
+			return nil, err
+		}
+		projectConfig.Version = version
+		projectConfig.versionFromGit = true
 	}
 
 	if projectConfig.ManagerFilename == "" {
 		projectConfig.ManagerFilename = projectConfig.Id
 	}
 
-	for i, _ := range projectConfig.Proxy {
-		if projectConfig.Proxy[i].ServicePort == 0 {
-			projectConfig.Proxy[i].ServicePort = projectConfig.Proxy[i].Port
-		}
-	}
-
-	for i, _ := range projectConfig.ManifestServices {
-		projectConfig.ManifestServices[i].ProjectVersion = projectConfig.Version
-		projectConfig.ManifestServices[i].ProjectId = projectConfig.Id
+	if err := projectConfig.mergeImports(projectDir, importedBy); err != nil {
+		return nil, err
 	}
 
-	for i, _ := range projectConfig.HelmServices {
-		projectConfig.HelmServices[i].ProjectVersion = projectConfig.Version
-		projectConfig.HelmServices[i].ProjectId = projectConfig.Id
+	if len(projectConfig.GetServices()) == 0 {
+		return nil, fmt.Errorf("No services are defined in %s", projectPath)
 	}
 
-	for i, _ := range projectConfig.DockerfileServices {
-		projectConfig.DockerfileServices[i].ProjectVersion = projectConfig.Version
-		projectConfig.DockerfileServices[i].ProjectId = projectConfig.Id
-	}
+	projectConfig.setDefaults()
 
 	if err := projectConfig.Validate(); err != nil {
 		return nil, err
@@ -64,6 +64,19 @@ helmRepos:
   - name: bitnami
     url: https://charts.bitnami.com/bitnami
 
+registries:
+  - host: registry.example.com
+    username: builder
+    passwordEnv: EXAMPLE_REGISTRY_PASSWORD
+    caCert: certs/example-ca.pem
+
+imagePolicy:
+  disallowLatest: true
+  allowedRegistries:
+    - docker.io
+    - ghcr.io/my-org
+  maxImageSize: 500MB
+
 dockerfileServices:
   - id: test_dockerfile
     dockerfile: Dockerfile
@@ -103,6 +116,8 @@ helmServices:
       sidecar:
         datasources:
           enabled: true
+    additionalImages:
+      - busybox:1.33
 
 manifestServices:
   - id: test_manifest
@@ -125,6 +140,15 @@ manifestServices:
 	assert.Equal(t, "bitnami", project.HelmRepos[0].Name)
 	assert.Equal(t, "https://charts.bitnami.com/bitnami", project.HelmRepos[0].Url)
 
+	assert.Equal(t, "registry.example.com", project.Registries[0].Host)
+	assert.Equal(t, "builder", project.Registries[0].Username)
+	assert.Equal(t, "EXAMPLE_REGISTRY_PASSWORD", project.Registries[0].PasswordEnv)
+	assert.Equal(t, "certs/example-ca.pem", project.Registries[0].CaCert)
+
+	assert.True(t, project.ImagePolicy.DisallowLatest)
+	assert.Equal(t, []string{"docker.io", "ghcr.io/my-org"}, project.ImagePolicy.AllowedRegistries)
+	assert.Equal(t, "500MB", project.ImagePolicy.MaxImageSize)
+
 	assert.Equal(t, 4, len(project.GetServices()))
 
 	assert.Equal(t, project.Id, project.DockerfileServices[0].ProjectId)
@@ -169,6 +193,7 @@ manifestServices:
 	assert.Equal(t, "7.3.9", project.HelmServices[0].Version)
 	assert.Equal(t, "admin", project.HelmServices[0].Parameters["adminUser"])
 	assert.Equal(t, "master", project.HelmServices[0].Parameters["image"].(map[string]interface{})["tag"])
+	assert.Equal(t, []string{"busybox:1.33"}, project.HelmServices[0].AdditionalImages)
 
 	assert.Equal(t, "test_manifest", project.ManifestServices[0].Id)
 	assert.Equal(t, "manifest", project.ManifestServices[0].GetType())
@@ -0,0 +1,196 @@
+package project
+
+import (
+	"fmt"
+	"github.com/ruckstack/ruckstack/builder/internal/project/service"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+/**
+Changes to the project for one edition of it, such as an enterprise edition with more services
+*/
+type Profile struct {
+	//Name, Support and ManagerFilename replace the project's branding when set
+	Name            string
+	Support         []string
+	ManagerFilename string `yaml:"managerFilename"`
+
+	//RemoveServices are ids of project services left out of the profile
+	RemoveServices []string `yaml:"removeServices"`
+
+	//Services are added to the project, replacing any project service with the same id
+	ManifestServices   []service.ManifestService   `yaml:"manifestServices"`
+	HelmServices       []service.HelmService       `yaml:"helmServices"`
+	DockerfileServices []service.DockerfileService `yaml:"dockerfileServices"`
+
+	//Parameters are merged into the parameters of the helm service with the same id
+	Parameters map[string]map[string]interface{} `yaml:"parameters"`
+
+	//Proxy is added to the project's proxies, replacing any on the same port
+	Proxy []ProxyConfig `yaml:"proxy"`
+
+	//RemoveProxies are ports of project proxies left out of the profile
+	RemoveProxies []int `yaml:"removeProxies"`
+}
+
+/**
+Returns the names of the project's profiles, sorted
+*/
+func (project *Project) ProfileNames() []string {
+	var names []string
+	for name := range project.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/**
+Changes the project to the given profile.
+The project's slices and maps are replaced rather than modified, so a copy of the project can have a profile applied without changing the original
+*/
+func (project *Project) ApplyProfile(name string) error {
+	if project.Profile != "" {
+		return fmt.Errorf("profile %s is already applied", project.Profile)
+	}
+
+	profile, found := project.Profiles[name]
+	if !found {
+		if len(project.Profiles) == 0 {
+			return fmt.Errorf("project %s has no profiles", project.Id)
+		}
+		return fmt.Errorf("project %s has no profile %s. Available profiles: %s", project.Id, name, strings.Join(project.ProfileNames(), ", "))
+	}
+
+	matched, _ := regexp.MatchString(`^[a-z0-9-]+$`, name)
+	if !matched {
+		return fmt.Errorf("profile name must be lower case, alphanumeric and dashes")
+	}
+	if name == "default" {
+		return fmt.Errorf("profile name default is reserved for the project without a profile")
+	}
+
+	if profile.Name != "" {
+		project.Name = profile.Name
+	}
+	if len(profile.Support) > 0 {
+		project.Support = profile.Support
+	}
+	if profile.ManagerFilename != "" {
+		project.ManagerFilename = profile.ManagerFilename
+	}
+
+	replacedServices := map[string]bool{}
+	for _, serviceId := range profile.RemoveServices {
+		if !project.hasService(serviceId) {
+			return fmt.Errorf("cannot remove service %s, which is not in the project", serviceId)
+		}
+		replacedServices[serviceId] = true
+	}
+	for _, serviceConfig := range (&Project{
+		ManifestServices:   profile.ManifestServices,
+		HelmServices:       profile.HelmServices,
+		DockerfileServices: profile.DockerfileServices,
+	}).GetServices() {
+		replacedServices[serviceConfig.GetId()] = true
+	}
+
+	var manifestServices []service.ManifestService
+	for _, serviceConfig := range project.ManifestServices {
+		if !replacedServices[serviceConfig.Id] {
+			manifestServices = append(manifestServices, serviceConfig)
+		}
+	}
+	project.ManifestServices = append(manifestServices, profile.ManifestServices...)
+
+	var helmServices []service.HelmService
+	for _, serviceConfig := range project.HelmServices {
+		if !replacedServices[serviceConfig.Id] {
+			helmServices = append(helmServices, serviceConfig)
+		}
+	}
+	project.HelmServices = append(helmServices, profile.HelmServices...)
+
+	var dockerfileServices []service.DockerfileService
+	for _, serviceConfig := range project.DockerfileServices {
+		if !replacedServices[serviceConfig.Id] {
+			dockerfileServices = append(dockerfileServices, serviceConfig)
+		}
+	}
+	project.DockerfileServices = append(dockerfileServices, profile.DockerfileServices...)
+
+	for serviceId, parameters := range profile.Parameters {
+		found := false
+		for i := range project.HelmServices {
+			if project.HelmServices[i].Id == serviceId {
+				project.HelmServices[i].Parameters = mergeParameters(project.HelmServices[i].Parameters, parameters)
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("cannot set parameters of %s, which is not a helm service in the profile", serviceId)
+		}
+	}
+
+	replacedPorts := map[int]bool{}
+	for _, port := range profile.RemoveProxies {
+		found := false
+		for _, proxyConfig := range project.Proxy {
+			if proxyConfig.Port == port {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("cannot remove proxy on port %d, which is not in the project", port)
+		}
+		replacedPorts[port] = true
+	}
+	for _, proxyConfig := range profile.Proxy {
+		replacedPorts[proxyConfig.Port] = true
+	}
+	var proxies []ProxyConfig
+	for _, proxyConfig := range project.Proxy {
+		if !replacedPorts[proxyConfig.Port] {
+			proxies = append(proxies, proxyConfig)
+		}
+	}
+	project.Proxy = append(proxies, profile.Proxy...)
+
+	project.Profile = name
+	project.setDefaults()
+
+	return project.Validate()
+}
+
+func (project *Project) hasService(serviceId string) bool {
+	for _, serviceConfig := range project.GetServices() {
+		if serviceConfig.GetId() == serviceId {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+Returns a copy of base with the values in override added. Nested maps are merged rather than replaced
+*/
+func mergeParameters(base map[string]interface{}, override map[string]interface{}) map[string]interface{} {
+	merged := map[string]interface{}{}
+	for key, value := range base {
+		merged[key] = value
+	}
+
+	for key, value := range override {
+		overrideMap, overrideIsMap := value.(map[string]interface{})
+		baseMap, baseIsMap := merged[key].(map[string]interface{})
+		if overrideIsMap && baseIsMap {
+			merged[key] = mergeParameters(baseMap, overrideMap)
+		} else {
+			merged[key] = value
+		}
+	}
+
+	return merged
+}
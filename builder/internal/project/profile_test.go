@@ -0,0 +1,126 @@
+package project
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+var profileProject = `id: editions
+name: Editions
+version: 1.0.0
+proxy:
+  - serviceName: web
+    port: 80
+  - serviceName: admin
+    port: 8080
+manifestServices:
+  - id: web
+    manifest: web.yaml
+  - id: admin
+    manifest: admin.yaml
+helmServices:
+  - id: cache
+    chart: stable/redis
+    version: 10.5.7
+    parameters:
+      cluster:
+        enabled: false
+        slaveCount: 1
+      usePassword: true
+profiles:
+  enterprise:
+    name: Editions Enterprise
+    removeServices: [admin]
+    removeProxies: [8080]
+    manifestServices:
+      - id: web
+        manifest: web-enterprise.yaml
+      - id: audit
+        manifest: audit.yaml
+    parameters:
+      cache:
+        cluster:
+          enabled: true
+    proxy:
+      - serviceName: web
+        port: 80
+        servicePort: 8000
+`
+
+func TestProject_ApplyProfile(t *testing.T) {
+	projectConfig, err := ParseData(strings.NewReader(profileProject), "ruckstack.yaml")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []string{"enterprise"}, projectConfig.ProfileNames())
+
+	standard := *projectConfig
+	assert.NoError(t, projectConfig.ApplyProfile("enterprise"))
+
+	assert.Equal(t, "enterprise", projectConfig.Profile)
+	assert.Equal(t, "Editions Enterprise", projectConfig.Name)
+
+	var serviceIds []string
+	for _, serviceConfig := range projectConfig.GetServices() {
+		serviceIds = append(serviceIds, serviceConfig.GetId())
+	}
+	assert.Equal(t, []string{"web", "audit", "cache"}, serviceIds)
+	assert.Equal(t, "web-enterprise.yaml", projectConfig.ManifestServices[0].Manifest)
+	assert.Equal(t, "editions", projectConfig.ManifestServices[1].ProjectId)
+
+	assert.Equal(t, map[string]interface{}{
+		"cluster": map[string]interface{}{
+			"enabled":    true,
+			"slaveCount": 1,
+		},
+		"usePassword": true,
+	}, projectConfig.HelmServices[0].Parameters)
+
+	assert.Equal(t, []ProxyConfig{{ServiceName: "web", Port: 80, ServicePort: 8000}}, projectConfig.Proxy)
+
+	//the project is not changed through shared slices or maps
+	assert.Equal(t, "Editions", standard.Name)
+	assert.Len(t, standard.ManifestServices, 2)
+	assert.Equal(t, "web.yaml", standard.ManifestServices[0].Manifest)
+	assert.Equal(t, false, standard.HelmServices[0].Parameters["cluster"].(map[string]interface{})["enabled"])
+	assert.Len(t, standard.Proxy, 2)
+
+	err = standard.ApplyProfile("community")
+	assert.EqualError(t, err, "project editions has no profile community. Available profiles: enterprise")
+}
+
+func TestProject_ValidateProfiles(t *testing.T) {
+	tests := []struct {
+		name    string
+		profile string
+		wantErr string
+	}{
+		{
+			name:    "Cannot remove a missing service",
+			profile: "removeServices: [missing]",
+			wantErr: "error parsing profile broken: cannot remove service missing, which is not in the project",
+		},
+		{
+			name:    "Parameters need a helm service",
+			profile: "parameters: {web: {replicas: 2}}",
+			wantErr: "error parsing profile broken: cannot set parameters of web, which is not a helm service in the profile",
+		},
+		{
+			name:    "Cannot remove a missing proxy",
+			profile: "removeProxies: [443]",
+			wantErr: "error parsing profile broken: cannot remove proxy on port 443, which is not in the project",
+		},
+		{
+			name:    "Cannot remove every service",
+			profile: "removeServices: [web, admin, cache]",
+			wantErr: "error parsing profile broken: error parsing project file: at least one service block is required",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseData(strings.NewReader(profileProject+"  broken:\n    "+tt.profile+"\n"), "ruckstack.yaml")
+			assert.EqualError(t, err, tt.wantErr)
+		})
+	}
+}
@@ -2,14 +2,24 @@ package project
 
 import (
 	"fmt"
+	"github.com/Masterminds/semver/v3"
 	"github.com/go-playground/validator/v10"
+	"github.com/ruckstack/ruckstack/builder/internal/artifacts"
 	"github.com/ruckstack/ruckstack/builder/internal/builder/install_file"
 	"github.com/ruckstack/ruckstack/builder/internal/project/service"
+	"github.com/ruckstack/ruckstack/builder/internal/registry"
+	"github.com/ruckstack/ruckstack/builder/internal/render"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 )
 
 type Project struct {
-	Id      string `validate:"required"`
-	Name    string `validate:"required"`
+	Id   string `validate:"required"`
+	Name string `validate:"required"`
+
+	//Version is a semantic version such as 1.2.3, or git to derive it from the nearest tag
 	Version string `validate:"required"`
 	Support []string
 
@@ -17,13 +27,91 @@ type Project struct {
 	K3sVersion      string
 	ManagerFilename string `yaml:"managerFilename"`
 
+	//Architectures are the server architectures to build installers for. Defaults to amd64
+	Architectures []string `yaml:"architectures"`
+
 	HelmRepos []HelmRepoConfig `yaml:"helmRepos"`
 
+	Artifacts artifacts.Config `yaml:"artifacts"`
+
+	Registries []registry.Config `yaml:"registries" validate:"dive"`
+
 	Proxy []ProxyConfig `yaml:"proxy"`
 
+	ImagePolicy install_file.ImagePolicy `yaml:"imagePolicy"`
+
 	ManifestServices   []service.ManifestService   `yaml:"manifestServices"`
 	HelmServices       []service.HelmService       `yaml:"helmServices"`
 	DockerfileServices []service.DockerfileService `yaml:"dockerfileServices"`
+
+	//Imports are other projects whose services, helm repositories and proxies are merged into this one
+	Imports []ImportConfig `yaml:"import"`
+
+	//Profiles are editions of the project, such as standard and enterprise, selected with --profile
+	Profiles map[string]Profile `yaml:"profiles"`
+
+	//Profile is the name of the profile applied with ApplyProfile, or empty for the project as written
+	Profile string `yaml:"-"`
+
+	//Git is the commit the project directory has checked out, or nil if it is not in a git repository
+	Git *GitInfo `yaml:"-"`
+
+	versionFromGit bool
+}
+
+/**
+Server architectures installers can be built for
+*/
+var SupportedArchitectures = []string{"amd64", "arm64"}
+
+func ValidateArchitecture(architecture string) error {
+	for _, supported := range SupportedArchitectures {
+		if architecture == supported {
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported architecture '%s'. Must be one of %s", architecture, strings.Join(SupportedArchitectures, ", "))
+}
+
+/**
+Returns the architectures to build installers for
+*/
+func (project Project) GetArchitectures() []string {
+	if len(project.Architectures) == 0 {
+		return []string{"amd64"}
+	}
+	return project.Architectures
+}
+
+/**
+Fills in the values services and proxies inherit from the project
+*/
+func (project *Project) setDefaults() {
+	for i := range project.Proxy {
+		if project.Proxy[i].ServicePort == 0 {
+			project.Proxy[i].ServicePort = project.Proxy[i].Port
+		}
+	}
+
+	for i := range project.ManifestServices {
+		project.ManifestServices[i].ProjectVersion = project.Version
+		project.ManifestServices[i].ProjectId = project.Id
+	}
+
+	for i := range project.HelmServices {
+		project.HelmServices[i].ProjectVersion = project.Version
+		project.HelmServices[i].ProjectId = project.Id
+	}
+
+	for i := range project.DockerfileServices {
+		project.DockerfileServices[i].ProjectVersion = project.Version
+		project.DockerfileServices[i].ProjectId = project.Id
+
+		//services without their own version are versioned with the project rather than the build time
+		if project.versionFromGit && project.DockerfileServices[i].ServiceVersion == "" {
+			project.DockerfileServices[i].ServiceVersion = project.Version
+		}
+	}
 }
 
 func (project Project) GetServices() []Service {
@@ -56,10 +144,78 @@ func (project *Project) Validate() error {
 	if len(project.GetServices()) == 0 {
 		return fmt.Errorf("error parsing project file: at least one service block is required")
 	}
+
+	if _, err := semver.StrictNewVersion(project.Version); err != nil {
+		return fmt.Errorf("error parsing project file: version %s is not a semantic version such as 1.2.3", project.Version)
+	}
+
+	if err := project.ImagePolicy.Validate(); err != nil {
+		return fmt.Errorf("error parsing project file: %s", err)
+	}
+
+	if err := project.Artifacts.Validate(); err != nil {
+		return fmt.Errorf("error parsing project file: %s", err)
+	}
+
+	seenArchitectures := map[string]bool{}
+	for _, architecture := range project.Architectures {
+		if err := ValidateArchitecture(architecture); err != nil {
+			return fmt.Errorf("error parsing project file: %s", err)
+		}
+		if seenArchitectures[architecture] {
+			return fmt.Errorf("error parsing project file: architecture %s is listed more than once", architecture)
+		}
+		seenArchitectures[architecture] = true
+	}
+
+	for _, registryConfig := range project.Registries {
+		if err := registryConfig.Validate(); err != nil {
+			return fmt.Errorf("error parsing project file: %s", err)
+		}
+	}
+
+	seenHelmRepos := map[string]bool{}
+	for _, helmRepo := range project.HelmRepos {
+		if err := helmRepo.Validate(); err != nil {
+			return fmt.Errorf("error parsing project file: %s", err)
+		}
+		if seenHelmRepos[helmRepo.Name] {
+			return fmt.Errorf("error parsing project file: helm repository %s is listed more than once", helmRepo.Name)
+		}
+		seenHelmRepos[helmRepo.Name] = true
+	}
+
+	seenServices := map[string]bool{}
 	for _, serviceConfig := range project.GetServices() {
 		if err := serviceConfig.Validate(structValidator); err != nil {
 			return fmt.Errorf("error parsing service %s: %s", serviceConfig.GetId(), err)
 		}
+		if seenServices[serviceConfig.GetId()] {
+			return fmt.Errorf("error parsing project file: service %s is defined more than once", serviceConfig.GetId())
+		}
+		seenServices[serviceConfig.GetId()] = true
+	}
+
+	pathPrefixes := map[string]string{}
+	for _, serviceConfig := range project.DockerfileServices {
+		pathPrefix := serviceConfig.Http.PathPrefix
+		if pathPrefix == "" {
+			continue
+		}
+		if otherId, found := pathPrefixes[pathPrefix]; found {
+			return fmt.Errorf("error parsing project file: http pathPrefix %s is used by both %s and %s", pathPrefix, otherId, serviceConfig.Id)
+		}
+		pathPrefixes[pathPrefix] = serviceConfig.Id
+	}
+
+	//profiles are checked when the project is parsed, not just when they are built
+	if project.Profile == "" {
+		for _, name := range project.ProfileNames() {
+			profiled := *project
+			if err := profiled.ApplyProfile(name); err != nil {
+				return fmt.Errorf("error parsing profile %s: %s", name, err)
+			}
+		}
 	}
 
 	return nil
@@ -80,6 +236,11 @@ type Service interface {
 	Build the service, adding anything needed to the InstallFile
 	*/
 	Build(*install_file.InstallFile) error
+
+	/**
+	Write the Kubernetes resources the service generates, without building or pulling images
+	*/
+	Render(*render.Renderer) error
 }
 
 type ProxyConfig struct {
@@ -89,8 +250,59 @@ type ProxyConfig struct {
 }
 
 type HelmRepoConfig struct {
-	Name     string `validate:"required"`
-	Url      string `validate:"required"`
-	Username string
+	Name         string `validate:"required"`
+	Url          string `validate:"required"`
+	Username     string
+	PasswordEnv  string `yaml:"passwordEnv"`
+	PasswordFile string `yaml:"passwordFile"`
+
+	//Password is stored in plain text in the project file. Use PasswordEnv or PasswordFile instead
 	Password string
 }
+
+func (config *HelmRepoConfig) Validate() error {
+	passwordSources := 0
+	for _, source := range []string{config.Password, config.PasswordEnv, config.PasswordFile} {
+		if source != "" {
+			passwordSources++
+		}
+	}
+	if passwordSources > 1 {
+		return fmt.Errorf("helm repository %s can only set one of password, passwordEnv and passwordFile", config.Name)
+	}
+	if config.Username != "" && passwordSources == 0 {
+		return fmt.Errorf("helm repository %s must set passwordEnv or passwordFile", config.Name)
+	}
+	if config.Username == "" && passwordSources > 0 {
+		return fmt.Errorf("helm repository %s must set a username", config.Name)
+	}
+
+	return nil
+}
+
+/**
+Returns the password for the repository from its environment variable or file. Files are relative to projectDir
+*/
+func (config *HelmRepoConfig) GetPassword(projectDir string) (string, error) {
+	if config.PasswordEnv != "" {
+		password := os.Getenv(config.PasswordEnv)
+		if password == "" {
+			return "", fmt.Errorf("environment variable %s for the %s helm repository password is not set", config.PasswordEnv, config.Name)
+		}
+		return password, nil
+	}
+
+	if config.PasswordFile != "" {
+		passwordPath := config.PasswordFile
+		if !filepath.IsAbs(passwordPath) {
+			passwordPath = filepath.Join(projectDir, passwordPath)
+		}
+		content, err := ioutil.ReadFile(passwordPath)
+		if err != nil {
+			return "", fmt.Errorf("cannot read password for helm repository %s: %s", config.Name, err)
+		}
+		return strings.TrimSpace(string(content)), nil
+	}
+
+	return config.Password, nil
+}
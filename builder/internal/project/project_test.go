@@ -1,8 +1,13 @@
 package project
 
 import (
+	"github.com/ruckstack/ruckstack/builder/internal/builder/install_file"
 	"github.com/ruckstack/ruckstack/builder/internal/project/service"
+	"github.com/ruckstack/ruckstack/builder/internal/registry"
 	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 )
@@ -48,6 +53,163 @@ func TestProject_Validate(t *testing.T) {
 				},
 			},
 		},
+		{
+			name:    "Version must be semantic",
+			wantErr: "error parsing project file: version 1.2 is not a semantic version such as 1.2.3",
+			args: args{
+				project: &Project{
+					Id:      "test-project",
+					Name:    "Test Project",
+					Version: "1.2",
+					ManifestServices: []service.ManifestService{
+						{
+							Id:       "service-id",
+							Manifest: "test-manifest.yaml",
+						},
+					},
+				},
+			},
+		},
+		{
+			name:    "Chart version must be semantic",
+			wantErr: "error parsing service cache: chart version latest is not a semantic version",
+			args: args{
+				project: &Project{
+					Id:      "test-project",
+					Name:    "Test Project",
+					Version: "1.2.3",
+					HelmServices: []service.HelmService{
+						{
+							Id:      "cache",
+							Chart:   "stable/redis",
+							Version: "latest",
+						},
+					},
+				},
+			},
+		},
+		{
+			name:    "Invalid image policy fails validation",
+			wantErr: "error parsing project file: invalid imagePolicy maxImageSize 'huge'",
+			args: args{
+				project: &Project{
+					Id:      "test-project",
+					Name:    "Test Project",
+					Version: "1.2.3",
+					ImagePolicy: install_file.ImagePolicy{
+						MaxImageSize: "huge",
+					},
+					ManifestServices: []service.ManifestService{
+						{
+							Id:       "service-id",
+							Manifest: "test-manifest.yaml",
+						},
+					},
+				},
+			},
+		},
+		{
+			name:    "Registry without password fails validation",
+			wantErr: "error parsing project file: registry registry.example.com must set passwordEnv or passwordFile",
+			args: args{
+				project: &Project{
+					Id:      "test-project",
+					Name:    "Test Project",
+					Version: "1.2.3",
+					Registries: []registry.Config{
+						{
+							Host:     "registry.example.com",
+							Username: "builder",
+						},
+					},
+					ManifestServices: []service.ManifestService{
+						{
+							Id:       "service-id",
+							Manifest: "test-manifest.yaml",
+						},
+					},
+				},
+			},
+		},
+		{
+			name:    "Unsupported architecture fails validation",
+			wantErr: "error parsing project file: unsupported architecture 'mips'. Must be one of amd64, arm64",
+			args: args{
+				project: &Project{
+					Id:            "test-project",
+					Name:          "Test Project",
+					Version:       "1.2.3",
+					Architectures: []string{"amd64", "mips"},
+					ManifestServices: []service.ManifestService{
+						{
+							Id:       "service-id",
+							Manifest: "test-manifest.yaml",
+						},
+					},
+				},
+			},
+		},
+		{
+			name:    "Helm repository password must come from one place",
+			wantErr: "error parsing project file: helm repository private can only set one of password, passwordEnv and passwordFile",
+			args: args{
+				project: &Project{
+					Id:      "test-project",
+					Name:    "Test Project",
+					Version: "1.2.3",
+					HelmRepos: []HelmRepoConfig{
+						{Name: "private", Url: "https://charts.example.com", Username: "user", PasswordEnv: "CHARTS_PASSWORD", PasswordFile: "charts-password"},
+					},
+					ManifestServices: []service.ManifestService{
+						{
+							Id:       "service-id",
+							Manifest: "test-manifest.yaml",
+						},
+					},
+				},
+			},
+		},
+		{
+			name:    "Helm repository username needs a password",
+			wantErr: "error parsing project file: helm repository private must set passwordEnv or passwordFile",
+			args: args{
+				project: &Project{
+					Id:      "test-project",
+					Name:    "Test Project",
+					Version: "1.2.3",
+					HelmRepos: []HelmRepoConfig{
+						{Name: "private", Url: "https://charts.example.com", Username: "user"},
+					},
+					ManifestServices: []service.ManifestService{
+						{
+							Id:       "service-id",
+							Manifest: "test-manifest.yaml",
+						},
+					},
+				},
+			},
+		},
+		{
+			name:    "Duplicate helm repository fails validation",
+			wantErr: "error parsing project file: helm repository charts is listed more than once",
+			args: args{
+				project: &Project{
+					Id:      "test-project",
+					Name:    "Test Project",
+					Version: "1.2.3",
+					HelmRepos: []HelmRepoConfig{
+						{Name: "charts", Url: "https://charts.example.com"},
+						{Name: "charts", Url: "https://other.example.com"},
+					},
+					ManifestServices: []service.ManifestService{
+						{
+							Id:       "service-id",
+							Manifest: "test-manifest.yaml",
+						},
+					},
+				},
+			},
+		},
 		{
 			name: "Minimum project passes validation",
 			args: args{
@@ -120,3 +282,25 @@ func TestProject_GetServices(t *testing.T) {
 	assert.Equal(t, "docker-2", project.GetServices()[5].GetId())
 
 }
+
+func TestHelmRepoConfig_GetPassword(t *testing.T) {
+	projectDir := t.TempDir()
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(projectDir, "charts-password"), []byte("from-file\n"), 0600))
+	assert.NoError(t, os.Setenv("RUCKSTACK_TEST_CHARTS_PASSWORD", "from-env"))
+	defer os.Unsetenv("RUCKSTACK_TEST_CHARTS_PASSWORD")
+
+	password, err := (&HelmRepoConfig{Name: "private", PasswordEnv: "RUCKSTACK_TEST_CHARTS_PASSWORD"}).GetPassword(projectDir)
+	assert.NoError(t, err)
+	assert.Equal(t, "from-env", password)
+
+	password, err = (&HelmRepoConfig{Name: "private", PasswordFile: "charts-password"}).GetPassword(projectDir)
+	assert.NoError(t, err)
+	assert.Equal(t, "from-file", password)
+
+	_, err = (&HelmRepoConfig{Name: "private", PasswordEnv: "RUCKSTACK_TEST_UNSET_PASSWORD"}).GetPassword(projectDir)
+	assert.EqualError(t, err, "environment variable RUCKSTACK_TEST_UNSET_PASSWORD for the private helm repository password is not set")
+
+	password, err = (&HelmRepoConfig{Name: "public"}).GetPassword(projectDir)
+	assert.NoError(t, err)
+	assert.Equal(t, "", password)
+}
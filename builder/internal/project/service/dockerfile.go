@@ -1,17 +1,22 @@
 package service
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"github.com/Masterminds/semver/v3"
 	"github.com/go-playground/validator/v10"
 	"github.com/ruckstack/ruckstack/builder/internal/builder/install_file"
 	"github.com/ruckstack/ruckstack/builder/internal/docker"
 	"github.com/ruckstack/ruckstack/builder/internal/environment"
+	"github.com/ruckstack/ruckstack/builder/internal/render"
 	"github.com/ruckstack/ruckstack/common/global_util"
-	"github.com/ruckstack/ruckstack/common/ui"
 	"gopkg.in/yaml.v3"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
 	"regexp"
 	"strings"
 	"time"
@@ -19,9 +24,10 @@ import (
 
 type DockerfileService struct {
 	//Common fields
-	Id             string `validate:"required"`
-	ProjectId      string
-	ProjectVersion string
+	Id               string `validate:"required"`
+	ProjectId        string
+	ProjectVersion   string
+	AdditionalImages []string `yaml:"additionalImages"`
 
 	//Unique Fields
 	Dockerfile     string `validate:"required"`
@@ -29,10 +35,30 @@ type DockerfileService struct {
 	Http           DockerfileServiceHttp
 	Env            []DockerfileServiceEnv
 	Mount          []DockerfileServiceMount
+	BuildKit       DockerfileServiceBuildKit `yaml:"buildKit"`
 
 	serviceWorkDir string
 }
 
+type DockerfileServiceBuildKit struct {
+	Enabled   bool
+	Secrets   []DockerfileServiceBuildSecret
+	Ssh       []DockerfileServiceBuildSsh
+	CacheFrom []string `yaml:"cacheFrom"`
+	CacheTo   string   `yaml:"cacheTo"`
+}
+
+type DockerfileServiceBuildSecret struct {
+	Id   string
+	File string
+	Env  string
+}
+
+type DockerfileServiceBuildSsh struct {
+	Id    string
+	Paths []string
+}
+
 type DockerfileServiceHttp struct {
 	ContainerPort   int    `yaml:"containerPort"`
 	PathPrefix      string `yaml:"pathPrefix"`
@@ -79,6 +105,13 @@ func (service *DockerfileService) Validate(structValidator *validator.Validate)
 		return err
 	}
 
+	//the version is used as the generated chart's version, which helm requires to be semantic
+	if service.ServiceVersion != "" {
+		if _, err := semver.NewVersion(service.ServiceVersion); err != nil {
+			return fmt.Errorf("serviceVersion %s is not a semantic version", service.ServiceVersion)
+		}
+	}
+
 	for _, env := range service.Env {
 		if (env.SecretKey != "" || env.SecretName != "") && (env.ConfigMapKey != "" || env.ConfigMapName != "") {
 			return fmt.Errorf("environment variable %s cannot specify both secret and configMap configurations", env.Name)
@@ -106,67 +139,237 @@ func (service *DockerfileService) Validate(structValidator *validator.Validate)
 		}
 	}
 
+	if err := service.BuildKit.validate(); err != nil {
+		return err
+	}
+
 	return nil
 }
 
 func (service *DockerfileService) Build(app *install_file.InstallFile) error {
-	ui.Printf("Building Dockerfile Service %s", service.Id)
+	app.Printf("Building Dockerfile Service %s", service.Id)
+
+	//hashed before the default version is set, since that changes every build
+	inputHash, err := service.hashInputs(app.Architecture, global_util.RuckstackVersion, app.ReproducibleModTime().String())
+	if err != nil {
+		return err
+	}
+	cacheDir := environment.CachePath(filepath.Join("services", service.ProjectId, service.Id+"-"+app.Architecture))
+
+	if cached := service.cachedBuild(cacheDir, inputHash, app.Architecture); cached != nil {
+		app.Printf("Service %s is unchanged since the last build. Reusing image %s", service.Id, cached.ImageId)
+		service.ServiceVersion = cached.ServiceVersion
+		if _, err := app.PinImage(service.dockerTag(app.Architecture)); err != nil {
+			return err
+		}
+		return service.addChart(app, filepath.Join(cacheDir, "chart.tgz"))
+	}
 
 	if service.ServiceVersion == "" {
-		service.ServiceVersion = fmt.Sprintf("0.0.%d", time.Now().Unix())
+		if app.Reproducible {
+			contentVersion, err := service.contentVersion()
+			if err != nil {
+				return err
+			}
+			service.ServiceVersion = contentVersion
+		} else {
+			service.ServiceVersion = fmt.Sprintf("0.0.%d", time.Now().Unix())
+		}
 	}
 
-	service.serviceWorkDir = environment.TempPath(service.Id + "-*")
-	if err := os.MkdirAll(service.serviceWorkDir+"/chart/templates", 0755); err != nil {
+	dockerTag := service.dockerTag(app.Architecture)
+	if err := service.buildContainer(dockerTag, app.Architecture, app.Output()); err != nil {
 		return err
 	}
 
-	dockerTag := "build.local/" + service.ProjectId + "/" + service.Id + ":" + service.ServiceVersion
-	if err := service.buildContainer(dockerTag); err != nil {
+	pinnedImage, err := app.PinImage(dockerTag)
+	if err != nil {
 		return err
 	}
 
-	if err := service.writeChart(); err != nil {
+	chart, err := service.generateChart(pinnedImage, app.ReproducibleModTime())
+	if err != nil {
 		return err
 	}
+	app.Printf("Created %s", chart)
+
+	if err := service.saveBuild(cacheDir, inputHash, dockerTag, chart); err != nil {
+		app.Printf("WARNING: cannot cache the build of %s: %s", service.Id, err)
+	}
+
+	return service.addChart(app, chart)
+}
+
+/**
+Writes the chart the service would be built with, using the image tag without building it
+*/
+func (service *DockerfileService) Render(renderer *render.Renderer) error {
+	if service.ServiceVersion == "" {
+		contentVersion, err := service.contentVersion()
+		if err != nil {
+			return err
+		}
+		service.ServiceVersion = contentVersion
+	}
 
-	if err := service.writeDaemonSet(); err != nil {
+	chart, err := service.generateChart(service.dockerTag(renderer.Architecture), renderer.ModTime)
+	if err != nil {
 		return err
 	}
 
+	return renderer.AddHelmChart(chart, service.Id, nil)
+}
+
+/**
+Writes the chart that runs the given image and packages it. If modTime is not zero, it is recorded for every file instead of when it was written
+*/
+func (service *DockerfileService) generateChart(image string, modTime time.Time) (string, error) {
+	service.serviceWorkDir = environment.TempPath(service.Id + "-*")
+	if err := os.MkdirAll(service.serviceWorkDir+"/chart/templates", 0755); err != nil {
+		return "", err
+	}
+
+	if err := service.writeChart(); err != nil {
+		return "", err
+	}
+
+	if err := service.writeDaemonSet(image); err != nil {
+		return "", err
+	}
+
 	if err := service.writeService(); err != nil {
-		return err
+		return "", err
 	}
 
 	if service.Http.PathPrefix != "" {
 		if err := service.writeIngress(); err != nil {
-			return err
+			return "", err
 		}
 	}
 
-	chart, err := service.buildChart()
-	if err != nil {
+	return service.buildChart(modTime)
+}
+
+/**
+Adds the built chart and the service's additional images to the install file
+*/
+func (service *DockerfileService) addChart(app *install_file.InstallFile, chart string) error {
+	if err := app.AddHelmChart(chart, service.Id, "", nil); err != nil {
 		return err
 	}
 
-	if err := app.AddHelmChart(chart, service.Id, nil); err != nil {
-		return err
+	for _, image := range service.AdditionalImages {
+		if err := app.AddImage(image); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-func (service *DockerfileService) buildContainer(dockerTag string) error {
+/**
+Returns the tag the service image is built as. Architectures other than amd64 are added to the version so each keeps its own image
+*/
+func (service *DockerfileService) dockerTag(architecture string) string {
+	tag := "build.local/" + service.ProjectId + "/" + service.Id + ":" + service.ServiceVersion
+	if architecture != "amd64" {
+		tag += "-" + architecture
+	}
+	return tag
+}
+
+/**
+Returns the BuildKit settings for the build, or nil to use the classic builder. Secret and ssh paths are relative to the project
+*/
+func (service *DockerfileService) buildKitOptions() *docker.BuildKitOptions {
+	if !service.BuildKit.Enabled {
+		return nil
+	}
+
+	options := &docker.BuildKitOptions{
+		CacheFrom: service.BuildKit.CacheFrom,
+		CacheTo:   service.BuildKit.CacheTo,
+	}
+	for _, secret := range service.BuildKit.Secrets {
+		buildSecret := docker.BuildSecret{
+			Id:  secret.Id,
+			Env: secret.Env,
+		}
+		if secret.File != "" {
+			buildSecret.File = projectPath(secret.File)
+		}
+		options.Secrets = append(options.Secrets, buildSecret)
+	}
+	for _, ssh := range service.BuildKit.Ssh {
+		buildSsh := docker.BuildSsh{
+			Id: ssh.Id,
+		}
+		for _, path := range ssh.Paths {
+			buildSsh.Paths = append(buildSsh.Paths, projectPath(path))
+		}
+		options.Ssh = append(options.Ssh, buildSsh)
+	}
+
+	return options
+}
+
+/**
+Returns the path to the Dockerfile. Its directory is the build context
+*/
+func (service *DockerfileService) dockerfilePath() string {
 	dockerfile := service.Dockerfile
 	if dockerfile == "" {
 		dockerfile = "Dockerfile"
 	}
+	return environment.ProjectDir + "/" + dockerfile
+}
+
+/**
+Returns a chart version derived from the service config and build context, so it only changes when they do
+*/
+func (service *DockerfileService) contentVersion() (string, error) {
+	inputHash, err := service.hashInputs()
+	if err != nil {
+		return "", err
+	}
+
+	//prefixed so the prerelease is never all digits with a leading zero, which semver does not allow
+	return "0.0.0-sha" + inputHash[:12], nil
+}
+
+/**
+Returns the hex sha256 of the service config, the build context and any extra values
+*/
+func (service *DockerfileService) hashInputs(extra ...string) (string, error) {
+	serviceConfig, err := yaml.Marshal(service)
+	if err != nil {
+		return "", err
+	}
 
-	err := docker.ImageBuild(environment.ProjectDir+"/"+dockerfile,
+	contextHash, err := global_util.HashDirectory(filepath.Dir(service.dockerfilePath()))
+	if err != nil {
+		return "", fmt.Errorf("cannot hash build context: %s", err)
+	}
+
+	hash := sha256.New()
+	hash.Write(serviceConfig)
+	hash.Write([]byte(contextHash))
+	for _, value := range extra {
+		hash.Write([]byte("\x00" + value))
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func (service *DockerfileService) buildContainer(dockerTag string, architecture string, output io.Writer) error {
+	err := docker.ImageBuild(service.dockerfilePath(),
 		[]string{dockerTag},
 		map[string]string{
 			"ruckstack.built": "true",
-		})
+		},
+		"linux/"+architecture,
+		service.buildKitOptions(),
+		output)
 
 	if err != nil {
 		return err
@@ -194,7 +397,7 @@ func (service *DockerfileService) writeChart() error {
 	return nil
 }
 
-func (service *DockerfileService) writeDaemonSet() error {
+func (service *DockerfileService) writeDaemonSet(image string) error {
 
 	envDef := []map[string]interface{}{}
 	for _, envConfig := range service.Env {
@@ -272,7 +475,7 @@ func (service *DockerfileService) writeDaemonSet() error {
 					"containers": []map[string]interface{}{
 						{
 							"name":  service.Id,
-							"image": "build.local/" + service.ProjectId + "/" + service.Id + ":" + service.ServiceVersion,
+							"image": image,
 							"ports": []map[string]int{
 								{"containerPort": service.Http.ContainerPort},
 							},
@@ -376,14 +579,63 @@ func (service *DockerfileService) writeIngress() error {
 	return ioutil.WriteFile(service.serviceWorkDir+"/chart/templates/ingress.yaml", out, 0644)
 }
 
-func (service *DockerfileService) buildChart() (string, error) {
+/**
+Packages the chart. If modTime is not zero, it is recorded for every file instead of when it was written
+*/
+func (service *DockerfileService) buildChart(modTime time.Time) (string, error) {
 	chartFilePath := service.serviceWorkDir + "/" + service.Id + ".tgz"
 
-	ui.Printf("Creating %s...", chartFilePath)
-
-	if err := global_util.TarDirectory(service.serviceWorkDir+"/chart", chartFilePath, true); err != nil {
+	if err := global_util.TarDirectoryAt(service.serviceWorkDir+"/chart", chartFilePath, true, modTime); err != nil {
 		return "", err
 	}
 
 	return chartFilePath, nil
 }
+
+func projectPath(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(environment.ProjectDir, path)
+}
+
+func (buildKit DockerfileServiceBuildKit) validate() error {
+	if !buildKit.Enabled {
+		if len(buildKit.Secrets) > 0 || len(buildKit.Ssh) > 0 || len(buildKit.CacheFrom) > 0 || buildKit.CacheTo != "" {
+			return fmt.Errorf("buildKit secrets, ssh and cache settings require buildKit.enabled")
+		}
+		return nil
+	}
+
+	secretIds := map[string]bool{}
+	for _, secret := range buildKit.Secrets {
+		if secret.Id == "" {
+			return fmt.Errorf("buildKit secrets must specify an id")
+		}
+		if secretIds[secret.Id] {
+			return fmt.Errorf("buildKit secret %s is specified more than once", secret.Id)
+		}
+		secretIds[secret.Id] = true
+
+		if secret.File != "" && secret.Env != "" {
+			return fmt.Errorf("buildKit secret %s cannot specify both file and env", secret.Id)
+		}
+		if secret.File == "" && secret.Env == "" {
+			return fmt.Errorf("buildKit secret %s must specify either file or env", secret.Id)
+		}
+	}
+
+	sshIds := map[string]bool{}
+	for _, ssh := range buildKit.Ssh {
+		id := ssh.Id
+		if id == "" {
+			id = "default"
+		}
+		if sshIds[id] {
+			return fmt.Errorf("buildKit ssh %s is specified more than once", id)
+		}
+		sshIds[id] = true
+	}
+
+	return nil
+}
@@ -0,0 +1,98 @@
+package service
+
+import (
+	"fmt"
+	"github.com/ruckstack/ruckstack/builder/internal/cache"
+	"github.com/ruckstack/ruckstack/builder/internal/docker"
+	"github.com/ruckstack/ruckstack/common/ui"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+/**
+What the last build of a Dockerfile service produced, so the next build can reuse it if nothing changed
+*/
+type dockerfileBuild struct {
+	//InputHash covers the service config, build context, architecture and ruckstack version
+	InputHash string `yaml:"inputHash"`
+
+	ServiceVersion string `yaml:"serviceVersion"`
+	ImageId        string `yaml:"imageId"`
+}
+
+/**
+Returns the last build of the service if its inputs have not changed and its image still exists, otherwise nil
+*/
+func (service *DockerfileService) cachedBuild(cacheDir string, inputHash string, architecture string) *dockerfileBuild {
+	buildPath := filepath.Join(cacheDir, "build.yaml")
+	if !cache.Lookup(buildPath) || !cache.Lookup(filepath.Join(cacheDir, "chart.tgz")) {
+		return nil
+	}
+
+	content, err := ioutil.ReadFile(buildPath)
+	if err != nil {
+		return nil
+	}
+	build := &dockerfileBuild{}
+	if err := yaml.Unmarshal(content, build); err != nil {
+		ui.VPrintf("Cannot parse %s: %s", buildPath, err)
+		return nil
+	}
+	if build.InputHash != inputHash {
+		ui.VPrintf("Inputs to %s changed since the last build", service.Id)
+		return nil
+	}
+
+	cachedService := *service
+	cachedService.ServiceVersion = build.ServiceVersion
+	imageId, err := docker.ImageId(cachedService.dockerTag(architecture))
+	if err != nil || imageId != build.ImageId {
+		ui.VPrintf("Image for %s is no longer available", service.Id)
+		return nil
+	}
+
+	return build
+}
+
+/**
+Saves the chart and what was built so the next build can skip the service if nothing changes
+*/
+func (service *DockerfileService) saveBuild(cacheDir string, inputHash string, dockerTag string, chart string) error {
+	imageId, err := docker.ImageId(dockerTag)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return err
+	}
+
+	chartContent, err := ioutil.ReadFile(chart)
+	if err != nil {
+		return err
+	}
+	chartPath := filepath.Join(cacheDir, "chart.tgz")
+	if err := ioutil.WriteFile(chartPath, chartContent, 0644); err != nil {
+		return fmt.Errorf("cannot write %s: %s", chartPath, err)
+	}
+	if err := cache.Record(chartPath); err != nil {
+		return err
+	}
+
+	buildContent, err := yaml.Marshal(dockerfileBuild{
+		InputHash:      inputHash,
+		ServiceVersion: service.ServiceVersion,
+		ImageId:        imageId,
+	})
+	if err != nil {
+		return err
+	}
+	buildPath := filepath.Join(cacheDir, "build.yaml")
+	if err := ioutil.WriteFile(buildPath, buildContent, 0644); err != nil {
+		return fmt.Errorf("cannot write %s: %s", buildPath, err)
+	}
+
+	return cache.Record(buildPath)
+}
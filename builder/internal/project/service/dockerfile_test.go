@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"compress/flate"
 	"github.com/ruckstack/ruckstack/builder/internal/builder/install_file"
+	"github.com/ruckstack/ruckstack/builder/internal/cache"
 	"github.com/ruckstack/ruckstack/builder/internal/environment"
 	"github.com/ruckstack/ruckstack/common/global_util"
 	"github.com/ruckstack/ruckstack/common/ui"
@@ -80,7 +81,7 @@ func TestDockerfileService_Build(t *testing.T) {
 				ServiceVersion: "0.5.2",
 			}
 
-			installFile, err := install_file.StartCreation(outFile, flate.BestSpeed)
+			installFile, err := install_file.StartCreation(outFile, flate.BestSpeed, "amd64")
 			assert.NoError(t, err)
 
 			err = service.Build(installFile)
@@ -109,3 +110,169 @@ func TestDockerfileService_Build(t *testing.T) {
 		})
 	}
 }
+
+func TestDockerfileService_ContentVersion(t *testing.T) {
+	projectDir := environment.TempPath("dockerfile-version-test-*")
+	assert.NoError(t, os.MkdirAll(filepath.Join(projectDir, "app"), 0755))
+	defer os.RemoveAll(projectDir)
+
+	defer func(original string) { environment.ProjectDir = original }(environment.ProjectDir)
+	environment.ProjectDir = projectDir
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(projectDir, "app", "Dockerfile"), []byte("FROM nginx:1.19"), 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(projectDir, "app", "index.html"), []byte("hello"), 0644))
+
+	service := &DockerfileService{
+		Id:         "test-service",
+		Dockerfile: "app/Dockerfile",
+	}
+
+	version, err := service.contentVersion()
+	assert.NoError(t, err)
+	assert.Regexp(t, `^0\.0\.0-sha[0-9a-f]{12}$`, version)
+
+	sameVersion, err := service.contentVersion()
+	assert.NoError(t, err)
+	assert.Equal(t, version, sameVersion)
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(projectDir, "app", "index.html"), []byte("changed"), 0644))
+	changedVersion, err := service.contentVersion()
+	assert.NoError(t, err)
+	assert.NotEqual(t, version, changedVersion, "changing the build context should change the version")
+
+	service.Http.ContainerPort = 8080
+	configChangedVersion, err := service.contentVersion()
+	assert.NoError(t, err)
+	assert.NotEqual(t, changedVersion, configChangedVersion, "changing the service config should change the version")
+}
+
+func TestDockerfileService_CachedBuild(t *testing.T) {
+	cacheDir := environment.CachePath(filepath.Join("services", "test-project", "cached-build-test-amd64"))
+	assert.NoError(t, os.RemoveAll(cacheDir))
+	assert.NoError(t, os.MkdirAll(cacheDir, 0755))
+	defer os.RemoveAll(cacheDir)
+
+	service := &DockerfileService{
+		Id:        "cached-build-test",
+		ProjectId: "test-project",
+	}
+
+	assert.Nil(t, service.cachedBuild(cacheDir, "abc123", "amd64"), "nothing cached yet")
+
+	chartPath := filepath.Join(cacheDir, "chart.tgz")
+	assert.NoError(t, ioutil.WriteFile(chartPath, []byte("chart"), 0644))
+	assert.NoError(t, cache.Record(chartPath))
+	buildPath := filepath.Join(cacheDir, "build.yaml")
+	assert.NoError(t, ioutil.WriteFile(buildPath, []byte("inputHash: abc123\nserviceVersion: 0.0.1\nimageId: sha256:1234\n"), 0644))
+	assert.NoError(t, cache.Record(buildPath))
+
+	assert.Nil(t, service.cachedBuild(cacheDir, "def456", "amd64"), "inputs changed")
+
+	assert.NoError(t, ioutil.WriteFile(chartPath, []byte("truncated"), 0644))
+	assert.Nil(t, service.cachedBuild(cacheDir, "abc123", "amd64"), "cached chart is invalid")
+}
+
+func TestDockerfileServiceBuildKit_Validate(t *testing.T) {
+	tests := []struct {
+		name     string
+		buildKit DockerfileServiceBuildKit
+		wantErr  string
+	}{
+		{
+			name: "Not enabled",
+		},
+		{
+			name: "Enabled with secrets and ssh",
+			buildKit: DockerfileServiceBuildKit{
+				Enabled: true,
+				Secrets: []DockerfileServiceBuildSecret{
+					{Id: "npmrc", File: ".npmrc"},
+					{Id: "token", Env: "API_TOKEN"},
+				},
+				Ssh:       []DockerfileServiceBuildSsh{{}, {Id: "github", Paths: []string{"keys/github"}}},
+				CacheFrom: []string{"registry.example.com/app:cache"},
+				CacheTo:   "registry.example.com/app:cache",
+			},
+		},
+		{
+			name: "Options without enabled",
+			buildKit: DockerfileServiceBuildKit{
+				CacheFrom: []string{"registry.example.com/app:cache"},
+			},
+			wantErr: "buildKit secrets, ssh and cache settings require buildKit.enabled",
+		},
+		{
+			name: "Secret without id",
+			buildKit: DockerfileServiceBuildKit{
+				Enabled: true,
+				Secrets: []DockerfileServiceBuildSecret{{File: ".npmrc"}},
+			},
+			wantErr: "buildKit secrets must specify an id",
+		},
+		{
+			name: "Secret with file and env",
+			buildKit: DockerfileServiceBuildKit{
+				Enabled: true,
+				Secrets: []DockerfileServiceBuildSecret{{Id: "token", File: ".npmrc", Env: "API_TOKEN"}},
+			},
+			wantErr: "buildKit secret token cannot specify both file and env",
+		},
+		{
+			name: "Secret without source",
+			buildKit: DockerfileServiceBuildKit{
+				Enabled: true,
+				Secrets: []DockerfileServiceBuildSecret{{Id: "token"}},
+			},
+			wantErr: "buildKit secret token must specify either file or env",
+		},
+		{
+			name: "Duplicate secret",
+			buildKit: DockerfileServiceBuildKit{
+				Enabled: true,
+				Secrets: []DockerfileServiceBuildSecret{{Id: "token", Env: "A"}, {Id: "token", Env: "B"}},
+			},
+			wantErr: "buildKit secret token is specified more than once",
+		},
+		{
+			name: "Duplicate default ssh",
+			buildKit: DockerfileServiceBuildKit{
+				Enabled: true,
+				Ssh:     []DockerfileServiceBuildSsh{{}, {Id: "default"}},
+			},
+			wantErr: "buildKit ssh default is specified more than once",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.buildKit.validate()
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestDockerfileService_BuildKitOptions(t *testing.T) {
+	defer func(original string) { environment.ProjectDir = original }(environment.ProjectDir)
+	environment.ProjectDir = "/project"
+
+	service := &DockerfileService{}
+	assert.Nil(t, service.buildKitOptions(), "classic builder unless enabled")
+
+	service.BuildKit = DockerfileServiceBuildKit{
+		Enabled: true,
+		Secrets: []DockerfileServiceBuildSecret{
+			{Id: "npmrc", File: "secrets/.npmrc"},
+			{Id: "token", Env: "API_TOKEN"},
+		},
+		Ssh: []DockerfileServiceBuildSsh{{Id: "github", Paths: []string{"/keys/github", "keys/other"}}},
+	}
+	options := service.buildKitOptions()
+	if assert.NotNil(t, options) {
+		assert.Equal(t, "/project/secrets/.npmrc", options.Secrets[0].File)
+		assert.Equal(t, "API_TOKEN", options.Secrets[1].Env)
+		assert.Equal(t, []string{"/keys/github", "/project/keys/other"}, options.Ssh[0].Paths)
+	}
+}
@@ -1,19 +1,23 @@
 package service
 
 import (
+	"fmt"
+	"github.com/Masterminds/semver/v3"
 	"github.com/go-playground/validator/v10"
 	"github.com/ruckstack/ruckstack/builder/internal/builder/install_file"
 	"github.com/ruckstack/ruckstack/builder/internal/environment"
 	"github.com/ruckstack/ruckstack/builder/internal/helm"
-	"github.com/ruckstack/ruckstack/common/ui"
+	"github.com/ruckstack/ruckstack/builder/internal/render"
 	"os"
+	"strings"
 )
 
 type HelmService struct {
 	//Common fields
-	Id             string `validate:"required"`
-	ProjectId      string
-	ProjectVersion string
+	Id               string `validate:"required"`
+	ProjectId        string
+	ProjectVersion   string
+	AdditionalImages []string `yaml:"additionalImages"`
 
 	//Unique Fields
 	Chart   string `validate:"required"`
@@ -47,11 +51,14 @@ func (service *HelmService) Validate(structValidator *validator.Validate) error
 	if err := structValidator.Struct(service); err != nil {
 		return err
 	}
+	if _, err := semver.NewVersion(service.Version); err != nil {
+		return fmt.Errorf("chart version %s is not a semantic version", service.Version)
+	}
 	return nil
 }
 
 func (service *HelmService) Build(installFile *install_file.InstallFile) error {
-	ui.Printf("Building Helm Service %s", service.Id)
+	installFile.Printf("Building Helm Service %s", service.Id)
 
 	serviceWorkDir := environment.TempPath(service.Id + "-*")
 	if err := os.MkdirAll(serviceWorkDir, 0755); err != nil {
@@ -63,9 +70,32 @@ func (service *HelmService) Build(installFile *install_file.InstallFile) error {
 		return err
 	}
 
-	if err := installFile.AddHelmChart(chartFile, service.Id, service.Parameters); err != nil {
+	repositoryUrl, err := helm.RepositoryUrl(strings.Split(service.Chart, "/")[0])
+	if err != nil {
 		return err
 	}
 
+	if err := installFile.AddHelmChart(chartFile, service.Id, repositoryUrl, service.Parameters); err != nil {
+		return err
+	}
+
+	for _, image := range service.AdditionalImages {
+		if err := installFile.AddImage(image); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
+
+/**
+Writes the HelmChart resource for the service and the chart rendered with its parameters
+*/
+func (service *HelmService) Render(renderer *render.Renderer) error {
+	chartFile, err := helm.DownloadChart(service.Chart, service.Version)
+	if err != nil {
+		return err
+	}
+
+	return renderer.AddHelmChart(chartFile, service.Id, service.Parameters)
+}
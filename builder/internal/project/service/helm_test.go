@@ -95,7 +95,7 @@ func TestHelmService_Build(t *testing.T) {
 				Parameters:     tt.args.values,
 			}
 
-			installFile, err := install_file.StartCreation(outFile, flate.BestSpeed)
+			installFile, err := install_file.StartCreation(outFile, flate.BestSpeed, "amd64")
 			assert.NoError(t, err)
 
 			err = service.Build(installFile)
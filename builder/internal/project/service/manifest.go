@@ -1,11 +1,12 @@
 package service
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/go-playground/validator/v10"
 	"github.com/ruckstack/ruckstack/builder/internal/builder/install_file"
 	"github.com/ruckstack/ruckstack/builder/internal/environment"
-	"github.com/ruckstack/ruckstack/common/ui"
+	"github.com/ruckstack/ruckstack/builder/internal/render"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -13,9 +14,10 @@ import (
 
 type ManifestService struct {
 	//Common fields
-	Id             string `validate:"required"`
-	ProjectId      string
-	ProjectVersion string
+	Id               string `validate:"required"`
+	ProjectId        string
+	ProjectVersion   string
+	AdditionalImages []string `yaml:"additionalImages"`
 
 	//Unique Fields
 	Manifest string `validate:"required"`
@@ -54,29 +56,86 @@ func (service *ManifestService) Validate(structValidator *validator.Validate) er
 }
 
 func (service *ManifestService) Build(installFile *install_file.InstallFile) error {
-	ui.Printf("Building Manifest Service %s", service.Id)
+	installFile.Printf("Building Manifest Service %s", service.Id)
 
-	fullManifestPath := filepath.Join(environment.ProjectDir, service.Manifest)
-	fullManifestFile, err := os.Open(fullManifestPath)
+	fullManifestPath, fullManifestInfo, fullManifestContent, err := service.readManifest()
 	if err != nil {
 		return err
 	}
-	fullManifestContent, err := ioutil.ReadFile(fullManifestPath)
-	if err != nil {
-		return fmt.Errorf("error reading %s: %s", fullManifestPath, err)
+
+	if err := installFile.AddImagesInManifest(fullManifestContent); err != nil {
+		return fmt.Errorf("error parsing manifest %s: %s", service.Manifest, err)
 	}
 
-	if len(fullManifestContent) == 0 {
-		return fmt.Errorf("empty manifest file %s", service.Manifest)
+	pinnedManifestContent, err := installFile.PinImagesInManifest(fullManifestContent)
+	if err != nil {
+		return fmt.Errorf("error pinning images in manifest %s: %s", service.Manifest, err)
 	}
 
-	if err := installFile.AddFile(fullManifestFile, "data/server/manifests/"+service.Id+".yaml"); err != nil {
+	if err := installFile.AddFileData(bytes.NewReader(pinnedManifestContent), int64(len(pinnedManifestContent)), "data/server/manifests/"+service.Id+".yaml", fullManifestInfo.ModTime()); err != nil {
 		return fmt.Errorf("error adding %s to installer: %s", fullManifestPath, err)
 	}
 
-	if err := installFile.AddImagesInManifest(fullManifestContent); err != nil {
-		return fmt.Errorf("error parsing manifest %s: %s", service.Manifest, err)
+	for _, image := range service.AdditionalImages {
+		if err := installFile.AddImage(image); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
+
+/**
+Writes the manifest with its images pinned to the digests in the lock file
+*/
+func (service *ManifestService) Render(renderer *render.Renderer) error {
+	_, _, fullManifestContent, err := service.readManifest()
+	if err != nil {
+		return err
+	}
+
+	pinnedManifestContent, err := renderer.PinImagesInManifest(fullManifestContent)
+	if err != nil {
+		return fmt.Errorf("error pinning images in manifest %s: %s", service.Manifest, err)
+	}
+
+	return renderer.WriteFile(service.Id, service.Id+".yaml", pinnedManifestContent)
+}
+
+/**
+Returns the images of the containers in the manifest and the additional images
+*/
+func (service *ManifestService) Images() ([]string, error) {
+	_, _, fullManifestContent, err := service.readManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	images, err := install_file.ImagesInManifest(fullManifestContent)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing manifest %s: %s", service.Manifest, err)
+	}
+
+	return append(images, service.AdditionalImages...), nil
+}
+
+/**
+Returns the path, file info and content of the manifest file
+*/
+func (service *ManifestService) readManifest() (string, os.FileInfo, []byte, error) {
+	fullManifestPath := filepath.Join(environment.ProjectDir, service.Manifest)
+	fullManifestInfo, err := os.Stat(fullManifestPath)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	fullManifestContent, err := ioutil.ReadFile(fullManifestPath)
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("error reading %s: %s", fullManifestPath, err)
+	}
+
+	if len(fullManifestContent) == 0 {
+		return "", nil, nil, fmt.Errorf("empty manifest file %s", service.Manifest)
+	}
+
+	return fullManifestPath, fullManifestInfo, fullManifestContent, nil
+}
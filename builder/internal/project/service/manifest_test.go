@@ -77,7 +77,7 @@ func TestManifestService_Build(t *testing.T) {
 				Manifest:       "test-manifest.yaml",
 			}
 
-			installFile, err := install_file.StartCreation(outFile, flate.BestSpeed)
+			installFile, err := install_file.StartCreation(outFile, flate.BestSpeed, "amd64")
 			assert.NoError(t, err)
 
 			err = service.Build(installFile)
@@ -0,0 +1,352 @@
+package registry
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"github.com/docker/distribution/reference"
+	godigest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/ruckstack/ruckstack/builder/internal/cache"
+	"github.com/ruckstack/ruckstack/common/ui"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+Image backend that reads images directly from registries and OCI layout directories without a docker daemon.
+*/
+type Backend struct {
+	Client *Client
+
+	//LayoutDirs are OCI layout directories checked for an image before its registry
+	LayoutDirs []string
+
+	//Architecture is the platform to select from multi-platform images
+	Architecture string
+
+	images     map[string]*pulledImage
+	imagesLock sync.Mutex
+}
+
+func NewBackend(layoutDirs []string, credentials *CredentialStore) *Backend {
+	return &Backend{
+		Client:       NewClient(credentials),
+		LayoutDirs:   layoutDirs,
+		Architecture: "amd64",
+		images:       map[string]*pulledImage{},
+	}
+}
+
+func (backend *Backend) Name() string {
+	return "registry"
+}
+
+/**
+Downloads the given image into the blob cache.
+If digest is set, that digest is downloaded instead of the current contents of imageRef.
+*/
+func (backend *Backend) Pull(imageRef string, digest string) error {
+	if strings.HasPrefix(imageRef, "build.local/") {
+		return fmt.Errorf("cannot use locally built image %s without docker", imageRef)
+	}
+
+	source, tagOrDigest, err := backend.locate(imageRef, digest)
+	if err != nil {
+		return err
+	}
+
+	ui.VPrintf("Pulling %s...", imageRef)
+	manifest, manifestDigest, err := resolveManifest(source, tagOrDigest, backend.Architecture)
+	if err != nil {
+		return err
+	}
+
+	image, err := pullImage(source, manifest, manifestDigest)
+	if err != nil {
+		return fmt.Errorf("error pulling %s: %s", imageRef, err)
+	}
+
+	backend.imagesLock.Lock()
+	backend.images[imageRef] = image
+	backend.imagesLock.Unlock()
+
+	return nil
+}
+
+/**
+Returns true if the image's manifest and blobs are in an OCI layout or the cache, so it can be pulled with --offline
+*/
+func (backend *Backend) Available(imageRef string, digest string) bool {
+	if strings.HasPrefix(imageRef, "build.local/") {
+		return false
+	}
+
+	source, tagOrDigest, err := backend.locate(imageRef, digest)
+	if err != nil {
+		return false
+	}
+	registry, isRegistry := source.(*registrySource)
+	if !isRegistry {
+		return true
+	}
+
+	cached := *registry
+	cached.cacheOnly = true
+	manifest, _, err := resolveManifest(&cached, tagOrDigest, backend.Architecture)
+	if err != nil {
+		return false
+	}
+
+	for _, blob := range append([]ocispec.Descriptor{manifest.Config}, manifest.Layers...) {
+		if !cache.Lookup(blobCachePath(blob.Digest)) {
+			return false
+		}
+	}
+	return true
+}
+
+/**
+Returns where to read the image from and the tag or digest to read from it
+*/
+func (backend *Backend) locate(imageRef string, digest string) (imageSource, string, error) {
+	named, err := reference.ParseNormalizedNamed(imageRef)
+	if err != nil {
+		return nil, "", err
+	}
+	named = reference.TagNameOnly(named)
+
+	tagOrDigest := ""
+	if digest != "" {
+		tagOrDigest = digest
+	} else if canonical, isDigested := named.(reference.Canonical); isDigested {
+		tagOrDigest = canonical.Digest().String()
+	} else {
+		tagOrDigest = named.(reference.Tagged).Tag()
+	}
+
+	source, err := backend.sourceFor(named)
+	if err != nil {
+		return nil, "", err
+	}
+	if layout, isLayout := source.(*layoutSource); isLayout && digest == "" {
+		descriptor, _ := layout.find(named)
+		tagOrDigest = descriptor.Digest.String()
+	}
+
+	return source, tagOrDigest, nil
+}
+
+/**
+Returns the layout containing the image, or the image's registry if no layout has it
+*/
+func (backend *Backend) sourceFor(named reference.Named) (imageSource, error) {
+	for _, layoutDir := range backend.LayoutDirs {
+		layout, err := openLayout(layoutDir)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, found := layout.find(named); found {
+			ui.VPrintf("Using %s from OCI layout %s", reference.FamiliarString(named), layoutDir)
+			return layout, nil
+		}
+	}
+
+	return backend.Client.source(named), nil
+}
+
+func (backend *Backend) pulled(imageRef string) (*pulledImage, error) {
+	backend.imagesLock.Lock()
+	defer backend.imagesLock.Unlock()
+
+	image, found := backend.images[imageRef]
+	if !found {
+		return nil, fmt.Errorf("%s has not been pulled", imageRef)
+	}
+	return image, nil
+}
+
+func (backend *Backend) Digest(imageRef string) (string, error) {
+	image, err := backend.pulled(imageRef)
+	if err != nil {
+		return "", err
+	}
+
+	return image.digest.String(), nil
+}
+
+/**
+Returns the uncompressed size of the image's layers
+*/
+func (backend *Backend) Size(imageRef string) (int64, error) {
+	image, err := backend.pulled(imageRef)
+	if err != nil {
+		return 0, err
+	}
+
+	return image.size, nil
+}
+
+/**
+Writes the given images as a tar in the same format as `docker save`
+*/
+func (backend *Backend) Save(outputPath string, imageRefs ...string) error {
+	defer ui.StartProgressf("Exporting images").Stop()
+
+	outputFile, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	defer outputFile.Close()
+
+	tarWriter := tar.NewWriter(outputFile)
+
+	type manifestEntry struct {
+		Config   string
+		RepoTags []string
+		Layers   []string
+	}
+	var manifest []manifestEntry
+	repositories := map[string]map[string]string{}
+	writtenFiles := map[string]bool{}
+
+	for _, imageRef := range imageRefs {
+		image, err := backend.pulled(imageRef)
+		if err != nil {
+			return err
+		}
+
+		named, err := reference.ParseNormalizedNamed(imageRef)
+		if err != nil {
+			return err
+		}
+
+		configDigest := godigest.FromBytes(image.config)
+		entry := manifestEntry{
+			Config: configDigest.Encoded() + ".json",
+		}
+		if tagged, isTagged := reference.TagNameOnly(named).(reference.Tagged); isTagged {
+			if _, isDigested := named.(reference.Canonical); !isDigested {
+				entry.RepoTags = []string{reference.FamiliarString(tagged)}
+
+				repositoryName := reference.FamiliarName(named)
+				if repositories[repositoryName] == nil {
+					repositories[repositoryName] = map[string]string{}
+				}
+				repositories[repositoryName][tagged.Tag()] = configDigest.Encoded()
+			}
+		}
+
+		if !writtenFiles[entry.Config] {
+			if err := writeTarEntry(tarWriter, entry.Config, image.config); err != nil {
+				return err
+			}
+			writtenFiles[entry.Config] = true
+		}
+
+		for i, layer := range image.manifest.Layers {
+			layerDir := image.diffIds[i].Encoded()
+			entry.Layers = append(entry.Layers, layerDir+"/layer.tar")
+
+			//layers shared between images are only written once
+			if writtenFiles[layerDir] {
+				continue
+			}
+			writtenFiles[layerDir] = true
+
+			if err := writeTarEntry(tarWriter, layerDir+"/VERSION", []byte("1.0")); err != nil {
+				return err
+			}
+			layerJson, err := json.Marshal(map[string]string{"id": layerDir})
+			if err != nil {
+				return err
+			}
+			if err := writeTarEntry(tarWriter, layerDir+"/json", layerJson); err != nil {
+				return err
+			}
+			if err := writeLayer(tarWriter, layerDir+"/layer.tar", layer, image.diffIds[i]); err != nil {
+				return err
+			}
+		}
+
+		manifest = append(manifest, entry)
+	}
+
+	manifestJson, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	if err := writeTarEntry(tarWriter, "manifest.json", manifestJson); err != nil {
+		return err
+	}
+
+	repositoriesJson, err := json.Marshal(repositories)
+	if err != nil {
+		return err
+	}
+	if err := writeTarEntry(tarWriter, "repositories", repositoriesJson); err != nil {
+		return err
+	}
+
+	return tarWriter.Close()
+}
+
+func writeTarEntry(tarWriter *tar.Writer, name string, content []byte) error {
+	if err := tarWriter.WriteHeader(&tar.Header{
+		Name:     name,
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     int64(len(content)),
+		ModTime:  time.Unix(0, 0),
+	}); err != nil {
+		return err
+	}
+
+	_, err := tarWriter.Write(content)
+	return err
+}
+
+/**
+Writes the uncompressed layer. The tar header needs the size before the content, so the layer is read once to measure it.
+*/
+func writeLayer(tarWriter *tar.Writer, name string, layer ocispec.Descriptor, diffId godigest.Digest) error {
+	layerReader, err := openLayer(layer)
+	if err != nil {
+		return err
+	}
+	size, err := io.Copy(io.Discard, layerReader)
+	_ = layerReader.Close()
+	if err != nil {
+		return fmt.Errorf("cannot read layer %s: %s", layer.Digest, err)
+	}
+
+	if err := tarWriter.WriteHeader(&tar.Header{
+		Name:     name,
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     size,
+		ModTime:  time.Unix(0, 0),
+	}); err != nil {
+		return err
+	}
+
+	layerReader, err = openLayer(layer)
+	if err != nil {
+		return err
+	}
+	defer layerReader.Close()
+
+	verifier := diffId.Verifier()
+	if _, err := io.Copy(io.MultiWriter(tarWriter, verifier), layerReader); err != nil {
+		return fmt.Errorf("cannot write layer %s: %s", layer.Digest, err)
+	}
+	if !verifier.Verified() {
+		return fmt.Errorf("cached layer %s does not match %s", layer.Digest, diffId)
+	}
+
+	return nil
+}
@@ -0,0 +1,360 @@
+package registry
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/ruckstack/ruckstack/common/ui"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/**
+Registry settings from the project file.
+Passwords are read from an environment variable or file so they are never stored in the project or the installer.
+*/
+type Config struct {
+	Host         string `validate:"required"`
+	Username     string
+	PasswordEnv  string `yaml:"passwordEnv"`
+	PasswordFile string `yaml:"passwordFile"`
+
+	//CaCert is a PEM file used to verify the registry's certificate
+	CaCert string `yaml:"caCert"`
+}
+
+func (config *Config) Validate() error {
+	if config.PasswordEnv != "" && config.PasswordFile != "" {
+		return fmt.Errorf("registry %s cannot set both passwordEnv and passwordFile", config.Host)
+	}
+	if config.Username != "" && config.PasswordEnv == "" && config.PasswordFile == "" {
+		return fmt.Errorf("registry %s must set passwordEnv or passwordFile", config.Host)
+	}
+	if config.Username == "" && (config.PasswordEnv != "" || config.PasswordFile != "") {
+		return fmt.Errorf("registry %s must set a username", config.Host)
+	}
+
+	return nil
+}
+
+type Credentials struct {
+	Username string
+	Password string
+
+	//IdentityToken is an OAuth refresh token, as stored by `docker login` for some registries
+	IdentityToken string
+}
+
+/**
+Finds credentials for registries: first from the project's registries, then from the docker config file and its credential helpers.
+*/
+type CredentialStore struct {
+	Registries []Config
+	ProjectDir string
+
+	//DockerConfigPath defaults to $DOCKER_CONFIG/config.json or ~/.docker/config.json
+	DockerConfigPath string
+
+	found     map[string]*Credentials
+	foundLock sync.Mutex
+}
+
+func NewCredentialStore(registries []Config, projectDir string) *CredentialStore {
+	return &CredentialStore{
+		Registries: registries,
+		ProjectDir: projectDir,
+		found:      map[string]*Credentials{},
+	}
+}
+
+/**
+Structure of ~/.docker/config.json used for finding credentials
+*/
+type dockerConfigFile struct {
+	Auths map[string]struct {
+		Auth          string `json:"auth"`
+		Username      string `json:"username"`
+		Password      string `json:"password"`
+		IdentityToken string `json:"identitytoken"`
+	} `json:"auths"`
+	CredsStore  string            `json:"credsStore"`
+	CredHelpers map[string]string `json:"credHelpers"`
+}
+
+/**
+Returns the credentials for the given registry host, or nil if there are none
+*/
+func (store *CredentialStore) Lookup(host string) (*Credentials, error) {
+	if store == nil {
+		return nil, nil
+	}
+	host = normalizeHost(host)
+
+	store.foundLock.Lock()
+	defer store.foundLock.Unlock()
+
+	if credentials, found := store.found[host]; found {
+		return credentials, nil
+	}
+
+	credentials, err := store.lookupProject(host)
+	if err == nil && credentials == nil {
+		credentials, err = store.lookupDockerConfig(host)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	store.found[host] = credentials
+	return credentials, nil
+}
+
+func (store *CredentialStore) lookupProject(host string) (*Credentials, error) {
+	registryConfig := store.registryConfig(host)
+	if registryConfig == nil || registryConfig.Username == "" {
+		return nil, nil
+	}
+
+	password := ""
+	if registryConfig.PasswordEnv != "" {
+		password = os.Getenv(registryConfig.PasswordEnv)
+		if password == "" {
+			return nil, fmt.Errorf("environment variable %s for the %s password is not set", registryConfig.PasswordEnv, registryConfig.Host)
+		}
+	} else {
+		passwordPath := store.projectPath(registryConfig.PasswordFile)
+		content, err := ioutil.ReadFile(passwordPath)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read password for %s: %s", registryConfig.Host, err)
+		}
+		password = strings.TrimSpace(string(content))
+	}
+
+	ui.VPrintf("Using credentials for %s from the project", host)
+	return &Credentials{
+		Username: registryConfig.Username,
+		Password: password,
+	}, nil
+}
+
+func (store *CredentialStore) lookupDockerConfig(host string) (*Credentials, error) {
+	dockerConfig, err := store.readDockerConfig()
+	if err != nil || dockerConfig == nil {
+		return nil, err
+	}
+
+	if helper := dockerConfig.CredHelpers[dockerConfigKey(dockerConfig.CredHelpers, host)]; helper != "" {
+		return runCredentialHelper(helper, host)
+	}
+
+	for key, auth := range dockerConfig.Auths {
+		if normalizeHost(key) != host {
+			continue
+		}
+
+		credentials := &Credentials{
+			Username:      auth.Username,
+			Password:      auth.Password,
+			IdentityToken: auth.IdentityToken,
+		}
+		if auth.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("invalid auth for %s in docker config: %s", key, err)
+			}
+			usernamePassword := strings.SplitN(string(decoded), ":", 2)
+			if len(usernamePassword) != 2 {
+				return nil, fmt.Errorf("invalid auth for %s in docker config", key)
+			}
+			credentials.Username = usernamePassword[0]
+			credentials.Password = usernamePassword[1]
+		}
+		if credentials.Username != "" || credentials.IdentityToken != "" {
+			ui.VPrintf("Using credentials for %s from docker config", host)
+			return credentials, nil
+		}
+	}
+
+	if dockerConfig.CredsStore != "" {
+		return runCredentialHelper(dockerConfig.CredsStore, host)
+	}
+
+	return nil, nil
+}
+
+func (store *CredentialStore) readDockerConfig() (*dockerConfigFile, error) {
+	configPath := store.DockerConfigPath
+	if configPath == "" {
+		if dockerConfigDir := os.Getenv("DOCKER_CONFIG"); dockerConfigDir != "" {
+			configPath = filepath.Join(dockerConfigDir, "config.json")
+		} else {
+			userHome, err := os.UserHomeDir()
+			if err != nil {
+				return nil, nil
+			}
+			configPath = filepath.Join(userHome, ".docker", "config.json")
+		}
+	}
+
+	content, err := ioutil.ReadFile(configPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read docker config %s: %s", configPath, err)
+	}
+
+	dockerConfig := &dockerConfigFile{}
+	if err := json.Unmarshal(content, dockerConfig); err != nil {
+		return nil, fmt.Errorf("cannot parse docker config %s: %s", configPath, err)
+	}
+
+	return dockerConfig, nil
+}
+
+/**
+Runs docker-credential-<helper> the same way the docker CLI does
+*/
+func runCredentialHelper(helper string, host string) (*Credentials, error) {
+	serverUrl := host
+	if host == "docker.io" {
+		serverUrl = "https://index.docker.io/v1/"
+	}
+
+	ui.VPrintf("Getting credentials for %s from docker-credential-%s", host, helper)
+	command := exec.Command("docker-credential-"+helper, "get")
+	command.Stdin = strings.NewReader(serverUrl)
+	stderr := new(bytes.Buffer)
+	command.Stderr = stderr
+	output, err := command.Output()
+	if err != nil {
+		if strings.Contains(string(output)+stderr.String(), "credentials not found") {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error running docker-credential-%s for %s: %s", helper, host, err)
+	}
+
+	helperResponse := struct {
+		Username string
+		Secret   string
+	}{}
+	if err := json.Unmarshal(output, &helperResponse); err != nil {
+		return nil, fmt.Errorf("cannot parse docker-credential-%s output: %s", helper, err)
+	}
+
+	if helperResponse.Username == "<token>" {
+		return &Credentials{IdentityToken: helperResponse.Secret}, nil
+	}
+	return &Credentials{
+		Username: helperResponse.Username,
+		Password: helperResponse.Secret,
+	}, nil
+}
+
+/**
+Returns the TLS config for the given host, trusting its caCert if one is configured
+*/
+func (store *CredentialStore) TLSConfig(host string) (*tls.Config, error) {
+	if store == nil {
+		return nil, nil
+	}
+
+	registryConfig := store.registryConfig(normalizeHost(host))
+	if registryConfig == nil || registryConfig.CaCert == "" {
+		return nil, nil
+	}
+
+	caCertPath := store.projectPath(registryConfig.CaCert)
+	caCert, err := ioutil.ReadFile(caCertPath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read caCert for %s: %s", registryConfig.Host, err)
+	}
+
+	certPool, err := x509.SystemCertPool()
+	if err != nil || certPool == nil {
+		certPool = x509.NewCertPool()
+	}
+	if !certPool.AppendCertsFromPEM(caCert) {
+		return nil, fmt.Errorf("no certificates found in %s", caCertPath)
+	}
+
+	return &tls.Config{RootCAs: certPool}, nil
+}
+
+/**
+Returns every host credentials may be available for. Used when the host is not known in advance, such as Dockerfile base images.
+*/
+func (store *CredentialStore) Hosts() []string {
+	if store == nil {
+		return nil
+	}
+
+	hosts := map[string]bool{}
+	for _, registryConfig := range store.Registries {
+		hosts[normalizeHost(registryConfig.Host)] = true
+	}
+	if dockerConfig, err := store.readDockerConfig(); err == nil && dockerConfig != nil {
+		for key := range dockerConfig.Auths {
+			hosts[normalizeHost(key)] = true
+		}
+		for key := range dockerConfig.CredHelpers {
+			hosts[normalizeHost(key)] = true
+		}
+	}
+
+	var sortedHosts []string
+	for host := range hosts {
+		sortedHosts = append(sortedHosts, host)
+	}
+	sort.Strings(sortedHosts)
+
+	return sortedHosts
+}
+
+func (store *CredentialStore) registryConfig(host string) *Config {
+	for i, registryConfig := range store.Registries {
+		if normalizeHost(registryConfig.Host) == host {
+			return &store.Registries[i]
+		}
+	}
+	return nil
+}
+
+func (store *CredentialStore) projectPath(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(store.ProjectDir, path)
+}
+
+/**
+Returns the host without a scheme or path. All Docker Hub hostnames become docker.io
+*/
+func normalizeHost(host string) string {
+	host = strings.TrimPrefix(host, "https://")
+	host = strings.TrimPrefix(host, "http://")
+	host = strings.SplitN(host, "/", 2)[0]
+
+	switch host {
+	case "index.docker.io", "registry-1.docker.io", "registry.hub.docker.com":
+		return "docker.io"
+	}
+	return host
+}
+
+func dockerConfigKey(values map[string]string, host string) string {
+	for key := range values {
+		if normalizeHost(key) == host {
+			return key
+		}
+	}
+	return ""
+}
@@ -0,0 +1,162 @@
+package registry
+
+import (
+	"github.com/ruckstack/ruckstack/builder/internal/environment"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCredentialStore_Lookup(t *testing.T) {
+	testDir, err := ioutil.TempDir(environment.TempPath(""), "credentials-")
+	require.NoError(t, err)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(testDir, "registry-password"), []byte("file-password\n"), 0600))
+
+	dockerConfigPath := filepath.Join(testDir, "config.json")
+	require.NoError(t, ioutil.WriteFile(dockerConfigPath, []byte(`{
+  "auths": {
+    "https://index.docker.io/v1/": {"auth": "aHViLXVzZXI6aHViLXBhc3N3b3Jk"},
+    "registry.example.com": {"auth": "Y29uZmlnLXVzZXI6Y29uZmlnLXBhc3N3b3Jk"}
+  },
+  "credHelpers": {
+    "helper.example.com": "ruckstack-test"
+  }
+}`), 0600))
+
+	//fake credential helper, found through PATH the same way docker finds them
+	require.NoError(t, ioutil.WriteFile(filepath.Join(testDir, "docker-credential-ruckstack-test"), []byte(`#!/bin/sh
+read host
+echo "{\"ServerURL\": \"$host\", \"Username\": \"helper-user\", \"Secret\": \"helper-password\"}"
+`), 0755))
+	originalPath := os.Getenv("PATH")
+	defer os.Setenv("PATH", originalPath)
+	require.NoError(t, os.Setenv("PATH", testDir+string(os.PathListSeparator)+originalPath))
+
+	defer os.Unsetenv("RUCKSTACK_TEST_REGISTRY_PASSWORD")
+	require.NoError(t, os.Setenv("RUCKSTACK_TEST_REGISTRY_PASSWORD", "env-password"))
+
+	store := NewCredentialStore([]Config{
+		{
+			Host:        "env.example.com",
+			Username:    "env-user",
+			PasswordEnv: "RUCKSTACK_TEST_REGISTRY_PASSWORD",
+		},
+		{
+			Host:         "file.example.com",
+			Username:     "file-user",
+			PasswordFile: "registry-password",
+		},
+		{
+			Host:        "registry.example.com",
+			Username:    "project-user",
+			PasswordEnv: "RUCKSTACK_TEST_REGISTRY_PASSWORD",
+		},
+		{
+			Host:        "unset.example.com",
+			Username:    "unset-user",
+			PasswordEnv: "RUCKSTACK_TEST_UNSET_PASSWORD",
+		},
+	}, testDir)
+	store.DockerConfigPath = dockerConfigPath
+
+	tests := []struct {
+		name    string
+		host    string
+		want    *Credentials
+		wantErr string
+	}{
+		{
+			name: "Password from environment",
+			host: "env.example.com",
+			want: &Credentials{Username: "env-user", Password: "env-password"},
+		},
+		{
+			name: "Password from file",
+			host: "file.example.com",
+			want: &Credentials{Username: "file-user", Password: "file-password"},
+		},
+		{
+			name: "Project takes precedence over docker config",
+			host: "registry.example.com",
+			want: &Credentials{Username: "project-user", Password: "env-password"},
+		},
+		{
+			name: "Docker Hub from docker config",
+			host: "registry-1.docker.io",
+			want: &Credentials{Username: "hub-user", Password: "hub-password"},
+		},
+		{
+			name: "Credential helper",
+			host: "helper.example.com",
+			want: &Credentials{Username: "helper-user", Password: "helper-password"},
+		},
+		{
+			name: "No credentials",
+			host: "public.example.com",
+		},
+		{
+			name:    "Unset environment variable",
+			host:    "unset.example.com",
+			wantErr: "environment variable RUCKSTACK_TEST_UNSET_PASSWORD for the unset.example.com password is not set",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := store.Lookup(tt.host)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	assert.Equal(t, []string{"docker.io", "env.example.com", "file.example.com", "helper.example.com", "registry.example.com", "unset.example.com"}, store.Hosts())
+}
+
+func TestConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr string
+	}{
+		{
+			name:   "Host only",
+			config: Config{Host: "registry.example.com", CaCert: "ca.pem"},
+		},
+		{
+			name:   "Username and password",
+			config: Config{Host: "registry.example.com", Username: "user", PasswordFile: "password"},
+		},
+		{
+			name:    "Missing password",
+			config:  Config{Host: "registry.example.com", Username: "user"},
+			wantErr: "registry registry.example.com must set passwordEnv or passwordFile",
+		},
+		{
+			name:    "Both password sources",
+			config:  Config{Host: "registry.example.com", Username: "user", PasswordEnv: "PASSWORD", PasswordFile: "password"},
+			wantErr: "registry registry.example.com cannot set both passwordEnv and passwordFile",
+		},
+		{
+			name:    "Missing username",
+			config:  Config{Host: "registry.example.com", PasswordEnv: "PASSWORD"},
+			wantErr: "registry registry.example.com must set a username",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.Validate()
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tt.wantErr)
+			}
+		})
+	}
+}
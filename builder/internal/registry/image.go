@@ -0,0 +1,236 @@
+package registry
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	godigest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/ruckstack/ruckstack/builder/internal/cache"
+	"github.com/ruckstack/ruckstack/builder/internal/environment"
+	"github.com/ruckstack/ruckstack/common/ui"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/**
+An image whose manifest and config have been read and whose layers are in the blob cache
+*/
+type pulledImage struct {
+	//digest is the digest the image reference resolved to. For multi-platform images it is the index digest.
+	digest   godigest.Digest
+	manifest ocispec.Manifest
+	config   []byte
+	diffIds  []godigest.Digest
+	size     int64
+}
+
+/**
+Reads the manifest for the given tag or digest, selecting the platform-specific manifest from an index
+*/
+func resolveManifest(source imageSource, tagOrDigest string, architecture string) (ocispec.Manifest, godigest.Digest, error) {
+	content, mediaType, digest, err := source.fetchManifest(tagOrDigest)
+	if err != nil {
+		return ocispec.Manifest{}, "", err
+	}
+
+	switch mediaType {
+	case mediaTypeDockerManifestList, mediaTypeOciIndex:
+		index := ocispec.Index{}
+		if err := json.Unmarshal(content, &index); err != nil {
+			return ocispec.Manifest{}, "", fmt.Errorf("cannot parse image index %s: %s", tagOrDigest, err)
+		}
+
+		for _, descriptor := range index.Manifests {
+			if descriptor.Platform == nil || (descriptor.Platform.OS == "linux" && descriptor.Platform.Architecture == architecture) {
+				manifest, _, err := resolveManifest(source, descriptor.Digest.String(), architecture)
+				return manifest, digest, err
+			}
+		}
+		return ocispec.Manifest{}, "", fmt.Errorf("%s has no image for linux/%s", tagOrDigest, architecture)
+
+	case mediaTypeDockerManifest, mediaTypeOciManifest:
+		manifest := ocispec.Manifest{}
+		if err := json.Unmarshal(content, &manifest); err != nil {
+			return ocispec.Manifest{}, "", fmt.Errorf("cannot parse image manifest %s: %s", tagOrDigest, err)
+		}
+		return manifest, digest, nil
+
+	default:
+		return ocispec.Manifest{}, "", fmt.Errorf("unsupported manifest type for %s: %s", tagOrDigest, mediaType)
+	}
+}
+
+/**
+Downloads the config and layers of the given manifest into the blob cache and verifies the layer contents against the config
+*/
+func pullImage(source imageSource, manifest ocispec.Manifest, digest godigest.Digest) (*pulledImage, error) {
+	configPath, err := cacheBlob(source, manifest.Config.Digest)
+	if err != nil {
+		return nil, err
+	}
+	config, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	imageConfig := ocispec.Image{}
+	if err := json.Unmarshal(config, &imageConfig); err != nil {
+		return nil, fmt.Errorf("cannot parse image config %s: %s", manifest.Config.Digest, err)
+	}
+	if len(imageConfig.RootFS.DiffIDs) != len(manifest.Layers) {
+		return nil, fmt.Errorf("image config %s lists %d layers but the manifest has %d", manifest.Config.Digest, len(imageConfig.RootFS.DiffIDs), len(manifest.Layers))
+	}
+
+	image := &pulledImage{
+		digest:   digest,
+		manifest: manifest,
+		config:   config,
+		diffIds:  imageConfig.RootFS.DiffIDs,
+	}
+
+	for i, layer := range manifest.Layers {
+		if _, err := cacheBlob(source, layer.Digest); err != nil {
+			return nil, err
+		}
+
+		layerReader, err := openLayer(layer)
+		if err != nil {
+			return nil, err
+		}
+
+		verifier := image.diffIds[i].Verifier()
+		size, err := io.Copy(verifier, layerReader)
+		_ = layerReader.Close()
+		if err != nil {
+			return nil, fmt.Errorf("cannot read layer %s: %s", layer.Digest, err)
+		}
+		if !verifier.Verified() {
+			return nil, fmt.Errorf("layer %s does not match %s", layer.Digest, image.diffIds[i])
+		}
+
+		image.size += size
+	}
+
+	return image, nil
+}
+
+/**
+Returns the path to the given blob in the cache, downloading it first if needed.
+Blobs are only stored in the cache once their digest has been verified.
+*/
+func cacheBlob(source imageSource, digest godigest.Digest) (string, error) {
+	if err := digest.Validate(); err != nil {
+		return "", fmt.Errorf("invalid blob digest %s: %s", digest, err)
+	}
+
+	cachePath := blobCachePath(digest)
+	if cache.Lookup(cachePath) {
+		return cachePath, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(cachePath), 0755); err != nil {
+		return "", fmt.Errorf("cannot create cache directory %s: %s", filepath.Dir(cachePath), err)
+	}
+
+	ui.VPrintf("Downloading %s", digest)
+	blobReader, err := source.openBlob(digest)
+	if err != nil {
+		return "", err
+	}
+	defer blobReader.Close()
+
+	tempFile, err := ioutil.TempFile(filepath.Dir(cachePath), digest.Encoded()+".*.tmp")
+	if err != nil {
+		return "", fmt.Errorf("cannot create cache file: %s", err)
+	}
+	defer os.Remove(tempFile.Name())
+
+	verifier := digest.Verifier()
+	_, err = io.Copy(io.MultiWriter(tempFile, verifier), blobReader)
+	_ = tempFile.Close()
+	if err != nil {
+		return "", fmt.Errorf("error downloading %s: %s", digest, err)
+	}
+	if !verifier.Verified() {
+		return "", fmt.Errorf("downloaded blob does not match %s", digest)
+	}
+
+	if err := os.Rename(tempFile.Name(), cachePath); err != nil {
+		return "", fmt.Errorf("cannot save %s to cache: %s", digest, err)
+	}
+
+	return cachePath, nil
+}
+
+/**
+Writes content to the cache through a temp file, so a failed write never leaves a partial entry
+*/
+func writeCacheFile(cachePath string, content []byte) error {
+	if err := os.MkdirAll(filepath.Dir(cachePath), 0755); err != nil {
+		return fmt.Errorf("cannot create cache directory %s: %s", filepath.Dir(cachePath), err)
+	}
+
+	tempFile, err := ioutil.TempFile(filepath.Dir(cachePath), filepath.Base(cachePath)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("cannot create cache file: %s", err)
+	}
+	defer os.Remove(tempFile.Name())
+
+	_, err = tempFile.Write(content)
+	_ = tempFile.Close()
+	if err != nil {
+		return fmt.Errorf("cannot write cache file %s: %s", cachePath, err)
+	}
+
+	if err := os.Rename(tempFile.Name(), cachePath); err != nil {
+		return fmt.Errorf("cannot save %s to cache: %s", cachePath, err)
+	}
+	return nil
+}
+
+func blobCachePath(digest godigest.Digest) string {
+	return environment.CachePath(filepath.Join("blobs", digest.Algorithm().String(), digest.Encoded()))
+}
+
+/**
+Opens the uncompressed contents of a cached layer
+*/
+func openLayer(layer ocispec.Descriptor) (io.ReadCloser, error) {
+	blobFile, err := os.Open(blobCachePath(layer.Digest))
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case strings.HasSuffix(layer.MediaType, "+zstd"):
+		_ = blobFile.Close()
+		return nil, fmt.Errorf("layer %s uses zstd compression which is not supported", layer.Digest)
+
+	case strings.HasSuffix(layer.MediaType, ".gzip") || strings.HasSuffix(layer.MediaType, "+gzip"):
+		gzipReader, err := gzip.NewReader(blobFile)
+		if err != nil {
+			_ = blobFile.Close()
+			return nil, fmt.Errorf("cannot decompress layer %s: %s", layer.Digest, err)
+		}
+		return &layerReader{Reader: gzipReader, closers: []io.Closer{gzipReader, blobFile}}, nil
+
+	default:
+		return blobFile, nil
+	}
+}
+
+type layerReader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (reader *layerReader) Close() error {
+	for _, closer := range reader.closers {
+		_ = closer.Close()
+	}
+	return nil
+}
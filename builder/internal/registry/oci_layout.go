@@ -0,0 +1,107 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/docker/distribution/reference"
+	godigest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+/**
+Image source for an OCI image layout directory, such as one created by `skopeo copy` or `buildah push`
+*/
+type layoutSource struct {
+	dir   string
+	index ocispec.Index
+}
+
+func openLayout(dir string) (*layoutSource, error) {
+	indexContent, err := ioutil.ReadFile(filepath.Join(dir, "index.json"))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read OCI layout %s: %s", dir, err)
+	}
+
+	source := &layoutSource{
+		dir: dir,
+	}
+	if err := json.Unmarshal(indexContent, &source.index); err != nil {
+		return nil, fmt.Errorf("cannot parse %s: %s", filepath.Join(dir, "index.json"), err)
+	}
+
+	return source, nil
+}
+
+/**
+Returns the descriptor in the layout index for the given image.
+The ref.name annotation can be the full reference, the familiar reference, or only the tag.
+*/
+func (source *layoutSource) find(named reference.Named) (ocispec.Descriptor, bool) {
+	var names []string
+	if canonical, isDigested := named.(reference.Canonical); isDigested {
+		for _, descriptor := range source.index.Manifests {
+			if descriptor.Digest == canonical.Digest() {
+				return descriptor, true
+			}
+		}
+		return ocispec.Descriptor{}, false
+	}
+
+	if tagged, isTagged := named.(reference.Tagged); isTagged {
+		names = []string{named.String(), reference.FamiliarString(named), tagged.Tag()}
+	} else {
+		names = []string{named.Name(), reference.FamiliarName(named)}
+	}
+
+	for _, descriptor := range source.index.Manifests {
+		refName := descriptor.Annotations[ocispec.AnnotationRefName]
+		for _, name := range names {
+			if refName == name {
+				return descriptor, true
+			}
+		}
+	}
+	return ocispec.Descriptor{}, false
+}
+
+func (source *layoutSource) fetchManifest(tagOrDigest string) ([]byte, string, godigest.Digest, error) {
+	digest, err := godigest.Parse(tagOrDigest)
+	if err != nil {
+		return nil, "", "", fmt.Errorf("OCI layout %s can only be read by digest, not %s", source.dir, tagOrDigest)
+	}
+
+	blobReader, err := source.openBlob(digest)
+	if err != nil {
+		return nil, "", "", err
+	}
+	defer blobReader.Close()
+
+	content, err := ioutil.ReadAll(blobReader)
+	if err != nil {
+		return nil, "", "", err
+	}
+	if godigest.FromBytes(content) != digest {
+		return nil, "", "", fmt.Errorf("manifest in %s does not match %s", source.dir, digest)
+	}
+
+	mediaType := ""
+	for _, descriptor := range source.index.Manifests {
+		if descriptor.Digest == digest {
+			mediaType = descriptor.MediaType
+		}
+	}
+
+	return content, detectMediaType(content, mediaType), digest, nil
+}
+
+func (source *layoutSource) openBlob(digest godigest.Digest) (io.ReadCloser, error) {
+	if err := digest.Validate(); err != nil {
+		return nil, err
+	}
+
+	return os.Open(filepath.Join(source.dir, "blobs", digest.Algorithm().String(), digest.Encoded()))
+}
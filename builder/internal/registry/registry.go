@@ -0,0 +1,426 @@
+package registry
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/docker/distribution/reference"
+	godigest "github.com/opencontainers/go-digest"
+	"github.com/ruckstack/ruckstack/builder/internal/cache"
+	"github.com/ruckstack/ruckstack/builder/internal/environment"
+	"github.com/ruckstack/ruckstack/common/ui"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const (
+	mediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeOciManifest        = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOciIndex           = "application/vnd.oci.image.index.v1+json"
+)
+
+var acceptedManifestTypes = []string{
+	mediaTypeDockerManifest,
+	mediaTypeDockerManifestList,
+	mediaTypeOciManifest,
+	mediaTypeOciIndex,
+}
+
+/**
+Where image manifests and blobs are read from: either a registry or an OCI layout directory
+*/
+type imageSource interface {
+	/**
+	Returns the manifest content, media type and digest for the given tag or digest
+	*/
+	fetchManifest(tagOrDigest string) ([]byte, string, godigest.Digest, error)
+
+	openBlob(digest godigest.Digest) (io.ReadCloser, error)
+}
+
+/**
+Client for the Docker Registry HTTP API V2
+*/
+type Client struct {
+	Credentials *CredentialStore
+
+	httpClients map[string]*http.Client
+	tokens      map[string]string
+	lock        sync.Mutex
+}
+
+func NewClient(credentials *CredentialStore) *Client {
+	return &Client{
+		Credentials: credentials,
+		httpClients: map[string]*http.Client{},
+		tokens:      map[string]string{},
+	}
+}
+
+/**
+Returns the http client for the given host, which trusts the host's caCert if it has one
+*/
+func (client *Client) httpClient(host string) (*http.Client, error) {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	if httpClient, found := client.httpClients[host]; found {
+		return httpClient, nil
+	}
+
+	httpClient := &http.Client{}
+	tlsConfig, err := client.Credentials.TLSConfig(host)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		httpClient.Transport = transport
+	}
+
+	client.httpClients[host] = httpClient
+	return httpClient, nil
+}
+
+/**
+Image source for a single repository in a registry
+*/
+type registrySource struct {
+	client     *Client
+	host       string
+	repository string
+
+	//cacheOnly reads manifests from the cache even when not offline
+	cacheOnly bool
+}
+
+func (client *Client) source(named reference.Named) *registrySource {
+	host := reference.Domain(named)
+	if host == "docker.io" {
+		host = "registry-1.docker.io"
+	}
+
+	return &registrySource{
+		client:     client,
+		host:       host,
+		repository: reference.Path(named),
+	}
+}
+
+func (source *registrySource) baseUrl() string {
+	scheme := "https"
+	if isLocalHost(source.host) {
+		//same as docker, local registries do not need TLS
+		scheme = "http"
+	}
+
+	return fmt.Sprintf("%s://%s/v2/%s", scheme, source.host, source.repository)
+}
+
+/**
+Returns the manifest from the registry and saves it to the cache, or reads it from the cache with --offline
+*/
+func (source *registrySource) fetchManifest(tagOrDigest string) ([]byte, string, godigest.Digest, error) {
+	if environment.Offline || source.cacheOnly {
+		return source.cachedManifest(tagOrDigest)
+	}
+
+	request, err := http.NewRequest(http.MethodGet, source.baseUrl()+"/manifests/"+tagOrDigest, nil)
+	if err != nil {
+		return nil, "", "", err
+	}
+	request.Header.Set("Accept", strings.Join(acceptedManifestTypes, ", "))
+
+	response, err := source.client.do(request, source)
+	if err != nil {
+		return nil, "", "", err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusNotFound {
+		return nil, "", "", fmt.Errorf("manifest unknown: %s/%s:%s", source.host, source.repository, tagOrDigest)
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, "", "", fmt.Errorf("cannot get manifest %s from %s: %s", tagOrDigest, source.host, response.Status)
+	}
+
+	content, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	digest := godigest.FromBytes(content)
+	if headerDigest := response.Header.Get("Docker-Content-Digest"); headerDigest != "" && headerDigest != digest.String() {
+		return nil, "", "", fmt.Errorf("manifest %s from %s does not match digest %s", tagOrDigest, source.host, headerDigest)
+	}
+
+	if err := source.cacheManifest(tagOrDigest, content, digest); err != nil {
+		return nil, "", "", err
+	}
+
+	return content, detectMediaType(content, response.Header.Get("Content-Type")), digest, nil
+}
+
+/**
+Saves the manifest to the blob cache by its digest. Tags also record the digest they resolved to, so they can be resolved offline
+*/
+func (source *registrySource) cacheManifest(tagOrDigest string, content []byte, digest godigest.Digest) error {
+	if err := writeCacheFile(blobCachePath(digest), content); err != nil {
+		return err
+	}
+
+	if _, err := godigest.Parse(tagOrDigest); err == nil {
+		return nil
+	}
+	return writeCacheFile(source.tagCachePath(tagOrDigest), []byte(digest.String()))
+}
+
+/**
+Returns the manifest saved by cacheManifest
+*/
+func (source *registrySource) cachedManifest(tagOrDigest string) ([]byte, string, godigest.Digest, error) {
+	notAvailable := fmt.Errorf("manifest %s for %s/%s is not available with --offline. Run `ruckstack fetch` first", tagOrDigest, source.host, source.repository)
+
+	digest, err := godigest.Parse(tagOrDigest)
+	if err != nil {
+		recorded, err := ioutil.ReadFile(source.tagCachePath(tagOrDigest))
+		if err != nil {
+			return nil, "", "", notAvailable
+		}
+		digest, err = godigest.Parse(strings.TrimSpace(string(recorded)))
+		if err != nil {
+			return nil, "", "", notAvailable
+		}
+	}
+
+	cachePath := blobCachePath(digest)
+	if !cache.Lookup(cachePath) {
+		return nil, "", "", notAvailable
+	}
+	content, err := ioutil.ReadFile(cachePath)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	return content, detectMediaType(content, ""), digest, nil
+}
+
+/**
+Tags are stored as manifests/<host>/<repository>/<tag>, containing the digest the tag last resolved to
+*/
+func (source *registrySource) tagCachePath(tag string) string {
+	return environment.CachePath(filepath.Join("manifests", source.host, filepath.FromSlash(source.repository), tag))
+}
+
+func (source *registrySource) openBlob(digest godigest.Digest) (io.ReadCloser, error) {
+	request, err := http.NewRequest(http.MethodGet, source.baseUrl()+"/blobs/"+digest.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := source.client.do(request, source)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		_ = response.Body.Close()
+		return nil, fmt.Errorf("cannot get blob %s from %s: %s", digest, source.host, response.Status)
+	}
+
+	return response.Body, nil
+}
+
+/**
+Sends the request, authenticating with the registry if it is requested
+*/
+func (client *Client) do(request *http.Request, source *registrySource) (*http.Response, error) {
+	if environment.Offline {
+		return nil, fmt.Errorf("cannot pull from %s with --offline. Run `ruckstack fetch` first or use --oci-layout", source.host)
+	}
+
+	httpClient, err := client.httpClient(source.host)
+	if err != nil {
+		return nil, err
+	}
+
+	tokenKey := source.host + "/" + source.repository
+
+	client.lock.Lock()
+	authorization := client.tokens[tokenKey]
+	client.lock.Unlock()
+
+	if authorization != "" {
+		request.Header.Set("Authorization", authorization)
+	}
+
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusUnauthorized {
+		return response, nil
+	}
+	_ = response.Body.Close()
+
+	credentials, err := client.Credentials.Lookup(source.host)
+	if err != nil {
+		return nil, err
+	}
+
+	challenge := response.Header.Get("WWW-Authenticate")
+	switch {
+	case strings.HasPrefix(strings.ToLower(challenge), "bearer "):
+		token, err := client.fetchToken(httpClient, challenge, source, credentials)
+		if err != nil {
+			return nil, err
+		}
+		authorization = "Bearer " + token
+
+	case strings.HasPrefix(strings.ToLower(challenge), "basic ") && credentials != nil && credentials.Username != "":
+		authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials.Username+":"+credentials.Password))
+
+	default:
+		return nil, fmt.Errorf("%s requires authentication. Add it to registries in the project or run `docker login %s`", source.host, source.host)
+	}
+
+	client.lock.Lock()
+	client.tokens[tokenKey] = authorization
+	client.lock.Unlock()
+
+	retryRequest := request.Clone(request.Context())
+	retryRequest.Header.Set("Authorization", authorization)
+
+	response, err = httpClient.Do(retryRequest)
+	if err == nil && response.StatusCode == http.StatusUnauthorized {
+		_ = response.Body.Close()
+		return nil, fmt.Errorf("%s rejected the credentials for %s", source.host, source.repository)
+	}
+	return response, err
+}
+
+func (client *Client) fetchToken(httpClient *http.Client, challenge string, source *registrySource, credentials *Credentials) (string, error) {
+	params := parseChallenge(challenge)
+	if params["realm"] == "" {
+		return "", fmt.Errorf("invalid authentication challenge from %s: %s", source.host, challenge)
+	}
+
+	tokenUrl, err := url.Parse(params["realm"])
+	if err != nil {
+		return "", fmt.Errorf("invalid token realm from %s: %s", source.host, err)
+	}
+
+	scope := params["scope"]
+	if scope == "" {
+		scope = "repository:" + source.repository + ":pull"
+	}
+
+	ui.VPrintf("Requesting token for %s from %s", source.repository, tokenUrl.Host)
+	var response *http.Response
+	if credentials != nil && credentials.IdentityToken != "" {
+		//identity tokens are exchanged with an OAuth2 refresh_token grant
+		response, err = httpClient.PostForm(tokenUrl.String(), url.Values{
+			"grant_type":    {"refresh_token"},
+			"refresh_token": {credentials.IdentityToken},
+			"service":       {params["service"]},
+			"scope":         {scope},
+			"client_id":     {"ruckstack"},
+		})
+	} else {
+		query := tokenUrl.Query()
+		if params["service"] != "" {
+			query.Set("service", params["service"])
+		}
+		query.Set("scope", scope)
+		tokenUrl.RawQuery = query.Encode()
+
+		request, requestErr := http.NewRequest(http.MethodGet, tokenUrl.String(), nil)
+		if requestErr != nil {
+			return "", requestErr
+		}
+		if credentials != nil && credentials.Username != "" {
+			request.SetBasicAuth(credentials.Username, credentials.Password)
+		}
+		response, err = httpClient.Do(request)
+	}
+	if err != nil {
+		return "", fmt.Errorf("cannot get token from %s: %s", tokenUrl.Host, err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("cannot get token from %s: %s", tokenUrl.Host, response.Status)
+	}
+
+	tokenResponse := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := json.NewDecoder(response.Body).Decode(&tokenResponse); err != nil {
+		return "", fmt.Errorf("cannot parse token from %s: %s", tokenUrl.Host, err)
+	}
+
+	if tokenResponse.Token != "" {
+		return tokenResponse.Token, nil
+	}
+	return tokenResponse.AccessToken, nil
+}
+
+var challengeParamRegexp = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+func parseChallenge(challenge string) map[string]string {
+	params := map[string]string{}
+	for _, match := range challengeParamRegexp.FindAllStringSubmatch(challenge, -1) {
+		params[strings.ToLower(match[1])] = match[2]
+	}
+	return params
+}
+
+/**
+Returns the manifest media type. Falls back to inspecting the content for registries and layouts that do not specify it
+*/
+func detectMediaType(content []byte, headerType string) string {
+	for _, mediaType := range acceptedManifestTypes {
+		if strings.HasPrefix(headerType, mediaType) {
+			return mediaType
+		}
+	}
+
+	contentType := struct {
+		MediaType string            `json:"mediaType"`
+		Manifests []json.RawMessage `json:"manifests"`
+	}{}
+	if err := json.Unmarshal(content, &contentType); err != nil {
+		return headerType
+	}
+	if contentType.MediaType != "" {
+		return contentType.MediaType
+	}
+	if contentType.Manifests != nil {
+		return mediaTypeOciIndex
+	}
+	return mediaTypeOciManifest
+}
+
+func isLocalHost(host string) bool {
+	hostname := host
+	if splitHost, _, err := net.SplitHostPort(host); err == nil {
+		hostname = splitHost
+	}
+
+	if hostname == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(hostname)
+	return ip != nil && ip.IsLoopback()
+}
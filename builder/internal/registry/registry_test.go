@@ -0,0 +1,379 @@
+package registry
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	godigest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/ruckstack/ruckstack/builder/internal/environment"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+/**
+An image built in memory, with random content so blobs are never already in the cache
+*/
+type testImage struct {
+	blobs       map[godigest.Digest][]byte
+	manifests   map[string][]byte
+	indexDigest godigest.Digest
+	layerTar    []byte
+}
+
+func newTestImage(t *testing.T, layerMediaType string) *testImage {
+	image := &testImage{
+		blobs:     map[godigest.Digest][]byte{},
+		manifests: map[string][]byte{},
+	}
+
+	randomContent := make([]byte, 64)
+	_, err := rand.Read(randomContent)
+	require.NoError(t, err)
+
+	layerTar := new(bytes.Buffer)
+	tarWriter := tar.NewWriter(layerTar)
+	require.NoError(t, tarWriter.WriteHeader(&tar.Header{Name: "hello.txt", Mode: 0644, Size: int64(len(randomContent)), Typeflag: tar.TypeReg}))
+	_, err = tarWriter.Write(randomContent)
+	require.NoError(t, err)
+	require.NoError(t, tarWriter.Close())
+	image.layerTar = layerTar.Bytes()
+
+	layerBlob := image.layerTar
+	if strings.HasSuffix(layerMediaType, "gzip") {
+		gzipped := new(bytes.Buffer)
+		gzipWriter := gzip.NewWriter(gzipped)
+		_, err = gzipWriter.Write(image.layerTar)
+		require.NoError(t, err)
+		require.NoError(t, gzipWriter.Close())
+		layerBlob = gzipped.Bytes()
+	}
+
+	config := ocispec.Image{
+		Architecture: "amd64",
+		OS:           "linux",
+		RootFS: ocispec.RootFS{
+			Type:    "layers",
+			DiffIDs: []godigest.Digest{godigest.FromBytes(image.layerTar)},
+		},
+	}
+	configBlob, err := json.Marshal(config)
+	require.NoError(t, err)
+
+	manifest := ocispec.Manifest{
+		Config: image.addBlob(ocispec.MediaTypeImageConfig, configBlob),
+		Layers: []ocispec.Descriptor{image.addBlob(layerMediaType, layerBlob)},
+	}
+	manifest.SchemaVersion = 2
+	manifestBlob, err := json.Marshal(manifest)
+	require.NoError(t, err)
+	manifestDescriptor := image.addBlob(mediaTypeOciManifest, manifestBlob)
+	manifestDescriptor.Platform = &ocispec.Platform{OS: "linux", Architecture: "amd64"}
+
+	index := ocispec.Index{
+		Manifests: []ocispec.Descriptor{
+			{MediaType: mediaTypeOciManifest, Digest: godigest.FromString("other"), Size: 5, Platform: &ocispec.Platform{OS: "linux", Architecture: "arm64"}},
+			manifestDescriptor,
+		},
+	}
+	index.SchemaVersion = 2
+	indexBlob, err := json.Marshal(index)
+	require.NoError(t, err)
+	image.indexDigest = image.addBlob(mediaTypeOciIndex, indexBlob).Digest
+	image.manifests["1.0"] = indexBlob
+
+	return image
+}
+
+func (image *testImage) addBlob(mediaType string, content []byte) ocispec.Descriptor {
+	digest := godigest.FromBytes(content)
+	image.blobs[digest] = content
+
+	return ocispec.Descriptor{MediaType: mediaType, Digest: digest, Size: int64(len(content))}
+}
+
+/**
+Serves the image at /v2/test/app. If token is set, requests must use a bearer token from /token
+*/
+func (image *testImage) serve(t *testing.T, token string) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.URL.Path == "/token" {
+			assert.Equal(t, "repository:test/app:pull", request.URL.Query().Get("scope"))
+			_, _ = writer.Write([]byte(fmt.Sprintf(`{"token": "%s"}`, token)))
+			return
+		}
+
+		if token != "" && request.Header.Get("Authorization") != "Bearer "+token {
+			writer.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test"`, server.URL))
+			writer.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		path := strings.TrimPrefix(request.URL.Path, "/v2/test/app/")
+		var content []byte
+		if strings.HasPrefix(path, "manifests/") {
+			reference := strings.TrimPrefix(path, "manifests/")
+			content = image.manifests[reference]
+			if content == nil {
+				content = image.blobs[godigest.Digest(reference)]
+			}
+		} else if strings.HasPrefix(path, "blobs/") {
+			content = image.blobs[godigest.Digest(strings.TrimPrefix(path, "blobs/"))]
+		}
+
+		if content == nil {
+			writer.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = writer.Write(content)
+	}))
+
+	return server
+}
+
+/**
+Writes the image as an OCI layout directory with the given ref.name
+*/
+func (image *testImage) writeLayout(t *testing.T, refName string) string {
+	layoutDir, err := ioutil.TempDir(environment.TempPath(""), "oci-layout-")
+	require.NoError(t, err)
+
+	for digest, content := range image.blobs {
+		blobPath := filepath.Join(layoutDir, "blobs", "sha256", digest.Encoded())
+		require.NoError(t, os.MkdirAll(filepath.Dir(blobPath), 0755))
+		require.NoError(t, ioutil.WriteFile(blobPath, content, 0644))
+	}
+
+	index := ocispec.Index{
+		Manifests: []ocispec.Descriptor{
+			{
+				MediaType:   mediaTypeOciIndex,
+				Digest:      image.indexDigest,
+				Size:        int64(len(image.blobs[image.indexDigest])),
+				Annotations: map[string]string{ocispec.AnnotationRefName: refName},
+			},
+		},
+	}
+	index.SchemaVersion = 2
+	indexContent, err := json.Marshal(index)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(layoutDir, "index.json"), indexContent, 0644))
+
+	return layoutDir
+}
+
+func TestBackend(t *testing.T) {
+	tests := []struct {
+		name           string
+		layerMediaType string
+		token          string
+		useLayout      bool
+		pullDigest     bool
+		wantErr        string
+	}{
+		{
+			name:           "Pulls gzip layers",
+			layerMediaType: ocispec.MediaTypeImageLayerGzip,
+		},
+		{
+			name:           "Pulls uncompressed layers",
+			layerMediaType: ocispec.MediaTypeImageLayer,
+		},
+		{
+			name:           "Authenticates with token",
+			layerMediaType: ocispec.MediaTypeImageLayerGzip,
+			token:          "secret-token",
+		},
+		{
+			name:           "Pulls locked digest",
+			layerMediaType: ocispec.MediaTypeImageLayerGzip,
+			pullDigest:     true,
+		},
+		{
+			name:           "Reads OCI layout",
+			layerMediaType: ocispec.MediaTypeImageLayerGzip,
+			useLayout:      true,
+		},
+		{
+			name:           "Rejects zstd layers",
+			layerMediaType: "application/vnd.oci.image.layer.v1.tar+zstd",
+			wantErr:        "zstd compression which is not supported",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			image := newTestImage(t, tt.layerMediaType)
+			server := image.serve(t, tt.token)
+			defer server.Close()
+
+			imageRef := strings.TrimPrefix(server.URL, "http://") + "/test/app:1.0"
+
+			var layoutDirs []string
+			if tt.useLayout {
+				layoutDirs = []string{image.writeLayout(t, "1.0")}
+				server.Close()
+			}
+
+			backend := NewBackend(layoutDirs, nil)
+
+			digest := ""
+			if tt.pullDigest {
+				digest = image.indexDigest.String()
+				delete(image.manifests, "1.0")
+			}
+
+			err := backend.Pull(imageRef, digest)
+			if tt.wantErr != "" {
+				assert.Contains(t, fmt.Sprint(err), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+
+			pulledDigest, err := backend.Digest(imageRef)
+			assert.NoError(t, err)
+			assert.Equal(t, image.indexDigest.String(), pulledDigest)
+
+			size, err := backend.Size(imageRef)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(len(image.layerTar)), size)
+
+			savePath := environment.TempPath("images-*.tar")
+			require.NoError(t, backend.Save(savePath, imageRef))
+
+			savedFiles := readTar(t, savePath)
+			saveManifest := []struct {
+				Config   string
+				RepoTags []string
+				Layers   []string
+			}{}
+			require.NoError(t, json.Unmarshal(savedFiles["manifest.json"], &saveManifest))
+			require.Len(t, saveManifest, 1)
+			assert.Equal(t, []string{imageRef}, saveManifest[0].RepoTags)
+			assert.Contains(t, savedFiles, saveManifest[0].Config)
+			assert.Contains(t, savedFiles, "repositories")
+			require.Len(t, saveManifest[0].Layers, 1)
+			assert.Equal(t, image.layerTar, savedFiles[saveManifest[0].Layers[0]])
+		})
+	}
+}
+
+func TestBackendErrors(t *testing.T) {
+	image := newTestImage(t, ocispec.MediaTypeImageLayerGzip)
+	server := image.serve(t, "")
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	backend := NewBackend(nil, nil)
+
+	err := backend.Pull(host+"/test/app:2.0", "")
+	assert.Contains(t, fmt.Sprint(err), "manifest unknown")
+
+	err = backend.Pull("build.local/test/app:1.0", "")
+	assert.Contains(t, fmt.Sprint(err), "without docker")
+
+	_, err = backend.Digest(host + "/test/app:2.0")
+	assert.Contains(t, fmt.Sprint(err), "has not been pulled")
+
+	for digest, content := range image.blobs {
+		if len(content) > 0 && content[0] == 0x1f {
+			image.blobs[digest] = append([]byte{}, content[:len(content)-1]...)
+		}
+	}
+	err = backend.Pull(host+"/test/app:1.0", "")
+	assert.Contains(t, fmt.Sprint(err), "does not match")
+}
+
+func TestBackend_Offline(t *testing.T) {
+	image := newTestImage(t, ocispec.MediaTypeImageLayerGzip)
+	server := image.serve(t, "")
+	imageRef := strings.TrimPrefix(server.URL, "http://") + "/test/app:1.0"
+
+	assert.False(t, NewBackend(nil, nil).Available(imageRef, ""), "not available before it is pulled")
+	require.NoError(t, NewBackend(nil, nil).Pull(imageRef, ""))
+	server.Close()
+
+	backend := NewBackend(nil, nil)
+	assert.True(t, backend.Available(imageRef, ""))
+	assert.True(t, backend.Available(imageRef, image.indexDigest.String()))
+	assert.False(t, backend.Available(imageRef, godigest.FromString("other").String()))
+
+	environment.Offline = true
+	defer func() { environment.Offline = false }()
+
+	require.NoError(t, backend.Pull(imageRef, ""), "tags resolve to the manifest pulled before")
+	pulledDigest, err := backend.Digest(imageRef)
+	assert.NoError(t, err)
+	assert.Equal(t, image.indexDigest.String(), pulledDigest)
+
+	err = backend.Pull(strings.Replace(imageRef, ":1.0", ":2.0", 1), "")
+	assert.Contains(t, fmt.Sprint(err), "is not available with --offline. Run `ruckstack fetch` first")
+}
+
+func TestBackend_BasicAuth(t *testing.T) {
+	image := newTestImage(t, ocispec.MediaTypeImageLayerGzip)
+	imageServer := image.serve(t, "")
+	defer imageServer.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		username, password, hasAuth := request.BasicAuth()
+		if !hasAuth || username != "builder" || password != "registry-password" {
+			writer.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			writer.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		imageServer.Config.Handler.ServeHTTP(writer, request)
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	projectDir, err := ioutil.TempDir(environment.TempPath(""), "project-")
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(projectDir, "registry-password"), []byte("registry-password"), 0600))
+
+	backend := NewBackend(nil, nil)
+	err = backend.Pull(host+"/test/app:1.0", "")
+	assert.Contains(t, fmt.Sprint(err), "requires authentication")
+
+	backend = NewBackend(nil, NewCredentialStore([]Config{
+		{
+			Host:         host,
+			Username:     "builder",
+			PasswordFile: "registry-password",
+		},
+	}, projectDir))
+	assert.NoError(t, backend.Pull(host+"/test/app:1.0", ""))
+}
+
+func readTar(t *testing.T, tarPath string) map[string][]byte {
+	tarFile, err := os.Open(tarPath)
+	require.NoError(t, err)
+	defer tarFile.Close()
+
+	files := map[string][]byte{}
+	tarReader := tar.NewReader(tarFile)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+
+		content, err := ioutil.ReadAll(tarReader)
+		require.NoError(t, err)
+		files[header.Name] = content
+	}
+
+	return files
+}
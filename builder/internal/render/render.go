@@ -0,0 +1,96 @@
+package render
+
+import (
+	"fmt"
+	"github.com/ruckstack/ruckstack/builder/internal/builder/install_file"
+	"github.com/ruckstack/ruckstack/common/global_util"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/**
+Writes the Kubernetes resources services generate to a directory instead of an install file, without building or pulling images
+*/
+type Renderer struct {
+	//OutDir contains a directory for each service's resources
+	OutDir string
+
+	//Architecture is the server architecture to render for
+	Architecture string
+
+	//ImageLock pins images to the digests from the last build. Images that are not locked are left as tags
+	ImageLock *install_file.ImageLock
+
+	//ModTime is recorded in generated charts, so their hashes only change when their contents do
+	ModTime time.Time
+}
+
+/**
+Writes the content to the given path in the service's directory
+*/
+func (renderer *Renderer) WriteFile(serviceId string, path string, content []byte) error {
+	outPath := filepath.Join(renderer.OutDir, serviceId, path)
+	if err := os.MkdirAll(filepath.Dir(outPath), 0755); err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(outPath, content, 0644); err != nil {
+		return fmt.Errorf("cannot write %s: %s", outPath, err)
+	}
+	return nil
+}
+
+/**
+Returns the image as it will be referenced in the install file if the lock is still current
+*/
+func (renderer *Renderer) PinImage(tag string) (string, error) {
+	if renderer.ImageLock == nil {
+		return tag, nil
+	}
+	return renderer.ImageLock.PinnedReference(tag)
+}
+
+/**
+Returns the manifest with its images pinned by PinImage
+*/
+func (renderer *Renderer) PinImagesInManifest(manifestContent []byte) ([]byte, error) {
+	return install_file.PinImagesInManifest(manifestContent, renderer.PinImage)
+}
+
+/**
+Writes the HelmChart resource that installs the chart, and the chart's templates rendered with the given values
+*/
+func (renderer *Renderer) AddHelmChart(chartFilePath string, chartId string, values map[string]interface{}) error {
+	chartFileHash, err := global_util.HashFile(chartFilePath)
+	if err != nil {
+		return err
+	}
+
+	manifestData, err := install_file.HelmChartManifest(chartId, chartFileHash, values)
+	if err != nil {
+		return err
+	}
+	if err := renderer.WriteFile(chartId, chartId+".yaml", manifestData); err != nil {
+		return err
+	}
+
+	loadedChart, err := loader.Load(chartFilePath)
+	if err != nil {
+		return err
+	}
+
+	rendered, err := install_file.RenderChart(loadedChart, chartId, values)
+	if err != nil {
+		return fmt.Errorf("cannot render chart %s: %s", chartId, err)
+	}
+	for filename, data := range rendered {
+		if err := renderer.WriteFile(chartId, filepath.Join("rendered", filename), []byte(data+"\n")); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
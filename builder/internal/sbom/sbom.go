@@ -0,0 +1,157 @@
+package sbom
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+/**
+Name of the SBOM inside the installer
+*/
+const InstallerPath = ".sbom.json"
+
+/**
+Software bill of materials in CycloneDX JSON format.
+Only the parts of the specification Ruckstack uses are modeled.
+*/
+type Bom struct {
+	BomFormat    string      `json:"bomFormat"`
+	SpecVersion  string      `json:"specVersion"`
+	SerialNumber string      `json:"serialNumber,omitempty"`
+	Version      int         `json:"version"`
+	Metadata     Metadata    `json:"metadata"`
+	Components   []Component `json:"components"`
+}
+
+type Metadata struct {
+	Timestamp string     `json:"timestamp"`
+	Tools     []Tool     `json:"tools,omitempty"`
+	Component *Component `json:"component,omitempty"`
+}
+
+type Tool struct {
+	Vendor  string `json:"vendor,omitempty"`
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+const (
+	TypeApplication = "application"
+	TypeContainer   = "container"
+	TypeFile        = "file"
+
+	HashSha1   = "SHA-1"
+	HashSha256 = "SHA-256"
+)
+
+type Component struct {
+	Type               string              `json:"type"`
+	BomRef             string              `json:"bom-ref,omitempty"`
+	Name               string              `json:"name"`
+	Version            string              `json:"version,omitempty"`
+	Purl               string              `json:"purl,omitempty"`
+	Hashes             []Hash              `json:"hashes,omitempty"`
+	ExternalReferences []ExternalReference `json:"externalReferences,omitempty"`
+	Properties         []Property          `json:"properties,omitempty"`
+}
+
+type Hash struct {
+	Alg     string `json:"alg"`
+	Content string `json:"content"`
+}
+
+type ExternalReference struct {
+	Type string `json:"type"`
+	Url  string `json:"url"`
+}
+
+type Property struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+func New() *Bom {
+	return &Bom{
+		BomFormat:   "CycloneDX",
+		SpecVersion: "1.4",
+		Version:     1,
+	}
+}
+
+func Read(content io.Reader) (*Bom, error) {
+	bom := &Bom{}
+	if err := json.NewDecoder(content).Decode(bom); err != nil {
+		return nil, fmt.Errorf("error parsing SBOM: %s", err)
+	}
+
+	return bom, nil
+}
+
+/**
+Returns the components of the given type, in the order they were added
+*/
+func (bom *Bom) ComponentsOfType(componentType string) []Component {
+	var components []Component
+	for _, component := range bom.Components {
+		if component.Type == componentType {
+			components = append(components, component)
+		}
+	}
+	return components
+}
+
+/**
+Returns the value of the given property, or "" if it is not set
+*/
+func (component Component) Property(name string) string {
+	for _, property := range component.Properties {
+		if property.Name == name {
+			return property.Value
+		}
+	}
+	return ""
+}
+
+/**
+Returns the hash with the given algorithm, or "" if there is none
+*/
+func (component Component) Hash(alg string) string {
+	for _, hash := range component.Hashes {
+		if hash.Alg == alg {
+			return hash.Content
+		}
+	}
+	return ""
+}
+
+/**
+Sorts the components so the output does not depend on the order things were built
+*/
+func (bom *Bom) Sort() {
+	sort.SliceStable(bom.Components, func(i, j int) bool {
+		if bom.Components[i].Type != bom.Components[j].Type {
+			return bom.Components[i].Type < bom.Components[j].Type
+		}
+		return bom.Components[i].Name < bom.Components[j].Name
+	})
+}
+
+func (bom *Bom) Write(writer io.Writer) error {
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(bom)
+}
+
+func (bom *Bom) Save(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("cannot write SBOM %s: %s", path, err)
+	}
+	defer file.Close()
+
+	return bom.Write(file)
+}
@@ -0,0 +1,137 @@
+package timing
+
+import (
+	"fmt"
+	"github.com/ruckstack/ruckstack/common/ui"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+/**
+Records how long each phase of a build takes.
+Phases can be nested: time is counted towards the most recently started phase that has not stopped, so phases never overlap.
+A nil Timings records nothing.
+*/
+type Timings struct {
+	started   time.Time
+	since     time.Time
+	running   []string
+	durations map[string]time.Duration
+	order     []string
+	lock      sync.Mutex
+
+	//now is replaced in tests
+	now func() time.Time
+}
+
+func New() *Timings {
+	timings := &Timings{
+		durations: map[string]time.Duration{},
+		now:       time.Now,
+	}
+	timings.started = timings.now()
+	timings.since = timings.started
+
+	return timings
+}
+
+/**
+Starts timing the given phase and returns the function to stop it.
+Starting a phase that was already timed adds to its duration.
+*/
+func (timings *Timings) Start(phase string) func() {
+	if timings == nil {
+		return func() {}
+	}
+
+	timings.lock.Lock()
+	defer timings.lock.Unlock()
+
+	timings.record()
+	timings.running = append(timings.running, phase)
+	if _, found := timings.durations[phase]; !found {
+		timings.durations[phase] = 0
+		timings.order = append(timings.order, phase)
+	}
+
+	return func() {
+		timings.lock.Lock()
+		defer timings.lock.Unlock()
+
+		timings.record()
+		for i := len(timings.running) - 1; i >= 0; i-- {
+			if timings.running[i] == phase {
+				timings.running = append(timings.running[:i], timings.running[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+/**
+Adds the time since the last change to the current phase
+*/
+func (timings *Timings) record() {
+	now := timings.now()
+	if len(timings.running) > 0 {
+		timings.durations[timings.running[len(timings.running)-1]] += now.Sub(timings.since)
+	}
+	timings.since = now
+}
+
+/**
+Returns the duration of each phase, plus "other" for time not in any phase
+*/
+func (timings *Timings) Durations() map[string]time.Duration {
+	timings.lock.Lock()
+	defer timings.lock.Unlock()
+
+	timings.record()
+
+	durations := map[string]time.Duration{}
+	var timed time.Duration
+	for phase, duration := range timings.durations {
+		durations[phase] = duration
+		timed += duration
+	}
+	if other := timings.now().Sub(timings.started) - timed; other > 0 {
+		durations["other"] = other
+	}
+
+	return durations
+}
+
+/**
+Prints the time spent in each phase, longest first
+*/
+func (timings *Timings) Print() error {
+	if timings == nil {
+		return nil
+	}
+
+	durations := timings.Durations()
+	var total time.Duration
+	var phases []string
+	for phase, duration := range durations {
+		total += duration
+		phases = append(phases, phase)
+	}
+	sort.SliceStable(phases, func(i, j int) bool {
+		return durations[phases[i]] > durations[phases[j]]
+	})
+
+	ui.Printf("Build time by phase:")
+	output := tabwriter.NewWriter(ui.GetOutput(), 0, 4, 2, ' ', 0)
+	for _, phase := range phases {
+		percent := 0.0
+		if total > 0 {
+			percent = float64(durations[phase]) * 100 / float64(total)
+		}
+		fmt.Fprintf(output, "    %s\t%s\t%.1f%%\n", phase, durations[phase].Round(time.Millisecond), percent)
+	}
+	fmt.Fprintf(output, "    total\t%s\n", total.Round(time.Millisecond))
+
+	return output.Flush()
+}
@@ -0,0 +1,54 @@
+package timing
+
+import (
+	"bytes"
+	"github.com/ruckstack/ruckstack/common/ui"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTimings(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	timings := New()
+	timings.now = func() time.Time { return now }
+	timings.started = now
+	timings.since = now
+
+	advance := func(seconds int) {
+		now = now.Add(time.Duration(seconds) * time.Second)
+	}
+
+	advance(1) //other
+	stopBuild := timings.Start("building")
+	advance(2)
+	stopCompress := timings.Start("compressing")
+	advance(3)
+	stopCompress()
+	advance(4)
+	stopBuild()
+	stopCompress = timings.Start("compressing")
+	advance(5)
+	stopCompress()
+
+	assert.Equal(t, map[string]time.Duration{
+		"building":    6 * time.Second,
+		"compressing": 8 * time.Second,
+		"other":       1 * time.Second,
+	}, timings.Durations())
+
+	output := new(bytes.Buffer)
+	ui.SetOutput(output)
+	defer ui.SetOutput(os.Stdout)
+
+	assert.NoError(t, timings.Print())
+	assert.Contains(t, output.String(), "compressing  8s  53.3%")
+	assert.Contains(t, output.String(), "total        15s")
+}
+
+func TestTimings_Nil(t *testing.T) {
+	var timings *Timings
+	timings.Start("anything")()
+	assert.NoError(t, timings.Print())
+}
@@ -3,33 +3,67 @@ package util
 import (
 	"archive/tar"
 	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"github.com/ruckstack/ruckstack/builder/internal/cache"
 	"github.com/ruckstack/ruckstack/builder/internal/environment"
+	"github.com/ruckstack/ruckstack/common/global_util"
 	"github.com/ruckstack/ruckstack/common/ui"
 	"io"
 	"io/fs"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
 )
 
+func downloadPath(url string) string {
+	cacheKey := regexp.MustCompile(`https?://`).ReplaceAllString(url, "")
+
+	return environment.CachePath("download/general/" + cacheKey)
+}
+
+/**
+Returns true if the url has already been downloaded to the cache
+*/
+func IsDownloaded(url string) bool {
+	return cache.Lookup(downloadPath(url))
+}
+
+/**
+Downloads the url to the cache, or returns the cached file if it was already downloaded
+*/
 func DownloadFile(url string) (string, error) {
+	return DownloadVerifiedFile(url, "")
+}
 
-	cacheKey := regexp.MustCompile(`https?://`).ReplaceAllString(url, "")
+/**
+Downloads the url to the cache, failing if its sha256 is not expectedSha256. If expectedSha256 is empty, the download is not checked.
+A file that fails the check is never saved to the cache, and a cached file is only checked once for each expected checksum.
+*/
+func DownloadVerifiedFile(url string, expectedSha256 string) (string, error) {
+	savePath := downloadPath(url)
+	if cache.Lookup(savePath) {
+		if expectedSha256 == "" || cache.IsVerified(savePath, expectedSha256) {
+			ui.VPrintf("Already downloaded %s to %s", filepath.Base(savePath), savePath)
+			return savePath, nil
+		}
 
-	savePath := environment.CachePath("download/general/" + cacheKey)
-	_, err := os.Stat(savePath)
-	if err == nil {
-		ui.VPrintf("Packaged file %s", filepath.Base(savePath))
-		return savePath, nil
-	} else {
-		if os.IsNotExist(err) {
-			//ok, will download
-		} else {
+		actualSha256, err := global_util.HashFileSha256(savePath)
+		if err != nil {
 			return "", err
 		}
+		if actualSha256 == expectedSha256 {
+			ui.VPrintf("Verified cached %s", filepath.Base(savePath))
+			return savePath, cache.MarkVerified(savePath, expectedSha256)
+		}
+		ui.Printf("Cached %s does not match its published checksum. Downloading again", url)
+	}
 
+	if environment.Offline {
+		return "", fmt.Errorf("cannot download %s with --offline. Run `ruckstack fetch` first or add it to the artifacts directory", url)
 	}
 
 	saveDir, _ := filepath.Split(savePath)
@@ -37,12 +71,6 @@ func DownloadFile(url string) (string, error) {
 		return "", fmt.Errorf("cannot create directory %s: %s", saveDir, err)
 	}
 
-	_, err = os.Stat(savePath)
-	if err == nil {
-		ui.VPrintf("Already downloaded %s to %s", filepath.Base(savePath), savePath)
-		return savePath, nil
-	}
-
 	defer ui.StartProgressf("Downloading %s", url).Stop()
 	resp, err := http.Get(url)
 	if err != nil {
@@ -54,19 +82,38 @@ func DownloadFile(url string) (string, error) {
 	}
 	defer resp.Body.Close()
 
-	// Create the file
-	out, err := os.Create(savePath)
+	// Write to a temp file so an interrupted download is never left in the cache
+	out, err := ioutil.TempFile(saveDir, filepath.Base(savePath)+".*.tmp")
 	if err != nil {
 		return "", fmt.Errorf("cannot create %s: %s", savePath, err)
 	}
-	defer out.Close()
+	defer os.Remove(out.Name())
 
-	// Write the body to file
-	_, err = io.Copy(out, resp.Body)
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(out, hash), resp.Body)
+	_ = out.Close()
 	if err != nil {
 		return "", fmt.Errorf("cannot write %s: %s", savePath, err)
 	}
 
+	actualSha256 := hex.EncodeToString(hash.Sum(nil))
+	if expectedSha256 != "" && actualSha256 != expectedSha256 {
+		return "", fmt.Errorf("%s does not match its published checksum: expected sha256 %s but downloaded %s", url, expectedSha256, actualSha256)
+	}
+
+	if err := os.Rename(out.Name(), savePath); err != nil {
+		return "", fmt.Errorf("cannot write %s: %s", savePath, err)
+	}
+
+	if err := cache.Record(savePath); err != nil {
+		return "", err
+	}
+	if expectedSha256 != "" {
+		if err := cache.MarkVerified(savePath, expectedSha256); err != nil {
+			return "", err
+		}
+	}
+
 	return savePath, nil
 }
 
@@ -1,15 +1,22 @@
 package util
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"github.com/ruckstack/ruckstack/builder/internal/bundled"
 	"github.com/ruckstack/ruckstack/builder/internal/environment"
 	"github.com/stretchr/testify/assert"
 	"io/fs"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestDownloadFile(t *testing.T) {
@@ -203,3 +210,33 @@ func TestCopyDir(t *testing.T) {
 		})
 	}
 }
+
+func TestDownloadVerifiedFile(t *testing.T) {
+	content := "k3s binary"
+	hash := sha256.Sum256([]byte(content))
+	checksum := hex.EncodeToString(hash[:])
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		_, _ = writer.Write([]byte(content))
+	}))
+	defer server.Close()
+
+	downloadUrl := fmt.Sprintf("%s/%d/k3s", server.URL, time.Now().UnixNano())
+
+	_, err := DownloadVerifiedFile(downloadUrl, strings.Repeat("0", 64))
+	assert.EqualError(t, err, downloadUrl+" does not match its published checksum: expected sha256 "+strings.Repeat("0", 64)+" but downloaded "+checksum)
+	assert.False(t, IsDownloaded(downloadUrl), "a file failing its checksum must not be cached")
+
+	savedPath, err := DownloadVerifiedFile(downloadUrl, checksum)
+	assert.NoError(t, err)
+	savedContent, err := ioutil.ReadFile(savedPath)
+	assert.NoError(t, err)
+	assert.Equal(t, content, string(savedContent))
+
+	//verified result is cached
+	_, err = DownloadVerifiedFile(downloadUrl, checksum)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+}
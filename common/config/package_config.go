@@ -19,11 +19,69 @@ type PackageConfig struct {
 	Version   string
 	BuildTime int64 `yaml:"buildTime"`
 
+	//Profile is the project profile the package was built with, such as an enterprise edition. Empty for the project as written
+	Profile string `yaml:"profile,omitempty"`
+
+	//Commit is the git commit the project was built from, if it was built from a git repository
+	Commit string `yaml:"commit,omitempty"`
+
+	K3sVersion  string `yaml:"k3sVersion"`
+	HelmVersion string `yaml:"helmVersion"`
+
+	//Architecture is the CPU architecture the installer is for, such as amd64 or arm64. Installers built before it was recorded are amd64
+	Architecture string `yaml:"architecture,omitempty"`
+
 	LicenseLevel int `yaml:"level"`
 
 	FilePermissions map[string]PackagedFileConfig `yaml:"filePermissions"`
 	Files           map[string]string
 	Support         []string
+
+	//Images maps each packaged image tag to the digest it was pinned to at build time
+	Images map[string]string
+
+	//DeltaBase is set on delta installers, which leave out files unchanged since the base build. Files still lists every file.
+	DeltaBase *DeltaBase `yaml:"deltaBase,omitempty"`
+}
+
+/**
+Returns the CPU architecture the package is for
+*/
+func (packageConfig *PackageConfig) GetArchitecture() string {
+	if packageConfig.Architecture == "" {
+		return "amd64"
+	}
+	return packageConfig.Architecture
+}
+
+/**
+Returns the project profile the package was built with, or "default" if it was built without one
+*/
+func (packageConfig *PackageConfig) GetProfile() string {
+	if packageConfig.Profile == "" {
+		return "default"
+	}
+	return packageConfig.Profile
+}
+
+/**
+The build a delta installer was created against. It can only upgrade an install of exactly this build.
+*/
+type DeltaBase struct {
+	Version   string
+	BuildTime int64 `yaml:"buildTime"`
+}
+
+/**
+Returns an error if the given installed package is not the exact build this delta was created from
+*/
+func (deltaBase *DeltaBase) CheckInstalled(installed *PackageConfig) error {
+	if installed.Version != deltaBase.Version || installed.BuildTime != deltaBase.BuildTime {
+		return fmt.Errorf("this is a delta installer for version %s (built %s) but version %s (built %s) is installed. Use the full installer instead",
+			deltaBase.Version, time.Unix(deltaBase.BuildTime, 0).Format(time.RFC3339),
+			installed.Version, time.Unix(installed.BuildTime, 0).Format(time.RFC3339))
+	}
+	return nil
 }
 
 type PackagedFileConfig struct {
@@ -108,6 +166,39 @@ func (packageConfig *PackageConfig) CheckFilePermissions(filePath string, localC
 
 	adminGroupGid := int(ownerGroupUid64)
 
+	fullFilePath := filepath.Join(serverHome, filePath)
+
+	mode, preservePermissions, err := packageConfig.ExpectedFileMode(filePath, fileStat.IsDir(), serverHome)
+	if err != nil {
+		return err
+	}
+	if preservePermissions {
+		return nil
+	}
+
+	if currentUser.Name == "root" {
+		err = os.Chown(fullFilePath, 0, adminGroupGid)
+		if err != nil {
+			return err
+		}
+	} else {
+		//normal code will run as root, but tests run as a random user
+		ui.VPrintf("Cannot change %s owner to root, because not running as root", fullFilePath)
+	}
+
+	err = os.Chmod(fullFilePath, mode)
+	if err != nil {
+		return nil
+	}
+
+	return nil
+}
+
+/**
+Returns the mode the file should have based on FilePermissions.
+If preservePermissions is true, the file keeps whatever permissions it has and the returned mode is meaningless.
+*/
+func (packageConfig *PackageConfig) ExpectedFileMode(filePath string, isDir bool, serverHome string) (mode os.FileMode, preservePermissions bool, err error) {
 	var foundFileConfigPath string
 	var foundFileConfig PackagedFileConfig
 
@@ -125,7 +216,7 @@ func (packageConfig *PackageConfig) CheckFilePermissions(filePath string, localC
 		} else {
 			match, err := filepath.Match(serverHome+"/"+fileConfigPath, fullFilePath)
 			if err != nil {
-				return err
+				return 0, false, err
 			}
 
 			if match {
@@ -138,7 +229,7 @@ func (packageConfig *PackageConfig) CheckFilePermissions(filePath string, localC
 	}
 
 	if foundFileConfigPath == "" {
-		if fileStat.IsDir() {
+		if isDir {
 			foundFileConfig = PackagedFileConfig{
 				AdminGroupReadable: true,
 				AdminGroupWritable: false,
@@ -154,35 +245,24 @@ func (packageConfig *PackageConfig) CheckFilePermissions(filePath string, localC
 	}
 
 	if foundFileConfig.PreservePermissions {
-		return nil
+		return 0, true, nil
 	}
 
-	if currentUser.Name == "root" {
-		err = os.Chown(fullFilePath, 0, adminGroupGid)
-		if err != nil {
-			return err
-		}
-	} else {
-		//normal code will run as root, but tests run as a random user
-		ui.VPrintf("Cannot change %s owner to root, because not running as root", fullFilePath)
-	}
-
-	var mode os.FileMode
 	if !foundFileConfig.AdminGroupReadable {
-		if fileStat.IsDir() || foundFileConfig.Executable {
+		if isDir || foundFileConfig.Executable {
 			mode = os.FileMode(0700)
 		} else {
 			mode = os.FileMode(0600)
 		}
 	} else {
 		if foundFileConfig.AdminGroupWritable {
-			if fileStat.IsDir() || foundFileConfig.Executable {
+			if isDir || foundFileConfig.Executable {
 				mode = os.FileMode(0770)
 			} else {
 				mode = os.FileMode(0660)
 			}
 		} else {
-			if fileStat.IsDir() || foundFileConfig.Executable {
+			if isDir || foundFileConfig.Executable {
 				mode = os.FileMode(0750)
 			} else {
 				mode = os.FileMode(0640)
@@ -190,12 +270,7 @@ func (packageConfig *PackageConfig) CheckFilePermissions(filePath string, localC
 		}
 	}
 
-	err = os.Chmod(fullFilePath, mode)
-	if err != nil {
-		return nil
-	}
-
-	return nil
+	return mode, false, nil
 }
 
 func isBetterFileMatch(newFilePath string, existingFilePath string) bool {
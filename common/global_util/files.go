@@ -2,10 +2,12 @@ package global_util
 
 import (
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 )
 
 func HashFile(filePath string) (string, error) {
@@ -22,3 +24,61 @@ func HashFile(filePath string) (string, error) {
 
 	return hex.EncodeToString(hash.Sum(nil)[:20]), nil
 }
+
+/**
+Returns the hex sha256 of the file, for comparing to published checksums
+*/
+func HashFileSha256(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", fmt.Errorf("cannot open %s for hashing: %s", filePath, err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", fmt.Errorf("cannot compute hash for %s: %s", filePath, err)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+/**
+Returns the hex sha256 of the path and contents of every file in the directory, so it only changes when the files do
+*/
+func HashDirectory(dirPath string) (string, error) {
+	hash := sha256.New()
+
+	err := filepath.Walk(dirPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		relativePath, err := filepath.Rel(dirPath, path)
+		if err != nil {
+			return err
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("cannot open %s for hashing: %s", path, err)
+		}
+		defer file.Close()
+
+		fmt.Fprintf(hash, "%s\x00", filepath.ToSlash(relativePath))
+		if _, err := io.Copy(hash, file); err != nil {
+			return fmt.Errorf("cannot compute hash for %s: %s", path, err)
+		}
+		fmt.Fprintf(hash, "\x00")
+
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
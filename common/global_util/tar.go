@@ -7,10 +7,19 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 func TarDirectory(sourceDir string, targetFilename string, compress bool) error {
-	targetFile, err := os.OpenFile(targetFilename, os.O_CREATE|os.O_RDWR, 0644)
+	return TarDirectoryAt(sourceDir, targetFilename, compress, time.Time{})
+}
+
+/**
+Tars the directory like TarDirectory, but records modTime for every file instead of its actual modification time so the tar only depends on the file contents.
+A zero modTime keeps the actual modification times.
+*/
+func TarDirectoryAt(sourceDir string, targetFilename string, compress bool, modTime time.Time) error {
+	targetFile, err := os.OpenFile(targetFilename, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
 	if err != nil {
 		return err
 	}
@@ -56,6 +65,9 @@ func TarDirectory(sourceDir string, targetFilename string, compress bool) error
 			ModTime: info.ModTime(),
 			Mode:    0644,
 		}
+		if !modTime.IsZero() {
+			header.ModTime = modTime
+		}
 
 		err = tarWriter.WriteHeader(header)
 		if err != nil {
@@ -1,10 +1,14 @@
 package global_util
 
 import (
+	"bytes"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestTarAndUntar(t *testing.T) {
@@ -53,3 +57,29 @@ func TestTarAndUntar(t *testing.T) {
 		})
 	}
 }
+
+func TestTarDirectoryAt(t *testing.T) {
+	tarDir := func(fileTime time.Time) []byte {
+		workDir, err := ioutil.TempDir("", "tar-test-")
+		require.NoError(t, err)
+		defer os.RemoveAll(workDir)
+
+		require.NoError(t, os.MkdirAll(filepath.Join(workDir, "source", "templates"), 0755))
+		for _, file := range []string{"Chart.yaml", "templates/service.yaml"} {
+			filePath := filepath.Join(workDir, "source", file)
+			require.NoError(t, ioutil.WriteFile(filePath, []byte(file), 0644))
+			require.NoError(t, os.Chtimes(filePath, fileTime, fileTime))
+		}
+
+		targetPath := filepath.Join(workDir, "source.tgz")
+		require.NoError(t, TarDirectoryAt(filepath.Join(workDir, "source"), targetPath, true, time.Unix(1600000000, 0)))
+
+		content, err := ioutil.ReadFile(targetPath)
+		require.NoError(t, err)
+		return content
+	}
+
+	first := tarDir(time.Unix(1600000000, 0))
+	second := tarDir(time.Now())
+	assert.True(t, bytes.Equal(first, second), "tars of the same files with different modification times should be identical")
+}
@@ -0,0 +1,15 @@
+package global_util
+
+import (
+	"archive/zip"
+	"github.com/klauspost/compress/zstd"
+)
+
+/**
+Zip method for zstd compressed entries, using the WinZip method number
+*/
+const ZipMethodZstd uint16 = zstd.ZipMethodWinZip
+
+func init() {
+	zip.RegisterDecompressor(ZipMethodZstd, zstd.ZipDecompressor())
+}
@@ -0,0 +1,374 @@
+package signature
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+/**
+Name of the signature inside the installer
+*/
+const InstallerPath = ".signature"
+
+/**
+Name the installer executable is signed under. The executable comes before the zip so is not one of its entries
+*/
+const ExecutablePath = ".executable"
+
+const (
+	AlgorithmEd25519   = "ed25519"
+	AlgorithmRsaSha256 = "rsa-sha256"
+)
+
+/**
+Signature over every file in an installer.
+The signed payload is the sorted list of "<sha256>  <path>" lines for all zip entries except the signature itself,
+plus the executable before the zip under ExecutablePath.
+*/
+type Signature struct {
+	Algorithm string
+
+	//ExecutableSize is how many bytes of the installer before the zip are signed under ExecutablePath. Zero for installers signed without their executable
+	ExecutableSize int64 `yaml:"executableSize,omitempty"`
+
+	//PublicKey is the PEM encoded key the installer was signed with
+	PublicKey string `yaml:"publicKey"`
+
+	//Value is the base64 encoded signature
+	Value string `yaml:"signature"`
+}
+
+/**
+A private key used to sign installers
+*/
+type Signer struct {
+	key       crypto.Signer
+	algorithm string
+}
+
+/**
+Loads the signing key from a PEM file, or from an environment variable if source is "env:<VARIABLE>"
+*/
+func LoadSigner(source string) (*Signer, error) {
+	var pemData []byte
+	if strings.HasPrefix(source, "env:") {
+		variable := strings.TrimPrefix(source, "env:")
+		value, found := os.LookupEnv(variable)
+		if !found || value == "" {
+			return nil, fmt.Errorf("signing key environment variable %s is not set", variable)
+		}
+		pemData = []byte(value)
+	} else {
+		var err error
+		pemData, err = ioutil.ReadFile(source)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read signing key: %s", err)
+		}
+	}
+
+	return ParseSigner(pemData)
+}
+
+/**
+Parses a PEM encoded ed25519 or RSA private key
+*/
+func ParseSigner(pemData []byte) (*Signer, error) {
+	block, _ := pem.Decode(pemData)
+	if block == nil {
+		return nil, fmt.Errorf("signing key is not PEM encoded")
+	}
+
+	var key interface{}
+	var err error
+	if block.Type == "RSA PRIVATE KEY" {
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	} else {
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse signing key: %s", err)
+	}
+
+	switch typedKey := key.(type) {
+	case ed25519.PrivateKey:
+		return &Signer{key: typedKey, algorithm: AlgorithmEd25519}, nil
+	case *rsa.PrivateKey:
+		return &Signer{key: typedKey, algorithm: AlgorithmRsaSha256}, nil
+	default:
+		return nil, fmt.Errorf("unsupported signing key type %T. Use an ed25519 or RSA key", key)
+	}
+}
+
+func (signer *Signer) PublicKey() crypto.PublicKey {
+	return signer.key.Public()
+}
+
+/**
+Signs the given path to sha256 digest map
+*/
+func (signer *Signer) Sign(digests map[string]string) (*Signature, error) {
+	publicKeyPem, err := EncodePublicKey(signer.PublicKey())
+	if err != nil {
+		return nil, err
+	}
+
+	payload := Payload(digests)
+
+	var value []byte
+	switch signer.algorithm {
+	case AlgorithmEd25519:
+		value, err = signer.key.Sign(rand.Reader, payload, crypto.Hash(0))
+	default:
+		hash := sha256.Sum256(payload)
+		value, err = signer.key.Sign(rand.Reader, hash[:], crypto.SHA256)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error signing installer: %s", err)
+	}
+
+	return &Signature{
+		Algorithm: signer.algorithm,
+		PublicKey: publicKeyPem,
+		Value:     base64.StdEncoding.EncodeToString(value),
+	}, nil
+}
+
+/**
+Returns the data that is signed: one "<sha256>  <path>" line per file, sorted by path
+*/
+func Payload(digests map[string]string) []byte {
+	var paths []string
+	for path := range digests {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	payload := new(bytes.Buffer)
+	for _, path := range paths {
+		fmt.Fprintf(payload, "%s  %s\n", digests[path], path)
+	}
+	return payload.Bytes()
+}
+
+/**
+Verifies the signature against the given digests.
+If trustedKey is not nil, the installer must have been signed by that key. Otherwise only the embedded key is checked.
+*/
+func (signature *Signature) Verify(digests map[string]string, trustedKey crypto.PublicKey) error {
+	signedBy, err := ParsePublicKey([]byte(signature.PublicKey))
+	if err != nil {
+		return err
+	}
+
+	if trustedKey != nil && Fingerprint(signedBy) != Fingerprint(trustedKey) {
+		return fmt.Errorf("installer is signed by key %s, not the trusted key %s", Fingerprint(signedBy), Fingerprint(trustedKey))
+	}
+
+	value, err := base64.StdEncoding.DecodeString(signature.Value)
+	if err != nil {
+		return fmt.Errorf("cannot decode signature: %s", err)
+	}
+
+	payload := Payload(digests)
+	switch signature.Algorithm {
+	case AlgorithmEd25519:
+		publicKey, ok := signedBy.(ed25519.PublicKey)
+		if !ok || !ed25519.Verify(publicKey, payload, value) {
+			return fmt.Errorf("invalid signature: installer contents have been modified")
+		}
+	case AlgorithmRsaSha256:
+		publicKey, ok := signedBy.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("invalid signature: key is not an RSA key")
+		}
+		hash := sha256.Sum256(payload)
+		if err := rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, hash[:], value); err != nil {
+			return fmt.Errorf("invalid signature: installer contents have been modified")
+		}
+	default:
+		return fmt.Errorf("unsupported signature algorithm %s", signature.Algorithm)
+	}
+
+	return nil
+}
+
+/**
+Returns the key the installer was signed with
+*/
+func (signature *Signature) SignedBy() (crypto.PublicKey, error) {
+	return ParsePublicKey([]byte(signature.PublicKey))
+}
+
+func Read(content io.Reader) (*Signature, error) {
+	signature := new(Signature)
+	if err := yaml.NewDecoder(content).Decode(signature); err != nil {
+		return nil, fmt.Errorf("error parsing signature: %s", err)
+	}
+	return signature, nil
+}
+
+func (signature *Signature) Write(writer io.Writer) error {
+	return yaml.NewEncoder(writer).Encode(signature)
+}
+
+/**
+Loads the signature saved in an install directory. Returns nil if the install was not signed
+*/
+func LoadInstalled(serverHome string) (*Signature, error) {
+	file, err := os.Open(serverHome + "/" + InstallerPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return Read(file)
+}
+
+/**
+Reads the signature from an installer zip and the sha256 of every other file in it. The signature is nil if the installer is not signed
+*/
+func ReadZip(zipReader *zip.Reader) (*Signature, map[string]string, error) {
+	var signature *Signature
+	digests := map[string]string{}
+
+	for _, zipFile := range zipReader.File {
+		if strings.HasSuffix(zipFile.Name, "/") {
+			continue
+		}
+
+		fileReader, err := zipFile.Open()
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot read %s: %s", zipFile.Name, err)
+		}
+
+		if zipFile.Name == InstallerPath {
+			signature, err = Read(fileReader)
+		} else {
+			hash := sha256.New()
+			if _, err = io.Copy(hash, fileReader); err == nil {
+				digests[zipFile.Name] = hex.EncodeToString(hash.Sum(nil))
+			}
+		}
+		_ = fileReader.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot read %s: %s", zipFile.Name, err)
+		}
+	}
+
+	return signature, digests, nil
+}
+
+/**
+Reads the signature from an installer and the sha256 of every file in it, including the executable before the zip.
+The signature is nil if the installer is not signed
+*/
+func ReadInstaller(installer io.ReaderAt, size int64) (*Signature, map[string]string, error) {
+	zipReader, err := zip.NewReader(installer, size)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot read installer: %s", err)
+	}
+
+	signature, digests, err := ReadZip(zipReader)
+	if err != nil || signature == nil || signature.ExecutableSize == 0 {
+		return signature, digests, err
+	}
+
+	if signature.ExecutableSize > size {
+		return nil, nil, fmt.Errorf("invalid signature: executable size %d is larger than the installer", signature.ExecutableSize)
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, io.NewSectionReader(installer, 0, signature.ExecutableSize)); err != nil {
+		return nil, nil, fmt.Errorf("cannot read installer executable: %s", err)
+	}
+	digests[ExecutablePath] = hex.EncodeToString(hash.Sum(nil))
+
+	return signature, digests, nil
+}
+
+/**
+Checks the installer file, including its executable, is signed by trustedKey
+*/
+func VerifyInstaller(installerPath string, trustedKey crypto.PublicKey) error {
+	installer, err := os.Open(installerPath)
+	if err != nil {
+		return fmt.Errorf("cannot open %s: %s", installerPath, err)
+	}
+	defer installer.Close()
+	installerInfo, err := installer.Stat()
+	if err != nil {
+		return fmt.Errorf("cannot open %s: %s", installerPath, err)
+	}
+
+	signature, digests, err := ReadInstaller(installer, installerInfo.Size())
+	if err != nil {
+		return err
+	}
+	if signature == nil {
+		return fmt.Errorf("installer is not signed but must be signed by key %s", Fingerprint(trustedKey))
+	}
+	if signature.ExecutableSize == 0 {
+		return fmt.Errorf("installer does not sign its executable. Rebuild it with a newer version of ruckstack")
+	}
+
+	return signature.Verify(digests, trustedKey)
+}
+
+func ParsePublicKey(pemData []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(pemData)
+	if block == nil {
+		return nil, fmt.Errorf("public key is not PEM encoded")
+	}
+
+	publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse public key: %s", err)
+	}
+	return publicKey, nil
+}
+
+func LoadPublicKey(path string) (crypto.PublicKey, error) {
+	pemData, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read public key: %s", err)
+	}
+	return ParsePublicKey(pemData)
+}
+
+func EncodePublicKey(publicKey crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return "", fmt.Errorf("cannot encode public key: %s", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})), nil
+}
+
+/**
+Returns a short identifier for the key, in the same format as ssh-keygen -l
+*/
+func Fingerprint(publicKey crypto.PublicKey) string {
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return "unknown"
+	}
+	hash := sha256.Sum256(der)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(hash[:])
+}
@@ -0,0 +1,257 @@
+package signature
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testKeys(t *testing.T) map[string][]byte {
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	ed25519Der, err := x509.MarshalPKCS8PrivateKey(ed25519Key)
+	require.NoError(t, err)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	rsaPkcs8Der, err := x509.MarshalPKCS8PrivateKey(rsaKey)
+	require.NoError(t, err)
+
+	return map[string][]byte{
+		"ed25519":   pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: ed25519Der}),
+		"rsa pkcs1": pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}),
+		"rsa pkcs8": pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: rsaPkcs8Der}),
+		"not a key": []byte("invalid"),
+		"empty pem": pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte("invalid")}),
+	}
+}
+
+func TestSignAndVerify(t *testing.T) {
+	keys := testKeys(t)
+	digests := map[string]string{
+		".package.config": "aaa",
+		"bin/manager":     "bbb",
+	}
+
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	for _, keyName := range []string{"ed25519", "rsa pkcs1", "rsa pkcs8"} {
+		t.Run(keyName, func(t *testing.T) {
+			signer, err := ParseSigner(keys[keyName])
+			require.NoError(t, err)
+
+			signature, err := signer.Sign(digests)
+			require.NoError(t, err)
+
+			content := new(bytes.Buffer)
+			require.NoError(t, signature.Write(content))
+			signature, err = Read(content)
+			require.NoError(t, err)
+
+			assert.NoError(t, signature.Verify(digests, nil))
+			assert.NoError(t, signature.Verify(digests, signer.PublicKey()))
+
+			err = signature.Verify(map[string]string{".package.config": "aaa", "bin/manager": "ccc"}, nil)
+			assert.EqualError(t, err, "invalid signature: installer contents have been modified")
+
+			err = signature.Verify(map[string]string{".package.config": "aaa"}, signer.PublicKey())
+			assert.EqualError(t, err, "invalid signature: installer contents have been modified")
+
+			err = signature.Verify(digests, otherKey.Public())
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), "not the trusted key "+Fingerprint(otherKey.Public()))
+			}
+		})
+	}
+}
+
+func TestParseSigner_Errors(t *testing.T) {
+	keys := testKeys(t)
+
+	_, err := ParseSigner(keys["not a key"])
+	assert.EqualError(t, err, "signing key is not PEM encoded")
+
+	_, err = ParseSigner(keys["empty pem"])
+	assert.Contains(t, err.Error(), "cannot parse signing key")
+}
+
+func TestLoadSigner(t *testing.T) {
+	keys := testKeys(t)
+
+	defer os.Unsetenv("TEST_SIGNING_KEY")
+	_ = os.Setenv("TEST_SIGNING_KEY", string(keys["ed25519"]))
+
+	signer, err := LoadSigner("env:TEST_SIGNING_KEY")
+	require.NoError(t, err)
+	assert.Equal(t, AlgorithmEd25519, signer.algorithm)
+
+	_, err = LoadSigner("env:TEST_MISSING_SIGNING_KEY")
+	assert.EqualError(t, err, "signing key environment variable TEST_MISSING_SIGNING_KEY is not set")
+
+	_, err = LoadSigner("missing.pem")
+	assert.Contains(t, err.Error(), "cannot read signing key")
+}
+
+func TestReadZip(t *testing.T) {
+	signer, err := ParseSigner(testKeys(t)["ed25519"])
+	require.NoError(t, err)
+
+	signature, err := signer.Sign(map[string]string{
+		"file.txt": "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9",
+	})
+	require.NoError(t, err)
+
+	zipContent := new(bytes.Buffer)
+	zipWriter := zip.NewWriter(zipContent)
+	fileWriter, err := zipWriter.Create("file.txt")
+	require.NoError(t, err)
+	_, err = fileWriter.Write([]byte("hello world"))
+	require.NoError(t, err)
+	_, err = zipWriter.Create("dir/")
+	require.NoError(t, err)
+	fileWriter, err = zipWriter.Create(InstallerPath)
+	require.NoError(t, err)
+	require.NoError(t, signature.Write(fileWriter))
+	require.NoError(t, zipWriter.Close())
+
+	zipReader, err := zip.NewReader(bytes.NewReader(zipContent.Bytes()), int64(zipContent.Len()))
+	require.NoError(t, err)
+
+	readSignature, digests, err := ReadZip(zipReader)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"file.txt": "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"}, digests)
+	assert.NoError(t, readSignature.Verify(digests, signer.PublicKey()))
+}
+
+func TestReadInstaller(t *testing.T) {
+	signer, err := ParseSigner(testKeys(t)["ed25519"])
+	require.NoError(t, err)
+
+	executable := []byte("#!/bin/sh\necho installer\n")
+	executableDigest := sha256.Sum256(executable)
+	fileDigest := sha256.Sum256([]byte("hello world"))
+
+	//writes the executable followed by a zip, the same as the builder does
+	buildInstaller := func(installerSignature *Signature) []byte {
+		installer := bytes.NewBuffer(append([]byte{}, executable...))
+		zipWriter := zip.NewWriter(installer)
+		zipWriter.SetOffset(int64(len(executable)))
+		fileWriter, err := zipWriter.Create("file.txt")
+		require.NoError(t, err)
+		_, err = fileWriter.Write([]byte("hello world"))
+		require.NoError(t, err)
+		fileWriter, err = zipWriter.Create(InstallerPath)
+		require.NoError(t, err)
+		require.NoError(t, installerSignature.Write(fileWriter))
+		require.NoError(t, zipWriter.Close())
+		return installer.Bytes()
+	}
+
+	installerSignature, err := signer.Sign(map[string]string{
+		"file.txt":     hex.EncodeToString(fileDigest[:]),
+		ExecutablePath: hex.EncodeToString(executableDigest[:]),
+	})
+	require.NoError(t, err)
+	installerSignature.ExecutableSize = int64(len(executable))
+	installer := buildInstaller(installerSignature)
+
+	readSignature, digests, err := ReadInstaller(bytes.NewReader(installer), int64(len(installer)))
+	require.NoError(t, err)
+	assert.Equal(t, hex.EncodeToString(executableDigest[:]), digests[ExecutablePath])
+	assert.NoError(t, readSignature.Verify(digests, signer.PublicKey()))
+
+	tampered := append([]byte{}, installer...)
+	copy(tampered, "#!/bin/sh\necho malicious\n")
+	readSignature, digests, err = ReadInstaller(bytes.NewReader(tampered), int64(len(tampered)))
+	require.NoError(t, err)
+	assert.EqualError(t, readSignature.Verify(digests, signer.PublicKey()), "invalid signature: installer contents have been modified")
+
+	//the executable is part of the signed payload, so leaving it out of the signature file does not skip the check
+	installerSignature.ExecutableSize = 0
+	stripped := buildInstaller(installerSignature)
+	readSignature, digests, err = ReadInstaller(bytes.NewReader(stripped), int64(len(stripped)))
+	require.NoError(t, err)
+	assert.NotContains(t, digests, ExecutablePath)
+	assert.Error(t, readSignature.Verify(digests, signer.PublicKey()))
+}
+
+func TestVerifyInstaller(t *testing.T) {
+	signer, err := ParseSigner(testKeys(t)["ed25519"])
+	require.NoError(t, err)
+	otherSigner, err := ParseSigner(testKeys(t)["ed25519"])
+	require.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "verify-installer-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	executable := []byte("#!/bin/sh\necho installer\n")
+	executableDigest := sha256.Sum256(executable)
+
+	//writes the executable followed by a zip signed by signer unless it is nil. The executable is only signed if signExecutable is set
+	writeInstaller := func(name string, signer *Signer, signExecutable bool, tamper bool) string {
+		installer := bytes.NewBuffer(append([]byte{}, executable...))
+		zipWriter := zip.NewWriter(installer)
+		zipWriter.SetOffset(int64(len(executable)))
+		if signer != nil {
+			digests := map[string]string{}
+			if signExecutable {
+				digests[ExecutablePath] = hex.EncodeToString(executableDigest[:])
+			}
+			installerSignature, err := signer.Sign(digests)
+			require.NoError(t, err)
+			if signExecutable {
+				installerSignature.ExecutableSize = int64(len(executable))
+			}
+			fileWriter, err := zipWriter.Create(InstallerPath)
+			require.NoError(t, err)
+			require.NoError(t, installerSignature.Write(fileWriter))
+		}
+		require.NoError(t, zipWriter.Close())
+
+		content := installer.Bytes()
+		if tamper {
+			copy(content, "#!/bin/sh\necho malicious\n")
+		}
+		installerPath := filepath.Join(dir, name)
+		require.NoError(t, ioutil.WriteFile(installerPath, content, 0755))
+		return installerPath
+	}
+
+	testData := []struct {
+		name          string
+		installerPath string
+		expectedError string
+	}{
+		{name: "trusted key", installerPath: writeInstaller("trusted", signer, true, false)},
+		{name: "other key", installerPath: writeInstaller("other", otherSigner, true, false), expectedError: "not the trusted key"},
+		{name: "unsigned", installerPath: writeInstaller("unsigned", nil, false, false), expectedError: "installer is not signed but must be signed by key"},
+		{name: "tampered executable", installerPath: writeInstaller("tampered", signer, true, true), expectedError: "installer contents have been modified"},
+		{name: "executable not signed", installerPath: writeInstaller("no-executable", signer, false, false), expectedError: "installer does not sign its executable"},
+		{name: "missing", installerPath: filepath.Join(dir, "missing"), expectedError: "cannot open"},
+	}
+
+	for _, data := range testData {
+		t.Run(data.name, func(t *testing.T) {
+			err := VerifyInstaller(data.installerPath, signer.PublicKey())
+			if data.expectedError == "" {
+				assert.NoError(t, err)
+			} else if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), data.expectedError)
+			}
+		})
+	}
+}
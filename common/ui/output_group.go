@@ -0,0 +1,61 @@
+package ui
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+/**
+Collects the output of one of several tasks running at once, so each task's output is printed together instead of interleaved with the others
+*/
+type OutputGroup struct {
+	name   string
+	lock   sync.Mutex
+	buffer bytes.Buffer
+}
+
+func NewOutputGroup(name string) *OutputGroup {
+	return &OutputGroup{name: name}
+}
+
+func (group *OutputGroup) Write(data []byte) (int, error) {
+	group.lock.Lock()
+	defer group.lock.Unlock()
+
+	return group.buffer.Write(data)
+}
+
+func (group *OutputGroup) Printf(format string, a ...interface{}) {
+	message := fmt.Sprintf(format, a...)
+	if !strings.HasSuffix(message, "\n") {
+		message += "\n"
+	}
+	_, _ = group.Write([]byte(message))
+}
+
+/**
+Prints the message only if verbose is enabled
+*/
+func (group *OutputGroup) VPrintf(format string, a ...interface{}) {
+	if verbose {
+		group.Printf(format, a...)
+	}
+}
+
+/**
+Prints everything collected so far under the group name
+*/
+func (group *OutputGroup) Flush() {
+	group.lock.Lock()
+	defer group.lock.Unlock()
+
+	if group.buffer.Len() == 0 {
+		return
+	}
+
+	//a single print so output from other groups cannot end up in the middle
+	logger.Print("---- " + group.name + " ----\n" + strings.TrimSuffix(group.buffer.String(), "\n"))
+	group.buffer.Reset()
+}
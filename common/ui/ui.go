@@ -11,6 +11,7 @@ import (
 	"os"
 	"runtime/debug"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -20,6 +21,7 @@ var (
 	verbose          bool
 	inputScanner     *bufio.Scanner
 	spinnerActive    bool
+	spinnerLock      sync.Mutex
 	IsTerminalOutput bool
 	IsTerminalInput  bool
 )
@@ -276,6 +278,9 @@ func PromptForBoolean(prompt string, defaultValue *bool) bool {
 }
 
 func StartProgressf(format string, a ...interface{}) UiSpinner {
+	spinnerLock.Lock()
+	defer spinnerLock.Unlock()
+
 	if !spinnerActive && IsTerminalOutput && !IsVerbose() {
 		spinnerActive = true
 
@@ -312,6 +317,9 @@ type wrappedUiSpinner struct {
 }
 
 func (spinner *batchUiSpinner) Stop() {
+	spinnerLock.Lock()
+	defer spinnerLock.Unlock()
+
 	if spinnerActive {
 		VPrintf("%s...DONE", spinner.message)
 	} else {
@@ -320,6 +328,9 @@ func (spinner *batchUiSpinner) Stop() {
 }
 
 func (spinner *wrappedUiSpinner) Stop() {
+	spinnerLock.Lock()
+	defer spinnerLock.Unlock()
+
 	spinnerActive = false
 	spinner.delegate.Stop()
 }
@@ -128,3 +128,22 @@ func TestPromptForBoolean(t *testing.T) {
 		})
 	}
 }
+
+func TestOutputGroup(t *testing.T) {
+	output := new(bytes.Buffer)
+	SetOutput(output)
+
+	frontend := NewOutputGroup("frontend")
+	backend := NewOutputGroup("backend")
+
+	frontend.Printf("Building %s", "frontend")
+	backend.Printf("Building backend")
+	fmt.Fprintf(frontend, "Step 1/2\nStep 2/2\n")
+	Printf("Not grouped")
+
+	backend.Flush()
+	frontend.Flush()
+	frontend.Flush()
+
+	assert.Equal(t, "Not grouped\n---- backend ----\nBuilding backend\n---- frontend ----\nBuilding frontend\nStep 1/2\nStep 2/2\n", output.String())
+}
@@ -3,19 +3,25 @@ module github.com/ruckstack/ruckstack
 go 1.16
 
 require (
+	github.com/Masterminds/semver/v3 v3.1.0
 	github.com/briandowns/spinner v1.12.0
 	github.com/containerd/cgroups v0.0.0-20201109155418-13abef5d31ec // indirect
-	github.com/containerd/containerd v1.4.0
+	github.com/containerd/containerd v1.4.1-0.20201117152358-0edc412565dc
+	github.com/docker/distribution v2.7.1+incompatible
 	github.com/docker/docker v20.10.1+incompatible
 	github.com/docker/go-events v0.0.0-20190806004212-e31b211e4f1c // indirect
+	github.com/docker/go-units v0.4.0
 	github.com/gin-gonic/gin v1.6.3
 	github.com/go-playground/assert/v2 v2.0.1
 	github.com/go-playground/validator/v10 v10.2.0
 	github.com/gogo/googleapis v1.4.0 // indirect
 	github.com/inetaf/tcpproxy v0.0.0-20200125044825-b6bb9b5b8252
-	github.com/mattn/go-colorable v0.1.4 // indirect
+	github.com/klauspost/compress v1.15.9
+	github.com/moby/buildkit v0.8.1
 	github.com/moby/sys/mount v0.2.0 // indirect
 	github.com/moby/term v0.0.0-20201216013528-df9cb8a40635 // indirect
+	github.com/opencontainers/go-digest v1.0.0
+	github.com/opencontainers/image-spec v1.0.1
 	github.com/opencontainers/selinux v1.6.0 // indirect
 	github.com/pkg/profile v1.5.0
 	github.com/satori/go.uuid v1.2.0
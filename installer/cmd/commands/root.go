@@ -14,6 +14,7 @@ import (
 var (
 	verboseMode        bool
 	installPackagePath string
+	trustKeyPath       string
 	extractOnly        bool
 
 	installOptions install_file.InstallOptions
@@ -75,6 +76,9 @@ func init() {
 	rootCmd.Flags().StringVar(&installOptions.AdminGroup, "admin-group", "", "Administrator group")
 	rootCmd.Flags().StringVar(&installOptions.BindAddress, "bind-address", "", "IP address to bind to")
 	rootCmd.Flags().StringVar(&installOptions.JoinToken, "join-token", "", "Token for joining cluster")
+	rootCmd.Flags().BoolVar(&installOptions.ChangeProfile, "change-profile", false, "Allow upgrading to a different profile, such as another edition, than the one installed")
+
+	rootCmd.Flags().StringVar(&trustKeyPath, "trust-key", "", "Public key the installer must be signed with")
 
 	rootCmd.Flags().BoolVar(&extractOnly, "extract-only", false, "INTERNAL: only extract the files, don't install")
 	rootCmd.Flag("extract-only").Hidden = true
@@ -90,9 +94,14 @@ func initConfig() {
 }
 
 func Execute(args []string) error {
-	for _, arg := range args {
+	//the install file is parsed and verified before the flags are
+	for i, arg := range args {
 		if strings.HasPrefix(arg, "--install-package=") {
 			installPackagePath = strings.Replace(arg, "--install-package=", "", 1)
+		} else if strings.HasPrefix(arg, "--trust-key=") {
+			trustKeyPath = strings.Replace(arg, "--trust-key=", "", 1)
+		} else if arg == "--trust-key" && i+1 < len(args) {
+			trustKeyPath = args[i+1]
 		}
 	}
 
@@ -101,7 +110,7 @@ func Execute(args []string) error {
 	}
 
 	var err error
-	installFile, err = install_file.Parse(installPackagePath)
+	installFile, err = install_file.Parse(installPackagePath, trustKeyPath)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,60 @@
+package install_file
+
+import (
+	"archive/zip"
+	"fmt"
+	"github.com/ruckstack/ruckstack/common/config"
+	"github.com/ruckstack/ruckstack/common/global_util"
+	"github.com/ruckstack/ruckstack/common/ui"
+	"path/filepath"
+)
+
+/**
+Returns true if this is a delta installer, which only contains the files changed since a specific build
+*/
+func (installFile *InstallFile) IsDelta() bool {
+	return installFile.PackageConfig.DeltaBase != nil
+}
+
+/**
+Checks that targetDir contains the exact build this delta installer was created from,
+and that every file left out of the delta is still installed unmodified.
+*/
+func (installFile *InstallFile) checkDeltaBase(targetDir string) error {
+	installedPackageConfig, err := config.LoadPackageConfig(targetDir)
+	if err != nil {
+		return fmt.Errorf("cannot read installed version: %s", err)
+	}
+
+	if err := installFile.PackageConfig.DeltaBase.CheckInstalled(installedPackageConfig); err != nil {
+		return err
+	}
+
+	zipReader, err := zip.OpenReader(installFile.FilePath)
+	if err != nil {
+		return fmt.Errorf("cannot read install package: %s", err)
+	}
+	defer zipReader.Close()
+
+	packagedFiles := map[string]bool{}
+	for _, zipFile := range zipReader.File {
+		packagedFiles[zipFile.Name] = true
+	}
+
+	for file, expectedHash := range installFile.PackageConfig.Files {
+		if packagedFiles[file] {
+			continue
+		}
+
+		ui.VPrintf("Checking unchanged file %s", file)
+		installedHash, err := global_util.HashFile(filepath.Join(targetDir, file))
+		if err != nil {
+			return fmt.Errorf("%s is not in the delta installer and cannot be read from the existing install: %s. Use the full installer instead", file, err)
+		}
+		if installedHash != expectedHash {
+			return fmt.Errorf("%s is not in the delta installer and has been modified in the existing install. Use the full installer instead", file)
+		}
+	}
+
+	return nil
+}
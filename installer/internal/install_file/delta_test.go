@@ -0,0 +1,79 @@
+package install_file
+
+import (
+	"archive/zip"
+	"crypto/sha1"
+	"encoding/hex"
+	"github.com/ruckstack/ruckstack/common/config"
+	"github.com/ruckstack/ruckstack/installer/internal/environment"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckDeltaBase(t *testing.T) {
+	unchangedHash := sha1.Sum([]byte("unchanged"))
+	changedHash := sha1.Sum([]byte("changed"))
+
+	deltaPath := environment.TempPath("delta-*.installer")
+	require.NoError(t, os.MkdirAll(filepath.Dir(deltaPath), 0755))
+	deltaFile, err := os.Create(deltaPath)
+	require.NoError(t, err)
+	zipWriter := zip.NewWriter(deltaFile)
+	fileWriter, err := zipWriter.Create("lib/changed")
+	require.NoError(t, err)
+	_, err = fileWriter.Write([]byte("changed"))
+	require.NoError(t, err)
+	require.NoError(t, zipWriter.Close())
+	require.NoError(t, deltaFile.Close())
+
+	installFile := &InstallFile{
+		FilePath: deltaPath,
+		PackageConfig: &config.PackageConfig{
+			Version:   "1.1.0",
+			DeltaBase: &config.DeltaBase{Version: "1.0.0", BuildTime: 1600000000},
+			Files: map[string]string{
+				"lib/changed":   hex.EncodeToString(changedHash[:]),
+				"lib/unchanged": hex.EncodeToString(unchangedHash[:]),
+			},
+		},
+	}
+	assert.True(t, installFile.IsDelta())
+
+	writeInstalled := func(version string, buildTime int64, unchangedContent string) string {
+		targetDir := environment.TempPath("delta-target-*")
+		require.NoError(t, os.MkdirAll(filepath.Join(targetDir, "lib"), 0755))
+
+		packageConfigContent, err := yaml.Marshal(&config.PackageConfig{Version: version, BuildTime: buildTime})
+		require.NoError(t, err)
+		require.NoError(t, ioutil.WriteFile(filepath.Join(targetDir, ".package.config"), packageConfigContent, 0644))
+		if unchangedContent != "" {
+			require.NoError(t, ioutil.WriteFile(filepath.Join(targetDir, "lib", "unchanged"), []byte(unchangedContent), 0644))
+		}
+		return targetDir
+	}
+
+	assert.NoError(t, installFile.checkDeltaBase(writeInstalled("1.0.0", 1600000000, "unchanged")))
+
+	err = installFile.checkDeltaBase(writeInstalled("0.9.0", 1600000000, "unchanged"))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "delta installer for version 1.0.0")
+	}
+
+	err = installFile.checkDeltaBase(writeInstalled("1.0.0", 1500000000, "unchanged"))
+	assert.Error(t, err, "a rebuild of the same version is not the same base")
+
+	err = installFile.checkDeltaBase(writeInstalled("1.0.0", 1600000000, "modified"))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "lib/unchanged is not in the delta installer and has been modified")
+	}
+
+	err = installFile.checkDeltaBase(writeInstalled("1.0.0", 1600000000, ""))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "cannot be read from the existing install")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/ruckstack/ruckstack/common/config"
 	"github.com/ruckstack/ruckstack/common/global_util"
+	"github.com/ruckstack/ruckstack/common/signature"
 	"github.com/ruckstack/ruckstack/common/ui"
 	"os"
 	"path/filepath"
@@ -14,6 +15,9 @@ type InstallFile struct {
 	FilePath      string
 	PackageConfig *config.PackageConfig
 	SystemConfig  *config.SystemConfig
+
+	//Signature is set if the install file is signed
+	Signature *signature.Signature
 }
 
 /**
@@ -29,7 +33,10 @@ func (installFile *InstallFile) Extract(targetDir string, localConfig *config.Lo
 		return err
 	}
 
-	for file, _ := range installFile.PackageConfig.Files {
+	verifyProgress := ui.StartProgressf("Verifying")
+	defer verifyProgress.Stop()
+
+	for file, expectedHash := range installFile.PackageConfig.Files {
 		_, err := os.Stat(filepath.Join(targetDir, file))
 		if err != nil {
 			if os.IsNotExist(err) {
@@ -37,6 +44,13 @@ func (installFile *InstallFile) Extract(targetDir string, localConfig *config.Lo
 			}
 			return fmt.Errorf("error checking expected file %s: %s", file, err)
 		}
+		installedHash, err := global_util.HashFile(filepath.Join(targetDir, file))
+		if err != nil {
+			return err
+		}
+		if installedHash != expectedHash {
+			return fmt.Errorf("file %s was not installed correctly: expected hash %s but was %s", file, expectedHash, installedHash)
+		}
 		if err := installFile.PackageConfig.CheckFilePermissions(file, localConfig, targetDir); err != nil {
 			return err
 		}
@@ -1,13 +1,18 @@
 package install_file
 
 import (
+	"archive/zip"
+	"crypto/sha1"
+	"encoding/hex"
 	"fmt"
 	"github.com/ruckstack/ruckstack/common/config"
 	"github.com/ruckstack/ruckstack/common/test_util"
 	"github.com/ruckstack/ruckstack/installer/internal/environment"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/sys/unix"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -25,7 +30,7 @@ func TestExtract(t *testing.T) {
 		BindAddress: "1.2.3.4",
 	}
 
-	installFile, err := Parse(installerPackagePath)
+	installFile, err := Parse(installerPackagePath, "")
 	assert.NoError(t, err)
 
 	err = installFile.Extract(serverHome, localConfig)
@@ -75,3 +80,39 @@ func TestExtract(t *testing.T) {
 		}
 	}
 }
+
+func TestExtract_HashMismatch(t *testing.T) {
+	installerPath := environment.TempPath("hash-mismatch-*.installer")
+	require.NoError(t, os.MkdirAll(filepath.Dir(installerPath), 0755))
+	installerFile, err := os.Create(installerPath)
+	require.NoError(t, err)
+	zipWriter := zip.NewWriter(installerFile)
+	for _, file := range []string{"bin/manager", "lib/k3s"} {
+		fileWriter, err := zipWriter.Create(file)
+		require.NoError(t, err)
+		_, err = fileWriter.Write([]byte(file))
+		require.NoError(t, err)
+	}
+	require.NoError(t, zipWriter.Close())
+	require.NoError(t, installerFile.Close())
+
+	managerHash := sha1.Sum([]byte("bin/manager"))
+	installFile := &InstallFile{
+		FilePath: installerPath,
+		PackageConfig: &config.PackageConfig{
+			Files: map[string]string{
+				"bin/manager": hex.EncodeToString(managerHash[:]),
+				"lib/k3s":     "da39a3ee5e6b4b0d3255bfef95601890afd80709",
+			},
+		},
+	}
+
+	localConfig := &config.LocalConfig{
+		AdminGroup: test_util.GetCurrentUserGroup(t).Name,
+	}
+
+	err = installFile.Extract(environment.TempPath("hash-mismatch-home-*"), localConfig)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "file lib/k3s was not installed correctly: expected hash da39a3ee5e6b4b0d3255bfef95601890afd80709")
+	}
+}
@@ -21,6 +21,9 @@ type InstallOptions struct {
 	BindAddress string
 	JoinToken   string
 	TargetDir   string
+
+	//ChangeProfile allows upgrading an install to a different profile of the project, such as from the standard to the enterprise edition
+	ChangeProfile bool
 }
 
 /**
@@ -48,6 +51,10 @@ func (installFile *InstallFile) Install(installOptions InstallOptions) error {
 		ui.Fatalf("Error checking path %s: %s", installOptions.TargetDir, err)
 	}
 
+	if installFile.IsDelta() {
+		return fmt.Errorf("this is a delta installer that can only upgrade an existing install of version %s. Use the full installer for new installs", installFile.PackageConfig.DeltaBase.Version)
+	}
+
 	shouldJoinCluster := false
 	if installOptions.JoinToken == "none" {
 		shouldJoinCluster = false
@@ -2,11 +2,17 @@ package install_file
 
 import (
 	"archive/zip"
+	"fmt"
 	"github.com/ruckstack/ruckstack/common/config"
 	"github.com/ruckstack/ruckstack/common/ui"
+	"os"
+	"runtime"
 )
 
-func Parse(installPackagePath string) (*InstallFile, error) {
+/**
+Reads the install file and verifies its signature. If trustKeyPath is set, the install file must be signed by that public key
+*/
+func Parse(installPackagePath string, trustKeyPath string) (*InstallFile, error) {
 	installFile := InstallFile{
 		FilePath: installPackagePath,
 	}
@@ -44,5 +50,30 @@ func Parse(installPackagePath string) (*InstallFile, error) {
 		ui.Fatalf("Cannot find system.config file")
 	}
 
+	if err := checkArchitecture(installFile.PackageConfig, runtime.GOARCH); err != nil {
+		return nil, err
+	}
+
+	installer, err := os.Open(installPackagePath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read install package: %s", err)
+	}
+	defer installer.Close()
+	installerInfo, err := installer.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read install package: %s", err)
+	}
+
+	if err := installFile.verifySignature(installer, installerInfo.Size(), trustKeyPath); err != nil {
+		return nil, fmt.Errorf("cannot verify installer: %s", err)
+	}
+
 	return &installFile, nil
 }
+
+func checkArchitecture(packageConfig *config.PackageConfig, serverArchitecture string) error {
+	if packageConfig.GetArchitecture() != serverArchitecture {
+		return fmt.Errorf("this installer is for %s servers but this server is %s. Use the %s installer instead", packageConfig.GetArchitecture(), serverArchitecture, serverArchitecture)
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package install_file
 
 import (
+	"github.com/ruckstack/ruckstack/common/config"
 	"github.com/ruckstack/ruckstack/common/global_util"
 	"github.com/stretchr/testify/assert"
 	"os"
@@ -17,10 +18,17 @@ func TestParse(t *testing.T) {
 	_, err := os.Stat(installerPackagePath)
 	assert.NoError(t, err)
 
-	installFile, err := Parse(installerPackagePath)
+	installFile, err := Parse(installerPackagePath, "")
 	assert.NoError(t, err)
 
 	assert.Equal(t, installerPackagePath, installFile.FilePath)
 	assert.NotNil(t, installFile.PackageConfig)
 	assert.Equal(t, "Example Project", installFile.PackageConfig.Name)
 }
+
+func TestCheckArchitecture(t *testing.T) {
+	assert.NoError(t, checkArchitecture(&config.PackageConfig{Architecture: "arm64"}, "arm64"))
+	assert.NoError(t, checkArchitecture(&config.PackageConfig{}, "amd64"), "installers without an architecture are amd64")
+	assert.EqualError(t, checkArchitecture(&config.PackageConfig{Architecture: "arm64"}, "amd64"), "this installer is for arm64 servers but this server is amd64. Use the amd64 installer instead")
+	assert.EqualError(t, checkArchitecture(&config.PackageConfig{}, "arm64"), "this installer is for amd64 servers but this server is arm64. Use the arm64 installer instead")
+}
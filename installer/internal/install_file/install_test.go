@@ -15,7 +15,7 @@ func TestInstallFile_Install(t *testing.T) {
 
 	serverHome := environment.TempPath("server-home-*")
 
-	installFile, err := Parse(installerPackagePath)
+	installFile, err := Parse(installerPackagePath, "")
 	assert.NoError(t, err)
 
 	installFile.SystemConfig = &config.SystemConfig{
@@ -0,0 +1,110 @@
+package install_file
+
+import (
+	"crypto"
+	"fmt"
+	"github.com/ruckstack/ruckstack/common/signature"
+	"github.com/ruckstack/ruckstack/common/ui"
+	"io"
+	"strings"
+)
+
+/**
+Public key every installer must be signed with, either PEM or the base64 encoded key.
+Set when compiling the installer with -ldflags "-X github.com/ruckstack/ruckstack/installer/internal/install_file.TrustedKey=<key>"
+*/
+var TrustedKey string
+
+/**
+Returns the key the installer must be signed with: the --trust-key file if given, otherwise the compiled in TrustedKey. Nil if neither is set
+*/
+func trustedKey(trustKeyPath string) (crypto.PublicKey, error) {
+	if trustKeyPath != "" {
+		return signature.LoadPublicKey(trustKeyPath)
+	}
+
+	if TrustedKey == "" {
+		return nil, nil
+	}
+
+	pemData := TrustedKey
+	if !strings.HasPrefix(pemData, "-----BEGIN") {
+		pemData = "-----BEGIN PUBLIC KEY-----\n" + pemData + "\n-----END PUBLIC KEY-----\n"
+	}
+	return signature.ParsePublicKey([]byte(pemData))
+}
+
+/**
+Checks the installer contents match its signature.
+If there is a trusted key, the installer must be signed by it. Otherwise unsigned installers are allowed.
+*/
+func (installFile *InstallFile) verifySignature(installer io.ReaderAt, size int64, trustKeyPath string) error {
+	trusted, err := trustedKey(trustKeyPath)
+	if err != nil {
+		return fmt.Errorf("invalid trusted key: %s", err)
+	}
+
+	progress := ui.StartProgressf("Verifying installer")
+	installerSignature, digests, err := signature.ReadInstaller(installer, size)
+	progress.Stop()
+	if err != nil {
+		return err
+	}
+
+	if installerSignature == nil {
+		if trusted != nil {
+			return fmt.Errorf("installer is not signed but must be signed by key %s", signature.Fingerprint(trusted))
+		}
+		ui.VPrintf("Installer is not signed")
+		return nil
+	}
+
+	if err := installerSignature.Verify(digests, trusted); err != nil {
+		return err
+	}
+	installFile.Signature = installerSignature
+
+	signedBy, err := installerSignature.SignedBy()
+	if err != nil {
+		return err
+	}
+	if trusted == nil {
+		ui.Printf("WARNING: installer is signed by key %s but there is no trusted key to check it against. Use --trust-key to check the publisher", signature.Fingerprint(signedBy))
+	} else {
+		ui.VPrintf("Installer is signed by trusted key %s", signature.Fingerprint(signedBy))
+	}
+
+	return nil
+}
+
+/**
+Checks that an upgrade is signed by the same key as the installed version, if the installed version was signed
+*/
+func (installFile *InstallFile) checkUpgradeSignature(targetDir string) error {
+	installedSignature, err := signature.LoadInstalled(targetDir)
+	if err != nil {
+		return fmt.Errorf("cannot read installed signature: %s", err)
+	}
+	if installedSignature == nil {
+		return nil
+	}
+
+	installedKey, err := installedSignature.SignedBy()
+	if err != nil {
+		return err
+	}
+
+	if installFile.Signature == nil {
+		return fmt.Errorf("the installed version is signed by key %s but this upgrade is not signed", signature.Fingerprint(installedKey))
+	}
+
+	upgradeKey, err := installFile.Signature.SignedBy()
+	if err != nil {
+		return err
+	}
+	if signature.Fingerprint(upgradeKey) != signature.Fingerprint(installedKey) {
+		return fmt.Errorf("the installed version is signed by key %s but this upgrade is signed by key %s", signature.Fingerprint(installedKey), signature.Fingerprint(upgradeKey))
+	}
+
+	return nil
+}
@@ -0,0 +1,166 @@
+package install_file
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"github.com/ruckstack/ruckstack/common/signature"
+	"github.com/ruckstack/ruckstack/installer/internal/environment"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testSigner(t *testing.T) *signature.Signer {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	privateKeyDer, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	require.NoError(t, err)
+
+	signer, err := signature.ParseSigner(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateKeyDer}))
+	require.NoError(t, err)
+	return signer
+}
+
+/**
+Returns an installer executable followed by a zip containing a file, signed by the given signer unless it is nil. If tamper is true, the file is changed after signing
+*/
+func testSignedZip(t *testing.T, signer *signature.Signer, tamper bool) *bytes.Reader {
+	executable := []byte("installer")
+	executableDigest := sha256.Sum256(executable)
+	content := []byte("manager")
+	digest := sha256.Sum256(content)
+
+	zipContent := bytes.NewBuffer(append([]byte{}, executable...))
+	zipWriter := zip.NewWriter(zipContent)
+	zipWriter.SetOffset(int64(len(executable)))
+	fileWriter, err := zipWriter.Create("bin/manager")
+	require.NoError(t, err)
+	if tamper {
+		content = []byte("tampered")
+	}
+	_, err = fileWriter.Write(content)
+	require.NoError(t, err)
+
+	if signer != nil {
+		installerSignature, err := signer.Sign(map[string]string{
+			"bin/manager":            hex.EncodeToString(digest[:]),
+			signature.ExecutablePath: hex.EncodeToString(executableDigest[:]),
+		})
+		require.NoError(t, err)
+		installerSignature.ExecutableSize = int64(len(executable))
+		fileWriter, err = zipWriter.Create(signature.InstallerPath)
+		require.NoError(t, err)
+		require.NoError(t, installerSignature.Write(fileWriter))
+	}
+	require.NoError(t, zipWriter.Close())
+
+	return bytes.NewReader(zipContent.Bytes())
+}
+
+func savePublicKey(t *testing.T, signer *signature.Signer) string {
+	publicKeyPem, err := signature.EncodePublicKey(signer.PublicKey())
+	require.NoError(t, err)
+
+	publicKeyPath := environment.TempPath("trust-key-*.pem")
+	require.NoError(t, os.MkdirAll(filepath.Dir(publicKeyPath), 0755))
+	require.NoError(t, ioutil.WriteFile(publicKeyPath, []byte(publicKeyPem), 0644))
+	return publicKeyPath
+}
+
+func TestVerifySignature(t *testing.T) {
+	signer := testSigner(t)
+	otherSigner := testSigner(t)
+
+	trustKeyPath := savePublicKey(t, signer)
+
+	testData := []struct {
+		name          string
+		zip           *bytes.Reader
+		trustKeyPath  string
+		expectedError string
+	}{
+		{name: "signed, trusted key", zip: testSignedZip(t, signer, false), trustKeyPath: trustKeyPath},
+		{name: "signed, no trusted key", zip: testSignedZip(t, signer, false)},
+		{name: "unsigned, no trusted key", zip: testSignedZip(t, nil, false)},
+		{name: "unsigned, trusted key", zip: testSignedZip(t, nil, false), trustKeyPath: trustKeyPath, expectedError: "installer is not signed but must be signed by key"},
+		{name: "other key", zip: testSignedZip(t, otherSigner, false), trustKeyPath: trustKeyPath, expectedError: "not the trusted key"},
+		{name: "tampered", zip: testSignedZip(t, signer, true), expectedError: "installer contents have been modified"},
+		{name: "tampered, trusted key", zip: testSignedZip(t, signer, true), trustKeyPath: trustKeyPath, expectedError: "installer contents have been modified"},
+	}
+
+	for _, data := range testData {
+		t.Run(data.name, func(t *testing.T) {
+			installFile := &InstallFile{}
+			err := installFile.verifySignature(data.zip, data.zip.Size(), data.trustKeyPath)
+			if data.expectedError == "" {
+				assert.NoError(t, err)
+			} else if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), data.expectedError)
+			}
+		})
+	}
+}
+
+func TestVerifySignature_CompiledInKey(t *testing.T) {
+	signer := testSigner(t)
+	publicKeyPem, err := signature.EncodePublicKey(signer.PublicKey())
+	require.NoError(t, err)
+
+	defer func() { TrustedKey = "" }()
+	TrustedKey = publicKeyPem
+
+	verify := func(installer *bytes.Reader, trustKeyPath string) error {
+		return (&InstallFile{}).verifySignature(installer, installer.Size(), trustKeyPath)
+	}
+	assert.NoError(t, verify(testSignedZip(t, signer, false), ""))
+	assert.Error(t, verify(testSignedZip(t, testSigner(t), false), ""))
+	assert.Error(t, verify(testSignedZip(t, nil, false), ""))
+
+	//--trust-key replaces the compiled in key
+	otherSigner := testSigner(t)
+	assert.NoError(t, verify(testSignedZip(t, otherSigner, false), savePublicKey(t, otherSigner)))
+}
+
+func TestCheckUpgradeSignature(t *testing.T) {
+	signer := testSigner(t)
+
+	signedInstall := environment.TempPath("signed-install-*")
+	require.NoError(t, os.MkdirAll(signedInstall, 0755))
+	installedSignature, err := signer.Sign(map[string]string{})
+	require.NoError(t, err)
+	signatureFile, err := os.Create(filepath.Join(signedInstall, signature.InstallerPath))
+	require.NoError(t, err)
+	require.NoError(t, installedSignature.Write(signatureFile))
+	require.NoError(t, signatureFile.Close())
+
+	unsignedInstall := environment.TempPath("unsigned-install-*")
+	require.NoError(t, os.MkdirAll(unsignedInstall, 0755))
+
+	sameKey, err := signer.Sign(map[string]string{"bin/manager": "abc"})
+	require.NoError(t, err)
+	otherKey, err := testSigner(t).Sign(map[string]string{"bin/manager": "abc"})
+	require.NoError(t, err)
+
+	assert.NoError(t, (&InstallFile{Signature: sameKey}).checkUpgradeSignature(signedInstall))
+	assert.NoError(t, (&InstallFile{Signature: otherKey}).checkUpgradeSignature(unsignedInstall))
+	assert.NoError(t, (&InstallFile{}).checkUpgradeSignature(unsignedInstall))
+
+	err = (&InstallFile{Signature: otherKey}).checkUpgradeSignature(signedInstall)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "but this upgrade is signed by key")
+	}
+
+	err = (&InstallFile{}).checkUpgradeSignature(signedInstall)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "but this upgrade is not signed")
+	}
+}
@@ -2,6 +2,7 @@ package install_file
 
 import (
 	"context"
+	"fmt"
 	"github.com/ruckstack/ruckstack/common/config"
 	"github.com/ruckstack/ruckstack/common/global_util"
 	"github.com/ruckstack/ruckstack/common/ui"
@@ -18,6 +19,20 @@ func (installFile *InstallFile) Upgrade(installOptions InstallOptions) error {
 
 	ui.Printf("Upgrading %s to version %s...", installOptions.TargetDir, installFile.PackageConfig.Version)
 
+	if err := installFile.checkUpgradeSignature(installOptions.TargetDir); err != nil {
+		return err
+	}
+
+	if err := installFile.checkUpgradeProfile(installOptions); err != nil {
+		return err
+	}
+
+	if installFile.IsDelta() {
+		if err := installFile.checkDeltaBase(installOptions.TargetDir); err != nil {
+			return err
+		}
+	}
+
 	serverShutdown, err := shutdownServer(installOptions.TargetDir)
 	if err != nil {
 		return err
@@ -111,3 +126,24 @@ func shutdownServer(serverHome string) (bool, error) {
 
 	return serverShutdown, nil
 }
+
+/**
+Checks that an upgrade is the same profile as the installed version, so an install does not change editions unless ChangeProfile is set
+*/
+func (installFile *InstallFile) checkUpgradeProfile(installOptions InstallOptions) error {
+	installedPackageConfig, err := config.LoadPackageConfig(installOptions.TargetDir)
+	if err != nil {
+		return fmt.Errorf("cannot read installed version: %s", err)
+	}
+
+	if installedPackageConfig.Profile == installFile.PackageConfig.Profile {
+		return nil
+	}
+
+	if installOptions.ChangeProfile {
+		ui.Printf("Changing profile from %s to %s", installedPackageConfig.GetProfile(), installFile.PackageConfig.GetProfile())
+		return nil
+	}
+
+	return fmt.Errorf("the installed version is the %s profile but this upgrade is the %s profile. Run with --change-profile to change it", installedPackageConfig.GetProfile(), installFile.PackageConfig.GetProfile())
+}
@@ -0,0 +1,39 @@
+package install_file
+
+import (
+	"github.com/ruckstack/ruckstack/common/config"
+	"github.com/ruckstack/ruckstack/installer/internal/environment"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckUpgradeProfile(t *testing.T) {
+	writeInstalled := func(profile string) string {
+		targetDir := environment.TempPath("profile-target-*")
+		require.NoError(t, os.MkdirAll(targetDir, 0755))
+
+		packageConfigContent, err := yaml.Marshal(&config.PackageConfig{Version: "1.0.0", Profile: profile})
+		require.NoError(t, err)
+		require.NoError(t, ioutil.WriteFile(filepath.Join(targetDir, ".package.config"), packageConfigContent, 0644))
+		return targetDir
+	}
+
+	enterprise := &InstallFile{PackageConfig: &config.PackageConfig{Version: "1.1.0", Profile: "enterprise"}}
+	standard := &InstallFile{PackageConfig: &config.PackageConfig{Version: "1.1.0"}}
+
+	assert.NoError(t, enterprise.checkUpgradeProfile(InstallOptions{TargetDir: writeInstalled("enterprise")}))
+	assert.NoError(t, standard.checkUpgradeProfile(InstallOptions{TargetDir: writeInstalled("")}))
+
+	err := enterprise.checkUpgradeProfile(InstallOptions{TargetDir: writeInstalled("")})
+	assert.EqualError(t, err, "the installed version is the default profile but this upgrade is the enterprise profile. Run with --change-profile to change it")
+
+	err = standard.checkUpgradeProfile(InstallOptions{TargetDir: writeInstalled("enterprise")})
+	assert.EqualError(t, err, "the installed version is the enterprise profile but this upgrade is the default profile. Run with --change-profile to change it")
+
+	assert.NoError(t, standard.checkUpgradeProfile(InstallOptions{TargetDir: writeInstalled("enterprise"), ChangeProfile: true}))
+}
@@ -9,6 +9,7 @@ import (
 
 func init() {
 	var file string
+	var changeProfile bool
 	packageConfig := environment.PackageConfig
 
 	var upgradeCmd = &cobra.Command{
@@ -18,11 +19,12 @@ func init() {
 			RequiresRoot: "true",
 		},
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return upgrade.Upgrade(file)
+			return upgrade.Upgrade(file, changeProfile)
 		},
 	}
 
 	upgradeCmd.Flags().StringVar(&file, "file", "", "Path to upgrade file (required)")
+	upgradeCmd.Flags().BoolVar(&changeProfile, "change-profile", false, "Allow upgrading to a different profile, such as another edition, than the one installed")
 
 	ui.MarkFlagsRequired(upgradeCmd, "file")
 	ui.MarkFlagsFilename(upgradeCmd, "file")
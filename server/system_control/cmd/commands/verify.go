@@ -0,0 +1,39 @@
+package commands
+
+import (
+	"fmt"
+	"github.com/ruckstack/ruckstack/common/ui"
+	"github.com/ruckstack/ruckstack/server/system_control/internal/environment"
+	"github.com/ruckstack/ruckstack/server/system_control/internal/verify"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(&cobra.Command{
+		Use:   "verify",
+		Short: "Checks installed files have not been changed",
+		Long:  "Re-hashes the installed files and reports any that were modified, are missing, are unexpected, or have different permissions than when installed",
+		Annotations: map[string]string{
+			RequiresRoot: "true",
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			packageConfig := environment.PackageConfig
+
+			ui.Printf("Verifying %s %s in %s", packageConfig.Name, packageConfig.Version, environment.ServerHome)
+			ui.Println()
+
+			progress := ui.StartProgressf("Checking files")
+			report, err := verify.Verify(environment.ServerHome, packageConfig, environment.LocalConfig.AdminGroupId, environment.IsRunningAsRoot)
+			progress.Stop()
+			if err != nil {
+				return err
+			}
+
+			report.Print()
+			if !report.IsEmpty() {
+				return fmt.Errorf("found %d differences from version %s", report.Problems(), packageConfig.Version)
+			}
+			return nil
+		},
+	})
+}
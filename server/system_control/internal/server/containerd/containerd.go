@@ -2,15 +2,16 @@ package containerd
 
 import (
 	"archive/tar"
-	"bytes"
-	"compress/gzip"
 	"context"
 	"crypto/sha1"
-	"encoding/binary"
 	"encoding/hex"
 	"fmt"
 	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
 	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/reference/docker"
+	"github.com/opencontainers/go-digest"
 	"github.com/ruckstack/ruckstack/common/global_util"
 	"github.com/ruckstack/ruckstack/common/ui"
 	"github.com/ruckstack/ruckstack/server/system_control/internal/environment"
@@ -161,29 +162,17 @@ func LoadPackagedImages() error {
 
 				defer file.Close()
 
-				if strings.HasSuffix(relativePath, "layer.tar.gz") {
-					_, _ = file.Seek(-4, 2)
-
-					sizeBuffer := new(bytes.Buffer)
-					written, err := io.Copy(sizeBuffer, file)
-					if err != nil {
-						return err
-					}
-					if written != 4 {
-						return fmt.Errorf("Didn't read size correctly")
-					}
-					uncompressedLength := binary.LittleEndian.Uint32(sizeBuffer.Bytes())
-
-					_, _ = file.Seek(0, 0)
-					gzipReader, err := gzip.NewReader(file)
+				if isCompressedLayer(relativePath) {
+					layerReader, uncompressedLength, err := openLayer(file, relativePath)
 					if err != nil {
-						return err
+						return fmt.Errorf("cannot read %s: %s", relativePath, err)
 					}
+					defer layerReader.Close()
 
 					header := &tar.Header{
-						Name:    strings.Replace(relativePath, ".tar.gz", ".tar", 1),
+						Name:    uncompressedLayerName(relativePath),
 						ModTime: info.ModTime(),
-						Size:    int64(uncompressedLength),
+						Size:    uncompressedLength,
 						Mode:    0644,
 					}
 
@@ -192,11 +181,10 @@ func LoadPackagedImages() error {
 						return err
 					}
 
-					_, err = io.Copy(tarWriter, gzipReader)
+					_, err = io.Copy(tarWriter, layerReader)
 					if err != nil {
 						return err
 					}
-					gzipReader.Close()
 				} else {
 					header := &tar.Header{
 						Name:    relativePath,
@@ -234,6 +222,10 @@ func LoadPackagedImages() error {
 
 		for _, image := range images {
 			logger.Printf("Imported %s", image.Name)
+
+			if err := addPinnedImageName(ctxContainerD, image); err != nil {
+				logger.Printf("Cannot add pinned reference for %s: %s", image.Name, err)
+			}
 		}
 
 		err = ioutil.WriteFile(importedInfoPath, []byte(currentHash), 0644)
@@ -247,6 +239,48 @@ func LoadPackagedImages() error {
 	return nil
 }
 
+/**
+Packaged manifests reference images by digest, but imported images are only named by tag.
+Adds the digest recorded at build time as another name for the imported image so those references resolve locally.
+*/
+func addPinnedImageName(ctx context.Context, image images.Image) error {
+	importedRef, err := docker.ParseDockerRef(image.Name)
+	if err != nil {
+		return err
+	}
+
+	for tag, digestString := range environment.PackageConfig.Images {
+		tagRef, err := docker.ParseDockerRef(tag)
+		if err != nil || tagRef.String() != importedRef.String() {
+			continue
+		}
+
+		pinnedRef, err := docker.WithDigest(docker.TrimNamed(importedRef), digest.Digest(digestString))
+		if err != nil {
+			return err
+		}
+
+		pinnedImage := images.Image{
+			Name:   pinnedRef.String(),
+			Labels: image.Labels,
+			Target: image.Target,
+		}
+
+		imageService := containerdClient.ImageService()
+		if _, err := imageService.Create(ctx, pinnedImage); err != nil {
+			if !errdefs.IsAlreadyExists(err) {
+				return err
+			}
+			if _, err := imageService.Update(ctx, pinnedImage); err != nil {
+				return err
+			}
+		}
+		logger.Printf("Added %s", pinnedImage.Name)
+	}
+
+	return nil
+}
+
 func KillProcesses(ctx context.Context) error {
 	processes, err := process.Processes()
 	if err != nil {
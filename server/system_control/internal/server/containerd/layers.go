@@ -0,0 +1,105 @@
+package containerd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+/**
+Image layers are compressed by the builder with either gzip or zstd
+*/
+var layerExtensions = []string{".tar.gz", ".tar.zst"}
+
+func isCompressedLayer(path string) bool {
+	for _, extension := range layerExtensions {
+		if strings.HasSuffix(path, "layer"+extension) {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+Returns the name the layer had in the original docker save tar
+*/
+func uncompressedLayerName(path string) string {
+	for _, extension := range layerExtensions {
+		if strings.HasSuffix(path, extension) {
+			return strings.TrimSuffix(path, extension) + ".tar"
+		}
+	}
+	return path
+}
+
+/**
+Returns a reader for the uncompressed layer and its uncompressed size, which the tar header needs before the data is written
+*/
+func openLayer(file *os.File, path string) (io.ReadCloser, int64, error) {
+	if strings.HasSuffix(path, ".zst") {
+		return openZstdLayer(file)
+	}
+	return openGzipLayer(file)
+}
+
+/**
+Gzip records the uncompressed size in the last 4 bytes
+*/
+func openGzipLayer(file *os.File) (io.ReadCloser, int64, error) {
+	if _, err := file.Seek(-4, io.SeekEnd); err != nil {
+		return nil, 0, err
+	}
+
+	sizeBuffer := new(bytes.Buffer)
+	written, err := io.Copy(sizeBuffer, file)
+	if err != nil {
+		return nil, 0, err
+	}
+	if written != 4 {
+		return nil, 0, fmt.Errorf("Didn't read size correctly")
+	}
+	uncompressedLength := binary.LittleEndian.Uint32(sizeBuffer.Bytes())
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+	gzipReader, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return gzipReader, int64(uncompressedLength), nil
+}
+
+/**
+Zstd frames do not always record their size, so the layer is decompressed once to count it
+*/
+func openZstdLayer(file *os.File) (io.ReadCloser, int64, error) {
+	decoder, err := zstd.NewReader(file)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	uncompressedLength, err := io.Copy(ioutil.Discard, decoder)
+	if err != nil {
+		decoder.Close()
+		return nil, 0, err
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		decoder.Close()
+		return nil, 0, err
+	}
+	if err := decoder.Reset(file); err != nil {
+		decoder.Close()
+		return nil, 0, err
+	}
+
+	return decoder.IOReadCloser(), uncompressedLength, nil
+}
@@ -0,0 +1,72 @@
+package containerd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenLayer(t *testing.T) {
+	content := bytes.Repeat([]byte("layer content "), 10000)
+
+	tempDir, err := ioutil.TempDir("", "layers-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	testData := []struct {
+		path       string
+		compressor func(io.Writer) io.WriteCloser
+	}{
+		{
+			path:       "abc/layer.tar.gz",
+			compressor: func(out io.Writer) io.WriteCloser { return gzip.NewWriter(out) },
+		},
+		{
+			path: "abc/layer.tar.zst",
+			compressor: func(out io.Writer) io.WriteCloser {
+				writer, err := zstd.NewWriter(out)
+				require.NoError(t, err)
+				return writer
+			},
+		},
+	}
+
+	for _, data := range testData {
+		t.Run(data.path, func(t *testing.T) {
+			layerPath := filepath.Join(tempDir, filepath.Base(data.path))
+			layerFile, err := os.Create(layerPath)
+			require.NoError(t, err)
+			compressor := data.compressor(layerFile)
+			_, err = compressor.Write(content)
+			require.NoError(t, err)
+			require.NoError(t, compressor.Close())
+			require.NoError(t, layerFile.Close())
+
+			assert.True(t, isCompressedLayer(data.path))
+			assert.Equal(t, "abc/layer.tar", uncompressedLayerName(data.path))
+
+			layerFile, err = os.Open(layerPath)
+			require.NoError(t, err)
+			defer layerFile.Close()
+
+			reader, size, err := openLayer(layerFile, data.path)
+			require.NoError(t, err)
+			defer reader.Close()
+
+			assert.Equal(t, int64(len(content)), size)
+			uncompressed, err := ioutil.ReadAll(reader)
+			require.NoError(t, err)
+			assert.Equal(t, content, uncompressed)
+		})
+	}
+
+	assert.False(t, isCompressedLayer("abc/json"))
+	assert.False(t, isCompressedLayer("manifest.json"))
+}
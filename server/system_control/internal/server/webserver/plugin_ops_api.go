@@ -33,6 +33,8 @@ func getStatus(ctx *gin.Context) {
 		"healthy":   monitor.ServerStatus.SystemReady,
 		"name":      environment.PackageConfig.Name,
 		"version":   environment.PackageConfig.Version,
+		"commit":    environment.PackageConfig.Commit,
+		"profile":   environment.PackageConfig.GetProfile(),
 		"support":   environment.PackageConfig.Support,
 		"buildTime": environment.PackageConfig.BuildTime,
 		"level":     environment.PackageConfig.LicenseLevel,
@@ -44,6 +46,8 @@ func getDetailedStatus(ctx *gin.Context) {
 		"healthy":   monitor.ServerStatus.SystemReady,
 		"name":      environment.PackageConfig.Name,
 		"version":   environment.PackageConfig.Version,
+		"commit":    environment.PackageConfig.Commit,
+		"profile":   environment.PackageConfig.GetProfile(),
 		"support":   environment.PackageConfig.Support,
 		"buildTime": environment.PackageConfig.BuildTime,
 		"trackers":  monitor.ServerStatus.Trackers,
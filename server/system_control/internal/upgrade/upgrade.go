@@ -1,14 +1,49 @@
 package upgrade
 
 import (
+	"fmt"
+	"github.com/ruckstack/ruckstack/common/signature"
 	"github.com/ruckstack/ruckstack/common/ui"
 	"github.com/ruckstack/ruckstack/server/system_control/internal/environment"
+	"io/ioutil"
+	"os"
 	"os/exec"
 )
 
-func Upgrade(upgradeFile string) error {
+/**
+Runs the upgrade installer against this install. ChangeProfile allows the upgrade to be a different profile of the project than the one installed
+*/
+func Upgrade(upgradeFile string, changeProfile bool) error {
+	args := []string{"--install-path", environment.ServerHome}
+	if changeProfile {
+		args = append(args, "--change-profile")
+	}
 
-	command := exec.Command(upgradeFile, "--upgrade", environment.ServerHome)
+	//if the installed version is signed, the upgrade must be signed by the same key
+	installedSignature, err := signature.LoadInstalled(environment.ServerHome)
+	if err != nil {
+		return fmt.Errorf("cannot read installed signature: %s", err)
+	}
+	if installedSignature != nil {
+		//checked before running anything in the upgrade, since an unsigned or malicious installer could ignore --trust-key
+		installedKey, err := installedSignature.SignedBy()
+		if err != nil {
+			return fmt.Errorf("cannot read installed signature: %s", err)
+		}
+		if err := signature.VerifyInstaller(upgradeFile, installedKey); err != nil {
+			return fmt.Errorf("cannot upgrade with %s: %s", upgradeFile, err)
+		}
+
+		trustKeyPath := environment.TempPath("trust-key-*.pem")
+		if err := ioutil.WriteFile(trustKeyPath, []byte(installedSignature.PublicKey), 0644); err != nil {
+			return fmt.Errorf("cannot save installed public key: %s", err)
+		}
+		defer os.Remove(trustKeyPath)
+
+		args = append(args, "--trust-key", trustKeyPath)
+	}
+
+	command := exec.Command(upgradeFile, args...)
 	command.Dir = environment.ServerHome
 	command.Stdout = ui.GetOutput()
 	command.Stderr = ui.GetOutput()
@@ -0,0 +1,209 @@
+package verify
+
+import (
+	"fmt"
+	"github.com/ruckstack/ruckstack/common/config"
+	"github.com/ruckstack/ruckstack/common/global_util"
+	"github.com/ruckstack/ruckstack/common/signature"
+	"github.com/ruckstack/ruckstack/common/ui"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"syscall"
+)
+
+/**
+Files that are created at runtime next to packaged files, so are not reported as unexpected
+*/
+var runtimeFiles = []string{
+	".package.config",
+	".package.config.bak.*",
+	signature.InstallerPath,
+	"config/*.config",
+	"data/agent/images/*.untar/imported.info",
+	"data/server/manifests/*.skip",
+	"data/server/manifests/ccm.yaml",
+	"data/server/manifests/coredns.yaml",
+	"data/server/manifests/local-storage.yaml",
+	"data/server/manifests/rolebindings.yaml",
+	"data/server/manifests/traefik.yaml",
+	"data/server/static/charts/traefik-*.tgz",
+}
+
+/**
+Differences between an installed tree and its package config
+*/
+type Report struct {
+	Checked int
+
+	Modified   []string
+	Missing    []string
+	Unexpected []string
+
+	Permissions []PermissionDrift
+}
+
+type PermissionDrift struct {
+	Path     string
+	Expected string
+	Actual   string
+}
+
+/**
+Re-hashes every packaged file in serverHome and compares it to the package config.
+Only directories that contain packaged files are checked for unexpected files.
+If checkOwnership is true, packaged files must also be owned by root and the admin group.
+*/
+func Verify(serverHome string, packageConfig *config.PackageConfig, adminGroupId int64, checkOwnership bool) (*Report, error) {
+	report := &Report{}
+
+	var files []string
+	packagedDirs := map[string]bool{}
+	for file := range packageConfig.Files {
+		files = append(files, file)
+		packagedDirs[path.Dir(file)] = true
+	}
+	sort.Strings(files)
+
+	for _, file := range files {
+		report.Checked++
+
+		fullPath := filepath.Join(serverHome, file)
+		fileStat, err := os.Stat(fullPath)
+		if os.IsNotExist(err) {
+			report.Missing = append(report.Missing, file)
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("cannot check %s: %s", file, err)
+		}
+
+		installedHash, err := global_util.HashFile(fullPath)
+		if err != nil {
+			return nil, err
+		}
+		if installedHash != packageConfig.Files[file] {
+			report.Modified = append(report.Modified, file)
+		}
+
+		if err := report.checkPermissions(serverHome, file, fileStat, packageConfig, adminGroupId, checkOwnership); err != nil {
+			return nil, err
+		}
+	}
+
+	var dirs []string
+	for dir := range packagedDirs {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	for _, dir := range dirs {
+		dirStat, err := os.Stat(filepath.Join(serverHome, dir))
+		if err != nil {
+			//the files in it are already reported as missing
+			continue
+		}
+		if dir != "." {
+			if err := report.checkPermissions(serverHome, dir, dirStat, packageConfig, adminGroupId, checkOwnership); err != nil {
+				return nil, err
+			}
+		}
+
+		entries, err := ioutil.ReadDir(filepath.Join(serverHome, dir))
+		if err != nil {
+			return nil, fmt.Errorf("cannot list %s: %s", dir, err)
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+
+			file := path.Join(dir, entry.Name())
+			if _, packaged := packageConfig.Files[file]; packaged || isRuntimeFile(file) {
+				continue
+			}
+			report.Unexpected = append(report.Unexpected, file)
+		}
+	}
+
+	return report, nil
+}
+
+func (report *Report) checkPermissions(serverHome string, file string, fileStat os.FileInfo, packageConfig *config.PackageConfig, adminGroupId int64, checkOwnership bool) error {
+	expectedMode, preservePermissions, err := packageConfig.ExpectedFileMode(file, fileStat.IsDir(), serverHome)
+	if err != nil {
+		return err
+	}
+	if preservePermissions {
+		return nil
+	}
+
+	if fileStat.Mode().Perm() != expectedMode {
+		report.Permissions = append(report.Permissions, PermissionDrift{
+			Path:     file,
+			Expected: fmt.Sprintf("mode %04o", expectedMode),
+			Actual:   fmt.Sprintf("mode %04o", fileStat.Mode().Perm()),
+		})
+	}
+
+	if checkOwnership {
+		if stat, ok := fileStat.Sys().(*syscall.Stat_t); ok && (stat.Uid != 0 || int64(stat.Gid) != adminGroupId) {
+			report.Permissions = append(report.Permissions, PermissionDrift{
+				Path:     file,
+				Expected: fmt.Sprintf("owner 0:%d", adminGroupId),
+				Actual:   fmt.Sprintf("owner %d:%d", stat.Uid, stat.Gid),
+			})
+		}
+	}
+
+	return nil
+}
+
+func isRuntimeFile(file string) bool {
+	for _, pattern := range runtimeFiles {
+		if match, _ := path.Match(pattern, file); match {
+			return true
+		}
+	}
+	return false
+}
+
+func (report *Report) IsEmpty() bool {
+	return report.Problems() == 0
+}
+
+func (report *Report) Problems() int {
+	return len(report.Modified) + len(report.Missing) + len(report.Unexpected) + len(report.Permissions)
+}
+
+func (report *Report) Print() {
+	if report.IsEmpty() {
+		ui.Printf("All %d packaged files match", report.Checked)
+		return
+	}
+
+	printFiles("Modified", report.Modified)
+	printFiles("Missing", report.Missing)
+	printFiles("Unexpected", report.Unexpected)
+
+	if len(report.Permissions) > 0 {
+		ui.Printf("Permissions:")
+		for _, drift := range report.Permissions {
+			ui.Printf("    %s: %s, expected %s", drift.Path, drift.Actual, drift.Expected)
+		}
+		ui.Println()
+	}
+}
+
+func printFiles(title string, files []string) {
+	if len(files) == 0 {
+		return
+	}
+
+	ui.Printf("%s:", title)
+	for _, file := range files {
+		ui.Printf("    %s", file)
+	}
+	ui.Println()
+}
@@ -0,0 +1,75 @@
+package verify
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"github.com/ruckstack/ruckstack/common/config"
+	"github.com/ruckstack/ruckstack/common/ui"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	serverHome, err := ioutil.TempDir("", "verify-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(serverHome)
+
+	packageConfig := &config.PackageConfig{
+		Files: map[string]string{},
+		FilePermissions: map[string]config.PackagedFileConfig{
+			"bin/*": {AdminGroupReadable: true, Executable: true},
+		},
+	}
+
+	writeFile := func(file string, content string, mode os.FileMode) {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(serverHome, file)), 0750))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(serverHome, file), []byte(content), mode))
+		require.NoError(t, os.Chmod(filepath.Join(serverHome, file), mode))
+	}
+	packageFile := func(file string, content string, mode os.FileMode) {
+		writeFile(file, content, mode)
+		hash := sha1.Sum([]byte(content))
+		packageConfig.Files[file] = hex.EncodeToString(hash[:])
+	}
+
+	packageFile("bin/manager", "manager", 0750)
+	packageFile("lib/k3s", "k3s", 0600)
+	packageFile("lib/helm", "helm", 0600)
+	packageFile("data/web/index.html", "index", 0600)
+	packageFile("data/agent/images/images.untar/manifest.json", "[]", 0600)
+	writeFile("data/agent/images/images.untar/imported.info", "abc", 0600)
+	writeFile(".package.config", "id: test", 0600)
+	writeFile("config/local.config", "adminGroup: test", 0600)
+	writeFile("data/server.pid", "123", 0600) //not in a packaged directory
+
+	report, err := Verify(serverHome, packageConfig, 0, false)
+	require.NoError(t, err)
+	assert.Equal(t, 5, report.Checked)
+	assert.True(t, report.IsEmpty(), "unexpected problems: %+v", report)
+
+	writeFile("lib/k3s", "changed", 0600)
+	require.NoError(t, os.Remove(filepath.Join(serverHome, "lib/helm")))
+	writeFile("data/web/extra.html", "extra", 0600)
+	require.NoError(t, os.Chmod(filepath.Join(serverHome, "bin/manager"), 0777))
+
+	report, err = Verify(serverHome, packageConfig, 0, false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"lib/k3s"}, report.Modified)
+	assert.Equal(t, []string{"lib/helm"}, report.Missing)
+	assert.Equal(t, []string{"data/web/extra.html"}, report.Unexpected)
+	assert.Equal(t, []PermissionDrift{{Path: "bin/manager", Expected: "mode 0750", Actual: "mode 0777"}}, report.Permissions)
+	assert.Equal(t, 4, report.Problems())
+
+	output := new(bytes.Buffer)
+	ui.SetOutput(output)
+	defer ui.SetOutput(os.Stdout)
+
+	report.Print()
+	assert.Contains(t, output.String(), "Modified:\n    lib/k3s")
+	assert.Contains(t, output.String(), "bin/manager: mode 0777, expected mode 0750")
+}